@@ -19,12 +19,14 @@
 	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tstime"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/views"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/util/execqueue"
 	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
 	"tailscale.com/util/slicesx"
 )
 
@@ -107,6 +109,13 @@ func recordMetric(val int64, buckets []int64, metrics []*clientmetric.Metric) {
 	metrics[bucket].Add(1)
 }
 
+var (
+	metricRoutesLearned = clientmetric.NewCounter("appc_routes_learned")
+	metricRoutesExpired = clientmetric.NewCounter("appc_routes_expired")
+	metricRoutesRemoved = clientmetric.NewCounter("appc_routes_removed_domain")
+	metricRoutesOverCap = clientmetric.NewCounter("appc_routes_dropped_domain_limit")
+)
+
 func metricStoreRoutes(rate, nRoutes int64) {
 	if len(metricStoreRoutesRate) == 0 {
 		initMetricStoreRoutes()
@@ -126,6 +135,47 @@ type RouteInfo struct {
 	// Wildcards are the configured DNS lookup domains to observe. When a DNS query matches Wildcards,
 	// its result is added to Domains.
 	Wildcards []string `json:",omitempty"`
+	// Addrs records when each address in Domains was last seen in a DNS
+	// response, for expiring them. See AppConnector.SetRouteExpiry.
+	Addrs map[netip.Addr]AddrState `json:",omitempty"`
+}
+
+// AddrState is when an address learned from DNS was last seen.
+type AddrState struct {
+	// LastSeen is when the address was last seen in a DNS response for a
+	// routed domain.
+	LastSeen time.Time
+	// TTL is the TTL, in seconds, of the record it was last seen in.
+	TTL uint32 `json:",omitempty"`
+}
+
+// maxRouteTTL caps the DNS TTL taken into account when expiring routes, so
+// that records with absurd TTLs don't keep routes around forever.
+const maxRouteTTL = 7 * 24 * time.Hour
+
+// expiresAt returns when a route to the address expires, given lifetime.
+func (st AddrState) expiresAt(lifetime time.Duration) time.Time {
+	ttl := min(time.Duration(st.TTL)*time.Second, maxRouteTTL)
+	return st.LastSeen.Add(ttl + lifetime)
+}
+
+// RouteExpiry is the policy for expiring routes learned from DNS responses.
+// The zero value never expires them.
+type RouteExpiry struct {
+	// Lifetime is how long a route learned from DNS is kept after the TTL
+	// of the DNS record it was last seen in has run out. Zero means routes
+	// never expire.
+	Lifetime time.Duration
+	// Interval is how often expired routes are collected. If zero, it
+	// defaults to a quarter of Lifetime, between a minute and an hour.
+	Interval time.Duration
+}
+
+func (x RouteExpiry) interval() time.Duration {
+	if x.Interval > 0 {
+		return x.Interval
+	}
+	return min(max(x.Lifetime/4, time.Minute), time.Hour)
 }
 
 // AppConnector is an implementation of an AppConnector that performs
@@ -154,12 +204,51 @@ type AppConnector struct {
 	// controlRoutes is the list of routes that were last supplied by control.
 	controlRoutes []netip.Prefix
 
-	// wildcards is the list of domain strings that match subdomains.
+	// wildcards is the list of domain strings that match subdomains, and
+	// domain patterns; see isDomainPattern.
 	wildcards []string
 
+	// patterns caches the parsed form of the domain patterns in wildcards.
+	// A nil value is an invalid pattern.
+	patterns map[string]*domainPattern
+
+	// routeLimits is the maximum number of routes advertised for all the
+	// names matched by a configured domain, keyed by the configured domain
+	// as passed to UpdateDomains. See UpdateDomainRouteLimits.
+	routeLimits map[string]int
+
+	// limitKeys caches the key of routeLimits that applies to each name in
+	// domains, or "" if none does, so that the wildcards and patterns are
+	// matched once per name. It's reset when the configured domains or
+	// limits change. See limitKeyLocked.
+	limitKeys map[string]string
+
+	// limitAddrs is, for each key of routeLimits, the number of names in
+	// domains limited by it that each address was learned for. Addresses
+	// covered by routes from control are not included. The number of
+	// addresses counts toward the limit. It's nil if it needs to be
+	// recomputed; see limitAddrsLocked.
+	limitAddrs map[string]map[netip.Addr]int
+
+	// addrs records when each address in domains was last seen.
+	addrs map[netip.Addr]AddrState
+
+	// addrsDirty is whether addrs changed since routes were last stored.
+	addrsDirty bool
+
 	// queue provides ordering for update operations
 	queue execqueue.ExecQueue
 
+	clock tstime.Clock
+
+	// gcMu guards the route expiry fields that follow. It's separate from
+	// mu so that SetRouteExpiry and Close may be called with locks held
+	// that storeRoutesFunc or the routeAdvertiser acquire.
+	gcMu    sync.Mutex
+	expiry  RouteExpiry
+	gcTimer tstime.TimerController // nil if routes don't expire
+	closed  bool
+
 	writeRateMinute *rateLogger
 	writeRateDay    *rateLogger
 }
@@ -170,11 +259,23 @@ func NewAppConnector(logf logger.Logf, routeAdvertiser RouteAdvertiser, routeInf
 		logf:            logger.WithPrefix(logf, "appc: "),
 		routeAdvertiser: routeAdvertiser,
 		storeRoutesFunc: storeRoutesFunc,
+		clock:           tstime.StdClock{},
 	}
 	if routeInfo != nil {
 		ac.domains = routeInfo.Domains
 		ac.wildcards = routeInfo.Wildcards
 		ac.controlRoutes = routeInfo.Control
+		ac.addrs = routeInfo.Addrs
+	}
+	// Routes stored before their last-seen times were recorded count as
+	// seen now, so that they get a full lifetime once expiry is enabled.
+	now := ac.clock.Now()
+	for _, addrs := range ac.domains {
+		for _, a := range addrs {
+			if _, ok := ac.addrs[a]; !ok {
+				mak.Set(&ac.addrs, a, AddrState{LastSeen: now})
+			}
+		}
 	}
 	ac.writeRateMinute = newRateLogger(time.Now, time.Minute, func(c int64, s time.Time, l int64) {
 		ac.logf("routeInfo write rate: %d in minute starting at %v (%d routes)", c, s, l)
@@ -206,13 +307,116 @@ func (e *AppConnector) storeRoutesLocked() error {
 	e.writeRateMinute.update(numRoutes)
 	e.writeRateDay.update(numRoutes)
 
+	e.addrsDirty = false
 	return e.storeRoutesFunc(&RouteInfo{
 		Control:   e.controlRoutes,
 		Domains:   e.domains,
 		Wildcards: e.wildcards,
+		Addrs:     e.addrs,
+	})
+}
+
+// SetRouteExpiry sets the policy for expiring routes learned from DNS
+// responses, replacing any previous one. Expired routes are collected
+// periodically, removed from the AppConnector's domains and unadvertised.
+func (e *AppConnector) SetRouteExpiry(x RouteExpiry) {
+	e.gcMu.Lock()
+	defer e.gcMu.Unlock()
+	if e.closed || e.expiry == x {
+		return
+	}
+	e.expiry = x
+	if e.gcTimer != nil {
+		e.gcTimer.Stop()
+		e.gcTimer = nil
+	}
+	if x.Lifetime > 0 {
+		e.gcTimer = e.clock.AfterFunc(x.interval(), e.onGCTimer)
+	}
+}
+
+// onGCTimer queues collection of expired routes, after which the timer is
+// re-armed.
+func (e *AppConnector) onGCTimer() {
+	e.queue.Add(func() {
+		e.gcMu.Lock()
+		x, closed := e.expiry, e.closed
+		e.gcMu.Unlock()
+		if closed {
+			return
+		}
+		if x.Lifetime > 0 {
+			e.expireRoutes(x.Lifetime)
+		}
+
+		e.gcMu.Lock()
+		defer e.gcMu.Unlock()
+		if !e.closed && e.gcTimer != nil {
+			e.gcTimer.Reset(e.expiry.interval())
+		}
 	})
 }
 
+// Close stops the AppConnector's periodic route expiry. Updates already
+// queued, such as advertising or unadvertising routes, still run, so that
+// the advertised routes stay consistent with the stored ones. Close doesn't
+// wait for them, so it may be called with locks held that they acquire.
+// It doesn't unadvertise any routes.
+func (e *AppConnector) Close() {
+	e.gcMu.Lock()
+	defer e.gcMu.Unlock()
+	e.closed = true
+	if e.gcTimer != nil {
+		e.gcTimer.Stop()
+		e.gcTimer = nil
+	}
+}
+
+// expireRoutes removes the addresses learned from DNS that haven't been seen
+// for lifetime past their TTL, and unadvertises their routes, except those
+// covered by routes from control.
+func (e *AppConnector) expireRoutes(lifetime time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.clock.Now()
+	expired := map[netip.Addr]bool{}
+	for a, st := range e.addrs {
+		if now.After(st.expiresAt(lifetime)) {
+			expired[a] = true
+			delete(e.addrs, a)
+		}
+	}
+
+	var toRemove []netip.Prefix
+	if len(expired) > 0 {
+		for domain, addrs := range e.domains {
+			e.domains[domain] = slices.DeleteFunc(addrs, func(a netip.Addr) bool { return expired[a] })
+		}
+		e.limitAddrs = nil
+		for a := range expired {
+			if !slices.ContainsFunc(e.controlRoutes, func(p netip.Prefix) bool { return p.Contains(a) }) {
+				toRemove = append(toRemove, netip.PrefixFrom(a, a.BitLen()))
+			}
+		}
+		metricRoutesExpired.Add(int64(len(expired)))
+		e.logf("expired %d routes learned from DNS", len(expired))
+	}
+	if len(toRemove) > 0 {
+		slices.SortFunc(toRemove, func(a, b netip.Prefix) int { return a.Addr().Compare(b.Addr()) })
+		e.queue.Add(func() {
+			if err := e.routeAdvertiser.UnadvertiseRoute(toRemove...); err != nil {
+				e.logf("failed to unadvertise expired routes: %v: %v", toRemove, err)
+			}
+		})
+	}
+	if len(expired) > 0 || e.addrsDirty {
+		if err := e.storeRoutesLocked(); err != nil {
+			e.logf("failed to store route info: %v", err)
+		}
+	}
+}
+
 // ClearRoutes removes all route state from the AppConnector.
 func (e *AppConnector) ClearRoutes() error {
 	e.mu.Lock()
@@ -220,6 +424,9 @@ func (e *AppConnector) ClearRoutes() error {
 	e.controlRoutes = nil
 	e.domains = nil
 	e.wildcards = nil
+	e.addrs = nil
+	e.limitKeys = nil
+	e.limitAddrs = nil
 	return e.storeRoutesLocked()
 }
 
@@ -236,13 +443,33 @@ func (e *AppConnector) UpdateDomainsAndRoutes(domains []string, routes []netip.P
 // UpdateDomains asynchronously replaces the current set of configured domains
 // with the supplied set of domains. Domains must not contain a trailing dot,
 // and should be lower case. If the domain contains a leading '*' label it
-// matches all subdomains of a domain.
+// matches all subdomains of a domain. Domains may also be patterns; see
+// isDomainPattern.
 func (e *AppConnector) UpdateDomains(domains []string) {
 	e.queue.Add(func() {
 		e.updateDomains(domains)
 	})
 }
 
+// UpdateDomainRouteLimits asynchronously replaces the limits on how many
+// routes are advertised for each domain. The keys of limits are configured
+// domains, as passed to UpdateDomains. The limit of a wildcard domain or
+// pattern applies to all the names it matches together, not to each of them
+// separately. Addresses learned beyond a limit are not advertised until
+// earlier ones expire. Domains without a positive limit are unlimited.
+func (e *AppConnector) UpdateDomainRouteLimits(limits map[string]int) {
+	e.queue.Add(func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.routeLimits = make(map[string]int, len(limits))
+		for d, n := range limits {
+			e.routeLimits[canonicalDomain(d)] = n
+		}
+		e.limitKeys = nil
+		e.limitAddrs = nil
+	})
+}
+
 // Wait waits for the currently scheduled asynchronous configuration changes to
 // complete.
 func (e *AppConnector) Wait(ctx context.Context) {
@@ -256,11 +483,24 @@ func (e *AppConnector) updateDomains(domains []string) {
 	var oldDomains map[string][]netip.Addr
 	oldDomains, e.domains = e.domains, make(map[string][]netip.Addr, len(domains))
 	e.wildcards = e.wildcards[:0]
+	e.patterns = nil
+	e.limitKeys = nil
+	e.limitAddrs = nil
 	for _, d := range domains {
-		d = strings.ToLower(d)
+		d = canonicalDomain(d)
 		if len(d) == 0 {
 			continue
 		}
+		if isDomainPattern(d) {
+			p, err := parseDomainPattern(d)
+			if err != nil {
+				e.logf("ignoring invalid domain pattern %q: %v", d, err)
+				continue
+			}
+			mak.Set(&e.patterns, d, p)
+			e.wildcards = append(e.wildcards, d)
+			continue
+		}
 		if strings.HasPrefix(d, "*.") {
 			e.wildcards = append(e.wildcards, d[2:])
 			continue
@@ -272,7 +512,7 @@ func (e *AppConnector) updateDomains(domains []string) {
 	// Ensure that still-live wildcards addresses are preserved as well.
 	for d, addrs := range oldDomains {
 		for _, wc := range e.wildcards {
-			if dnsname.HasSuffix(d, wc) {
+			if e.wildcardMatchesLocked(wc, d) {
 				e.domains[d] = addrs
 				delete(oldDomains, d)
 				break
@@ -287,8 +527,12 @@ func (e *AppConnector) updateDomains(domains []string) {
 		for _, addrs := range oldDomains {
 			for _, a := range addrs {
 				toRemove = append(toRemove, netip.PrefixFrom(a, a.BitLen()))
+				if !e.isAddrInAnyDomainLocked(a) {
+					delete(e.addrs, a)
+				}
 			}
 		}
+		metricRoutesRemoved.Add(int64(len(toRemove)))
 		e.queue.Add(func() {
 			if err := e.routeAdvertiser.UnadvertiseRoute(toRemove...); err != nil {
 				e.logf("failed to unadvertise routes on domain removal: %v: %v: %v", slicesx.MapKeys(oldDomains), toRemove, err)
@@ -345,6 +589,7 @@ func (e *AppConnector) updateRoutes(routes []netip.Prefix) {
 	})
 
 	e.controlRoutes = routes
+	e.limitAddrs = nil
 	if err := e.storeRoutesLocked(); err != nil {
 		e.logf("failed to store route info: %v", err)
 	}
@@ -395,6 +640,9 @@ func (e *AppConnector) ObserveDNSResponse(res []byte) error {
 	// addressRecords is a list of address records found in the response.
 	var addressRecords map[string][]netip.Addr
 
+	// ttls are the largest TTL of each address in addressRecords.
+	var ttls map[netip.Addr]uint32
+
 	for {
 		h, err := p.AnswerHeader()
 		if err == dnsmessage.ErrSectionDone {
@@ -447,6 +695,7 @@ func (e *AppConnector) ObserveDNSResponse(res []byte) error {
 			}
 			addr := netip.AddrFrom4(r.A)
 			mak.Set(&addressRecords, domain, append(addressRecords[domain], addr))
+			mak.Set(&ttls, addr, max(ttls[addr], h.TTL))
 		case dnsmessage.TypeAAAA:
 			r, err := p.AAAAResource()
 			if err != nil {
@@ -454,6 +703,7 @@ func (e *AppConnector) ObserveDNSResponse(res []byte) error {
 			}
 			addr := netip.AddrFrom16(r.AAAA)
 			mak.Set(&addressRecords, domain, append(addressRecords[domain], addr))
+			mak.Set(&ttls, addr, max(ttls[addr], h.TTL))
 		default:
 			if err := p.SkipAnswer(); err != nil {
 				return err
@@ -465,6 +715,7 @@ func (e *AppConnector) ObserveDNSResponse(res []byte) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	now := e.clock.Now()
 	for domain, addrs := range addressRecords {
 		domain, isRouted := e.findRoutedDomainLocked(domain, cnameChain)
 
@@ -477,14 +728,17 @@ func (e *AppConnector) ObserveDNSResponse(res []byte) error {
 		// was not already known.
 		var toAdvertise []netip.Prefix
 		for _, addr := range addrs {
-			if !e.isAddrKnownLocked(domain, addr) {
+			if e.isAddrKnownLocked(domain, addr) {
+				e.noteAddrSeenLocked(addr, now, ttls[addr])
+			} else {
 				toAdvertise = append(toAdvertise, netip.PrefixFrom(addr, addr.BitLen()))
 			}
 		}
 
+		toAdvertise = e.capRoutesLocked(domain, toAdvertise)
 		if len(toAdvertise) > 0 {
 			e.logf("[v2] observed new routes for %s: %s", domain, toAdvertise)
-			e.scheduleAdvertisement(domain, toAdvertise...)
+			e.scheduleAdvertisement(domain, now, ttls, toAdvertise...)
 		}
 	}
 	return nil
@@ -505,7 +759,7 @@ func (e *AppConnector) findRoutedDomainLocked(domain string, cnameChain map[stri
 
 		// match wildcard domains
 		for _, wc := range e.wildcards {
-			if dnsname.HasSuffix(domain, wc) {
+			if e.wildcardMatchesLocked(wc, domain) {
 				e.domains[domain] = nil
 				isRouted = true
 				break
@@ -521,6 +775,132 @@ func (e *AppConnector) findRoutedDomainLocked(domain string, cnameChain map[stri
 	return domain, isRouted
 }
 
+// wildcardMatchesLocked reports whether domain matches wc, an entry of
+// e.wildcards.
+// e.mu must be held.
+func (e *AppConnector) wildcardMatchesLocked(wc, domain string) bool {
+	if !isDomainPattern(wc) {
+		return dnsname.HasSuffix(domain, wc)
+	}
+	p, ok := e.patterns[wc]
+	if !ok {
+		// Restored from RouteInfo rather than configured by updateDomains.
+		p, _ = parseDomainPattern(wc)
+		mak.Set(&e.patterns, wc, p)
+	}
+	return p != nil && p.match(domain)
+}
+
+// routeLimitLocked returns the configured domain whose route limit applies
+// to domain, as a key of e.routeLimits, and the limit. The limit is 0 if
+// domain is unlimited.
+// e.mu must be held.
+func (e *AppConnector) routeLimitLocked(domain string) (configured string, limit int) {
+	if len(e.routeLimits) == 0 {
+		return "", 0
+	}
+	if n, ok := e.routeLimits[domain]; ok {
+		return domain, n
+	}
+	for _, wc := range e.wildcards {
+		configured := wc
+		if !isDomainPattern(wc) {
+			configured = "*." + wc
+		}
+		if n, ok := e.routeLimits[configured]; ok && e.wildcardMatchesLocked(wc, domain) {
+			return configured, n
+		}
+	}
+	return "", 0
+}
+
+// limitKeyLocked returns the key of e.routeLimits that applies to domain,
+// or "" if none does.
+// e.mu must be held.
+func (e *AppConnector) limitKeyLocked(domain string) string {
+	if len(e.routeLimits) == 0 {
+		return ""
+	}
+	if key, ok := e.limitKeys[domain]; ok {
+		return key
+	}
+	key, _ := e.routeLimitLocked(domain)
+	mak.Set(&e.limitKeys, domain, key)
+	return key
+}
+
+// limitAddrsLocked returns the addresses counting toward the route limit
+// with the given key, each with the number of names it was learned for.
+// e.mu must be held.
+func (e *AppConnector) limitAddrsLocked(key string) map[netip.Addr]int {
+	if e.limitAddrs == nil {
+		e.limitAddrs = make(map[string]map[netip.Addr]int)
+		for domain, addrs := range e.domains {
+			for _, a := range addrs {
+				e.countLimitAddrLocked(domain, a)
+			}
+		}
+	}
+	return e.limitAddrs[key]
+}
+
+// countLimitAddrLocked counts addr, newly learned for domain, toward the
+// route limit that applies to domain, if any.
+// e.mu must be held.
+func (e *AppConnector) countLimitAddrLocked(domain string, addr netip.Addr) {
+	key := e.limitKeyLocked(domain)
+	if key == "" || slices.ContainsFunc(e.controlRoutes, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+		return
+	}
+	m := e.limitAddrs[key]
+	if m == nil {
+		m = make(map[netip.Addr]int)
+		e.limitAddrs[key] = m
+	}
+	m[addr]++
+}
+
+// capRoutesLocked returns the routes that may be advertised for domain
+// without exceeding the limit of the configured domain that matches it.
+// The addresses already advertised for all names that configured domain
+// matches count toward its limit, so that a wildcard or pattern can't
+// advertise an unbounded number of routes across its subdomains. Addresses
+// covered by routes from control don't count.
+// e.mu must be held.
+func (e *AppConnector) capRoutesLocked(domain string, routes []netip.Prefix) []netip.Prefix {
+	key := e.limitKeyLocked(domain)
+	limit := e.routeLimits[key]
+	if key == "" || limit <= 0 {
+		return routes
+	}
+	advertised := e.limitAddrsLocked(key)
+	n := len(advertised)
+	var (
+		allowed, dropped []netip.Prefix
+		added            set.Set[netip.Addr]
+	)
+	for _, r := range routes {
+		switch {
+		case r.IsSingleIP() && (advertised[r.Addr()] > 0 || added.Contains(r.Addr())):
+			// Already advertised for another name.
+			allowed = append(allowed, r)
+		case n < limit:
+			allowed = append(allowed, r)
+			n++
+			if r.IsSingleIP() {
+				mak.Set(&added, r.Addr(), struct{}{})
+			}
+		default:
+			dropped = append(dropped, r)
+		}
+	}
+	if len(dropped) > 0 {
+		metricRoutesOverCap.Add(int64(len(dropped)))
+		e.logf("[v1] %s reached its limit of %d routes; not advertising %v for %s", key, limit, dropped, domain)
+	}
+	return allowed
+}
+
 // isAddrKnownLocked returns true if the address is known to be associated with
 // the given domain. Known domain tables are updated for covered routes to speed
 // up future matches.
@@ -541,9 +921,19 @@ func (e *AppConnector) isAddrKnownLocked(domain string, addr netip.Addr) bool {
 }
 
 // scheduleAdvertisement schedules an advertisement of the given address
-// associated with the given domain.
-func (e *AppConnector) scheduleAdvertisement(domain string, routes ...netip.Prefix) {
+// associated with the given domain. The addresses of the routes advertised
+// are recorded as seen at seen, with their TTLs from ttls; those dropped by
+// the domain's route limit aren't, so that they're never expired.
+func (e *AppConnector) scheduleAdvertisement(domain string, seen time.Time, ttls map[netip.Addr]uint32, routes ...netip.Prefix) {
 	e.queue.Add(func() {
+		// Earlier advertisements for the domain may have used up its
+		// limit since this one was scheduled.
+		e.mu.Lock()
+		routes = e.capRoutesLocked(domain, routes)
+		e.mu.Unlock()
+		if len(routes) == 0 {
+			return
+		}
 		if err := e.routeAdvertiser.AdvertiseRoute(routes...); err != nil {
 			e.logf("failed to advertise routes for %s: %v: %v", domain, routes, err)
 			return
@@ -556,8 +946,12 @@ func (e *AppConnector) scheduleAdvertisement(domain string, routes ...netip.Pref
 				continue
 			}
 			addr := route.Addr()
+			if st, ok := e.addrs[addr]; !ok || st.LastSeen.Before(seen) {
+				e.noteAddrSeenLocked(addr, seen, ttls[addr])
+			}
 			if !e.hasDomainAddrLocked(domain, addr) {
 				e.addDomainAddrLocked(domain, addr)
+				metricRoutesLearned.Add(1)
 				e.logf("[v2] advertised route for %v: %v", domain, addr)
 			}
 		}
@@ -567,6 +961,28 @@ func (e *AppConnector) scheduleAdvertisement(domain string, routes ...netip.Pref
 	})
 }
 
+// isAddrInAnyDomainLocked reports whether addr has been observed in a
+// resolution of any of the current domains.
+// e.mu must be held.
+func (e *AppConnector) isAddrInAnyDomainLocked(addr netip.Addr) bool {
+	for domain := range e.domains {
+		if e.hasDomainAddrLocked(domain, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// noteAddrSeenLocked records that addr was seen in a DNS response at now,
+// in a record with the given TTL. The change is stored along with the next
+// change of routes, or by the next collection of expired routes, so as not
+// to write state on every DNS response.
+// e.mu must be held.
+func (e *AppConnector) noteAddrSeenLocked(addr netip.Addr, now time.Time, ttl uint32) {
+	mak.Set(&e.addrs, addr, AddrState{LastSeen: now, TTL: ttl})
+	e.addrsDirty = true
+}
+
 // hasDomainAddrLocked returns true if the address has been observed in a
 // resolution of domain.
 func (e *AppConnector) hasDomainAddrLocked(domain string, addr netip.Addr) bool {
@@ -579,6 +995,9 @@ func (e *AppConnector) hasDomainAddrLocked(domain string, addr netip.Addr) bool
 func (e *AppConnector) addDomainAddrLocked(domain string, addr netip.Addr) {
 	e.domains[domain] = append(e.domains[domain], addr)
 	slices.SortFunc(e.domains[domain], compareAddr)
+	if e.limitAddrs != nil {
+		e.countLimitAddrLocked(domain, addr)
+	}
 }
 
 func compareAddr(l, r netip.Addr) int {
@@ -5,9 +5,11 @@
 
 import (
 	"context"
+	"fmt"
 	"net/netip"
 	"reflect"
 	"slices"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -18,6 +20,7 @@
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/must"
+	"tailscale.com/util/set"
 	"tailscale.com/util/slicesx"
 )
 
@@ -626,6 +629,9 @@ func TestRouteStoreMetrics(t *testing.T) {
 		"appc_store_routes_rate_over":     1,
 	}
 	for _, x := range clientmetric.Metrics() {
+		if !strings.HasPrefix(x.Name(), "appc_store_routes_") {
+			continue
+		}
 		if x.Value() != wanted[x.Name()] {
 			t.Errorf("%s: want: %d, got: %d", x.Name(), wanted[x.Name()], x.Value())
 		}
@@ -694,3 +700,179 @@ func TestUpdateRoutesDeadlock(t *testing.T) {
 		t.Fatalf("got %v, want %v", rc.Routes(), want)
 	}
 }
+
+func TestRouteExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1_000_000, 0)})
+	rc := &appctest.RouteCollector{}
+	var stored *RouteInfo
+	a := NewAppConnector(t.Logf, rc, &RouteInfo{}, func(ri *RouteInfo) error {
+		stored = ri
+		return nil
+	})
+	defer a.Close()
+	a.clock = clock
+	a.updateDomains([]string{"example.com"})
+	a.updateRoutes([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+	a.Wait(ctx)
+
+	old := netip.MustParseAddr("2001:db8::1")
+	fresh := netip.MustParseAddr("192.0.0.8")
+	covered := netip.MustParseAddr("192.0.2.5") // by the control route
+	for _, addr := range []netip.Addr{old, fresh, covered} {
+		must.Do(a.ObserveDNSResponse(dnsResponse("example.com.", addr.String())))
+	}
+	a.Wait(ctx)
+
+	clock.Advance(30 * time.Minute)
+	must.Do(a.ObserveDNSResponse(dnsResponse("example.com.", fresh.String())))
+	a.Wait(ctx)
+
+	a.SetRouteExpiry(RouteExpiry{Lifetime: time.Hour, Interval: 35 * time.Minute})
+	clock.Advance(40 * time.Minute)
+	a.Wait(ctx)
+
+	if got, want := a.DomainRoutes()["example.com"], []netip.Addr{fresh}; !slices.Equal(got, want) {
+		t.Errorf("after expiry, routes for example.com = %v; want %v", got, want)
+	}
+	if got, want := rc.RemovedRoutes(), []netip.Prefix{netip.PrefixFrom(old, old.BitLen())}; !slices.Equal(got, want) {
+		t.Errorf("unadvertised %v; want %v", got, want)
+	}
+	if _, ok := stored.Addrs[old]; ok || len(stored.Addrs) != 1 {
+		t.Errorf("stored addrs = %v; want only %v", stored.Addrs, fresh)
+	}
+
+	// A restarted connector expires the remaining route based on its
+	// stored last-seen time.
+	b := NewAppConnector(t.Logf, rc, stored, fakeStoreRoutes)
+	defer b.Close()
+	b.clock = clock
+	b.expireRoutes(30 * time.Minute)
+	if got := b.DomainRoutes()["example.com"]; len(got) != 0 {
+		t.Errorf("after restart and expiry, routes for example.com = %v; want none", got)
+	}
+}
+
+func TestCloseRunsQueuedUpdates(t *testing.T) {
+	ctx := context.Background()
+	rc := &appctest.RouteCollector{}
+	a := NewAppConnector(t.Logf, rc, &RouteInfo{}, fakeStoreRoutes)
+
+	// Hold up the queue so the update is still queued when Close is called.
+	unblock := make(chan struct{})
+	a.queue.Add(func() { <-unblock })
+	routes := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	a.UpdateDomainsAndRoutes([]string{"example.com"}, routes)
+	a.Close()
+	close(unblock)
+	a.Wait(ctx)
+
+	if got := rc.Routes(); !slices.Equal(got, routes) {
+		t.Errorf("advertised %v after Close; want %v", got, routes)
+	}
+}
+
+func TestDomainPatternsAndRouteLimits(t *testing.T) {
+	ctx := context.Background()
+	rc := &appctest.RouteCollector{}
+	var stored *RouteInfo
+	a := NewAppConnector(t.Logf, rc, &RouteInfo{}, func(ri *RouteInfo) error {
+		stored = ri
+		return nil
+	})
+	a.UpdateDomains([]string{"*.s3.*.amazonaws.com", "example.com", "{bad.com"})
+	a.UpdateDomainRouteLimits(map[string]int{"*.s3.*.amazonaws.com": 2})
+	a.Wait(ctx)
+
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		must.Do(a.ObserveDNSResponse(dnsResponse("bucket.s3.us-east-1.amazonaws.com.", addr)))
+	}
+	must.Do(a.ObserveDNSResponse(dnsResponse("other.s3.eu-west-1.amazonaws.com.", "192.0.2.4")))
+	for _, addr := range []string{"192.0.2.5", "192.0.2.6", "192.0.2.7"} {
+		must.Do(a.ObserveDNSResponse(dnsResponse("example.com.", addr)))
+	}
+	must.Do(a.ObserveDNSResponse(dnsResponse("bucket.s3.amazonaws.com.", "192.0.2.8")))
+	a.Wait(ctx)
+
+	// The pattern's limit covers all the names it matches, so the first
+	// name uses it up.
+	want := map[string][]netip.Addr{
+		"bucket.s3.us-east-1.amazonaws.com": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")},
+		"other.s3.eu-west-1.amazonaws.com":  nil,
+		"example.com":                       {netip.MustParseAddr("192.0.2.5"), netip.MustParseAddr("192.0.2.6"), netip.MustParseAddr("192.0.2.7")},
+	}
+	if got := a.DomainRoutes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DomainRoutes = %v; want %v", got, want)
+	}
+	if got := len(rc.Routes()); got != 5 {
+		t.Errorf("advertised %d routes (%v); want 5", got, rc.Routes())
+	}
+	// Addresses dropped by the limit aren't tracked, so they're never
+	// expired.
+	for _, addr := range []string{"192.0.2.3", "192.0.2.4"} {
+		if _, ok := stored.Addrs[netip.MustParseAddr(addr)]; ok {
+			t.Errorf("stored last-seen time for %s, which was never advertised", addr)
+		}
+	}
+	if got := len(stored.Addrs); got != 5 {
+		t.Errorf("stored %d addrs (%v); want 5", got, stored.Addrs)
+	}
+}
+
+func TestRegexpDomainPatternKeepsCase(t *testing.T) {
+	ctx := context.Background()
+	rc := &appctest.RouteCollector{}
+	a := NewAppConnector(t.Logf, rc, &RouteInfo{}, fakeStoreRoutes)
+	// Lowering the expression would turn \D into \d and stop it matching
+	// "eu", so the pattern must keep its case and match names regardless
+	// of theirs.
+	const pattern = `re:API\.\D+\.example\.com`
+	a.UpdateDomains([]string{pattern})
+	a.UpdateDomainRouteLimits(map[string]int{pattern: 1})
+	a.Wait(ctx)
+
+	must.Do(a.ObserveDNSResponse(dnsResponse("api.eu.example.com.", "192.0.2.1")))
+	must.Do(a.ObserveDNSResponse(dnsResponse("API.US.example.com.", "192.0.2.2")))
+	must.Do(a.ObserveDNSResponse(dnsResponse("api.42.example.com.", "192.0.2.3")))
+	a.Wait(ctx)
+
+	want := map[string][]netip.Addr{
+		"api.eu.example.com": {netip.MustParseAddr("192.0.2.1")},
+		"api.us.example.com": nil,
+	}
+	if got := a.DomainRoutes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DomainRoutes = %v; want %v", got, want)
+	}
+	if got, want := rc.Routes(), []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}; !slices.Equal(got, want) {
+		t.Errorf("advertised %v; want %v", got, want)
+	}
+}
+
+func TestWildcardRouteLimitCoversSubdomains(t *testing.T) {
+	ctx := context.Background()
+	rc := &appctest.RouteCollector{}
+	a := NewAppConnector(t.Logf, rc, &RouteInfo{}, fakeStoreRoutes)
+	a.UpdateDomains([]string{"*.cdn.example"})
+	a.UpdateDomainRouteLimits(map[string]int{"*.cdn.example": 10})
+	a.Wait(ctx)
+
+	for i := range 100 {
+		name := fmt.Sprintf("host%d.cdn.example.", i)
+		must.Do(a.ObserveDNSResponse(dnsResponse(name, fmt.Sprintf("192.0.2.%d", i+1))))
+		a.Wait(ctx)
+	}
+	if got := len(rc.Routes()); got != 10 {
+		t.Errorf("advertised %d routes (%v); want 10", got, rc.Routes())
+	}
+
+	// An address already advertised for one name may still be learned for
+	// another once the limit is reached.
+	must.Do(a.ObserveDNSResponse(dnsResponse("shared.cdn.example.", "192.0.2.1")))
+	a.Wait(ctx)
+	if got, want := a.DomainRoutes()["shared.cdn.example"], []netip.Addr{netip.MustParseAddr("192.0.2.1")}; !slices.Equal(got, want) {
+		t.Errorf("routes for shared.cdn.example = %v; want %v", got, want)
+	}
+	if got := len(set.SetOf(rc.Routes())); got != 10 {
+		t.Errorf("advertised %d distinct routes after shared address; want 10", got)
+	}
+}
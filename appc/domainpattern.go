@@ -0,0 +1,133 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package appc
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// domainPattern is a configured domain that matches names by more than a
+// simple "*." suffix. See isDomainPattern for the syntax.
+type domainPattern struct {
+	re     *regexp.Regexp // for "re:" patterns; nil otherwise
+	labels []string       // for wildcard patterns, in order
+}
+
+// isDomainPattern reports whether the configured domain d is a pattern
+// rather than an exact domain or a "*." suffix wildcard.
+//
+// Patterns are either "re:" followed by a regular expression that must match
+// the whole domain name, ignoring case and without a trailing dot, or
+// wildcard patterns. In wildcard patterns, each label is matched against one label
+// of the name, except that:
+//
+//   - "**", or "*" as the first label, matches one or more labels;
+//   - "*" elsewhere matches any one label;
+//   - "*" within a label matches any run of characters, as in "s3-*";
+//   - "{a,b,c}" matches any one of the comma-separated alternatives, each
+//     of which may use "*" within the label.
+//
+// For example, "*.s3.*.amazonaws.com" matches "bucket.s3.us-east-1.amazonaws.com".
+func isDomainPattern(d string) bool {
+	return strings.HasPrefix(d, "re:") || strings.ContainsAny(strings.TrimPrefix(d, "*."), "*{")
+}
+
+// canonicalDomain returns the configured domain d as it's used internally:
+// lower case, except for the expression of a "re:" pattern, which is kept
+// as is because lowering it would change escapes such as \S into \s. Such
+// patterns match case-insensitively instead.
+func canonicalDomain(d string) string {
+	if len(d) >= 3 && strings.EqualFold(d[:3], "re:") {
+		return "re:" + d[3:]
+	}
+	return strings.ToLower(d)
+}
+
+// parseDomainPattern parses a pattern for which isDomainPattern is true.
+func parseDomainPattern(d string) (*domainPattern, error) {
+	if expr, ok := strings.CutPrefix(d, "re:"); ok {
+		re, err := regexp.Compile("(?i)^(?:" + expr + ")$")
+		if err != nil {
+			return nil, err
+		}
+		return &domainPattern{re: re}, nil
+	}
+	labels := strings.Split(d, ".")
+	for _, l := range labels {
+		if l == "" {
+			return nil, errors.New("empty label")
+		}
+		if strings.ContainsAny(l, "{}") {
+			if !strings.HasPrefix(l, "{") || !strings.HasSuffix(l, "}") || strings.Count(l, "{") != 1 || strings.Count(l, "}") != 1 {
+				return nil, fmt.Errorf("invalid alternatives %q; must be a whole label", l)
+			}
+		}
+	}
+	return &domainPattern{labels: labels}, nil
+}
+
+// match reports whether name, lower case and without a trailing dot,
+// matches p.
+func (p *domainPattern) match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	return matchLabels(p.labels, strings.Split(name, "."), true)
+}
+
+// matchLabels reports whether the name labels match the pattern labels.
+// first is whether pat starts at the pattern's first label.
+func matchLabels(pat, name []string, first bool) bool {
+	if len(pat) == 0 {
+		return len(name) == 0
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if pat[0] == "**" || (first && pat[0] == "*") {
+		// One or more labels.
+		for i := 1; i <= len(name); i++ {
+			if matchLabels(pat[1:], name[i:], false) {
+				return true
+			}
+		}
+		return false
+	}
+	return matchLabel(pat[0], name[0]) && matchLabels(pat[1:], name[1:], false)
+}
+
+// matchLabel reports whether the name label l matches the pattern label p.
+func matchLabel(p, l string) bool {
+	if alts, ok := strings.CutPrefix(p, "{"); ok {
+		for _, alt := range strings.Split(strings.TrimSuffix(alts, "}"), ",") {
+			if matchGlob(alt, l) {
+				return true
+			}
+		}
+		return false
+	}
+	return matchGlob(p, l)
+}
+
+// matchGlob reports whether s matches the glob p, in which "*" matches any
+// run of characters, including none.
+func matchGlob(p, s string) bool {
+	prefix, rest, ok := strings.Cut(p, "*")
+	if !ok {
+		return p == s
+	}
+	if !strings.HasPrefix(s, prefix) {
+		return false
+	}
+	s = s[len(prefix):]
+	for i := 0; i <= len(s); i++ {
+		if matchGlob(rest, s[i:]) {
+			return true
+		}
+	}
+	return false
+}
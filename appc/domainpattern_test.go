@@ -0,0 +1,56 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package appc
+
+import "testing"
+
+func TestDomainPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.s3.*.amazonaws.com", "bucket.s3.us-east-1.amazonaws.com", true},
+		{"*.s3.*.amazonaws.com", "a.bucket.s3.us-east-1.amazonaws.com", true},
+		{"*.s3.*.amazonaws.com", "s3.us-east-1.amazonaws.com", false},
+		{"*.s3.*.amazonaws.com", "bucket.s3.amazonaws.com", false},
+		{"*.s3.*.amazonaws.com", "bucket.s3.a.b.amazonaws.com", false},
+		{"api.**.example.com", "api.eu.prod.example.com", true},
+		{"api.**.example.com", "api.example.com", false},
+		{"s3-*.amazonaws.com", "s3-us-west-2.amazonaws.com", true},
+		{"s3-*.amazonaws.com", "ec2.amazonaws.com", false},
+		{"*.{slack,slack-edge}.com", "files.slack-edge.com", true},
+		{"*.{slack,slack-edge}.com", "files.slack.com", true},
+		{"*.{slack,slack-edge}.com", "files.slackb.com", false},
+		{"{www,cdn-*}.example.com", "cdn-7.example.com", true},
+		{"re:[a-z]+[0-9]+\\.example\\.com", "host12.example.com", true},
+		{"re:[a-z]+[0-9]+\\.example\\.com", "host12.example.com.evil.com", false},
+		{"re:HOST\\S+\\.example\\.com", "host12.example.com", true},
+	}
+	for _, tt := range tests {
+		if !isDomainPattern(tt.pattern) {
+			t.Errorf("isDomainPattern(%q) = false", tt.pattern)
+			continue
+		}
+		p, err := parseDomainPattern(tt.pattern)
+		if err != nil {
+			t.Errorf("parseDomainPattern(%q): %v", tt.pattern, err)
+			continue
+		}
+		if got := p.match(tt.name); got != tt.want {
+			t.Errorf("%q matching %q = %v; want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+
+	for _, d := range []string{"example.com", "*.example.com"} {
+		if isDomainPattern(d) {
+			t.Errorf("isDomainPattern(%q) = true", d)
+		}
+	}
+	for _, bad := range []string{"re:(", "a..*.com", "x{a,b}.com"} {
+		if _, err := parseDomainPattern(bad); err == nil {
+			t.Errorf("parseDomainPattern(%q) succeeded", bad)
+		}
+	}
+}
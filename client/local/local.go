@@ -472,6 +472,47 @@ func (lc *Client) StreamBusEvents(ctx context.Context) iter.Seq2[eventbus.DebugE
 	}
 }
 
+// StreamFlows returns an iterator of the traffic through this node, with a
+// flow per connection every time the traffic is aggregated, as it arrives.
+// If peer is non-empty, it's the name or IP address of the only peer to
+// return flows for.
+// Each pair is a valid flow and a nil error, or a zero flow and a non-nil
+// error. In case of error, the iterator ends after the pair reporting the
+// error. Iteration stops if ctx ends.
+func (lc *Client) StreamFlows(ctx context.Context, peer string) iter.Seq2[apitype.Flow, error] {
+	return func(yield func(apitype.Flow, error) bool) {
+		req, err := http.NewRequestWithContext(ctx, "GET",
+			"http://"+apitype.LocalAPIHost+"/localapi/v0/debug-flows?peer="+url.QueryEscape(peer), nil)
+		if err != nil {
+			yield(apitype.Flow{}, err)
+			return
+		}
+		res, err := lc.doLocalRequestNiceError(req)
+		if err != nil {
+			yield(apitype.Flow{}, err)
+			return
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			yield(apitype.Flow{}, errors.New(res.Status))
+			return
+		}
+		dec := json.NewDecoder(bufio.NewReader(res.Body))
+		for {
+			var f apitype.Flow
+			if err := dec.Decode(&f); err == io.EOF {
+				return
+			} else if err != nil {
+				yield(apitype.Flow{}, err)
+				return
+			}
+			if !yield(f, nil) {
+				return
+			}
+		}
+	}
+}
+
 // Pprof returns a pprof profile of the Tailscale daemon.
 func (lc *Client) Pprof(ctx context.Context, pprofType string, sec int) ([]byte, error) {
 	var secArg string
@@ -718,6 +759,22 @@ func (lc *Client) FileTargets(ctx context.Context) ([]apitype.FileTarget, error)
 	return decodeJSON[[]apitype.FileTarget](body)
 }
 
+// TaildropReceivePolicy returns the node's Taildrop receive policy.
+func (lc *Client) TaildropReceivePolicy(ctx context.Context) (*apitype.TaildropReceivePolicy, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/file-receive-policy")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.TaildropReceivePolicy](body)
+}
+
+// SetTaildropReceivePolicy sets the node's Taildrop receive policy, which
+// applies to files received from then on.
+func (lc *Client) SetTaildropReceivePolicy(ctx context.Context, p *apitype.TaildropReceivePolicy) error {
+	_, err := lc.send(ctx, "PUT", "/localapi/v0/file-receive-policy", http.StatusNoContent, jsonBody(p))
+	return err
+}
+
 // PushFile sends Taildrop file r to target.
 //
 // A size of -1 means unknown.
@@ -887,6 +944,56 @@ func (lc *Client) QueryDNS(ctx context.Context, name string, queryType string) (
 	return res.Bytes, res.Resolvers, nil
 }
 
+// StreamDNSQueries returns an iterator of the DNS queries answered by the
+// internal DNS forwarder, as they're answered. If peer is non-empty, it's
+// the name or IP address of the only peer to return queries from.
+// Each pair is a valid entry and a nil error, or a zero entry and a non-nil
+// error. In case of error, the iterator ends after the pair reporting the
+// error. Iteration stops if ctx ends.
+func (lc *Client) StreamDNSQueries(ctx context.Context, peer string) iter.Seq2[apitype.DNSQueryLogEntry, error] {
+	return func(yield func(apitype.DNSQueryLogEntry, error) bool) {
+		req, err := http.NewRequestWithContext(ctx, "GET",
+			"http://"+apitype.LocalAPIHost+"/localapi/v0/dns-log?peer="+url.QueryEscape(peer), nil)
+		if err != nil {
+			yield(apitype.DNSQueryLogEntry{}, err)
+			return
+		}
+		res, err := lc.doLocalRequestNiceError(req)
+		if err != nil {
+			yield(apitype.DNSQueryLogEntry{}, err)
+			return
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			yield(apitype.DNSQueryLogEntry{}, errors.New(res.Status))
+			return
+		}
+		dec := json.NewDecoder(bufio.NewReader(res.Body))
+		for {
+			var e apitype.DNSQueryLogEntry
+			if err := dec.Decode(&e); err == io.EOF {
+				return
+			} else if err != nil {
+				yield(apitype.DNSQueryLogEntry{}, err)
+				return
+			}
+			if !yield(e, nil) {
+				return
+			}
+		}
+	}
+}
+
+// DNSQueryStats returns counts of the DNS queries answered by the internal
+// DNS forwarder, by route and by peer.
+func (lc *Client) DNSQueryStats(ctx context.Context) (*apitype.DNSQueryStatsResponse, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/dns-stats")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.DNSQueryStatsResponse](body)
+}
+
 // StartLoginInteractive starts an interactive login.
 func (lc *Client) StartLoginInteractive(ctx context.Context) error {
 	_, err := lc.send(ctx, "POST", "/localapi/v0/login-interactive", http.StatusNoContent, nil)
@@ -1195,6 +1302,16 @@ func (lc *Client) DebugPeerRelaySessions(ctx context.Context) (*status.ServerSta
 	return decodeJSON[*status.ServerStatus](body)
 }
 
+// SSHRecordingsDir returns the directory that Tailscale SSH records sessions
+// to on local disk.
+func (lc *Client) SSHRecordingsDir(ctx context.Context) (string, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/ssh-recordings-dir")
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
 // StreamDebugCapture streams a pcap-formatted packet capture.
 //
 // The provided context does not determine the lifetime of the
@@ -5,8 +5,12 @@
 package apitype
 
 import (
+	"net/netip"
+	"time"
+
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/dnstype"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/util/ctxkey"
 )
 
@@ -56,6 +60,77 @@ type WaitingFile struct {
 	Size int64
 }
 
+// TaildropReceivePolicy is a node's policy for which files it accepts over
+// Taildrop and where they're put, as set with the LocalAPI endpoint
+// /file-receive-policy. The zero value accepts all files into the inbox.
+type TaildropReceivePolicy struct {
+	// MaxFileSize, if non-zero, is the size in bytes of the largest file
+	// accepted.
+	MaxFileSize int64 `json:",omitempty"`
+
+	// AllowedSenders, if non-empty, are the only senders that files are
+	// accepted from. Each is either an ACL tag such as "tag:ci", matching
+	// nodes with that tag, or a user's login name, matching that user's
+	// untagged nodes.
+	AllowedSenders []string `json:",omitempty"`
+
+	// SenderDailyQuota, if non-zero, is the number of bytes accepted from
+	// each sending node in any 24 hour period. Usage is tracked in memory
+	// and starts over when tailscaled restarts.
+	SenderDailyQuota int64 `json:",omitempty"`
+
+	// SortRules put received files into directories of the Taildrop inbox
+	// (or of the directory files are received directly into) rather than
+	// its top level. The first rule that matches a file applies.
+	SortRules []TaildropSortRule `json:",omitempty"`
+}
+
+// TaildropSortRule is a rule in a TaildropReceivePolicy that puts the files
+// it matches into a directory.
+type TaildropSortRule struct {
+	// Sender, if non-empty, matches files from the sender it names, in the
+	// same form as TaildropReceivePolicy.AllowedSenders.
+	Sender string `json:",omitempty"`
+
+	// Extensions, if non-empty, matches files whose names end in one of
+	// them, such as ".log", ignoring case.
+	Extensions []string `json:",omitempty"`
+
+	// Dir is the slash-separated directory, relative to the inbox, that
+	// matching files are put into. The string "{sender}" in it is replaced
+	// with the sender's first tag, without its "tag:" prefix, or the login
+	// name of its user.
+	Dir string
+}
+
+// Flow is the traffic of a connection through this node over an interval,
+// as streamed by the LocalAPI endpoint /debug-flows. It's the same traffic
+// that network logging records.
+type Flow struct {
+	Start time.Time
+	End   time.Time
+
+	// Kind is "virtual" for traffic between Tailscale IPs, "subnet" for
+	// traffic to or from a subnet route, "exit" for exit node traffic, or
+	// "physical" for the WireGuard traffic between this node and a peer's
+	// endpoint that carries the others.
+	//
+	// Exit traffic has its non-Tailscale addresses and its ports removed.
+	Kind string
+
+	Proto ipproto.Proto  `json:",omitempty"`
+	Src   netip.AddrPort // for physical traffic, the peer's Tailscale IP
+	Dst   netip.AddrPort // for physical traffic, the peer's endpoint
+
+	TxPackets uint64 `json:",omitempty"`
+	TxBytes   uint64 `json:",omitempty"`
+	RxPackets uint64 `json:",omitempty"`
+	RxBytes   uint64 `json:",omitempty"`
+
+	// Peer is the name of the peer the traffic is to or from, if known.
+	Peer string `json:",omitempty"`
+}
+
 // SetPushDeviceTokenRequest is the body POSTed to the LocalAPI endpoint /set-device-token.
 type SetPushDeviceTokenRequest struct {
 	// PushDeviceToken is the iOS/macOS APNs device token (and any future Android equivalent).
@@ -94,3 +169,66 @@ type DNSQueryResponse struct {
 	// Resolvers is the list of resolvers that the forwarder deemed able to resolve the query.
 	Resolvers []*dnstype.Resolver
 }
+
+// DNSQueryLogEntry is a DNS query answered by the internal DNS forwarder
+// (100.100.100.100), as streamed by the LocalAPI endpoint /dns-log.
+type DNSQueryLogEntry struct {
+	// Time is when the query arrived.
+	Time time.Time
+
+	// From is the address the query came from, and Peer the name of the
+	// peer with that address, if any.
+	From netip.AddrPort
+	Peer string `json:",omitempty"`
+
+	// ViaPeerAPI is whether the query came from a peer using this node as
+	// an exit node or app connector.
+	ViaPeerAPI bool `json:",omitempty"`
+
+	Name  string // fully qualified, in lowercase
+	Type  string // e.g. "A", "AAAA", "TYPE65"
+	RCode string `json:",omitempty"` // e.g. "NOERROR", "NXDOMAIN"; empty if Error is set
+
+	// Route is the route the query was forwarded by: the suffix of a
+	// configured DNS route, or the resolvers it was forwarded to
+	// otherwise. It's empty if the query was answered locally.
+	Route string `json:",omitempty"`
+
+	// Upstream is the address of the resolver that answered the query,
+	// "cache" if it was answered from the forwarder's cache, or "system"
+	// if answered by the operating system's resolver. It's empty if the
+	// query was answered locally.
+	Upstream string `json:",omitempty"`
+
+	// Latency is how long the query took to answer.
+	Latency time.Duration
+
+	// Error is why the query wasn't answered, if it wasn't.
+	Error string `json:",omitempty"`
+
+	// Dropped is how many queries before this one weren't sent, as
+	// queries were arriving faster than they're logged.
+	Dropped int `json:",omitempty"`
+}
+
+// DNSQueryStats are counts of the queries answered by the internal DNS
+// forwarder.
+type DNSQueryStats struct {
+	Queries   uint64
+	NXDomain  uint64        `json:",omitempty"` // answered with NXDOMAIN
+	ServFail  uint64        `json:",omitempty"` // answered with SERVFAIL
+	Errors    uint64        `json:",omitempty"` // not answered
+	CacheHits uint64        `json:",omitempty"` // answered from the forwarder's cache
+	Latency   time.Duration // total latency of all queries
+}
+
+// DNSQueryStatsResponse is the response to the LocalAPI endpoint /dns-stats.
+type DNSQueryStatsResponse struct {
+	// ByRoute are the stats per DNSQueryLogEntry.Route. Queries answered
+	// locally are under the empty route.
+	ByRoute map[string]DNSQueryStats
+
+	// ByPeer are the stats per peer name, or per IP address for queries
+	// from addresses that aren't a peer's.
+	ByPeer map[string]DNSQueryStats
+}
@@ -75,6 +75,9 @@
 	bootstrapDNS    = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
 	unpublishedDNS  = flag.String("unpublished-bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns and not publish in the list. If an entry contains a slash, the second part names a DNS record to poll for its TXT record with a `0` to `100` value for rollout percentage.")
 
+	meshDiscovery         = flag.String("mesh-discovery", "", "optional source of further hostnames to mesh with, re-read every --mesh-discovery-interval: \"srv:<name>\" for the targets of a DNS SRV record, \"file:<path>\" for a file, or an http(s) URL. Files and URLs list entries in the --mesh-with format, separated by commas or newlines.")
+	meshDiscoveryInterval = flag.Duration("mesh-discovery-interval", 30*time.Second, "how often to re-read --mesh-discovery")
+
 	verifyClients   = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
 	verifyClientURL = flag.String("verify-client-url", "", "if non-empty, an admission controller URL for permitting client connections; see tailcfg.DERPAdmitClientRequest")
 	verifyFailOpen  = flag.Bool("verify-client-url-fail-open", true, "whether we fail open if --verify-client-url is unreachable")
@@ -91,6 +94,15 @@
 	// tcpWriteTimeout is the timeout for writing to client TCP connections. It does not apply to mesh connections.
 	tcpWriteTimeout = flag.Duration("tcp-write-timeout", derpserver.DefaultTCPWiteTimeout, "TCP write timeout; 0 results in no timeout being set on writes")
 
+	// Per-client traffic accounting.
+	clientStatsFile     = flag.String("client-stats-file", "", "if non-empty, enables per-client traffic accounting and persists cumulative per-client-key totals to this file across restarts")
+	clientStatsLog      = flag.String("client-stats-log", "", "if non-empty, enables per-client traffic accounting and appends a JSON line per active client key every --client-stats-interval to this file")
+	clientStatsInterval = flag.Duration("client-stats-interval", time.Minute, "how often per-client traffic is collected, logged and saved")
+	clientStatsTopK     = flag.Int("client-stats-top-k", 100, "number of client keys with the most traffic to export per-key metrics for")
+
+	// Per-client rate limits.
+	rateLimitConfig = flag.String("rate-limit-config", "", "if non-empty, path to a JSON file of per-client-key and per-IP rate limits (see derpserver.RateLimitConfig), re-read on SIGHUP")
+
 	// ACE
 	flagACEEnabled = flag.Bool("ace", false, "whether to enable embedded ACE server [experimental + in-development as of 2025-09-12; not yet documented]")
 )
@@ -194,6 +206,17 @@ func main() {
 	s.SetVerifyClientURL(*verifyClientURL)
 	s.SetVerifyClientURLFailOpen(*verifyFailOpen)
 	s.SetTCPWriteTimeout(*tcpWriteTimeout)
+	if *clientStatsFile != "" || *clientStatsLog != "" {
+		if err := startClientStats(s); err != nil {
+			log.Fatalf("client stats: %v", err)
+		}
+	}
+	if *rateLimitConfig != "" {
+		if err := loadRateLimits(s); err != nil {
+			log.Fatalf("rate limits: %v", err)
+		}
+		go reloadRateLimitsOnSIGHUP(ctx, s)
+	}
 
 	var meshKey string
 	if *dev {
@@ -243,7 +266,8 @@ func main() {
 		log.Println("DERP mesh key configured")
 	}
 
-	if err := startMesh(s); err != nil {
+	mesh, err := startMesh(s)
+	if err != nil {
 		log.Fatalf("startMesh: %v", err)
 	}
 	expvar.Publish("derp", s.ExpVar())
@@ -283,6 +307,7 @@ func main() {
 	debug := tsweb.Debugger(mux)
 	debug.KV("TLS hostname", *hostname)
 	debug.KV("Mesh key", s.HasMeshKey())
+	debug.Handle("mesh", "Mesh membership", mesh)
 	debug.Handle("check", "Consistency check", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := s.ConsistencyCheck()
 		if err != nil {
@@ -292,6 +317,10 @@ func main() {
 		}
 	}))
 	debug.Handle("traffic", "Traffic check", http.HandlerFunc(s.ServeDebugTraffic))
+	debug.Handle("client-traffic", "Per-client traffic totals (JSON)", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.ClientTraffic())
+	}))
 	debug.Handle("set-mutex-profile-fraction", "SetMutexProfileFraction", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		s := r.FormValue("rate")
 		if s == "" || r.Header.Get("Sec-Debug") != "derp" {
@@ -428,6 +457,60 @@ func main() {
 	}
 }
 
+// startClientStats enables per-client traffic accounting on s per the
+// --client-stats-* flags.
+func startClientStats(s *derpserver.Server) error {
+	cfg := derpserver.ClientStatsConfig{
+		StateFile: *clientStatsFile,
+		Interval:  *clientStatsInterval,
+		TopK:      *clientStatsTopK,
+	}
+	if *clientStatsLog != "" {
+		f, err := os.OpenFile(*clientStatsLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		cfg.Log = f
+	}
+	return s.StartClientStats(cfg)
+}
+
+// loadRateLimits sets the rate limits of s from the --rate-limit-config
+// file.
+func loadRateLimits(s *derpserver.Server) error {
+	b, err := os.ReadFile(*rateLimitConfig)
+	if err != nil {
+		return err
+	}
+	cfg, err := derpserver.ParseRateLimitConfig(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *rateLimitConfig, err)
+	}
+	s.SetRateLimits(cfg)
+	return nil
+}
+
+// reloadRateLimitsOnSIGHUP reloads the --rate-limit-config file each time
+// the process gets SIGHUP, until ctx is done. If the file fails to load, the
+// previous limits are kept.
+func reloadRateLimitsOnSIGHUP(ctx context.Context, s *derpserver.Server) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	defer signal.Stop(sigc)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigc:
+		}
+		if err := loadRateLimits(s); err != nil {
+			log.Printf("reloading rate limits: %v; keeping previous limits", err)
+			continue
+		}
+		log.Printf("reloaded rate limits from %s", *rateLimitConfig)
+	}
+}
+
 var validProdHostname = regexp.MustCompile(`^derp([^.]*)\.tailscale\.com\.?$`)
 
 func prodAutocertHostPolicy(_ context.Context, host string) error {
@@ -4,41 +4,203 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"html"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/derp/derpserver"
 	"tailscale.com/net/netmon"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
 )
 
-func startMesh(s *derpserver.Server) error {
-	if *meshWith == "" {
-		return nil
+// meshManager tracks the set of DERP servers this one meshes with, and
+// adds and removes them as they're discovered.
+type meshManager struct {
+	s *derpserver.Server
+
+	// start starts meshing with host, dialing dialHost, and returns a
+	// func to stop it. It's startMeshWithHost, except in tests.
+	start func(host, dialHost string) (stop func(), err error)
+
+	mu       sync.Mutex
+	peers    map[string]*meshPeer // keyed by host tuple
+	lastErr  error                // of the last discovery attempt
+	lastScan time.Time            // of the last discovery attempt
+}
+
+// meshPeer is a DERP server that this one meshes with.
+type meshPeer struct {
+	host, dialHost string
+	static         bool // from --mesh-with rather than discovered
+	since          time.Time
+	stop           func()
+}
+
+func startMesh(s *derpserver.Server) (*meshManager, error) {
+	m := &meshManager{s: s}
+	m.start = func(host, dialHost string) (func(), error) {
+		return startMeshWithHost(s, host, dialHost)
+	}
+	if *meshWith == "" && *meshDiscovery == "" {
+		return m, nil
 	}
 	if !s.HasMeshKey() {
-		return errors.New("--mesh-with requires --mesh-psk-file")
+		return nil, errors.New("--mesh-with and --mesh-discovery require --mesh-psk-file")
+	}
+	if *meshWith != "" {
+		if err := m.setPeers(strings.Split(*meshWith, ","), true); err != nil {
+			return nil, err
+		}
 	}
-	for _, hostTuple := range strings.Split(*meshWith, ",") {
-		if err := startMeshWithHost(s, hostTuple); err != nil {
+	if *meshDiscovery != "" {
+		discover, err := meshDiscoverer(*meshDiscovery)
+		if err != nil {
+			return nil, err
+		}
+		m.discover(discover)
+		go func() {
+			for range time.Tick(*meshDiscoveryInterval) {
+				m.discover(discover)
+			}
+		}()
+	}
+	return m, nil
+}
+
+// discover updates the discovered mesh peers from discover.
+func (m *meshManager) discover(discover func(context.Context) ([]string, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	hosts, err := discover(ctx)
+	if err == nil {
+		err = m.setPeers(hosts, false)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastScan = time.Now()
+	if err != nil && (m.lastErr == nil || m.lastErr.Error() != err.Error()) {
+		log.Printf("mesh discovery: %v", err)
+	}
+	m.lastErr = err
+}
+
+// setPeers sets the mesh peers of the given kind (static or discovered) to
+// hostTuples, each of the form accepted by --mesh-with, starting and
+// stopping meshing with peers as needed.
+func (m *meshManager) setPeers(hostTuples []string, static bool) error {
+	want := map[string]bool{}
+	for _, ht := range hostTuples {
+		ht = strings.TrimSpace(ht)
+		if ht == "" {
+			continue
+		}
+		if _, _, err := parseMeshHost(ht); err != nil {
 			return err
 		}
+		want[ht] = true
+	}
+
+	m.mu.Lock()
+	removed, err := m.setPeersLocked(want, static)
+	m.mu.Unlock()
+
+	// Stopping a peer waits for its client to shut down, so it's done
+	// without m.mu held, so as not to block the debug page or other calls.
+	for _, p := range removed {
+		p.stop()
+	}
+	return err
+}
+
+// setPeersLocked updates m.peers for setPeers, starting meshing with the
+// peers in want that are new. It returns the removed peers, which the
+// caller must stop.
+//
+// m.mu must be held.
+func (m *meshManager) setPeersLocked(want map[string]bool, static bool) (removed []*meshPeer, _ error) {
+	for ht, p := range m.peers {
+		if p.static == static && !want[ht] {
+			log.Printf("mesh: removing %q", ht)
+			removed = append(removed, p)
+			delete(m.peers, ht)
+		}
+	}
+	for ht := range want {
+		if _, ok := m.peers[ht]; ok {
+			continue
+		}
+		host, dialHost, _ := parseMeshHost(ht)
+		stop, err := m.start(host, dialHost)
+		if err != nil {
+			return removed, err
+		}
+		if !static {
+			log.Printf("mesh: adding %q", ht)
+		}
+		mak.Set(&m.peers, ht, &meshPeer{
+			host:     host,
+			dialHost: dialHost,
+			static:   static,
+			since:    time.Now(),
+			stop:     stop,
+		})
 	}
-	return nil
+	return removed, nil
 }
 
-func startMeshWithHost(s *derpserver.Server, hostTuple string) error {
-	var host string
-	var dialHost string
+// ServeHTTP serves the mesh membership for the debug page.
+func (m *meshManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, "<html><body><h1>Mesh</h1>")
+	if *meshDiscovery != "" {
+		fmt.Fprintf(w, "<p>Discovery: %s, every %v; last scan %v",
+			html.EscapeString(*meshDiscovery), *meshDiscoveryInterval, m.lastScan.Format(time.RFC3339))
+		if m.lastErr != nil {
+			fmt.Fprintf(w, " (error: %s)", html.EscapeString(m.lastErr.Error()))
+		}
+		io.WriteString(w, "</p>")
+	}
+	io.WriteString(w, "<table><tr><th>Host</th><th>Dial host</th><th>Source</th><th>Since</th></tr>\n")
+	hts := make([]string, 0, len(m.peers))
+	for ht := range m.peers {
+		hts = append(hts, ht)
+	}
+	slices.Sort(hts)
+	for _, ht := range hts {
+		p := m.peers[ht]
+		source := "discovered"
+		if p.static {
+			source = "--mesh-with"
+		}
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(p.host), html.EscapeString(p.dialHost), source, p.since.Format(time.RFC3339))
+	}
+	io.WriteString(w, "</table></body></html>\n")
+}
+
+// parseMeshHost parses a --mesh-with entry: a hostname, optionally followed
+// by a slash and a hostname to dial instead.
+func parseMeshHost(hostTuple string) (host, dialHost string, err error) {
 	hostParts := strings.Split(hostTuple, "/")
 	if len(hostParts) > 2 {
-		return fmt.Errorf("too many components in host tuple %q", hostTuple)
+		return "", "", fmt.Errorf("too many components in host tuple %q", hostTuple)
 	}
 	host = hostParts[0]
 	if len(hostParts) == 2 {
@@ -46,12 +208,94 @@ func startMeshWithHost(s *derpserver.Server, hostTuple string) error {
 	} else {
 		dialHost = hostParts[0]
 	}
+	if host == "" || dialHost == "" {
+		return "", "", fmt.Errorf("empty host in host tuple %q", hostTuple)
+	}
+	return host, dialHost, nil
+}
+
+// meshDiscoverer returns a func that discovers mesh peers per the
+// --mesh-discovery flag value v.
+func meshDiscoverer(v string) (func(context.Context) ([]string, error), error) {
+	switch {
+	case strings.HasPrefix(v, "srv:"):
+		name := strings.TrimPrefix(v, "srv:")
+		return func(ctx context.Context) ([]string, error) {
+			return discoverMeshSRV(ctx, net.DefaultResolver, name)
+		}, nil
+	case strings.HasPrefix(v, "file:"):
+		path := strings.TrimPrefix(v, "file:")
+		return func(context.Context) ([]string, error) {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			return parseMeshHostList(f)
+		}, nil
+	case strings.HasPrefix(v, "http://"), strings.HasPrefix(v, "https://"):
+		return func(ctx context.Context) ([]string, error) {
+			req, err := http.NewRequestWithContext(ctx, "GET", v, nil)
+			if err != nil {
+				return nil, err
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("%s: %s", v, res.Status)
+			}
+			return parseMeshHostList(io.LimitReader(res.Body, 1<<20))
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid --mesh-discovery %q; want srv:<name>, file:<path> or an http(s) URL", v)
+}
+
+// parseMeshHostList parses a list of --mesh-with entries, separated by
+// commas or newlines. Blank lines and lines starting with # are ignored.
+func parseMeshHostList(r io.Reader) ([]string, error) {
+	var hosts []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, ht := range strings.Split(line, ",") {
+			if ht = strings.TrimSpace(ht); ht != "" {
+				hosts = append(hosts, ht)
+			}
+		}
+	}
+	return hosts, sc.Err()
+}
+
+// discoverMeshSRV returns the targets of the DNS SRV record name as mesh
+// hosts. Targets with a port other than 443 include it.
+func discoverMeshSRV(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+	_, addrs, err := r.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, a := range addrs {
+		host := strings.TrimSuffix(a.Target, ".")
+		if a.Port != 443 && a.Port != 0 {
+			host = net.JoinHostPort(host, strconv.Itoa(int(a.Port)))
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
 
+func startMeshWithHost(s *derpserver.Server, host, dialHost string) (stop func(), _ error) {
 	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", host))
 	netMon := netmon.NewStatic() // good enough for cmd/derper; no need for netns fanciness
 	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+host+"/derp", logf, netMon)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	c.MeshKey = s.MeshKey()
 	c.WatchConnectionChanges = true
@@ -74,6 +318,17 @@ func startMeshWithHost(s *derpserver.Server, hostTuple string) error {
 	add := func(m derp.PeerPresentMessage) { s.AddPacketForwarder(m.Key, c) }
 	remove := func(m derp.PeerGoneMessage) { s.RemovePacketForwarder(m.Peer, c) }
 	notifyError := func(err error) {}
-	go c.RunWatchConnectionLoop(context.Background(), s.PublicKey(), logf, add, remove, notifyError)
-	return nil
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.RunWatchConnectionLoop(ctx, s.PublicKey(), logf, add, remove, notifyError)
+	}()
+	return func() {
+		// Closing the client makes the watch loop remove the
+		// forwarders it added, and canceling ctx makes it return.
+		cancel()
+		c.Close()
+		<-done
+	}, nil
 }
@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseMeshHostList(t *testing.T) {
+	got, err := parseMeshHostList(strings.NewReader(`
+# region 1
+derp1a.example.com, derp1b.example.com/10.0.0.2
+
+derp1c.example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"derp1a.example.com", "derp1b.example.com/10.0.0.2", "derp1c.example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestMeshManagerSetPeers(t *testing.T) {
+	running := map[string]string{} // host => dialHost
+	m := new(meshManager)
+	m.start = func(host, dialHost string) (func(), error) {
+		running[host] = dialHost
+		return func() {
+			// Stopping can be slow, so mustn't block m.
+			if !m.mu.TryLock() {
+				t.Errorf("stopping %s with m.mu held", host)
+			} else {
+				m.mu.Unlock()
+			}
+			delete(running, host)
+		}, nil
+	}
+	hosts := func() []string {
+		var hs []string
+		for h := range running {
+			hs = append(hs, h)
+		}
+		slices.Sort(hs)
+		return hs
+	}
+
+	if err := m.setPeers([]string{"a.example.com"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "mesh")
+	discover, err := meshDiscoverer("file:" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("b.example.com\nc.example.com/10.0.0.3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m.discover(discover)
+	if got, want := hosts(), []string{"a.example.com", "b.example.com", "c.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after first discovery, meshing with %q; want %q", got, want)
+	}
+	if got := running["c.example.com"]; got != "10.0.0.3" {
+		t.Errorf("dial host for c = %q; want 10.0.0.3", got)
+	}
+
+	// Removing a discovered peer stops meshing with it, but never with
+	// the static ones.
+	if err := os.WriteFile(file, []byte("c.example.com/10.0.0.3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m.discover(discover)
+	if got, want := hosts(), []string{"a.example.com", "c.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after second discovery, meshing with %q; want %q", got, want)
+	}
+
+	// Discovery errors leave the mesh as it was.
+	os.Remove(file)
+	m.discover(discover)
+	if got, want := hosts(), []string{"a.example.com", "c.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after failed discovery, meshing with %q; want %q", got, want)
+	}
+	if m.lastErr == nil {
+		t.Error("lastErr not set after failed discovery")
+	}
+
+	if _, err := meshDiscoverer("bogus"); err == nil {
+		t.Error("meshDiscoverer accepted bogus value")
+	}
+	if err := m.setPeers([]string{"a/b/c"}, false); err == nil {
+		t.Error("setPeers accepted bad host tuple")
+	}
+}
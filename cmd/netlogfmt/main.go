@@ -6,9 +6,26 @@
 // according to the schema in "tailscale.com/types/netlogtype.Message"
 // in a more humanly readable format.
 //
+// It can also read the files that tailscaled writes network traffic logs
+// to when TS_NETLOG_FILE is set, named as arguments. Each file's rotated
+// predecessors (file.1, file.2, etc.) are read first, oldest first.
+//
+// With --group-by, it instead sums the traffic of the connections with the
+// same values of the given keys, optionally within windows of time set by
+// --window, and prints a table of the totals once all input is read.
+// Messages can be filtered by node with --node and connections by address
+// with --addr. With --format=csv, --format=json or --format=parquet, each
+// connection, or aggregated group of connections, is output as a CSV
+// record, JSON object or Parquet row for loading into other tools.
+//
+// Tailscale IPs and node IDs can be converted to names using either a
+// netmap, as printed by "tailscale debug netmap", or the Tailscale API.
+//
 // Example usage:
 //
 //	$ cat netlog.json | go run tailscale.com/cmd/netlogfmt
+//	$ go run tailscale.com/cmd/netlogfmt /var/lib/tailscale/netlog.jsonl
+//	$ go run tailscale.com/cmd/netlogfmt --group-by=node,peer,dstport --window=1h --format=csv netlog.json
 //	=========================================================================================
 //	NodeID: n123456CNTRL
 //	Logged: 2022-10-13T20:23:10.165Z
@@ -44,6 +61,7 @@
 	"github.com/dsnet/try"
 	jsonv2 "github.com/go-json-experiment/json"
 	"github.com/go-json-experiment/json/jsontext"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netlogtype"
 	"tailscale.com/util/must"
@@ -53,31 +71,121 @@
 	resolveNames = flag.Bool("resolve-names", false, "convert tailscale IP addresses to hostnames; must also specify --api-key and --tailnet-id")
 	apiKey       = flag.String("api-key", "", "API key to query the Tailscale API with; see https://login.tailscale.com/admin/settings/keys")
 	tailnetName  = flag.String("tailnet-name", "", "tailnet domain name to lookup devices in; see https://login.tailscale.com/admin/settings/general")
+	netmapFile   = flag.String("netmap", "", "convert tailscale IP addresses and node IDs to hostnames using the netmap in this file, as printed by 'tailscale debug netmap'")
+	nodeFilter   = flag.String("node", "", "comma-separated node IDs or hostnames to only show the traffic of")
+	addrFilter   = flag.String("addr", "", "comma-separated IP addresses or prefixes to only show the connections to or from")
+	groupBy      = flag.String("group-by", "", "comma-separated keys to sum the traffic of connections by: "+strings.Join(groupKeys, ", "))
+	window       = flag.Duration("window", 0, "with --group-by, the duration of the windows of time to sum traffic within; zero means all time")
+	format       = flag.String("format", "text", "output format: text, csv, json (as JSON lines) or parquet")
 )
 
-var namesByAddr map[netip.Addr]string
+var (
+	namesByAddr   map[netip.Addr]string
+	namesByNodeID map[tailcfg.StableNodeID]string
+)
+
+var (
+	filt *filter     // messages and connections to output
+	agg  *aggregator // non-nil with --group-by
+	rw   *rowWriter  // non-nil with --format=csv, json or parquet
+)
 
 func main() {
 	flag.Parse()
-	if *resolveNames {
-		namesByAddr = mustMakeNamesByAddr()
+	switch {
+	case *netmapFile != "":
+		namesByAddr, namesByNodeID = makeNames(mustReadNetmapDevices(*netmapFile))
+	case *resolveNames:
+		namesByAddr, namesByNodeID = makeNames(mustFetchDevices())
+	}
+	var err error
+	if filt, err = parseFilter(*nodeFilter, *addrFilter); err != nil {
+		log.Fatalf("--addr: %v", err)
+	}
+	if *groupBy != "" {
+		if agg, err = newAggregator(*groupBy, *window); err != nil {
+			log.Fatalf("--group-by: %v", err)
+		}
+	} else if *window != 0 {
+		log.Fatalf("--window requires --group-by")
+	}
+	switch *format {
+	case "text":
+	case "csv", "json", "parquet":
+		rw = newRowWriter(os.Stdout, *format)
+	default:
+		log.Fatalf("invalid --format %q; want text, csv, json or parquet", *format)
 	}
+	defer flush()
 
 	// The logic handles a stream of arbitrary JSON.
 	// So long as a JSON object seems like a network log message,
 	// then this will unmarshal and print it.
-	if err := processStream(os.Stdin); err != nil {
-		if err == io.EOF {
-			return
+	if flag.NArg() == 0 {
+		if err := processStream(os.Stdin); err != nil {
+			log.Fatalf("processStream: %v", err)
+		}
+		return
+	}
+	for _, name := range flag.Args() {
+		for _, file := range rotatedFiles(name) {
+			if err := processFile(file); err != nil {
+				log.Fatalf("%s: %v", file, err)
+			}
+		}
+	}
+}
+
+// flush outputs the aggregated traffic, if any, and any buffered output.
+func flush() {
+	switch {
+	case agg != nil && rw == nil:
+		agg.printTable(os.Stdout, agg.rows())
+	case agg != nil:
+		for _, r := range agg.rows() {
+			must.Do(rw.write(r))
+		}
+	}
+	if rw != nil {
+		must.Do(rw.flush())
+	}
+}
+
+// rotatedFiles returns the files that make up the log file name, as
+// rotated by tailscaled: the existing name.N files, from the highest N
+// down, followed by name itself.
+func rotatedFiles(name string) []string {
+	var files []string
+	for i := 1; ; i++ {
+		rotated := name + "." + strconv.Itoa(i)
+		if _, err := os.Stat(rotated); err != nil {
+			break
 		}
-		log.Fatalf("processStream: %v", err)
+		files = append(files, rotated)
 	}
+	slices.Reverse(files)
+	return append(files, name)
 }
 
+func processFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return processStream(f)
+}
+
+// processStream processes the JSON values in r until its end.
 func processStream(r io.Reader) (err error) {
 	defer try.Handle(&err)
-	dec := jsontext.NewDecoder(os.Stdin)
+	dec := jsontext.NewDecoder(r)
 	for {
+		if dec.PeekKind() == 0 {
+			if _, err := dec.ReadToken(); err == io.EOF {
+				return nil
+			}
+		}
 		processValue(dec)
 	}
 }
@@ -131,6 +239,26 @@ func processObject(dec *jsontext.Decoder) {
 	if hasTraffic {
 		var msg message
 		try.E(jsonv2.Unmarshal(rawMsg, &msg))
+		handleMessage(msg)
+	}
+}
+
+// handleMessage filters msg and then prints it, outputs its connections,
+// or aggregates them, per the flags.
+func handleMessage(msg message) {
+	if !filt.filterMessage(&msg) {
+		return
+	}
+	switch {
+	case agg != nil:
+		for _, r := range messageRows(msg) {
+			agg.add(r)
+		}
+	case rw != nil:
+		for _, r := range messageRows(msg) {
+			try.E(rw.write(r))
+		}
+	default:
 		printMessage(msg)
 	}
 }
@@ -229,7 +357,11 @@ func printMessage(msg message) {
 		fmt.Printf("LogID:  %s\n", msg.Logtail.ID)
 	}
 	if msg.NodeID != "" {
-		fmt.Printf("NodeID: %s\n", msg.NodeID)
+		if name, ok := namesByNodeID[msg.NodeID]; ok {
+			fmt.Printf("NodeID: %s (%s)\n", msg.NodeID, name)
+		} else {
+			fmt.Printf("NodeID: %s\n", msg.NodeID)
+		}
 	}
 	formatTime := func(t time.Time) string {
 		return t.In(time.Local).Format("2006-01-02 15:04:05.000")
@@ -279,7 +411,14 @@ func printMessage(msg message) {
 	}
 }
 
-func mustMakeNamesByAddr() map[netip.Addr]string {
+// device is a node in the tailnet that names are resolved for.
+type device struct {
+	NodeID tailcfg.StableNodeID `json:"nodeId"`
+	Name   string               `json:"name"`
+	Addrs  []netip.Addr         `json:"addresses"`
+}
+
+func mustFetchDevices() []device {
 	switch {
 	case *apiKey == "":
 		log.Fatalf("--api-key must be specified with --resolve-names")
@@ -300,24 +439,58 @@ func mustMakeNamesByAddr() map[netip.Addr]string {
 
 	// Unmarshal the API response.
 	var m struct {
-		Devices []struct {
-			Name  string       `json:"name"`
-			Addrs []netip.Addr `json:"addresses"`
-		} `json:"devices"`
+		Devices []device `json:"devices"`
 	}
 	must.Do(json.Unmarshal(b, &m))
+	return m.Devices
+}
 
+// mustReadNetmapDevices returns the nodes in the netmap in the named file,
+// as printed by "tailscale debug netmap".
+func mustReadNetmapDevices(name string) []device {
+	type node struct {
+		StableID  tailcfg.StableNodeID
+		Name      string
+		Addresses []netip.Prefix
+	}
+	var nm struct {
+		SelfNode *node
+		Peers    []*node
+	}
+	b := must.Get(os.ReadFile(name))
+	if err := json.Unmarshal(b, &nm); err != nil {
+		log.Fatalf("--netmap: %v", err)
+	}
+	var devices []device
+	for _, n := range append([]*node{nm.SelfNode}, nm.Peers...) {
+		if n == nil {
+			continue
+		}
+		d := device{NodeID: n.StableID, Name: strings.TrimSuffix(n.Name, ".")}
+		for _, p := range n.Addresses {
+			d.Addrs = append(d.Addrs, p.Addr())
+		}
+		devices = append(devices, d)
+	}
+	return devices
+}
+
+// makeNames returns the names of the devices by their addresses and node
+// IDs.
+func makeNames(devices []device) (map[netip.Addr]string, map[tailcfg.StableNodeID]string) {
 	// Construct a unique mapping of Tailscale IP addresses to hostnames.
 	// For brevity, we start with the first segment of the name and
 	// use more segments until we find the shortest prefix that is unique
 	// for all names in the tailnet.
 	seen := make(map[string]bool)
 	namesByAddr := make(map[netip.Addr]string)
+	namesByNodeID := make(map[tailcfg.StableNodeID]string)
 retry:
-	for i := range 10 {
+	for i := 1; i <= 10; i++ {
 		clear(seen)
 		clear(namesByAddr)
-		for _, d := range m.Devices {
+		clear(namesByNodeID)
+		for _, d := range devices {
 			name := fieldPrefix(d.Name, i)
 			if seen[name] {
 				continue retry
@@ -326,8 +499,11 @@ func mustMakeNamesByAddr() map[netip.Addr]string {
 			for _, a := range d.Addrs {
 				namesByAddr[a] = name
 			}
+			if d.NodeID != "" {
+				namesByNodeID[d.NodeID] = name
+			}
 		}
-		return namesByAddr
+		return namesByAddr, namesByNodeID
 	}
 	panic("unable to produce unique mapping of address to names")
 }
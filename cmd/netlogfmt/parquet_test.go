@@ -0,0 +1,72 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestParquetWriter(t *testing.T) {
+	namesByNodeID, namesByAddr = nil, nil
+	start := time.Date(2025, 1, 2, 3, 4, 5, 6000, time.UTC)
+	rows := messageRows(testMessage(start, "A",
+		conn("100.64.0.1:1234", "100.64.0.2:80", 100),
+		conn("100.64.0.1:1235", "100.64.0.3:443", 200),
+	))
+	// Spill into a second row group.
+	for len(rows) <= parquetRowGroupRows {
+		rows = append(rows, rows[len(rows)%2])
+	}
+
+	var buf bytes.Buffer
+	pw := newParquetWriter(&buf)
+	for _, r := range rows {
+		if err := pw.write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.NumRows(); got != int64(len(rows)) {
+		t.Errorf("NumRows = %d; want %d", got, len(rows))
+	}
+	if got := len(f.RowGroups()); got != 2 {
+		t.Errorf("got %d row groups; want 2", got)
+	}
+	var names []string
+	for _, c := range f.Schema().Fields() {
+		names = append(names, c.Name())
+	}
+	if !slices.Equal(names, csvHeader) {
+		t.Errorf("columns = %q; want %q", names, csvHeader)
+	}
+
+	got, err := parquet.Read[parquetRow](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(rows) {
+		t.Fatalf("read %d rows; want %d", len(got), len(rows))
+	}
+	want := []parquetRow{rows[0].parquetRow(), rows[1].parquetRow()}
+	if want[0].Src != "100.64.0.1" || want[0].DstPort != 80 || want[1].TxBytes != 200 {
+		t.Fatalf("unexpected test rows %+v", want)
+	}
+	for i, r := range got {
+		if r != want[i%2] {
+			t.Fatalf("row %d = %+v; want %+v", i, r, want[i%2])
+		}
+	}
+}
@@ -0,0 +1,474 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+// row is the traffic of a connection, or of a group of connections when
+// aggregating, over a period of time.
+type row struct {
+	Start, End time.Time
+	NodeID     tailcfg.StableNodeID
+	Kind       string // "virtual", "subnet", "exit" or "physical"
+	Proto      ipproto.Proto
+	Src, Dst   netip.AddrPort
+	Peer       netip.Addr // the remote node's address; see peerAddr
+	netlogtype.Counts
+}
+
+// peerAddr returns the address of the remote end of a connection of the
+// given kind. Physical traffic is from the peer's Tailscale IP to its
+// endpoint, while other traffic is from a local address to a remote one.
+func peerAddr(kind string, cc netlogtype.ConnectionCounts) netip.Addr {
+	if kind == "physical" {
+		return cc.Src.Addr()
+	}
+	return cc.Dst.Addr()
+}
+
+// messageRows returns the rows for each connection in msg.
+func messageRows(msg message) []row {
+	var rows []row
+	add := func(kind string, traffic []netlogtype.ConnectionCounts) {
+		for _, cc := range traffic {
+			rows = append(rows, row{
+				Start:  msg.Start,
+				End:    msg.End,
+				NodeID: msg.NodeID,
+				Kind:   kind,
+				Proto:  cc.Proto,
+				Src:    cc.Src,
+				Dst:    cc.Dst,
+				Peer:   peerAddr(kind, cc),
+				Counts: cc.Counts,
+			})
+		}
+	}
+	add("virtual", msg.VirtualTraffic)
+	add("subnet", msg.SubnetTraffic)
+	add("exit", msg.ExitTraffic)
+	add("physical", msg.PhysicalTraffic)
+	return rows
+}
+
+// filter selects the messages and connections to output.
+type filter struct {
+	nodes    []string       // node IDs or names; empty means all nodes
+	prefixes []netip.Prefix // empty means all addresses
+}
+
+// parseFilter parses the comma-separated lists of node IDs or names, and
+// of IP addresses or prefixes, in the --node and --addr flags.
+func parseFilter(nodes, addrs string) (*filter, error) {
+	f := new(filter)
+	for n := range strings.SplitSeq(nodes, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			f.nodes = append(f.nodes, n)
+		}
+	}
+	for a := range strings.SplitSeq(addrs, ",") {
+		if a = strings.TrimSpace(a); a == "" {
+			continue
+		}
+		if p, err := netip.ParsePrefix(a); err == nil {
+			f.prefixes = append(f.prefixes, p.Masked())
+		} else if ip, err := netip.ParseAddr(a); err == nil {
+			f.prefixes = append(f.prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+		} else {
+			return nil, fmt.Errorf("invalid address or prefix %q", a)
+		}
+	}
+	return f, nil
+}
+
+// matchNode reports whether messages from the node with the given ID
+// should be output.
+func (f *filter) matchNode(id tailcfg.StableNodeID) bool {
+	if len(f.nodes) == 0 {
+		return true
+	}
+	name, hasName := namesByNodeID[id]
+	for _, n := range f.nodes {
+		if n == string(id) || hasName && n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddr reports whether a connection with either of the given
+// addresses should be output.
+func (f *filter) matchAddr(src, dst netip.Addr) bool {
+	if len(f.prefixes) == 0 {
+		return true
+	}
+	for _, p := range f.prefixes {
+		if p.Contains(src) || p.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMessage removes the connections from msg that f doesn't match,
+// and reports whether any traffic remains.
+func (f *filter) filterMessage(msg *message) bool {
+	if !f.matchNode(msg.NodeID) {
+		return false
+	}
+	keep := func(traffic []netlogtype.ConnectionCounts) []netlogtype.ConnectionCounts {
+		return slices.DeleteFunc(traffic, func(cc netlogtype.ConnectionCounts) bool {
+			return !f.matchAddr(cc.Src.Addr(), cc.Dst.Addr())
+		})
+	}
+	msg.VirtualTraffic = keep(msg.VirtualTraffic)
+	msg.SubnetTraffic = keep(msg.SubnetTraffic)
+	msg.ExitTraffic = keep(msg.ExitTraffic)
+	msg.PhysicalTraffic = keep(msg.PhysicalTraffic)
+	return len(msg.VirtualTraffic)+len(msg.SubnetTraffic)+len(msg.ExitTraffic)+len(msg.PhysicalTraffic) > 0
+}
+
+// groupKeys are the keys that rows can be aggregated by, in the order
+// they're output.
+var groupKeys = []string{"node", "kind", "proto", "src", "srcport", "dst", "dstport", "peer"}
+
+// aggregator sums rows with the same values of its keys, optionally
+// within fixed windows of time.
+type aggregator struct {
+	keys   map[string]bool
+	window time.Duration // zero means across all time
+
+	groups map[aggKey]*row
+}
+
+type aggKey struct {
+	window int64 // start of the window in Unix nanoseconds, if any
+	row    row   // with its times and counts zeroed
+}
+
+// newAggregator returns an aggregator that groups rows by the
+// comma-separated keys in groupBy, from groupKeys.
+func newAggregator(groupBy string, window time.Duration) (*aggregator, error) {
+	a := &aggregator{
+		keys:   make(map[string]bool),
+		window: window,
+		groups: make(map[aggKey]*row),
+	}
+	for k := range strings.SplitSeq(groupBy, ",") {
+		if k = strings.TrimSpace(k); k == "" {
+			continue
+		}
+		if !slices.Contains(groupKeys, k) {
+			return nil, fmt.Errorf("invalid group key %q; want one of %s", k, strings.Join(groupKeys, ", "))
+		}
+		a.keys[k] = true
+	}
+	return a, nil
+}
+
+// key returns the group that r belongs to.
+func (a *aggregator) key(r row) aggKey {
+	var k aggKey
+	if a.window > 0 {
+		k.window = r.Start.Truncate(a.window).UnixNano()
+	}
+	if a.keys["node"] {
+		k.row.NodeID = r.NodeID
+	}
+	if a.keys["kind"] {
+		k.row.Kind = r.Kind
+	}
+	if a.keys["proto"] {
+		k.row.Proto = r.Proto
+	}
+	var src, dst netip.Addr
+	var srcPort, dstPort uint16
+	if a.keys["src"] {
+		src = r.Src.Addr()
+	}
+	if a.keys["srcport"] {
+		srcPort = r.Src.Port()
+	}
+	if a.keys["dst"] {
+		dst = r.Dst.Addr()
+	}
+	if a.keys["dstport"] {
+		dstPort = r.Dst.Port()
+	}
+	k.row.Src = netip.AddrPortFrom(src, srcPort)
+	k.row.Dst = netip.AddrPortFrom(dst, dstPort)
+	if a.keys["peer"] {
+		k.row.Peer = r.Peer
+	}
+	return k
+}
+
+func (a *aggregator) add(r row) {
+	k := a.key(r)
+	g, ok := a.groups[k]
+	if !ok {
+		g = new(row)
+		*g = k.row
+		if a.window > 0 {
+			g.Start = time.Unix(0, k.window)
+			g.End = g.Start.Add(a.window)
+		} else {
+			g.Start, g.End = r.Start, r.End
+		}
+		a.groups[k] = g
+	}
+	if a.window == 0 {
+		if r.Start.Before(g.Start) {
+			g.Start = r.Start
+		}
+		if r.End.After(g.End) {
+			g.End = r.End
+		}
+	}
+	g.Counts = g.Counts.Add(r.Counts)
+}
+
+// rows returns the aggregated rows in order of time, and then of the most
+// traffic.
+func (a *aggregator) rows() []row {
+	rows := make([]row, 0, len(a.groups))
+	for _, g := range a.groups {
+		rows = append(rows, *g)
+	}
+	slices.SortFunc(rows, func(x, y row) int {
+		if c := x.Start.Compare(y.Start); c != 0 && a.window > 0 {
+			return c
+		}
+		return cmp.Or(
+			cmp.Compare(y.TxBytes+y.RxBytes, x.TxBytes+x.RxBytes),
+			cmp.Compare(y.TxPackets+y.RxPackets, x.TxPackets+x.RxPackets),
+			x.Start.Compare(y.Start),
+		)
+	})
+	return rows
+}
+
+// printTable prints rows, as aggregated by a, as a table.
+func (a *aggregator) printTable(w io.Writer, rows []row) {
+	formatTime := func(t time.Time) string {
+		return t.In(time.Local).Format("2006-01-02 15:04:05.000")
+	}
+	if a.window == 0 && len(rows) > 0 {
+		start, end := rows[0].Start, rows[0].End
+		for _, r := range rows {
+			if r.Start.Before(start) {
+				start = r.Start
+			}
+			if r.End.After(end) {
+				end = r.End
+			}
+		}
+		fmt.Fprintf(w, "Window: %s - %s\n", formatTime(start), formatTime(end))
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	var header []string
+	if a.window > 0 {
+		header = append(header, "WINDOW")
+	}
+	for _, k := range groupKeys {
+		if a.keys[k] {
+			header = append(header, strings.ToUpper(k))
+		}
+	}
+	header = append(header, "TX PKTS", "TX BYTES", "RX PKTS", "RX BYTES")
+	fmt.Fprintln(tw, strings.Join(header, "\t")+"\t")
+	for _, r := range rows {
+		var cols []string
+		if a.window > 0 {
+			cols = append(cols, formatTime(r.Start))
+		}
+		for _, k := range groupKeys {
+			if a.keys[k] {
+				cols = append(cols, cmp.Or(r.column(k, true), "-"))
+			}
+		}
+		cols = append(cols,
+			formatSI(float64(r.TxPackets)), formatIEC(float64(r.TxBytes)),
+			formatSI(float64(r.RxPackets)), formatIEC(float64(r.RxBytes)))
+		fmt.Fprintln(tw, strings.Join(cols, "\t")+"\t")
+	}
+	tw.Flush()
+}
+
+// column returns the value of r for the given key from groupKeys,
+// or the empty string if it has none. If resolve is true, node IDs and
+// addresses are converted to names where known.
+func (r *row) column(key string, resolve bool) string {
+	addr := func(a netip.Addr) string {
+		if !a.IsValid() {
+			return ""
+		}
+		if name, ok := namesByAddr[a]; ok && resolve {
+			return name
+		}
+		return a.String()
+	}
+	port := func(p uint16) string {
+		if p == 0 {
+			return ""
+		}
+		return strconv.Itoa(int(p))
+	}
+	switch key {
+	case "node":
+		if name, ok := namesByNodeID[r.NodeID]; ok && resolve {
+			return name
+		}
+		return string(r.NodeID)
+	case "kind":
+		return r.Kind
+	case "proto":
+		if r.Proto == 0 {
+			return ""
+		}
+		return r.Proto.String()
+	case "src":
+		return addr(r.Src.Addr())
+	case "srcport":
+		return port(r.Src.Port())
+	case "dst":
+		return addr(r.Dst.Addr())
+	case "dstport":
+		return port(r.Dst.Port())
+	case "peer":
+		return addr(r.Peer)
+	}
+	panic("unknown key " + key)
+}
+
+// csvHeader is the header of CSV output.
+var csvHeader = []string{
+	"start", "end", "node_id", "node_name", "kind", "proto",
+	"src", "src_port", "dst", "dst_port", "peer", "peer_name",
+	"tx_packets", "tx_bytes", "rx_packets", "rx_bytes",
+}
+
+// csvRecord returns r as a CSV record with the columns in csvHeader.
+func (r *row) csvRecord() []string {
+	return []string{
+		r.Start.UTC().Format(time.RFC3339Nano),
+		r.End.UTC().Format(time.RFC3339Nano),
+		string(r.NodeID),
+		namesByNodeID[r.NodeID],
+		r.Kind,
+		r.column("proto", false),
+		r.column("src", false),
+		r.column("srcport", false),
+		r.column("dst", false),
+		r.column("dstport", false),
+		r.column("peer", false),
+		namesByAddr[r.Peer],
+		strconv.FormatUint(r.TxPackets, 10),
+		strconv.FormatUint(r.TxBytes, 10),
+		strconv.FormatUint(r.RxPackets, 10),
+		strconv.FormatUint(r.RxBytes, 10),
+	}
+}
+
+// jsonRow is r as output with --format=json, with the same fields as
+// the CSV output.
+type jsonRow struct {
+	Start     time.Time            `json:"start"`
+	End       time.Time            `json:"end"`
+	NodeID    tailcfg.StableNodeID `json:"node_id,omitempty"`
+	NodeName  string               `json:"node_name,omitempty"`
+	Kind      string               `json:"kind,omitempty"`
+	Proto     string               `json:"proto,omitempty"`
+	Src       string               `json:"src,omitempty"`
+	SrcPort   uint16               `json:"src_port,omitempty"`
+	Dst       string               `json:"dst,omitempty"`
+	DstPort   uint16               `json:"dst_port,omitempty"`
+	Peer      string               `json:"peer,omitempty"`
+	PeerName  string               `json:"peer_name,omitempty"`
+	TxPackets uint64               `json:"tx_packets"`
+	TxBytes   uint64               `json:"tx_bytes"`
+	RxPackets uint64               `json:"rx_packets"`
+	RxBytes   uint64               `json:"rx_bytes"`
+}
+
+func (r *row) jsonRow() jsonRow {
+	return jsonRow{
+		Start:     r.Start.UTC(),
+		End:       r.End.UTC(),
+		NodeID:    r.NodeID,
+		NodeName:  namesByNodeID[r.NodeID],
+		Kind:      r.Kind,
+		Proto:     r.column("proto", false),
+		Src:       r.column("src", false),
+		SrcPort:   r.Src.Port(),
+		Dst:       r.column("dst", false),
+		DstPort:   r.Dst.Port(),
+		Peer:      r.column("peer", false),
+		PeerName:  namesByAddr[r.Peer],
+		TxPackets: r.TxPackets,
+		TxBytes:   r.TxBytes,
+		RxPackets: r.RxPackets,
+		RxBytes:   r.RxBytes,
+	}
+}
+
+// rowWriter writes rows as CSV, JSON lines or Parquet.
+type rowWriter struct {
+	csv     *csv.Writer    // non-nil for CSV
+	json    *json.Encoder  // non-nil for JSON
+	parquet *parquetWriter // non-nil for Parquet
+}
+
+func newRowWriter(w io.Writer, format string) *rowWriter {
+	rw := new(rowWriter)
+	switch format {
+	case "csv":
+		rw.csv = csv.NewWriter(w)
+		rw.csv.Write(csvHeader)
+	case "json":
+		rw.json = json.NewEncoder(w)
+	case "parquet":
+		rw.parquet = newParquetWriter(w)
+	}
+	return rw
+}
+
+func (rw *rowWriter) write(r row) error {
+	switch {
+	case rw.csv != nil:
+		return rw.csv.Write(r.csvRecord())
+	case rw.parquet != nil:
+		return rw.parquet.write(r)
+	}
+	return rw.json.Encode(r.jsonRow())
+}
+
+// flush writes any buffered output. For Parquet, it completes the file, so
+// it must be called once, after all rows are written.
+func (rw *rowWriter) flush() error {
+	switch {
+	case rw.csv != nil:
+		rw.csv.Flush()
+		return rw.csv.Error()
+	case rw.parquet != nil:
+		return rw.parquet.close()
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+func testMessage(start time.Time, node string, virtual ...netlogtype.ConnectionCounts) message {
+	var msg message
+	msg.NodeID = tailcfg.StableNodeID("n" + node)
+	msg.Start = start
+	msg.End = start.Add(5 * time.Second)
+	msg.VirtualTraffic = virtual
+	return msg
+}
+
+func conn(src, dst string, txBytes uint64) netlogtype.ConnectionCounts {
+	return netlogtype.ConnectionCounts{
+		Connection: netlogtype.Connection{
+			Proto: ipproto.TCP,
+			Src:   netip.MustParseAddrPort(src),
+			Dst:   netip.MustParseAddrPort(dst),
+		},
+		Counts: netlogtype.Counts{TxPackets: 1, TxBytes: txBytes},
+	}
+}
+
+func TestFilter(t *testing.T) {
+	namesByNodeID = nil
+	start := time.Unix(1700000000, 0)
+	f, err := parseFilter("nA", "100.64.0.2, 100.64.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testMessage(start, "A",
+		conn("100.64.0.1:1000", "100.64.0.2:22", 10),
+		conn("100.64.0.1:1001", "100.64.0.3:22", 20),
+		conn("100.64.1.5:1002", "100.64.0.1:80", 30),
+	)
+	if !f.filterMessage(&msg) {
+		t.Fatal("message filtered out")
+	}
+	var got []uint64
+	for _, cc := range msg.VirtualTraffic {
+		got = append(got, cc.TxBytes)
+	}
+	if want := []uint64{10, 30}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept connections with TxBytes %v; want %v", got, want)
+	}
+	msg = testMessage(start, "B", conn("100.64.0.1:1000", "100.64.0.2:22", 10))
+	if f.filterMessage(&msg) {
+		t.Error("message from other node not filtered out")
+	}
+	if _, err := parseFilter("", "bogus"); err == nil {
+		t.Error("parseFilter accepted invalid address")
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	a, err := newAggregator("node,dstport", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := []message{
+		testMessage(start, "A",
+			conn("100.64.0.1:1000", "100.64.0.2:22", 10),
+			conn("100.64.0.1:1001", "100.64.0.3:22", 20),
+			conn("100.64.0.1:1002", "100.64.0.2:443", 100)),
+		testMessage(start.Add(30*time.Minute), "A", conn("100.64.0.1:1003", "100.64.0.2:22", 5)),
+		testMessage(start.Add(time.Hour), "A", conn("100.64.0.1:1004", "100.64.0.2:22", 7)),
+	}
+	for _, msg := range msgs {
+		for _, r := range messageRows(msg) {
+			a.add(r)
+		}
+	}
+	type result struct {
+		start   time.Time
+		dstPort uint16
+		txBytes uint64
+	}
+	var got []result
+	for _, r := range a.rows() {
+		if r.NodeID != "nA" || r.Src.Addr().IsValid() || r.Dst.Addr().IsValid() {
+			t.Errorf("row has ungrouped values: %+v", r)
+		}
+		got = append(got, result{r.Start.UTC(), r.Dst.Port(), r.TxBytes})
+	}
+	want := []result{
+		{start, 443, 100},
+		{start, 22, 35},
+		{start.Add(time.Hour), 22, 7},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rows = %v; want %v", got, want)
+	}
+
+	if _, err := newAggregator("node,bogus", 0); err == nil {
+		t.Error("newAggregator accepted invalid key")
+	}
+}
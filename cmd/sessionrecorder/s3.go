@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"io"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"tailscale.com/sessionrecording/recorder"
+)
+
+// s3Storage is a recorder.Storage that uploads recordings to an S3 bucket.
+type s3Storage struct {
+	up     *manager.Uploader
+	bucket string
+	prefix string
+}
+
+// newS3Storage returns an s3Storage for the bucket, using the AWS SDK's
+// default configuration for credentials. If endpoint is non-empty, it is
+// the URL of an S3-compatible service to use instead of AWS.
+func newS3Storage(ctx context.Context, bucket, prefix, endpoint, region string) (recorder.Storage, error) {
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			// Most S3-compatible services don't support
+			// virtual-hosted-style bucket addressing.
+			o.UsePathStyle = true
+		}
+	})
+	return &s3Storage{
+		up:     manager.NewUploader(client),
+		bucket: bucket,
+		prefix: prefix,
+	}, nil
+}
+
+// Create implements recorder.Storage. The recording is uploaded as it is
+// written, in parts, and the object is created when the writer is closed.
+func (s *s3Storage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	w := &s3Writer{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := s.up.Upload(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(path.Join(s.prefix, name)),
+			Body:        pr,
+			ContentType: aws.String("application/x-asciicast"),
+		})
+		// Fail any further writes if the upload failed.
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// s3Writer is the io.WriteCloser for a recording being uploaded to S3.
+type s3Writer struct {
+	pw   *io.PipeWriter
+	done chan error // receives the upload's result
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close finishes the upload and returns its error, if any.
+func (w *s3Writer) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// The sessionrecorder command is a session recording server that joins a
+// tailnet with tsnet and stores the recordings that Tailscale SSH and the
+// Kubernetes API server proxy upload to it, in a local directory or an
+// S3-compatible bucket.
+//
+// It is a reference implementation of the recorder protocol, for testing and
+// for self-hosting where tsrecorder isn't an option, such as in air-gapped
+// environments.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/peterbourgon/ff/v3"
+	"tailscale.com/hostinfo"
+	"tailscale.com/ipn"
+	"tailscale.com/sessionrecording/recorder"
+	"tailscale.com/tsnet"
+)
+
+func main() {
+	hostinfo.SetApp("sessionrecorder")
+
+	fs := flag.NewFlagSet("sessionrecorder", flag.ExitOnError)
+	var (
+		hostname      = fs.String("hostname", "recorder", "hostname to join the tailnet as")
+		stateDir      = fs.String("state-dir", "", "path to directory in which to store tsnet state; defaults to tsnet's default")
+		controlURL    = fs.String("login-server", ipn.DefaultControlURL, "the base URL of control server")
+		port          = fs.Int("port", 80, "tailnet port to receive recordings on")
+		recordingsDir = fs.String("recordings-dir", "", "local directory to store recordings in; defaults to recordings in the state directory")
+		s3Bucket      = fs.String("s3-bucket", "", "if set, store recordings in this S3 bucket instead of a local directory")
+		s3Prefix      = fs.String("s3-prefix", "", "prefix for the keys of recordings stored in S3")
+		s3Endpoint    = fs.String("s3-endpoint", "", "URL of an S3-compatible service to use instead of AWS")
+		s3Region      = fs.String("s3-region", "", "S3 region; defaults to the AWS SDK's configuration")
+		verbose       = fs.Bool("verbose", false, "enable verbose tsnet logging")
+	)
+	ff.Parse(fs, os.Args[1:], ff.WithEnvVarPrefix("TS_SESSIONRECORDER"))
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	ts := &tsnet.Server{
+		Hostname:   *hostname,
+		Dir:        *stateDir,
+		ControlURL: *controlURL,
+	}
+	if *verbose {
+		ts.Logf = log.Printf
+	}
+	defer ts.Close()
+
+	var st recorder.Storage
+	if *s3Bucket != "" {
+		var err error
+		st, err = newS3Storage(ctx, *s3Bucket, *s3Prefix, *s3Endpoint, *s3Region)
+		if err != nil {
+			log.Fatalf("S3 storage: %v", err)
+		}
+		log.Printf("storing recordings in s3://%s/%s", *s3Bucket, *s3Prefix)
+	} else {
+		dir := *recordingsDir
+		if dir == "" {
+			if err := ts.Start(); err != nil {
+				log.Fatalf("ts.Start: %v", err)
+			}
+			dir = filepath.Join(ts.GetRootPath(), "recordings")
+		}
+		st = recorder.DirStorage(dir)
+		log.Printf("storing recordings in %s", dir)
+	}
+
+	ln, err := ts.Listen("tcp", fmt.Sprintf(":%d", *port))
+	if err != nil {
+		log.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	hs := &http.Server{Handler: &recorder.Server{Storage: st}}
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+	if err := hs.Serve(ln); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("serve: %v", err)
+	}
+}
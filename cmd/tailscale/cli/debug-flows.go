@@ -0,0 +1,171 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/ipproto"
+)
+
+var debugFlowsArgs struct {
+	peer string
+	top  int
+	json bool
+}
+
+func debugFlowsCmd() *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "flows",
+		ShortUsage: "tailscale debug flows [--peer=<hostname-or-IP>] [--top=N] [--json]",
+		Exec:       runDebugFlows,
+		ShortHelp:  "Stream the connections through this node and their traffic",
+		LongHelp: strings.TrimSpace(`
+The 'tailscale debug flows' command streams the traffic of each connection
+through this node, as network logging records it, every few seconds.
+Exit node traffic has its non-Tailscale addresses removed.
+
+With --top, it instead shows the connections with the most traffic since
+it started, updating as traffic is recorded.
+`),
+		FlagSet: (func() *flag.FlagSet {
+			fs := newFlagSet("flows")
+			fs.StringVar(&debugFlowsArgs.peer, "peer", "", "only show connections with this peer, by name or Tailscale IP")
+			fs.IntVar(&debugFlowsArgs.top, "top", 0, "if positive, show the N connections with the most traffic")
+			fs.BoolVar(&debugFlowsArgs.json, "json", false, "output each flow as JSON")
+			return fs
+		})(),
+	}
+}
+
+func runDebugFlows(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	if debugFlowsArgs.top > 0 && debugFlowsArgs.json {
+		return errors.New("--top and --json are mutually exclusive")
+	}
+	var top *flowTop
+	if debugFlowsArgs.top > 0 {
+		top = &flowTop{
+			n:     debugFlowsArgs.top,
+			clear: isatty.IsTerminal(os.Stdout.Fd()),
+		}
+	}
+	enc := json.NewEncoder(Stdout)
+	for f, err := range localClient.StreamFlows(ctx, debugFlowsArgs.peer) {
+		if err != nil {
+			return err
+		}
+		switch {
+		case debugFlowsArgs.json:
+			enc.Encode(f)
+		case top != nil:
+			top.add(f)
+		default:
+			printf("%s %-8s %-4s %s -> %s %s tx=%d/%dB rx=%d/%dB\n",
+				f.End.Local().Format(time.TimeOnly), f.Kind, flowProto(f.Proto),
+				flowAddr(f.Src), flowAddr(f.Dst), cmp.Or(f.Peer, "-"),
+				f.TxPackets, f.TxBytes, f.RxPackets, f.RxBytes)
+		}
+	}
+	return nil
+}
+
+func flowProto(p ipproto.Proto) string {
+	if p == 0 {
+		return "-"
+	}
+	return p.String()
+}
+
+func flowAddr(ap netip.AddrPort) string {
+	switch {
+	case !ap.Addr().IsValid():
+		return "*"
+	case ap.Port() == 0:
+		return ap.Addr().String()
+	}
+	return ap.String()
+}
+
+// flowKey identifies a connection in a flowTop.
+type flowKey struct {
+	kind     string
+	proto    ipproto.Proto
+	src, dst netip.AddrPort
+}
+
+// flowTop accumulates flows and shows the n connections with the most
+// traffic every time a new interval of traffic starts arriving.
+type flowTop struct {
+	n     int
+	clear bool // whether to clear the terminal before each update
+
+	end   time.Time // end of the interval being received
+	flows map[flowKey]*apitype.Flow
+}
+
+func (t *flowTop) add(f apitype.Flow) {
+	if !f.End.Equal(t.end) {
+		if !t.end.IsZero() {
+			t.print(Stdout)
+		}
+		t.end = f.End
+	}
+	k := flowKey{f.Kind, f.Proto, f.Src, f.Dst}
+	cur, ok := t.flows[k]
+	if !ok {
+		if t.flows == nil {
+			t.flows = make(map[flowKey]*apitype.Flow)
+		}
+		t.flows[k] = &f
+		return
+	}
+	cur.End = f.End
+	cur.TxPackets += f.TxPackets
+	cur.TxBytes += f.TxBytes
+	cur.RxPackets += f.RxPackets
+	cur.RxBytes += f.RxBytes
+	cur.Peer = cmp.Or(f.Peer, cur.Peer)
+}
+
+func (t *flowTop) print(w io.Writer) {
+	flows := slices.SortedFunc(maps.Values(t.flows), func(a, b *apitype.Flow) int {
+		return cmp.Compare(b.TxBytes+b.RxBytes, a.TxBytes+a.RxBytes)
+	})
+	if len(flows) > t.n {
+		flows = flows[:t.n]
+	}
+	if t.clear {
+		io.WriteString(w, "\x1b[H\x1b[2J")
+	} else {
+		io.WriteString(w, "\n")
+	}
+	fmt.Fprintf(w, "Top connections as of %s:\n", t.end.Local().Format(time.TimeOnly))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "KIND\tPROTO\tSOURCE\tDESTINATION\tPEER\tTX PKTS\tTX BYTES\tRX PKTS\tRX BYTES\t")
+	for _, f := range flows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t\n",
+			f.Kind, flowProto(f.Proto), flowAddr(f.Src), flowAddr(f.Dst), cmp.Or(f.Peer, "-"),
+			f.TxPackets, f.TxBytes, f.RxPackets, f.RxBytes)
+	}
+	tw.Flush()
+}
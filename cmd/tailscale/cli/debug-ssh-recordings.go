@@ -0,0 +1,235 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ts_omit_ssh
+
+package cli
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/sessionrecording"
+)
+
+func init() {
+	debugSSHRecordingsCmd = mkDebugSSHRecordingsCmd
+}
+
+func mkDebugSSHRecordingsCmd() *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "ssh-recordings",
+		ShortUsage: "tailscale debug ssh-recordings <list|play> ...",
+		ShortHelp:  "List and replay Tailscale SSH sessions recorded to local disk",
+		LongHelp: strings.TrimSpace(`
+Tailscale SSH records sessions to local disk if tailscaled is run with the
+environment variable TS_SSH_RECORD_LOCALLY=true and either no recorders are
+configured or none of them can be reached. Unless --dir is given, the
+recordings directory is asked of tailscaled. Reading the recordings typically
+requires root.
+`),
+		FlagSet: (func() *flag.FlagSet {
+			fs := newFlagSet("ssh-recordings")
+			fs.StringVar(&sshRecordingsArgs.dir, "dir", "", "directory containing the recordings; if empty, tailscaled's")
+			return fs
+		})(),
+		Subcommands: []*ffcli.Command{
+			{
+				Name:       "list",
+				ShortUsage: "tailscale debug ssh-recordings list",
+				ShortHelp:  "List recorded sessions, oldest first",
+				Exec:       runSSHRecordingsList,
+				FlagSet: (func() *flag.FlagSet {
+					fs := newFlagSet("list")
+					fs.StringVar(&sshRecordingsArgs.user, "user", "", "only list sessions whose source user, SSH user or local user is this")
+					fs.StringVar(&sshRecordingsArgs.node, "node", "", "only list sessions from nodes whose name starts with this, or with this node ID")
+					fs.DurationVar(&sshRecordingsArgs.since, "since", 0, "if non-zero, only list sessions started at most this long ago")
+					fs.BoolVar(&sshRecordingsArgs.json, "json", false, "output in JSON format")
+					return fs
+				})(),
+			},
+			{
+				Name:       "play",
+				ShortUsage: "tailscale debug ssh-recordings play <file>",
+				ShortHelp:  "Replay a recorded session in the terminal",
+				Exec:       runSSHRecordingsPlay,
+				FlagSet: (func() *flag.FlagSet {
+					fs := newFlagSet("play")
+					fs.Float64Var(&sshRecordingsArgs.speed, "speed", 1, "playback speed multiplier")
+					fs.DurationVar(&sshRecordingsArgs.idleLimit, "idle-limit", 0, "if non-zero, shorten pauses longer than this to this")
+					return fs
+				})(),
+			},
+		},
+		Exec: func(context.Context, []string) error {
+			return flag.ErrHelp
+		},
+	}
+}
+
+var sshRecordingsArgs struct {
+	dir       string
+	user      string
+	node      string
+	since     time.Duration
+	json      bool
+	speed     float64
+	idleLimit time.Duration
+}
+
+// sshRecordingsDir returns the directory given with --dir, or else the one
+// tailscaled records sessions to.
+func sshRecordingsDir(ctx context.Context) (string, error) {
+	if sshRecordingsArgs.dir != "" {
+		return sshRecordingsArgs.dir, nil
+	}
+	dir, err := localClient.SSHRecordingsDir(ctx)
+	if err != nil {
+		return "", fmt.Errorf("getting recordings directory from tailscaled (use --dir to set it): %w", err)
+	}
+	return dir, nil
+}
+
+// sshRecording is a recording in the recordings directory.
+type sshRecording struct {
+	File   string
+	Header sessionrecording.CastHeader
+}
+
+// matches reports whether rec passes the list filters.
+func (rec *sshRecording) matches(now time.Time) bool {
+	h := &rec.Header
+	if u := sshRecordingsArgs.user; u != "" &&
+		!strings.EqualFold(h.SrcNodeUser, u) && h.SSHUser != u && h.LocalUser != u {
+		return false
+	}
+	if n := sshRecordingsArgs.node; n != "" &&
+		!strings.HasPrefix(h.SrcNode, n) && string(h.SrcNodeID) != n {
+		return false
+	}
+	if d := sshRecordingsArgs.since; d > 0 && time.Unix(h.Timestamp, 0).Before(now.Add(-d)) {
+		return false
+	}
+	return true
+}
+
+func readSSHRecordings(dir string) ([]*sshRecording, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.cast"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+	}
+	var recs []*sshRecording
+	for _, name := range names {
+		h, err := readCastHeader(name)
+		if err != nil {
+			fmt.Fprintf(Stderr, "skipping %s: %v\n", name, err)
+			continue
+		}
+		recs = append(recs, &sshRecording{File: name, Header: *h})
+	}
+	slices.SortStableFunc(recs, func(a, b *sshRecording) int {
+		return cmp.Compare(a.Header.Timestamp, b.Header.Timestamp)
+	})
+	return recs, nil
+}
+
+func readCastHeader(name string) (*sessionrecording.CastHeader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cr, err := sessionrecording.NewCastReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return &cr.Header, nil
+}
+
+func runSSHRecordingsList(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	dir, err := sshRecordingsDir(ctx)
+	if err != nil {
+		return err
+	}
+	recs, err := readSSHRecordings(dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	recs = slices.DeleteFunc(recs, func(rec *sshRecording) bool {
+		return !rec.matches(now)
+	})
+	if sshRecordingsArgs.json {
+		j, err := json.MarshalIndent(recs, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	w := tabwriter.NewWriter(Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSTARTED\tFROM\tNODE\tSSH USER\tLOCAL USER\tCOMMAND")
+	for _, rec := range recs {
+		h := &rec.Header
+		from := h.SrcNodeUser
+		if len(h.SrcNodeTags) > 0 {
+			from = strings.Join(h.SrcNodeTags, ",")
+		}
+		cmd := h.Command
+		if cmd == "" {
+			cmd = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			filepath.Base(rec.File),
+			time.Unix(h.Timestamp, 0).Format(time.DateTime),
+			from, h.SrcNode, h.SSHUser, h.LocalUser, cmd)
+	}
+	return w.Flush()
+}
+
+func runSSHRecordingsPlay(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale debug ssh-recordings play <file>")
+	}
+	if sshRecordingsArgs.speed <= 0 {
+		return errors.New("--speed must be positive")
+	}
+	name := args[0]
+	f, err := os.Open(name)
+	if os.IsNotExist(err) && !strings.ContainsRune(name, filepath.Separator) {
+		if dir, dirErr := sshRecordingsDir(ctx); dirErr == nil {
+			f, err = os.Open(filepath.Join(dir, name))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cr, err := sessionrecording.NewCastReader(f)
+	if err != nil {
+		return err
+	}
+	return sessionrecording.Replay(ctx, Stdout, cr, sessionrecording.ReplayOptions{
+		Speed:   sshRecordingsArgs.speed,
+		MaxIdle: sshRecordingsArgs.idleLimit,
+	})
+}
@@ -49,9 +49,10 @@
 )
 
 var (
-	debugCaptureCmd   func() *ffcli.Command // or nil
-	debugPortmapCmd   func() *ffcli.Command // or nil
-	debugPeerRelayCmd func() *ffcli.Command // or nil
+	debugCaptureCmd       func() *ffcli.Command // or nil
+	debugPortmapCmd       func() *ffcli.Command // or nil
+	debugPeerRelayCmd     func() *ffcli.Command // or nil
+	debugSSHRecordingsCmd func() *ffcli.Command // or nil
 )
 
 func debugCmd() *ffcli.Command {
@@ -341,6 +342,7 @@ func debugCmd() *ffcli.Command {
 					return fs
 				})(),
 			},
+			debugFlowsCmd(),
 			{
 				Name:       "resolve",
 				ShortUsage: "tailscale debug resolve <hostname>",
@@ -376,6 +378,7 @@ func debugCmd() *ffcli.Command {
 				})(),
 			},
 			ccall(debugPeerRelayCmd),
+			ccall(debugSSHRecordingsCmd),
 		}...),
 	}
 }
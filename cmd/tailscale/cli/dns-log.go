@@ -0,0 +1,129 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var dnsLogCmd = &ffcli.Command{
+	Name:       "log",
+	ShortUsage: "tailscale dns log [--peer=<hostname-or-IP>] [--json] [--stats]",
+	Exec:       runDNSLog,
+	ShortHelp:  "Stream the queries answered by the internal DNS forwarder",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale dns log' subcommand streams the DNS queries answered by the
+internal DNS forwarder (100.100.100.100), both from this device and from peers
+using it as an exit node or app connector. Each query is shown with the client
+that sent it, its response code, the DNS route and upstream resolver it was
+forwarded to, and how long it took to answer.
+
+Queries are logged at a limited rate; when some aren't shown, a line saying how
+many were skipped is printed.
+
+With --stats, it instead prints the number of queries answered per DNS route
+and per peer since tailscaled started.
+`),
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("log")
+		fs.StringVar(&dnsLogArgs.peer, "peer", "", "only show queries from this peer, by name or Tailscale IP")
+		fs.BoolVar(&dnsLogArgs.json, "json", false, "output each query, or the stats, as JSON")
+		fs.BoolVar(&dnsLogArgs.stats, "stats", false, "print query counts per DNS route and per peer, and exit")
+		return fs
+	})(),
+}
+
+// dnsLogArgs are the arguments for the "dns log" subcommand.
+var dnsLogArgs struct {
+	peer  string
+	json  bool
+	stats bool
+}
+
+func runDNSLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	if dnsLogArgs.stats {
+		if dnsLogArgs.peer != "" {
+			return errors.New("--peer and --stats are mutually exclusive")
+		}
+		return runDNSLogStats(ctx)
+	}
+	enc := json.NewEncoder(Stdout)
+	for e, err := range localClient.StreamDNSQueries(ctx, dnsLogArgs.peer) {
+		if err != nil {
+			return err
+		}
+		if dnsLogArgs.json {
+			enc.Encode(e)
+			continue
+		}
+		if e.Dropped > 0 {
+			printf("... %d queries not shown\n", e.Dropped)
+		}
+		result := e.RCode
+		if e.Error != "" {
+			result = "error: " + e.Error
+		}
+		from := e.From.Addr().String()
+		if e.Peer != "" {
+			from = e.Peer + " (" + from + ")"
+		}
+		printf("%s %s %s %s %s route=%s upstream=%s %v\n",
+			e.Time.Local().Format(time.TimeOnly), from, e.Name, e.Type, result,
+			cmp.Or(e.Route, "-"), cmp.Or(e.Upstream, "-"), e.Latency.Round(time.Millisecond))
+	}
+	return nil
+}
+
+func runDNSLogStats(ctx context.Context) error {
+	res, err := localClient.DNSQueryStats(ctx)
+	if err != nil {
+		return err
+	}
+	if dnsLogArgs.json {
+		enc := json.NewEncoder(Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	printDNSQueryStats(Stdout, "ROUTE", res.ByRoute)
+	printf("\n")
+	printDNSQueryStats(Stdout, "PEER", res.ByPeer)
+	return nil
+}
+
+// printDNSQueryStats prints stats as a table with the stats' keys in a
+// column named keyName, busiest first.
+func printDNSQueryStats(w io.Writer, keyName string, stats map[string]apitype.DNSQueryStats) {
+	keys := slices.SortedFunc(maps.Keys(stats), func(a, b string) int {
+		return cmp.Or(cmp.Compare(stats[b].Queries, stats[a].Queries), strings.Compare(a, b))
+	})
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tQUERIES\tNXDOMAIN\tSERVFAIL\tERRORS\tCACHED\tAVG LATENCY\n", keyName)
+	for _, k := range keys {
+		s := stats[k]
+		var avg time.Duration
+		if s.Queries > 0 {
+			avg = s.Latency / time.Duration(s.Queries)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%v\n",
+			cmp.Or(k, "(local)"), s.Queries, s.NXDomain, s.ServFail, s.Errors, s.CacheHits, avg.Round(time.Millisecond))
+	}
+	tw.Flush()
+}
@@ -22,14 +22,12 @@
 	ShortUsage: strings.Join([]string{
 		dnsStatusCmd.ShortUsage,
 		dnsQueryCmd.ShortUsage,
+		dnsLogCmd.ShortUsage,
 	}, "\n"),
 	UsageFunc: usageFuncNoDefaultValues,
 	Subcommands: []*ffcli.Command{
 		dnsStatusCmd,
 		dnsQueryCmd,
-
-		// TODO: implement `tailscale log` here
-
-		// The above work is tracked in https://github.com/tailscale/tailscale/issues/13326
+		dnsLogCmd,
 	},
 }
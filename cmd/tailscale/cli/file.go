@@ -7,11 +7,14 @@
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"mime"
 	"net/http"
@@ -47,11 +50,12 @@ func init() {
 func getFileCmd() *ffcli.Command {
 	return &ffcli.Command{
 		Name:       "file",
-		ShortUsage: "tailscale file <cp|get> ...",
+		ShortUsage: "tailscale file <cp|get|policy> ...",
 		ShortHelp:  "Send or receive files",
 		Subcommands: []*ffcli.Command{
 			fileCpCmd,
 			fileGetCmd,
+			filePolicyCmd,
 		},
 	}
 }
@@ -71,10 +75,17 @@ func (c *countingReader) Read(buf []byte) (int, error) {
 	Name:       "cp",
 	ShortUsage: "tailscale file cp <files...> <target>:",
 	ShortHelp:  "Copy file(s) to a host",
-	Exec:       runCp,
+	LongHelp: strings.TrimSpace(`
+Copies files to a host's Taildrop inbox.
+
+Directories are sent recursively, with their regular files keeping their
+paths relative to the directory's parent. Empty directories, symlinks and
+other special files within them are not sent.
+`),
+	Exec: runCp,
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("cp")
-		fs.StringVar(&cpArgs.name, "name", "", "alternate filename to use, especially useful when <file> is \"-\" (stdin)")
+		fs.StringVar(&cpArgs.name, "name", "", "alternate file or directory name to use, especially useful when <file> is \"-\" (stdin)")
 		fs.BoolVar(&cpArgs.verbose, "verbose", false, "verbose output")
 		fs.BoolVar(&cpArgs.targets, "targets", false, "list possible file cp targets")
 		return fs
@@ -134,6 +145,20 @@ func runCp(ctx context.Context, args []string) error {
 	}
 
 	for _, fileArg := range files {
+		if fileArg != "-" {
+			if fi, err := os.Stat(fileArg); err == nil && fi.IsDir() {
+				name, err := dirSendName(fileArg)
+				if err != nil {
+					return err
+				}
+				name = cmp.Or(cpArgs.name, name)
+				if err := pushDir(ctx, stableID, target, ip, fileArg, name); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
 		var fileContents *countingReader
 		var name = cpArgs.name
 		var contentLength int64 = -1
@@ -158,9 +183,6 @@ func runCp(ctx context.Context, args []string) error {
 			if err != nil {
 				return err
 			}
-			if fi.IsDir() {
-				return errors.New("directories not supported")
-			}
 			contentLength = fi.Size()
 			fileContents = &countingReader{Reader: io.LimitReader(f, contentLength)}
 			if name == "" {
@@ -172,28 +194,87 @@ func runCp(ctx context.Context, args []string) error {
 			}
 		}
 
-		if cpArgs.verbose {
-			log.Printf("sending %q to %v/%v/%v ...", name, target, ip, stableID)
+		if err := pushFile(ctx, stableID, target, ip, name, fileContents, contentLength); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		var group sync.WaitGroup
-		ctxProgress, cancelProgress := context.WithCancel(ctx)
-		defer cancelProgress()
-		if isatty.IsTerminal(os.Stderr.Fd()) {
-			group.Go(func() { progressPrinter(ctxProgress, name, fileContents.n.Load, contentLength) })
-		}
+// pushFile sends fileContents to the node with stableID as name, printing
+// progress to a terminal.
+func pushFile(ctx context.Context, stableID tailcfg.StableNodeID, target, ip string, name string, fileContents *countingReader, contentLength int64) error {
+	if cpArgs.verbose {
+		log.Printf("sending %q to %v/%v/%v ...", name, target, ip, stableID)
+	}
+
+	var group sync.WaitGroup
+	ctxProgress, cancelProgress := context.WithCancel(ctx)
+	defer cancelProgress()
+	if isatty.IsTerminal(os.Stderr.Fd()) {
+		group.Go(func() { progressPrinter(ctxProgress, name, fileContents.n.Load, contentLength) })
+	}
+
+	err := localClient.PushFile(ctx, stableID, contentLength, name, fileContents)
+	cancelProgress()
+	group.Wait() // wait for progress printer to stop before reporting the error
+	if err != nil {
+		return err
+	}
+	if cpArgs.verbose {
+		log.Printf("sent %q", name)
+	}
+	return nil
+}
+
+// dirSendName returns the name to send the directory dir as by default:
+// its base name, after resolving relative paths such as "." and "..".
+func dirSendName(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if filepath.Dir(abs) == abs {
+		return "", fmt.Errorf("can't send root directory %q", dir)
+	}
+	return filepath.Base(abs), nil
+}
 
-		err := localClient.PushFile(ctx, stableID, contentLength, name, fileContents)
-		cancelProgress()
-		group.Wait() // wait for progress printer to stop before reporting the error
+// pushDir sends the regular files in the directory tree at dir to the node
+// with stableID, each named by its slash-separated path relative to dir
+// under the directory name root. As with single files, a file whose
+// earlier transfer was interrupted resumes where it left off.
+func pushDir(ctx context.Context, stableID tailcfg.StableNodeID, target, ip string, dir, root string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		if cpArgs.verbose {
-			log.Printf("sent %q", name)
+		if !d.Type().IsRegular() {
+			if !d.IsDir() && cpArgs.verbose {
+				log.Printf("skipping %q: not a regular file", p)
+			}
+			return nil
 		}
-	}
-	return nil
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		contentLength := fi.Size()
+		fileContents := &countingReader{Reader: io.LimitReader(f, contentLength)}
+		if envknob.Bool("TS_DEBUG_SLOW_PUSH") {
+			fileContents = &countingReader{Reader: &slowReader{r: fileContents}}
+		}
+		return pushFile(ctx, stableID, target, ip, path.Join(root, filepath.ToSlash(rel)), fileContents, contentLength)
+	})
 }
 
 func progressPrinter(ctx context.Context, name string, contentCount func() int64, contentLength int64) {
@@ -526,7 +607,20 @@ func receiveFile(ctx context.Context, wf apitype.WaitingFile, dir string) (targe
 		return "", 0, fmt.Errorf("opening inbox file %q: %w", wf.Name, err)
 	}
 	defer rc.Close()
-	f, err := openFileOrSubstitute(dir, wf.Name, getArgs.conflict)
+	// Files sent as part of a directory have slash-separated names
+	// relative to the inbox. Recreate their parent directories.
+	base := wf.Name
+	if i := strings.LastIndexByte(wf.Name, '/'); i >= 0 {
+		if strings.Contains(wf.Name, "\\") || !filepath.IsLocal(filepath.FromSlash(wf.Name)) {
+			return "", 0, fmt.Errorf("invalid inbox file name %q", wf.Name)
+		}
+		dir = filepath.Join(dir, filepath.FromSlash(wf.Name[:i]))
+		base = wf.Name[i+1:]
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", 0, err
+		}
+	}
+	f, err := openFileOrSubstitute(dir, base, getArgs.conflict)
 	if err != nil {
 		return "", 0, err
 	}
@@ -677,3 +771,83 @@ func waitForFile(ctx context.Context) error {
 		}
 	}
 }
+
+var filePolicyCmd = &ffcli.Command{
+	Name:       "policy",
+	ShortUsage: "tailscale file policy [set <file> | reset]",
+	ShortHelp:  "Show or set the policy for receiving files",
+	LongHelp: strings.TrimSpace(`
+Shows the policy for which files this node accepts and where they're put,
+as JSON. "set" sets it from a JSON file, or from stdin if the file is "-",
+and "reset" accepts all files into the inbox again.
+
+For example:
+
+  {
+    "MaxFileSize": 1073741824,
+    "AllowedSenders": ["tag:ci", "alice@example.com"],
+    "SenderDailyQuota": 10737418240,
+    "SortRules": [
+      {"Extensions": [".log"], "Dir": "logs/{sender}"},
+      {"Sender": "tag:ci", "Dir": "builds"}
+    ]
+  }
+`),
+	Exec: runFilePolicy,
+	Subcommands: []*ffcli.Command{
+		{
+			Name:       "set",
+			ShortUsage: "tailscale file policy set <file>",
+			ShortHelp:  "Set the policy for receiving files from a JSON file",
+			Exec:       runFilePolicySet,
+		},
+		{
+			Name:       "reset",
+			ShortUsage: "tailscale file policy reset",
+			ShortHelp:  "Accept all files into the inbox",
+			Exec: func(ctx context.Context, args []string) error {
+				if len(args) > 0 {
+					return errors.New("unexpected arguments")
+				}
+				return localClient.SetTaildropReceivePolicy(ctx, &apitype.TaildropReceivePolicy{})
+			},
+		},
+	},
+}
+
+func runFilePolicy(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	p, err := localClient.TaildropReceivePolicy(ctx)
+	if err != nil {
+		return err
+	}
+	j, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	outln(string(j))
+	return nil
+}
+
+func runFilePolicySet(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale file policy set <file>")
+	}
+	var b []byte
+	var err error
+	if args[0] == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	p := new(apitype.TaildropReceivePolicy)
+	if err := json.Unmarshal(b, p); err != nil {
+		return fmt.Errorf("parsing policy: %w", err)
+	}
+	return localClient.SetTaildropReceivePolicy(ctx, p)
+}
@@ -0,0 +1,45 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ts_omit_taildrop
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirSendName(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "build-output")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(filepath.Join(dir, "sub"))
+
+	for _, tt := range []struct {
+		arg  string
+		want string
+	}{
+		{".", "sub"},
+		{"./", "sub"},
+		{"..", "build-output"},
+		{"../sub/", "sub"},
+		{dir, "build-output"},
+	} {
+		got, err := dirSendName(tt.arg)
+		if err != nil {
+			t.Errorf("dirSendName(%q): %v", tt.arg, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("dirSendName(%q) = %q; want %q", tt.arg, got, tt.want)
+		}
+	}
+
+	root := filepath.VolumeName(dir) + string(filepath.Separator)
+	if got, err := dirSendName(root); err == nil {
+		t.Errorf("dirSendName(%q) = %q; want error", root, got)
+	}
+}
@@ -29,6 +29,7 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
+	"tailscale.com/util/set"
 	"tailscale.com/util/slicesx"
 	"tailscale.com/version"
 )
@@ -162,16 +163,28 @@ type serveEnv struct {
 	json bool // output JSON (status only for now)
 
 	// v2 specific flags
-	bg               bgBoolFlag          // background mode
-	setPath          string              // serve path
-	https            uint                // HTTP port
-	http             uint                // HTTP port
-	tcp              uint                // TCP port
-	tlsTerminatedTCP uint                // a TLS terminated TCP port
-	subcmd           serveMode           // subcommand
-	yes              bool                // update without prompt
-	service          tailcfg.ServiceName // service name
-	tun              bool                // redirect traffic to OS for service
+	bg               bgBoolFlag               // background mode
+	setPath          string                   // serve path
+	https            uint                     // HTTP port
+	http             uint                     // HTTP port
+	tcp              uint                     // TCP port
+	tlsTerminatedTCP uint                     // a TLS terminated TCP port
+	subcmd           serveMode                // subcommand
+	yes              bool                     // update without prompt
+	service          tailcfg.ServiceName      // service name
+	tun              bool                     // redirect traffic to OS for service
+	statusCode       uint                     // HTTP status code for text and redirect targets
+	keepPrefix       bool                     // don't strip the mount point when proxying
+	setReqHeaders    map[string]string        // headers to set on proxied requests
+	removeReqHeaders []string                 // headers to remove from proxied requests
+	setResHeaders    map[string]string        // headers to set on responses
+	removeResHeaders []string                 // headers to remove from responses
+	allowCaps        []tailcfg.PeerCapability // peer capabilities allowed to use the handler
+	allowTags        []string                 // peer tags allowed to use the handler
+	allowLogins      []string                 // peer login names allowed to use the handler
+	backends         []string                 // further proxy or TCP forward targets to load balance across
+	loadBalance      string                   // load balancing policy for backends
+	healthCheckPath  string                   // HTTP path to health check backends with
 
 	lc localServeClient // localClient interface, specific to serve
 
@@ -639,8 +652,9 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 		}
 		printf("\n")
 	}
+	down := set.SetOf(st.ServeBackendsDown)
 	for hp := range sc.Web {
-		err := e.printWebStatusTree(sc, hp)
+		err := e.printWebStatusTree(sc, hp, down)
 		if err != nil {
 			return err
 		}
@@ -670,12 +684,16 @@ func printTCPStatusTree(ctx context.Context, sc *ipn.ServeConfig, st *ipnstate.S
 			ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(p)))
 			printf("|-- tcp://%s\n", ipp)
 		}
-		printf("|--> tcp://%s\n", h.TCPForward)
+		for _, be := range tcpForwardBackends(h, set.SetOf(st.ServeBackendsDown)) {
+			printf("|--> tcp://%s\n", be)
+		}
 	}
 	return nil
 }
 
-func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) error {
+// printWebStatusTree prints the handlers served on hp. Load balanced
+// backends in down are marked as unhealthy.
+func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort, down set.Set[string]) error {
 	// No-op if no serve config
 	if sc == nil {
 		return nil
@@ -711,7 +729,7 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 		case h.Path != "":
 			return "path", h.Path
 		case h.Proxy != "":
-			return "proxy", h.Proxy
+			return "proxy", proxyDesc(h, down)
 		case h.Text != "":
 			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
 		}
@@ -6,6 +6,7 @@
 package cli
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
@@ -15,6 +16,7 @@
 	"log"
 	"math"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
@@ -32,6 +34,7 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/prompt"
+	"tailscale.com/util/set"
 	"tailscale.com/util/slicesx"
 	"tailscale.com/version"
 )
@@ -93,6 +96,54 @@ func (b *bgBoolFlag) String() string {
 	return strconv.FormatBool(b.Value)
 }
 
+// headerFlag is a repeatable flag of HTTP headers in the form "Name: value".
+type headerFlag struct {
+	Value *map[string]string
+}
+
+func (h headerFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, ":")
+	k = strings.TrimSpace(k)
+	if !ok || k == "" {
+		return fmt.Errorf("invalid header %q; want \"Name: value\"", s)
+	}
+	mak.Set(h.Value, http.CanonicalHeaderKey(k), strings.TrimSpace(v))
+	return nil
+}
+
+func (h headerFlag) String() string {
+	if h.Value == nil {
+		return ""
+	}
+	var hs []string
+	for k, v := range *h.Value {
+		hs = append(hs, k+": "+v)
+	}
+	slices.Sort(hs)
+	return strings.Join(hs, ", ")
+}
+
+// headerNamesFlag is a repeatable flag of HTTP header names.
+type headerNamesFlag struct {
+	Value *[]string
+}
+
+func (h headerNamesFlag) Set(s string) error {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.ContainsAny(s, ": ") {
+		return fmt.Errorf("invalid header name %q", s)
+	}
+	*h.Value = append(*h.Value, http.CanonicalHeaderKey(s))
+	return nil
+}
+
+func (h headerNamesFlag) String() string {
+	if h.Value == nil {
+		return ""
+	}
+	return strings.Join(*h.Value, ", ")
+}
+
 var serveHelpCommon = strings.TrimSpace(`
 <target> can be a file, directory, text, or most commonly the location to a service running on the
 local machine. The location to the location service can be expressed as a port number (e.g., 3000),
@@ -108,6 +159,15 @@ func (b *bgBoolFlag) String() string {
   - Expose an HTTPS server with invalid or self-signed certificates at https://localhost:8443
     $ tailscale %[1]s https+insecure://localhost:8443
 
+  - Permanently redirect requests under /old to another site, keeping their path:
+    $ tailscale %[1]s --set-path=/old --status-code=301 'redirect:https://example.com${REQUEST_URI}'
+
+  - Respond to requests under /admin with a fixed status code:
+    $ tailscale %[1]s --set-path=/admin status:403
+
+  - Balance requests across HTTP servers at 127.0.0.1:3000 to 3002 that respond to /healthz:
+    $ tailscale %[1]s --backend=3001 --backend=3002 --health-check-path=/healthz 3000
+
 For more examples and use cases visit our docs site https://tailscale.com/kb/1247/funnel-serve-use-cases
 `)
 
@@ -186,6 +246,30 @@ func newServeV2Command(e *serveEnv, subcmd serveMode) *ffcli.Command {
 			fs.Var(&serviceNameFlag{Value: &e.service}, "service", "Serve for a service with distinct virtual IP instead on node itself.")
 			fs.BoolVar(&e.yes, "yes", false, "Update without interactive prompts (default false)")
 			fs.BoolVar(&e.tun, "tun", false, "Forward all traffic to the local machine (default false), only supported for services. Refer to docs for more information.")
+			fs.UintVar(&e.statusCode, "status-code", 0, "HTTP status code to respond with for text: and redirect: targets (default 200 and 302)")
+			fs.BoolVar(&e.keepPrefix, "keep-prefix", false, "Forward proxied requests with their full path, without stripping the --set-path mount point (default false)")
+			fs.Var(headerFlag{&e.setReqHeaders}, "set-request-header", `Set a header on proxied requests, as "Name: value"; can be repeated`)
+			fs.Var(headerNamesFlag{&e.removeReqHeaders}, "remove-request-header", "Remove a header from proxied requests; can be repeated")
+			fs.Var(headerFlag{&e.setResHeaders}, "set-response-header", `Set a header on responses, as "Name: value"; can be repeated`)
+			fs.Var(headerNamesFlag{&e.removeResHeaders}, "remove-response-header", "Remove a header from responses; can be repeated")
+			fs.Func("allow-cap", "Only allow peers with this peer capability to use the handler; can be repeated", func(s string) error {
+				e.allowCaps = append(e.allowCaps, tailcfg.PeerCapability(s))
+				return nil
+			})
+			fs.Func("allow-tag", "Only allow peers with this tag to use the handler; can be repeated", func(s string) error {
+				e.allowTags = append(e.allowTags, s)
+				return nil
+			})
+			fs.Func("backend", "Also load balance across this target; can be repeated", func(s string) error {
+				e.backends = append(e.backends, s)
+				return nil
+			})
+			fs.StringVar(&e.loadBalance, "lb-policy", "", `Load balancing policy for --backend targets, "round-robin" or "least-conn" (default "round-robin")`)
+			fs.StringVar(&e.healthCheckPath, "health-check-path", "", "HTTP path to health check --backend targets with (default checks that they accept TCP connections)")
+			fs.Func("allow-login", "Only allow peers owned by this login name to use the handler; can be repeated", func(s string) error {
+				e.allowLogins = append(e.allowLogins, s)
+				return nil
+			})
 		}),
 		UsageFunc: usageFuncNoDefaultValues,
 		Subcommands: []*ffcli.Command{
@@ -694,9 +778,13 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 		case h.Path != "":
 			return "path", h.Path
 		case h.Proxy != "":
-			return "proxy", h.Proxy
+			return "proxy", proxyDesc(h, nil)
 		case h.Text != "":
 			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
+		case h.Redirect != "":
+			return "redirect", h.Redirect
+		case h.Status != 0:
+			return "status", strconv.Itoa(h.Status)
 		}
 		return "", ""
 	}
@@ -758,7 +846,10 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 			ipp := net.JoinHostPort(a.String(), strconv.Itoa(int(srvPort)))
 			output.WriteString(fmt.Sprintf("|-- tcp://%s\n", ipp))
 		}
-		output.WriteString(fmt.Sprintf("|--> tcp://%s\n\n", tcpHandler.TCPForward))
+		for _, be := range tcpForwardBackends(tcpHandler, nil) {
+			output.WriteString(fmt.Sprintf("|--> tcp://%s\n", be))
+		}
+		output.WriteString("\n")
 	}
 
 	if !forService && !e.bg.Value {
@@ -782,8 +873,58 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 	return output.String()
 }
 
+// proxyDesc describes the proxy targets of h for status output. If down is
+// non-nil, load balanced backends are marked as healthy unless in down.
+func proxyDesc(h *ipn.HTTPHandler, down set.Set[string]) string {
+	if len(h.Backends) == 0 {
+		return h.Proxy
+	}
+	bes := append([]string{h.Proxy}, h.Backends...)
+	for i, be := range bes {
+		bes[i] += backendHealth(be, down)
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(bes, ", "), cmp.Or(h.LoadBalance, ipn.LoadBalanceRoundRobin))
+}
+
+// tcpForwardBackends returns the addresses th forwards connections to, the
+// policy used to pick among them appended to the last one. If down is
+// non-nil, load balanced backends are marked as healthy unless in down.
+func tcpForwardBackends(th *ipn.TCPPortHandler, down set.Set[string]) []string {
+	bes := append([]string{th.TCPForward}, th.TCPForwardBackends...)
+	if len(bes) > 1 {
+		for i, be := range bes {
+			bes[i] += backendHealth(be, down)
+		}
+		bes[len(bes)-1] += fmt.Sprintf(" (%s)", cmp.Or(th.LoadBalance, ipn.LoadBalanceRoundRobin))
+	}
+	return bes
+}
+
+// backendHealth returns the health of the load balanced backend be for
+// status output, or "" if down is nil.
+func backendHealth(be string, down set.Set[string]) string {
+	switch {
+	case down == nil:
+		return ""
+	case down.Contains(be):
+		return " [down]"
+	default:
+		return " [up]"
+	}
+}
+
 func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort uint16, useTLS bool, mount, target string, mds string) error {
-	h := new(ipn.HTTPHandler)
+	h := &ipn.HTTPHandler{
+		Status:                int(e.statusCode),
+		KeepPrefix:            e.keepPrefix,
+		SetRequestHeaders:     e.setReqHeaders,
+		RemoveRequestHeaders:  e.removeReqHeaders,
+		SetResponseHeaders:    e.setResHeaders,
+		RemoveResponseHeaders: e.removeResHeaders,
+		AllowCaps:             e.allowCaps,
+		AllowTags:             e.allowTags,
+		AllowLogins:           e.allowLogins,
+	}
 	switch {
 	case strings.HasPrefix(target, "text:"):
 		text := strings.TrimPrefix(target, "text:")
@@ -791,6 +932,21 @@ func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort ui
 			return errors.New("unable to serve; text cannot be an empty string")
 		}
 		h.Text = text
+	case strings.HasPrefix(target, "redirect:"):
+		dst := strings.TrimPrefix(target, "redirect:")
+		if dst == "" {
+			return errors.New("unable to serve; redirect target cannot be an empty string")
+		}
+		h.Redirect = dst
+	case strings.HasPrefix(target, "status:"):
+		if e.statusCode != 0 {
+			return errors.New("cannot use --status-code with a status: target")
+		}
+		code, err := strconv.Atoi(strings.TrimPrefix(target, "status:"))
+		if err != nil {
+			return fmt.Errorf("invalid status code in %q", target)
+		}
+		h.Status = code
 	case filepath.IsAbs(target):
 		if version.IsMacAppStore() || version.IsMacSys() {
 			// The Tailscale network extension cannot serve arbitrary paths on macOS due to sandbox restrictions (2024-03-26)
@@ -816,6 +972,21 @@ func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort ui
 			return err
 		}
 		h.Proxy = t
+		for _, be := range e.backends {
+			t, err := ipn.ExpandProxyTargetValue(be, []string{"http", "https", "https+insecure"}, "http")
+			if err != nil {
+				return err
+			}
+			h.Backends = append(h.Backends, t)
+		}
+		h.LoadBalance = e.loadBalance
+		h.HealthCheckPath = e.healthCheckPath
+	}
+	if len(e.backends) > 0 && h.Proxy == "" {
+		return errors.New("--backend can only be used with a proxy target")
+	}
+	if err := h.CheckValid(); err != nil {
+		return err
 	}
 
 	// TODO: validation needs to check nested foreground configs
@@ -856,9 +1027,32 @@ func (e *serveEnv) applyTCPServe(sc *ipn.ServeConfig, dnsName string, srcType se
 		return fmt.Errorf("cannot serve TCP; already serving web on %d for %s", srcPort, dnsName)
 	}
 
+	if e.healthCheckPath != "" {
+		return errors.New("--health-check-path is only supported for web targets")
+	}
+
 	sc.SetTCPForwarding(srcPort, dstURL.Host, terminateTLS, dnsName)
 
-	return nil
+	if len(e.backends) == 0 && e.loadBalance == "" {
+		return nil
+	}
+	th := sc.TCP[srcPort]
+	if svcName != noService {
+		th = sc.Services[svcName].TCP[srcPort]
+	}
+	for _, be := range e.backends {
+		t, err := ipn.ExpandProxyTargetValue(be, []string{"tcp"}, "tcp")
+		if err != nil {
+			return fmt.Errorf("unable to expand backend: %v", err)
+		}
+		u, err := url.Parse(t)
+		if err != nil {
+			return fmt.Errorf("invalid TCP backend %q: %v", be, err)
+		}
+		th.TCPForwardBackends = append(th.TCPForwardBackends, u.Host)
+	}
+	th.LoadBalance = e.loadBalance
+	return th.CheckValid()
 }
 
 func (e *serveEnv) applyFunnel(sc *ipn.ServeConfig, dnsName string, srvPort uint16, allowFunnel bool) {
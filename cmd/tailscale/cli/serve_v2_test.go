@@ -22,6 +22,7 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
+	"tailscale.com/util/set"
 )
 
 func TestServeDevConfigMutations(t *testing.T) {
@@ -461,6 +462,27 @@ type group struct {
 				},
 			},
 		},
+		{
+			name: "tcp_backends",
+			steps: []step{
+				{
+					command: cmd("serve --tcp=5432 --bg --backend=5433 --backend=tcp://localhost:5434 --lb-policy=least-conn 5432"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							5432: {
+								TCPForward:         "127.0.0.1:5432",
+								TCPForwardBackends: []string{"127.0.0.1:5433", "localhost:5434"},
+								LoadBalance:        ipn.LoadBalanceLeastConn,
+							},
+						},
+					},
+				},
+				{
+					command: cmd("serve --tcp=5433 --bg --backend=5434 --health-check-path=/healthz 5432"),
+					wantErr: anyErr(),
+				},
+			},
+		},
 		{
 			name: "tcp_off",
 			steps: []step{
@@ -784,6 +806,138 @@ type group struct {
 				},
 			},
 		},
+		{
+			name: "handler_options",
+			steps: []step{
+				{
+					command: cmd("serve --bg --set-path=/old --status-code=301 redirect:https://example.com${REQUEST_URI}"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/old": {Redirect: "https://example.com${REQUEST_URI}", Status: 301},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/admin status:403"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/old":   {Redirect: "https://example.com${REQUEST_URI}", Status: 301},
+								"/admin": {Status: 403},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/app --keep-prefix --set-request-header=x-app:yes --remove-request-header=tailscale-user-login --set-response-header=X-Frame-Options:DENY --remove-response-header=Server 3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/old":   {Redirect: "https://example.com${REQUEST_URI}", Status: 301},
+								"/admin": {Status: 403},
+								"/app": {
+									Proxy:                 "http://127.0.0.1:3000",
+									KeepPrefix:            true,
+									SetRequestHeaders:     map[string]string{"X-App": "yes"},
+									RemoveRequestHeaders:  []string{"Tailscale-User-Login"},
+									SetResponseHeaders:    map[string]string{"X-Frame-Options": "DENY"},
+									RemoveResponseHeaders: []string{"Server"},
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/ops --allow-tag=tag:ops --allow-login=alice@example.com --allow-cap=example.com/cap/ops 3001"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/old":   {Redirect: "https://example.com${REQUEST_URI}", Status: 301},
+								"/admin": {Status: 403},
+								"/app": {
+									Proxy:                 "http://127.0.0.1:3000",
+									KeepPrefix:            true,
+									SetRequestHeaders:     map[string]string{"X-App": "yes"},
+									RemoveRequestHeaders:  []string{"Tailscale-User-Login"},
+									SetResponseHeaders:    map[string]string{"X-Frame-Options": "DENY"},
+									RemoveResponseHeaders: []string{"Server"},
+								},
+								"/ops": {
+									Proxy:       "http://127.0.0.1:3001",
+									AllowCaps:   []tailcfg.PeerCapability{"example.com/cap/ops"},
+									AllowTags:   []string{"tag:ops"},
+									AllowLogins: []string{"alice@example.com"},
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --http=8080 --backend=3001 --backend=localhost:3002 --lb-policy=least-conn --health-check-path=/healthz 3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}, 8080: {HTTP: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/old":   {Redirect: "https://example.com${REQUEST_URI}", Status: 301},
+								"/admin": {Status: 403},
+								"/app": {
+									Proxy:                 "http://127.0.0.1:3000",
+									KeepPrefix:            true,
+									SetRequestHeaders:     map[string]string{"X-App": "yes"},
+									RemoveRequestHeaders:  []string{"Tailscale-User-Login"},
+									SetResponseHeaders:    map[string]string{"X-Frame-Options": "DENY"},
+									RemoveResponseHeaders: []string{"Server"},
+								},
+								"/ops": {
+									Proxy:       "http://127.0.0.1:3001",
+									AllowCaps:   []tailcfg.PeerCapability{"example.com/cap/ops"},
+									AllowTags:   []string{"tag:ops"},
+									AllowLogins: []string{"alice@example.com"},
+								},
+							}},
+							"foo.test.ts.net:8080": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {
+									Proxy:           "http://127.0.0.1:3000",
+									Backends:        []string{"http://127.0.0.1:3001", "http://localhost:3002"},
+									LoadBalance:     ipn.LoadBalanceLeastConn,
+									HealthCheckPath: "/healthz",
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --http=8081 --lb-policy=random --backend=3001 3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --backend=3001 text:hi"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --allow-tag=ops 3001"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --status-code=200 redirect:https://example.com"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --keep-prefix text:hi"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --set-request-header=nocolon 3000"),
+					wantErr: anyErr(),
+				},
+			},
+		},
 		{
 			name: "no_http_with_funnel",
 			steps: []step{
@@ -1557,6 +1711,30 @@ func TestMessageForPort(t *testing.T) {
 	}
 }
 
+func TestBackendHealthDesc(t *testing.T) {
+	down := set.Of("http://127.0.0.1:3001", "127.0.0.1:4001")
+	h := &ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000", Backends: []string{"http://127.0.0.1:3001"}}
+	if got, want := proxyDesc(h, down), "http://127.0.0.1:3000 [up], http://127.0.0.1:3001 [down] (round-robin)"; got != want {
+		t.Errorf("proxyDesc = %q; want %q", got, want)
+	}
+	if got, want := proxyDesc(h, nil), "http://127.0.0.1:3000, http://127.0.0.1:3001 (round-robin)"; got != want {
+		t.Errorf("proxyDesc without health = %q; want %q", got, want)
+	}
+	if got, want := proxyDesc(&ipn.HTTPHandler{Proxy: "http://127.0.0.1:3001"}, down), "http://127.0.0.1:3001"; got != want {
+		t.Errorf("proxyDesc without backends = %q; want %q", got, want)
+	}
+
+	th := &ipn.TCPPortHandler{
+		TCPForward:         "127.0.0.1:4000",
+		TCPForwardBackends: []string{"127.0.0.1:4001"},
+		LoadBalance:        ipn.LoadBalanceLeastConn,
+	}
+	want := []string{"127.0.0.1:4000 [up]", "127.0.0.1:4001 [down] (" + ipn.LoadBalanceLeastConn + ")"}
+	if got := tcpForwardBackends(th, down); !slices.Equal(got, want) {
+		t.Errorf("tcpForwardBackends = %q; want %q", got, want)
+	}
+}
+
 func TestIsLegacyInvocation(t *testing.T) {
 	tests := []struct {
 		subcmd      serveMode
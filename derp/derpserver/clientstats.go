@@ -0,0 +1,379 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derpserver
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/types/key"
+	"tailscale.com/util/topk"
+)
+
+const (
+	// defaultClientStatsInterval is the default ClientStatsConfig.Interval.
+	defaultClientStatsInterval = time.Minute
+
+	// defaultClientStatsTopK is the default ClientStatsConfig.TopK.
+	defaultClientStatsTopK = 100
+
+	// clientStatsRetention is how long cumulative totals are kept for a
+	// client key that has had no traffic.
+	clientStatsRetention = 90 * 24 * time.Hour
+)
+
+// ClientStatsConfig configures the per-client traffic accounting enabled by
+// [Server.StartClientStats].
+type ClientStatsConfig struct {
+	// StateFile, if non-empty, is the file that cumulative per-client
+	// totals are loaded from when accounting starts, and saved to after
+	// every Interval and when the Server closes, so that they survive
+	// restarts.
+	StateFile string
+
+	// Log, if non-nil, receives a JSON object per line for each client
+	// key that had traffic during each Interval. See ClientTrafficRecord.
+	Log io.Writer
+
+	// Interval is how often traffic is collected from connected clients.
+	// If zero, it defaults to one minute.
+	Interval time.Duration
+
+	// TopK is how many of the clients with the most cumulative traffic
+	// are exported individually in [Server.ExpVar], to bound the metrics'
+	// cardinality. If zero, it defaults to 100.
+	TopK int
+}
+
+// ClientTraffic is the traffic relayed by a DERP server for one client key.
+type ClientTraffic struct {
+	Key         key.NodePublic `json:"key"`
+	BytesRecv   int64          `json:"bytesRecv"`   // data bytes received from the client
+	BytesSent   int64          `json:"bytesSent"`   // data bytes sent to the client
+	PacketsRecv int64          `json:"packetsRecv"` // data packets received from the client
+	PacketsSent int64          `json:"packetsSent"` // data packets sent to the client
+	LastSeen    time.Time      `json:"lastSeen"`    // end of the last interval with traffic
+}
+
+func (t *ClientTraffic) add(o ClientTraffic) {
+	t.BytesRecv += o.BytesRecv
+	t.BytesSent += o.BytesSent
+	t.PacketsRecv += o.PacketsRecv
+	t.PacketsSent += o.PacketsSent
+}
+
+func (t ClientTraffic) bytes() int64 { return t.BytesRecv + t.BytesSent }
+
+// ClientTrafficRecord is a line written to ClientStatsConfig.Log.
+type ClientTrafficRecord struct {
+	Start time.Time `json:"start"` // start of the interval
+	End   time.Time `json:"end"`   // end of the interval
+	ClientTraffic
+}
+
+// clientStatsState is the JSON form of ClientStatsConfig.StateFile.
+type clientStatsState struct {
+	Clients []ClientTraffic `json:"clients"`
+}
+
+// clientStats accounts the traffic of each client key across connections
+// and, if configured, across restarts.
+type clientStats struct {
+	cfg  ClientStatsConfig
+	stop chan struct{} // closed to stop the collection loop
+	done chan struct{} // closed when the collection loop returns
+
+	mu         sync.Mutex
+	pending    map[key.NodePublic]ClientTraffic // collected since the last flush
+	totals     map[key.NodePublic]*ClientTraffic
+	top        *topk.TopK[key.NodePublic] // by cumulative bytes
+	lastFlush  time.Time
+	saveErrLog bool // whether a failure to save the state file was logged
+}
+
+// StartClientStats starts accounting the traffic of each client key,
+// as configured by cfg. It may only be called once, and should be called
+// before serving begins.
+func (s *Server) StartClientStats(cfg ClientStatsConfig) error {
+	cfg.Interval = cmp.Or(cfg.Interval, defaultClientStatsInterval)
+	cfg.TopK = cmp.Or(cfg.TopK, defaultClientStatsTopK)
+	cs := &clientStats{
+		cfg:     cfg,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: map[key.NodePublic]ClientTraffic{},
+		totals:  map[key.NodePublic]*ClientTraffic{},
+		top: topk.New(cfg.TopK, func(b []byte, k key.NodePublic) []byte {
+			return k.AppendTo(b)
+		}),
+		lastFlush: s.clock.Now(),
+	}
+	if cfg.StateFile != "" {
+		if err := cs.load(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clientStats != nil {
+		return errors.New("client stats already started")
+	}
+	s.clientStats = cs
+	go s.clientStatsLoop(cs)
+	return nil
+}
+
+// load reads cs.cfg.StateFile, if it exists.
+func (cs *clientStats) load() error {
+	b, err := os.ReadFile(cs.cfg.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st clientStatsState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("parsing client stats state %s: %w", cs.cfg.StateFile, err)
+	}
+	for _, t := range st.Clients {
+		cs.totals[t.Key] = &t
+		cs.top.AddN(t.Key, uint64(t.bytes()))
+	}
+	return nil
+}
+
+func (s *Server) clientStatsLoop(cs *clientStats) {
+	defer close(cs.done)
+	ticker, tickc := s.clock.NewTicker(cs.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cs.stop:
+			s.flushClientStats()
+			return
+		case <-tickc:
+			s.flushClientStats()
+		}
+	}
+}
+
+// stopClientStats stops client stats collection, if started, after a
+// final flush.
+func (s *Server) stopClientStats() {
+	s.mu.Lock()
+	cs := s.clientStats
+	s.mu.Unlock()
+	if cs == nil {
+		return
+	}
+	close(cs.stop)
+	<-cs.done
+}
+
+// takeTraffic returns the traffic counted on c since it was last called,
+// resetting c's counters.
+func (c *sclient) takeTraffic() ClientTraffic {
+	return ClientTraffic{
+		Key:         c.key,
+		BytesRecv:   c.bytesRecv.Swap(0),
+		BytesSent:   c.bytesSent.Swap(0),
+		PacketsRecv: c.packetsRecv.Swap(0),
+		PacketsSent: c.packetsSent.Swap(0),
+	}
+}
+
+// noteClientTrafficLocked moves the traffic counted on c to the pending
+// client stats, if enabled.
+//
+// s.mu must be held.
+func (s *Server) noteClientTrafficLocked(c *sclient) {
+	cs := s.clientStats
+	if cs == nil {
+		return
+	}
+	t := c.takeTraffic()
+	if t.PacketsRecv == 0 && t.PacketsSent == 0 {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	p := cs.pending[c.key]
+	p.Key = c.key
+	p.add(t)
+	cs.pending[c.key] = p
+}
+
+// flushClientStats collects the traffic of all connected clients, adds it to
+// the cumulative totals, and logs and saves them as configured.
+func (s *Server) flushClientStats() {
+	s.mu.Lock()
+	cs := s.clientStats
+	if cs == nil {
+		s.mu.Unlock()
+		return
+	}
+	for _, set := range s.clients {
+		set.ForeachClient(s.noteClientTrafficLocked)
+	}
+	s.mu.Unlock()
+
+	now := s.clock.Now()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	start := cs.lastFlush
+	cs.lastFlush = now
+
+	var bw *bufio.Writer
+	if cs.cfg.Log != nil {
+		bw = bufio.NewWriter(cs.cfg.Log)
+	}
+	for k, t := range cs.pending {
+		t.LastSeen = now
+		total, ok := cs.totals[k]
+		if !ok {
+			total = &ClientTraffic{Key: k}
+			cs.totals[k] = total
+		}
+		total.add(t)
+		total.LastSeen = now
+		cs.top.AddN(k, uint64(t.bytes()))
+		if bw != nil {
+			j, err := json.Marshal(ClientTrafficRecord{Start: start, End: now, ClientTraffic: t})
+			if err == nil {
+				bw.Write(j)
+				bw.WriteByte('\n')
+			}
+		}
+	}
+	clear(cs.pending)
+	if bw != nil {
+		if err := bw.Flush(); err != nil {
+			s.limitedLogf("derp: writing client stats log: %v", err)
+		}
+	}
+
+	for k, t := range cs.totals {
+		if now.Sub(t.LastSeen) > clientStatsRetention {
+			delete(cs.totals, k)
+		}
+	}
+	if cs.cfg.StateFile != "" {
+		if err := cs.saveLocked(); err != nil && !cs.saveErrLog {
+			s.logf("derp: saving client stats: %v", err)
+			cs.saveErrLog = true
+		}
+	}
+}
+
+// saveLocked writes the cumulative totals to cs.cfg.StateFile.
+//
+// cs.mu must be held.
+func (cs *clientStats) saveLocked() error {
+	st := clientStatsState{Clients: make([]ClientTraffic, 0, len(cs.totals))}
+	for _, t := range cs.totals {
+		st.Clients = append(st.Clients, *t)
+	}
+	slices.SortFunc(st.Clients, func(a, b ClientTraffic) int {
+		return a.Key.Compare(b.Key)
+	})
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(cs.cfg.StateFile, b, 0600)
+}
+
+// ClientTraffic returns the cumulative traffic of each client key seen since
+// [Server.StartClientStats] was first used with the current state file, as of
+// the last collection interval. It returns nil if client stats aren't
+// enabled.
+func (s *Server) ClientTraffic() []ClientTraffic {
+	s.mu.Lock()
+	cs := s.clientStats
+	s.mu.Unlock()
+	if cs == nil {
+		return nil
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	ret := make([]ClientTraffic, 0, len(cs.totals))
+	for _, t := range cs.totals {
+		ret = append(ret, *t)
+	}
+	slices.SortFunc(ret, func(a, b ClientTraffic) int {
+		return cmp.Or(cmp.Compare(b.bytes(), a.bytes()), a.Key.Compare(b.Key))
+	})
+	return ret
+}
+
+// topClientTraffic returns the cumulative traffic of the clients with the
+// most traffic, per the top-K tracker, heaviest first.
+func (s *Server) topClientTraffic() []ClientTraffic {
+	s.mu.Lock()
+	cs := s.clientStats
+	s.mu.Unlock()
+	if cs == nil {
+		return nil
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var ret []ClientTraffic
+	for _, k := range cs.top.Top() {
+		if t, ok := cs.totals[k]; ok {
+			ret = append(ret, *t)
+		}
+	}
+	slices.SortFunc(ret, func(a, b ClientTraffic) int {
+		return cmp.Or(cmp.Compare(b.bytes(), a.bytes()), a.Key.Compare(b.Key))
+	})
+	return ret
+}
+
+// topClientTrafficVar is an expvar.Var of the top clients' cumulative
+// traffic, that also writes itself in Prometheus format with a "key" label.
+type topClientTrafficVar struct {
+	s *Server
+}
+
+// String returns the top clients' traffic as a JSON object keyed by client
+// key.
+func (v topClientTrafficVar) String() string {
+	m := map[string]ClientTraffic{}
+	for _, t := range v.s.topClientTraffic() {
+		m[t.Key.String()] = t
+	}
+	j, _ := json.Marshal(m)
+	return string(j)
+}
+
+// WritePrometheus implements tsweb/varz.PrometheusWriter.
+func (v topClientTrafficVar) WritePrometheus(w io.Writer, name string) {
+	top := v.s.topClientTraffic()
+	for _, m := range []struct {
+		suffix string
+		get    func(ClientTraffic) int64
+	}{
+		{"bytes_received", func(t ClientTraffic) int64 { return t.BytesRecv }},
+		{"bytes_sent", func(t ClientTraffic) int64 { return t.BytesSent }},
+		{"packets_received", func(t ClientTraffic) int64 { return t.PacketsRecv }},
+		{"packets_sent", func(t ClientTraffic) int64 { return t.PacketsSent }},
+	} {
+		fmt.Fprintf(w, "# TYPE %s_%s counter\n", name, m.suffix)
+		for _, t := range top {
+			fmt.Fprintf(w, "%s_%s{key=%q} %d\n", name, m.suffix, t.Key.String(), m.get(t))
+		}
+	}
+}
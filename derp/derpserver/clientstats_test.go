@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+func TestClientStats(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "client-stats.json")
+	var log bytes.Buffer
+
+	s := New(key.NewNode(), t.Logf)
+	if err := s.StartClientStats(ClientStatsConfig{
+		StateFile: stateFile,
+		Log:       &log,
+		Interval:  time.Hour,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &sclient{s: s, key: pubAll(1), logf: t.Logf}
+	s.registerClient(c)
+	c.packetsRecv.Add(1)
+	c.bytesRecv.Add(100)
+	c.packetsSent.Add(2)
+	c.bytesSent.Add(50)
+	s.flushClientStats()
+
+	got := s.ClientTraffic()
+	if len(got) != 1 || got[0].Key != c.key || got[0].BytesRecv != 100 || got[0].BytesSent != 50 {
+		t.Fatalf("ClientTraffic after first flush = %+v", got)
+	}
+
+	// Traffic counted before a client disconnects is kept.
+	c.packetsRecv.Add(1)
+	c.bytesRecv.Add(10)
+	s.unregisterClient(c)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines; want 2:\n%s", len(lines), log.Bytes())
+	}
+	var rec ClientTrafficRecord
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Key != c.key || rec.BytesRecv != 10 || rec.PacketsRecv != 1 || rec.BytesSent != 0 {
+		t.Errorf("second log record = %+v", rec)
+	}
+
+	// A new server picks up the totals from the state file.
+	s2 := New(key.NewNode(), t.Logf)
+	defer s2.Close()
+	if err := s2.StartClientStats(ClientStatsConfig{StateFile: stateFile, TopK: 1}); err != nil {
+		t.Fatal(err)
+	}
+	got = s2.ClientTraffic()
+	want := ClientTraffic{Key: c.key, BytesRecv: 110, BytesSent: 50, PacketsRecv: 2, PacketsSent: 2}
+	if len(got) != 1 {
+		t.Fatalf("ClientTraffic after restart = %+v", got)
+	}
+	got[0].LastSeen = time.Time{}
+	if got[0] != want {
+		t.Errorf("ClientTraffic after restart = %+v; want %+v", got[0], want)
+	}
+
+	var prom bytes.Buffer
+	topClientTrafficVar{s2}.WritePrometheus(&prom, "derp_counter_top_clients")
+	wantLine := `derp_counter_top_clients_bytes_received{key="` + c.key.String() + `"} 110`
+	if !strings.Contains(prom.String(), wantLine) {
+		t.Errorf("Prometheus output missing %q:\n%s", wantLine, prom.Bytes())
+	}
+}
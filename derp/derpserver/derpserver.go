@@ -197,6 +197,17 @@ type Server struct {
 	// maps from netip.AddrPort to a client's public key
 	keyOfAddr map[netip.AddrPort]key.NodePublic
 
+	// clientStats is non-nil if per-client traffic accounting was
+	// started with StartClientStats.
+	clientStats *clientStats
+
+	// rateLimits are the limits set by SetRateLimits, if any, and
+	// keyRateLimits and ipRateLimits the buckets of the client keys and
+	// source IPs with connected clients subject to them.
+	rateLimits    *RateLimitConfig
+	keyRateLimits map[keyRateLimitKey]*sharedRateLimit
+	ipRateLimits  map[netip.Addr]*sharedRateLimit
+
 	// Sets the client send queue depth for the server.
 	perClientSendQueueDepth int
 
@@ -438,6 +449,8 @@ func genDroppedCounters() {
 		dropReasonQueueTail,
 		dropReasonWriteError,
 		dropReasonDupClient,
+		dropReasonRateLimitKey,
+		dropReasonRateLimitIP,
 	}
 
 	for _, dr := range dropReasons {
@@ -540,6 +553,7 @@ func (s *Server) Close() error {
 		<-closed
 	}
 
+	s.stopClientStats()
 	return nil
 }
 
@@ -712,6 +726,7 @@ func (s *Server) registerClient(c *sclient) {
 	if c.isNotIdealConn {
 		s.curClientsNotIdeal.Add(1)
 	}
+	s.setClientRateLimitsLocked(c)
 	s.broadcastPeerStateChangeLocked(c.key, c.remoteIPPort, c.presentFlags(), true)
 }
 
@@ -737,6 +752,9 @@ func (s *Server) unregisterClient(c *sclient) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.noteClientTrafficLocked(c)
+	s.releaseClientRateLimitsLocked(c)
+
 	set, ok := s.clients[c.key]
 	if !ok {
 		c.logf("[unexpected]; clients map is empty")
@@ -922,7 +940,8 @@ func (s *Server) accept(ctx context.Context, nc derp.Conn, brw *bufio.ReadWriter
 	}
 
 	remoteIPPort, _ := netip.ParseAddrPort(remoteAddr)
-	if err := s.verifyClient(ctx, clientKey, clientInfo, remoteIPPort.Addr()); err != nil {
+	verified, err := s.verifyClient(ctx, clientKey, clientInfo, remoteIPPort.Addr())
+	if err != nil {
 		return fmt.Errorf("client %v rejected: %v", clientKey, err)
 	}
 
@@ -948,6 +967,7 @@ func (s *Server) accept(ctx context.Context, nc derp.Conn, brw *bufio.ReadWriter
 		sendPongCh:     make(chan [8]byte, 1),
 		peerGone:       make(chan peerGoneMsg),
 		canMesh:        s.isMeshPeer(clientInfo),
+		verified:       verified,
 		isNotIdealConn: IdealNodeContextKey.Value(ctx) != "",
 		peerGoneLim:    rate.NewLimiter(rate.Every(time.Second), 3),
 	}
@@ -1143,6 +1163,11 @@ func (c *sclient) handleFrameForwardPacket(ft derp.FrameType, fl uint32) error {
 	}
 	s.packetsForwardedIn.Add(1)
 
+	if reason, ok := c.allowPacket(len(contents)); !ok {
+		s.recordDrop(contents, srcKey, dstKey, reason)
+		return nil
+	}
+
 	var dstLen int
 	var dst *sclient
 
@@ -1181,6 +1206,14 @@ func (c *sclient) handleFrameSendPacket(ft derp.FrameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %v: recvPacket: %v", c.key, err)
 	}
+	c.packetsRecv.Add(1)
+	c.bytesRecv.Add(int64(len(contents)))
+
+	if reason, ok := c.allowPacket(len(contents)); !ok {
+		s.recordDrop(contents, c.key, dstKey, reason)
+		c.debugLogf("SendPacket for %s, dropping with reason=%s", dstKey.ShortString(), reason)
+		return nil
+	}
 
 	var fwd PacketForwarder
 	var dstLen int
@@ -1249,6 +1282,8 @@ type dropReasonKindLabels struct {
 	dropReasonQueueTail        dropReason = "queue_tail"          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError       dropReason = "write_error"         // OS write() failed
 	dropReasonDupClient        dropReason = "dup_client"          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonRateLimitKey     dropReason = "rate_limit_key"      // sender exceeded its per-key rate limit
+	dropReasonRateLimitIP      dropReason = "rate_limit_ip"       // sender's source IP exceeded its rate limit
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
@@ -1368,27 +1403,30 @@ func (s *Server) isMeshPeer(info *derp.ClientInfo) bool {
 
 // verifyClient checks whether the client is allowed to connect to the derper,
 // depending on how & whether the server's been configured to verify.
-func (s *Server) verifyClient(ctx context.Context, clientKey key.NodePublic, info *derp.ClientInfo, clientIP netip.Addr) error {
+// It reports whether the client was positively verified, rather than allowed
+// because verification is off or failed open, or because it's a mesh peer.
+func (s *Server) verifyClient(ctx context.Context, clientKey key.NodePublic, info *derp.ClientInfo, clientIP netip.Addr) (verified bool, _ error) {
 	if s.isMeshPeer(info) {
 		// Trusted mesh peer. No need to verify further. In fact, verifying
 		// further wouldn't work: it's not part of the tailnet so tailscaled and
 		// likely the admission control URL wouldn't know about it.
-		return nil
+		return false, nil
 	}
 
 	// tailscaled-based verification:
 	if s.verifyClientsLocalTailscaled {
 		_, err := s.localClient.WhoIsNodeKey(ctx, clientKey)
 		if err == local.ErrPeerNotFound {
-			return fmt.Errorf("peer %v not authorized (not found in local tailscaled)", clientKey)
+			return false, fmt.Errorf("peer %v not authorized (not found in local tailscaled)", clientKey)
 		}
 		if err != nil {
 			if strings.Contains(err.Error(), "invalid 'addr' parameter") {
 				// Issue 12617
-				return errors.New("tailscaled version is too old (out of sync with derper binary)")
+				return false, errors.New("tailscaled version is too old (out of sync with derper binary)")
 			}
-			return fmt.Errorf("failed to query local tailscaled status for %v: %w", clientKey, err)
+			return false, fmt.Errorf("failed to query local tailscaled status for %v: %w", clientKey, err)
 		}
+		verified = true
 	}
 
 	// admission controller-based verification:
@@ -1401,34 +1439,34 @@ func (s *Server) verifyClient(ctx context.Context, clientKey key.NodePublic, inf
 			Source:     clientIP,
 		})
 		if err != nil {
-			return err
+			return false, err
 		}
 		req, err := http.NewRequestWithContext(ctx, "POST", s.verifyClientsURL, bytes.NewReader(jreq))
 		if err != nil {
-			return err
+			return false, err
 		}
 		res, err := http.DefaultClient.Do(req)
 		if err != nil {
 			if s.verifyClientsURLFailOpen {
 				s.logf("admission controller unreachable; allowing client %v", clientKey)
-				return nil
+				return verified, nil
 			}
-			return err
+			return false, err
 		}
 		defer res.Body.Close()
 		if res.StatusCode != 200 {
-			return fmt.Errorf("admission controller: %v", res.Status)
+			return false, fmt.Errorf("admission controller: %v", res.Status)
 		}
 		var jres tailcfg.DERPAdmitClientResponse
 		if err := json.NewDecoder(io.LimitReader(res.Body, 4<<10)).Decode(&jres); err != nil {
-			return err
+			return false, err
 		}
 		if !jres.Allow {
-			return fmt.Errorf("admission controller: %v/%v not allowed", clientKey, clientIP)
+			return false, fmt.Errorf("admission controller: %v/%v not allowed", clientKey, clientIP)
 		}
-		// TODO(bradfitz): add policy for configurable bandwidth rate per client?
+		verified = true
 	}
-	return nil
+	return verified, nil
 }
 
 func (s *Server) sendServerKey(lw *lazyBufioWriter) error {
@@ -1629,11 +1667,22 @@ type sclient struct {
 	peerGone       chan peerGoneMsg // write request that a peer is not at this server (not used by mesh peers)
 	meshUpdate     chan struct{}    // write request to write peerStateChange
 	canMesh        bool             // clientInfo had correct mesh token for inter-region routing
+	verified       bool             // admitted by the local tailscaled or admission controller
 	isNotIdealConn bool             // client indicated it is not its ideal node in the region
 	isDup          atomic.Bool      // whether more than 1 sclient for key is connected
 	isDisabled     atomic.Bool      // whether sends to this peer are disabled due to active/active dups
 	debug          bool             // turn on for verbose logging
 
+	// Traffic counters since last collected for client stats; see
+	// Server.StartClientStats.
+	packetsRecv, bytesRecv atomic.Int64
+	packetsSent, bytesSent atomic.Int64
+
+	// rateLimits are the buckets packets from the client are taken from,
+	// or nil if it isn't rate limited. Written with s.mu held; see
+	// Server.SetRateLimits.
+	rateLimits atomic.Pointer[clientRateLimits]
+
 	// Owned by run, not thread-safe.
 	br          *bufio.Reader
 	connectedAt time.Time
@@ -1989,6 +2038,8 @@ func (c *sclient) sendPacket(srcKey key.NodePublic, contents []byte) (err error)
 		} else {
 			c.s.packetsSent.Add(1)
 			c.s.bytesSent.Add(int64(len(contents)))
+			c.packetsSent.Add(1)
+			c.bytesSent.Add(int64(len(contents)))
 		}
 		c.debugLogf("sendPacket from %s: %v", srcKey.ShortString(), err)
 	}()
@@ -2217,6 +2268,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("counter_mesh_update_batch_size", s.meshUpdateBatchSize)
 	m.Set("counter_mesh_update_loop_count", s.meshUpdateLoopCount)
 	m.Set("counter_buffered_write_frames", s.bufferedWriteFrames)
+	m.Set("counter_top_clients", topClientTrafficVar{s})
 	var expvarVersion expvar.String
 	expvarVersion.Set(version.Long())
 	m.Set("version", &expvarVersion)
@@ -2281,7 +2333,7 @@ func (s *Server) checkVerifyClientsLocalTailscaled() error {
 		IsProber: true,
 	}
 	clientIP := netip.IPv6Loopback()
-	if err := s.verifyClient(ctx, status.Self.PublicKey, info, clientIP); err != nil {
+	if _, err := s.verifyClient(ctx, status.Self.PublicKey, info, clientIP); err != nil {
 		return fmt.Errorf("verifyClient for self nodekey: %w", err)
 	}
 	return nil
@@ -0,0 +1,322 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	xrate "golang.org/x/time/rate"
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// RateLimit is a token bucket limit on the data packets a client sends
+// through the server. A zero rate means unlimited.
+type RateLimit struct {
+	// BytesPerSec is the sustained rate of packet payload bytes allowed.
+	BytesPerSec int64 `json:",omitempty"`
+
+	// BytesBurst is the size of the byte bucket. It defaults to one second
+	// of BytesPerSec, and is never less than the largest DERP packet.
+	BytesBurst int `json:",omitempty"`
+
+	// PacketsPerSec is the sustained rate of packets allowed.
+	PacketsPerSec int64 `json:",omitempty"`
+
+	// PacketsBurst is the size of the packet bucket. It defaults to one
+	// second of PacketsPerSec.
+	PacketsBurst int `json:",omitempty"`
+}
+
+func (l RateLimit) check() error {
+	if l.BytesPerSec < 0 || l.BytesBurst < 0 || l.PacketsPerSec < 0 || l.PacketsBurst < 0 {
+		return errors.New("negative rate or burst")
+	}
+	return nil
+}
+
+// RateLimitConfig configures the rate limits set with [Server.SetRateLimits].
+//
+// Each client connection gets the first of Keys, Mesh, Verified or PerKey
+// that applies to it. Clients given one of the overrides are exempt from
+// PerIP.
+type RateLimitConfig struct {
+	// PerKey is the limit for each client key that no override applies to.
+	// Duplicate connections of a key share its buckets.
+	PerKey RateLimit `json:",omitzero"`
+
+	// PerIP is the limit shared by all client connections from one source
+	// IP address that no override applies to.
+	PerIP RateLimit `json:",omitzero"`
+
+	// Verified, if non-nil, is the limit for clients that were admitted
+	// by the local tailscaled or the admission controller, rather than
+	// because verification is off or failed open.
+	Verified *RateLimit `json:",omitempty"`
+
+	// Mesh, if non-nil, is the limit for mesh peers, which are otherwise
+	// not rate limited.
+	Mesh *RateLimit `json:",omitempty"`
+
+	// Keys are limits for specific client keys.
+	Keys map[key.NodePublic]RateLimit `json:",omitempty"`
+}
+
+// ParseRateLimitConfig parses a JSON RateLimitConfig and checks that it's
+// valid.
+func ParseRateLimitConfig(b []byte) (*RateLimitConfig, error) {
+	cfg := new(RateLimitConfig)
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.PerKey.check(); err != nil {
+		return nil, fmt.Errorf("PerKey: %w", err)
+	}
+	if err := cfg.PerIP.check(); err != nil {
+		return nil, fmt.Errorf("PerIP: %w", err)
+	}
+	if cfg.Verified != nil {
+		if err := cfg.Verified.check(); err != nil {
+			return nil, fmt.Errorf("Verified: %w", err)
+		}
+	}
+	if cfg.Mesh != nil {
+		if err := cfg.Mesh.check(); err != nil {
+			return nil, fmt.Errorf("Mesh: %w", err)
+		}
+	}
+	for k, l := range cfg.Keys {
+		if err := l.check(); err != nil {
+			return nil, fmt.Errorf("Keys[%v]: %w", k, err)
+		}
+	}
+	return cfg, nil
+}
+
+// tokenBuckets enforces a RateLimit.
+type tokenBuckets struct {
+	bytes   *xrate.Limiter // nil if unlimited
+	packets *xrate.Limiter // nil if unlimited
+}
+
+// newTokenBuckets returns the buckets enforcing l, or nil if l is
+// unlimited.
+func newTokenBuckets(l RateLimit) *tokenBuckets {
+	if l.BytesPerSec == 0 && l.PacketsPerSec == 0 {
+		return nil
+	}
+	b := new(tokenBuckets)
+	if l.BytesPerSec > 0 {
+		burst := l.BytesBurst
+		if burst == 0 {
+			burst = int(min(l.BytesPerSec, 1<<30))
+		}
+		b.bytes = xrate.NewLimiter(xrate.Limit(l.BytesPerSec), max(burst, derp.MaxPacketSize))
+	}
+	if l.PacketsPerSec > 0 {
+		burst := l.PacketsBurst
+		if burst == 0 {
+			burst = int(min(l.PacketsPerSec, 1<<30))
+		}
+		b.packets = xrate.NewLimiter(xrate.Limit(l.PacketsPerSec), burst)
+	}
+	return b
+}
+
+// allow reports whether a packet of n bytes sent at now is within the
+// limits, taking tokens for it from both buckets if so, and from neither if
+// not. The returned undo func returns the tokens taken. A nil b allows
+// everything.
+func (b *tokenBuckets) allow(now time.Time, n int) (undo func(), ok bool) {
+	undo = func() {}
+	if b == nil {
+		return undo, true
+	}
+	var packet *xrate.Reservation
+	if b.packets != nil {
+		if packet, ok = reserveNow(b.packets, now, 1); !ok {
+			return nil, false
+		}
+	}
+	if b.bytes != nil {
+		bytes, ok := reserveNow(b.bytes, now, n)
+		if !ok {
+			if packet != nil {
+				packet.CancelAt(now)
+			}
+			return nil, false
+		}
+		undo = func() { bytes.CancelAt(now) }
+	}
+	if packet != nil {
+		undoBytes := undo
+		undo = func() {
+			undoBytes()
+			packet.CancelAt(now)
+		}
+	}
+	return undo, true
+}
+
+// reserveNow takes n tokens from lim at now, if they're available without
+// waiting, and returns the reservation to cancel to return them.
+func reserveNow(lim *xrate.Limiter, now time.Time, n int) (_ *xrate.Reservation, ok bool) {
+	r := lim.ReserveN(now, n)
+	if !r.OK() {
+		return nil, false
+	}
+	if r.DelayFrom(now) > 0 {
+		r.CancelAt(now)
+		return nil, false
+	}
+	return r, true
+}
+
+// clientRateLimits are the buckets a client's packets are taken from.
+type clientRateLimits struct {
+	key    *tokenBuckets // shared by connections of the same key and limit; nil if unlimited
+	ip     *tokenBuckets // shared by connections from the same IP; nil if unlimited
+	keyRef keyRateLimitKey
+}
+
+// keyRateLimitKey identifies the buckets of a client key. The limit is part
+// of it because a key's connections can get different limits, such as when
+// one is verified and another isn't.
+type keyRateLimitKey struct {
+	key   key.NodePublic
+	limit RateLimit
+}
+
+// sharedRateLimit is the buckets of one client key or source IP.
+type sharedRateLimit struct {
+	buckets *tokenBuckets
+	refs    int // client connections using it
+}
+
+// acquireRateLimit returns the buckets enforcing l for k in *m, creating
+// them if needed, and adds a reference to them. It returns nil if l is
+// unlimited.
+func acquireRateLimit[K comparable](m *map[K]*sharedRateLimit, k K, l RateLimit) *tokenBuckets {
+	sl, ok := (*m)[k]
+	if !ok {
+		b := newTokenBuckets(l)
+		if b == nil {
+			return nil
+		}
+		sl = &sharedRateLimit{buckets: b}
+		if *m == nil {
+			*m = map[K]*sharedRateLimit{}
+		}
+		(*m)[k] = sl
+	}
+	sl.refs++
+	return sl.buckets
+}
+
+// releaseRateLimit drops a reference to the buckets b of k in m, acquired
+// with acquireRateLimit, deleting them once unused.
+func releaseRateLimit[K comparable](m map[K]*sharedRateLimit, k K, b *tokenBuckets) {
+	sl, ok := m[k]
+	if !ok || sl.buckets != b {
+		// Limits were replaced by SetRateLimits since b was acquired.
+		return
+	}
+	sl.refs--
+	if sl.refs <= 0 {
+		delete(m, k)
+	}
+}
+
+// SetRateLimits sets the rate limits applied to the data packets clients send
+// through the server, replacing any previous limits, including those of
+// connected clients. A nil cfg removes all limits. It may be called at any
+// time.
+func (s *Server) SetRateLimits(cfg *RateLimitConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimits = cfg
+	clear(s.keyRateLimits)
+	clear(s.ipRateLimits)
+	for _, cs := range s.clients {
+		cs.ForeachClient(s.setClientRateLimitsLocked)
+	}
+}
+
+// setClientRateLimitsLocked sets c's rate limits per s.rateLimits.
+//
+// s.mu must be held.
+func (s *Server) setClientRateLimitsLocked(c *sclient) {
+	cfg := s.rateLimits
+	if cfg == nil {
+		c.rateLimits.Store(nil)
+		return
+	}
+	var perKey RateLimit
+	override := true
+	if l, ok := cfg.Keys[c.key]; ok {
+		perKey = l
+	} else if c.canMesh {
+		if cfg.Mesh == nil {
+			c.rateLimits.Store(nil)
+			return
+		}
+		perKey = *cfg.Mesh
+	} else if c.verified && cfg.Verified != nil {
+		perKey = *cfg.Verified
+	} else {
+		perKey = cfg.PerKey
+		override = false
+	}
+
+	lims := &clientRateLimits{keyRef: keyRateLimitKey{c.key, perKey}}
+	lims.key = acquireRateLimit(&s.keyRateLimits, lims.keyRef, perKey)
+	if !override && c.remoteIPPort.IsValid() {
+		lims.ip = acquireRateLimit(&s.ipRateLimits, c.remoteIPPort.Addr(), cfg.PerIP)
+	}
+	if lims.key == nil && lims.ip == nil {
+		lims = nil
+	}
+	c.rateLimits.Store(lims)
+}
+
+// releaseClientRateLimitsLocked releases c's share of its key's and source
+// IP's rate limits, when c disconnects.
+//
+// s.mu must be held.
+func (s *Server) releaseClientRateLimitsLocked(c *sclient) {
+	lims := c.rateLimits.Swap(nil)
+	if lims == nil {
+		return
+	}
+	if lims.key != nil {
+		releaseRateLimit(s.keyRateLimits, lims.keyRef, lims.key)
+	}
+	if lims.ip != nil {
+		releaseRateLimit(s.ipRateLimits, c.remoteIPPort.Addr(), lims.ip)
+	}
+}
+
+// allowPacket reports whether c may send a packet of n bytes now, per its
+// rate limits. If not, it returns the reason to drop the packet with.
+func (c *sclient) allowPacket(n int) (dropReason, bool) {
+	lims := c.rateLimits.Load()
+	if lims == nil {
+		return "", true
+	}
+	now := c.s.clock.Now()
+	undoKey, ok := lims.key.allow(now, n)
+	if !ok {
+		return dropReasonRateLimitKey, false
+	}
+	if _, ok := lims.ip.allow(now, n); !ok {
+		// The packet is dropped, so it doesn't count against the
+		// per-key limit either.
+		undoKey()
+		return dropReasonRateLimitIP, false
+	}
+	return "", true
+}
@@ -0,0 +1,245 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derpserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/tstest"
+	"tailscale.com/types/key"
+)
+
+func TestParseRateLimitConfig(t *testing.T) {
+	k := pubAll(3)
+	cfg, err := ParseRateLimitConfig([]byte(`{
+		"PerKey": {"PacketsPerSec": 10},
+		"PerIP": {"BytesPerSec": 100000},
+		"Mesh": {},
+		"Keys": {"` + k.String() + `": {"PacketsPerSec": 1000}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PerKey.PacketsPerSec != 10 || cfg.PerIP.BytesPerSec != 100000 || cfg.Mesh == nil || cfg.Verified != nil || cfg.Keys[k].PacketsPerSec != 1000 {
+		t.Errorf("parsed config = %+v", cfg)
+	}
+
+	if _, err := ParseRateLimitConfig([]byte(`{"PerIP": {"PacketsPerSec": -1}}`)); err == nil {
+		t.Error("negative rate accepted")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1_000_000, 0)})
+	s := New(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.clock = clock
+
+	ip := netip.MustParseAddr("100.64.0.1")
+	newClient := func(k key.NodePublic, port uint16) *sclient {
+		c := &sclient{s: s, key: k, logf: t.Logf, remoteIPPort: netip.AddrPortFrom(ip, port)}
+		s.registerClient(c)
+		return c
+	}
+	a := newClient(pubAll(1), 1)
+	b := newClient(pubAll(2), 2)
+	special := newClient(pubAll(3), 3)
+	mesh := newClient(pubAll(4), 4)
+	mesh.canMesh = true
+
+	if _, ok := a.allowPacket(100); !ok {
+		t.Fatal("packet dropped before limits were set")
+	}
+
+	s.SetRateLimits(&RateLimitConfig{
+		PerKey: RateLimit{PacketsPerSec: 2},
+		PerIP:  RateLimit{PacketsPerSec: 3},
+		Keys:   map[key.NodePublic]RateLimit{special.key: {BytesPerSec: derp.MaxPacketSize}},
+	})
+
+	send := func(c *sclient, n int) (dropped []dropReason) {
+		t.Helper()
+		for range n {
+			if reason, ok := c.allowPacket(100); !ok {
+				dropped = append(dropped, reason)
+			}
+		}
+		return dropped
+	}
+	if got := send(a, 3); len(got) != 1 || got[0] != dropReasonRateLimitKey {
+		t.Errorf("a dropped %v; want one per-key drop", got)
+	}
+	// a used 2 of the IP's 3 packets, so b gets one more.
+	if got := send(b, 2); len(got) != 1 || got[0] != dropReasonRateLimitIP {
+		t.Errorf("b dropped %v; want one per-IP drop", got)
+	}
+	// Clients with overrides aren't subject to the per-IP limit.
+	if got := send(special, 10); len(got) != 0 {
+		t.Errorf("special dropped %v; want none", got)
+	}
+	if _, ok := special.allowPacket(derp.MaxPacketSize); ok {
+		t.Error("special's per-key byte limit not applied")
+	}
+	if got := send(mesh, 10); len(got) != 0 {
+		t.Errorf("mesh peer dropped %v; want none", got)
+	}
+
+	clock.Advance(time.Second)
+	if got := send(a, 2); len(got) != 0 {
+		t.Errorf("after refill, a dropped %v", got)
+	}
+
+	s.mu.Lock()
+	refs := s.ipRateLimits[ip].refs
+	s.mu.Unlock()
+	if refs != 2 {
+		t.Errorf("per-IP refs = %d; want 2", refs)
+	}
+	s.unregisterClient(a)
+	s.unregisterClient(b)
+	s.mu.Lock()
+	n := len(s.ipRateLimits)
+	s.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d per-IP limits left after clients disconnected", n)
+	}
+
+	s.SetRateLimits(nil)
+	if got := send(special, 10); len(got) != 0 {
+		t.Errorf("after removing limits, dropped %v", got)
+	}
+}
+
+func TestRateLimitsDroppedPacketsTakeNoTokens(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1_000_000, 0)})
+	s := New(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.clock = clock
+
+	ip := netip.MustParseAddr("100.64.0.1")
+	newClient := func(k key.NodePublic, port uint16) *sclient {
+		c := &sclient{s: s, key: k, logf: t.Logf, remoteIPPort: netip.AddrPortFrom(ip, port)}
+		s.registerClient(c)
+		return c
+	}
+	a := newClient(pubAll(1), 1)
+	b := newClient(pubAll(2), 2)
+
+	// A packet dropped for the byte limit takes no packet token.
+	s.SetRateLimits(&RateLimitConfig{
+		PerKey: RateLimit{PacketsPerSec: 2, BytesPerSec: derp.MaxPacketSize},
+	})
+	if _, ok := a.allowPacket(derp.MaxPacketSize); !ok {
+		t.Fatal("first packet dropped")
+	}
+	if reason, ok := a.allowPacket(100); ok || reason != dropReasonRateLimitKey {
+		t.Fatalf("packet over byte limit: %q, %v; want per-key drop", reason, ok)
+	}
+	clock.Advance(10 * time.Millisecond) // refills bytes, but not a packet
+	if reason, ok := a.allowPacket(100); !ok {
+		t.Errorf("packet after byte bucket refilled dropped: %q", reason)
+	}
+
+	// A packet dropped for the per-IP limit takes no per-key tokens.
+	s.SetRateLimits(&RateLimitConfig{
+		PerKey: RateLimit{PacketsPerSec: 1},
+		PerIP:  RateLimit{PacketsPerSec: 10, PacketsBurst: 1},
+	})
+	if _, ok := a.allowPacket(100); !ok {
+		t.Fatal("a's packet dropped")
+	}
+	if reason, ok := b.allowPacket(100); ok || reason != dropReasonRateLimitIP {
+		t.Fatalf("b's packet: %q, %v; want per-IP drop", reason, ok)
+	}
+	clock.Advance(100 * time.Millisecond) // refills the IP's bucket, but not b's
+	if reason, ok := b.allowPacket(100); !ok {
+		t.Errorf("b's packet after per-IP bucket refilled dropped: %q", reason)
+	}
+}
+
+func TestRateLimitsSharedByKey(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1_000_000, 0)})
+	s := New(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.clock = clock
+	s.SetRateLimits(&RateLimitConfig{PerKey: RateLimit{PacketsPerSec: 2}})
+
+	k := pubAll(1)
+	newClient := func(ip string) *sclient {
+		c := &sclient{s: s, key: k, logf: t.Logf, remoteIPPort: netip.AddrPortFrom(netip.MustParseAddr(ip), 1)}
+		s.registerClient(c)
+		return c
+	}
+	a := newClient("100.64.0.1")
+	b := newClient("100.64.0.2")
+
+	if _, ok := a.allowPacket(100); !ok {
+		t.Fatal("a's first packet dropped")
+	}
+	if _, ok := b.allowPacket(100); !ok {
+		t.Fatal("b's first packet dropped")
+	}
+	// Both connections used the key's 2 packets.
+	if reason, ok := a.allowPacket(100); ok || reason != dropReasonRateLimitKey {
+		t.Errorf("a's second packet: %q, %v; want per-key drop", reason, ok)
+	}
+
+	// Reconnecting doesn't get the key a new budget.
+	s.unregisterClient(b)
+	b = newClient("100.64.0.2")
+	if reason, ok := b.allowPacket(100); ok || reason != dropReasonRateLimitKey {
+		t.Errorf("reconnected b's packet: %q, %v; want per-key drop", reason, ok)
+	}
+
+	s.unregisterClient(a)
+	s.unregisterClient(b)
+	s.mu.Lock()
+	n := len(s.keyRateLimits)
+	s.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d per-key limits left after clients disconnected", n)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestVerifyClientLocalTailscaledAndURLFailOpen(t *testing.T) {
+	s := New(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	// The local tailscaled knows every peer.
+	s.SetVerifyClient(true)
+	s.localClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("{}")),
+			Request:    r,
+		}, nil
+	})
+
+	// The admission controller is unreachable, and fails open.
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	s.SetVerifyClientURL(ts.URL)
+	s.SetVerifyClientURLFailOpen(true)
+
+	verified, err := s.verifyClient(context.Background(), pubAll(1), &derp.ClientInfo{}, netip.MustParseAddr("100.64.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified {
+		t.Error("client verified by tailscaled not reported as verified when admission controller failed open")
+	}
+}
@@ -0,0 +1,8 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ts_omit_healthalert
+
+package condregister
+
+import _ "tailscale.com/feature/healthalert"
@@ -0,0 +1,368 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package healthalert registers an extension that sends alerts to external
+// systems when health warnings become visible or are resolved.
+//
+// It's configured with environment variables; with none of the destinations
+// set, it does nothing:
+//
+//   - TS_HEALTH_ALERT_WEBHOOK is a URL to POST each [Alert] to as JSON.
+//   - TS_HEALTH_ALERT_SYSLOG, if true, logs each alert to the local syslog.
+//   - TS_HEALTH_ALERT_COMMAND is the path of a command to run for each
+//     alert, with the alert as JSON on its standard input and its main
+//     fields in TS_HEALTH_* environment variables.
+//   - TS_HEALTH_ALERT_MIN_SEVERITY is the lowest [health.Severity] to alert
+//     on: "low", "medium" (the default) or "high".
+//   - TS_HEALTH_ALERT_DEBOUNCE is how long to wait for a warning's state to
+//     settle before alerting, as a Go duration. It defaults to 10s.
+//
+// Warnings are only alerted on once they're visible to the user, per
+// [health.Warnable.TimeToVisible], and resolved warnings only if they were
+// alerted on.
+package healthalert
+
+import (
+	"context"
+	"maps"
+	"os"
+	"sync"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/feature"
+	"tailscale.com/health"
+	"tailscale.com/ipn/ipnext"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/tstime"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/eventbus"
+)
+
+// featureName is the name of the feature implemented by this package.
+// It is also the extension name and the log prefix.
+const featureName = "healthalert"
+
+func init() {
+	feature.Register(featureName)
+	ipnext.RegisterExtension(featureName, newExtension)
+}
+
+var (
+	envWebhook     = envknob.RegisterString("TS_HEALTH_ALERT_WEBHOOK")
+	envSyslog      = envknob.RegisterBool("TS_HEALTH_ALERT_SYSLOG")
+	envCommand     = envknob.RegisterString("TS_HEALTH_ALERT_COMMAND")
+	envMinSeverity = envknob.RegisterString("TS_HEALTH_ALERT_MIN_SEVERITY")
+	envDebounce    = envknob.RegisterDuration("TS_HEALTH_ALERT_DEBOUNCE")
+)
+
+const (
+	defaultDebounce    = 10 * time.Second
+	defaultMinSeverity = health.SeverityMedium
+
+	// sendTimeout bounds how long sending an alert to a destination may
+	// take.
+	sendTimeout = 30 * time.Second
+
+	// maxQueuedAlerts is how many alerts may be waiting to be sent before
+	// more are dropped.
+	maxQueuedAlerts = 64
+)
+
+// Alert is a change in the state of a health warning.
+type Alert struct {
+	// Time is when the alert was generated.
+	Time time.Time `json:"time"`
+
+	// Hostname is the hostname of the machine that generated the alert.
+	Hostname string `json:"hostname,omitempty"`
+
+	// Code identifies the warning.
+	Code health.WarnableCode `json:"code"`
+
+	// Healthy is whether the warning was resolved. If false, the warning
+	// became visible or changed.
+	Healthy bool `json:"healthy"`
+
+	Severity            health.Severity `json:"severity"`
+	Title               string          `json:"title"`
+	Text                string          `json:"text,omitempty"`
+	Args                health.Args     `json:"args,omitempty"`
+	ImpactsConnectivity bool            `json:"impactsConnectivity,omitempty"`
+
+	// BrokenSince is when the warning's problem started.
+	BrokenSince time.Time `json:"brokenSince,omitzero"`
+
+	// UnhealthySeconds is how long the problem lasted, or has lasted so
+	// far if the warning isn't resolved.
+	UnhealthySeconds float64 `json:"unhealthySeconds"`
+}
+
+// sender sends alerts to a destination.
+type sender interface {
+	send(ctx context.Context, a Alert) error
+	String() string
+}
+
+func newExtension(logf logger.Logf, sb ipnext.SafeBackend) (ipnext.Extension, error) {
+	return &extension{
+		logf:   logger.WithPrefix(logf, featureName+": "),
+		bus:    sb.Sys().Bus.Get(),
+		dialer: sb.Sys().Dialer.Get(),
+		clock:  sb.Clock(),
+	}, nil
+}
+
+// extension is an [ipnext.Extension] that sends health alerts.
+type extension struct {
+	logf   logger.Logf
+	bus    *eventbus.Bus
+	dialer *tsdial.Dialer
+	clock  tstime.Clock
+
+	events eventbus.Monitor // zero until Init
+	n      *notifier        // nil until Init
+}
+
+// Name implements [ipnext.Extension].
+func (e *extension) Name() string { return featureName }
+
+// Init implements [ipnext.Extension].
+func (e *extension) Init(ipnext.Host) error {
+	var senders []sender
+	if u := envWebhook(); u != "" {
+		// Dial as a user would, so the webhook may be on the tailnet.
+		senders = append(senders, newWebhookSender(u, e.dialer.UserDial))
+	}
+	if envSyslog() {
+		s, err := newSyslogSender()
+		if err != nil {
+			e.logf("TS_HEALTH_ALERT_SYSLOG: %v", err)
+		} else {
+			senders = append(senders, s)
+		}
+	}
+	if c := envCommand(); c != "" {
+		senders = append(senders, commandSender(c))
+	}
+	if len(senders) == 0 {
+		return ipnext.SkipExtension
+	}
+
+	minSeverity := defaultMinSeverity
+	switch s := health.Severity(envMinSeverity()); s {
+	case "":
+	case health.SeverityLow, health.SeverityMedium, health.SeverityHigh:
+		minSeverity = s
+	default:
+		e.logf("invalid TS_HEALTH_ALERT_MIN_SEVERITY %q; using %q", s, minSeverity)
+	}
+	debounce := defaultDebounce
+	if d := envDebounce(); d > 0 {
+		debounce = d
+	}
+	hostname, _ := os.Hostname()
+
+	e.n = newNotifier(e.logf, e.clock, senders, minSeverity, debounce, hostname)
+	ec := e.bus.Client(featureName)
+	sub := eventbus.Subscribe[health.Change](ec)
+	e.events = ec.Monitor(func(ec *eventbus.Client) {
+		for {
+			select {
+			case <-ec.Done():
+				return
+			case c := <-sub.Events():
+				e.n.onChange(c)
+			}
+		}
+	})
+	return nil
+}
+
+// Shutdown implements [ipnext.Extension].
+func (e *extension) Shutdown() error {
+	e.events.Close()
+	if e.n != nil {
+		e.n.close()
+	}
+	return nil
+}
+
+// notifier turns health changes into alerts and sends them.
+type notifier struct {
+	logf        logger.Logf
+	clock       tstime.Clock
+	senders     []sender
+	minSeverity health.Severity
+	debounce    time.Duration
+	hostname    string
+
+	ctx    context.Context // canceled by close
+	cancel context.CancelFunc
+	queue  chan Alert
+	done   chan struct{} // closed when the sending goroutine returns
+
+	mu      sync.Mutex
+	closed  bool
+	pending map[health.WarnableCode]*pendingChange
+	alerted map[health.WarnableCode]*health.UnhealthyState // last alerted on
+}
+
+// pendingChange is the latest change to a warning within the debounce
+// period since its first.
+type pendingChange struct {
+	us    *health.UnhealthyState // nil if healthy
+	timer tstime.TimerController
+}
+
+func newNotifier(logf logger.Logf, clock tstime.Clock, senders []sender, minSeverity health.Severity, debounce time.Duration, hostname string) *notifier {
+	n := &notifier{
+		logf:        logf,
+		clock:       clock,
+		senders:     senders,
+		minSeverity: minSeverity,
+		debounce:    debounce,
+		hostname:    hostname,
+		queue:       make(chan Alert, maxQueuedAlerts),
+		done:        make(chan struct{}),
+		pending:     make(map[health.WarnableCode]*pendingChange),
+		alerted:     make(map[health.WarnableCode]*health.UnhealthyState),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	go n.sendLoop()
+	return n
+}
+
+// onChange handles a change published by the health.Tracker. The Tracker
+// only publishes a warning becoming unhealthy once it's visible, so that
+// isn't repeated here.
+func (n *notifier) onChange(c health.Change) {
+	if !c.WarnableChanged || c.Warnable == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	code := c.Warnable.Code
+	if p, ok := n.pending[code]; ok {
+		p.us = c.UnhealthyState
+		return
+	}
+	p := &pendingChange{us: c.UnhealthyState}
+	n.pending[code] = p
+	// Settle on another goroutine, as some clocks call AfterFunc funcs
+	// with their own locks held, and settle uses the clock.
+	p.timer = n.clock.AfterFunc(n.debounce, func() { go n.settle(code) })
+}
+
+// settle alerts on the state that the warning with the given code settled
+// in after the debounce period, if it differs from the state last alerted.
+func (n *notifier) settle(code health.WarnableCode) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	p, ok := n.pending[code]
+	if !ok || n.closed {
+		return
+	}
+	delete(n.pending, code)
+
+	now := n.clock.Now()
+	prev := n.alerted[code]
+	a := Alert{
+		Time:     now,
+		Hostname: n.hostname,
+		Code:     code,
+	}
+	switch {
+	case p.us == nil && prev == nil:
+		// It recovered without having been alerted on.
+		return
+	case p.us == nil:
+		delete(n.alerted, code)
+		a.Healthy = true
+		a.Severity = prev.Severity
+		a.Title = prev.Title
+		a.ImpactsConnectivity = prev.ImpactsConnectivity
+		if prev.BrokenSince != nil {
+			a.BrokenSince = *prev.BrokenSince
+		}
+	case severityRank(p.us.Severity) < severityRank(n.minSeverity):
+		return
+	case prev != nil && sameProblem(prev, p.us):
+		return
+	default:
+		n.alerted[code] = p.us
+		a.Severity = p.us.Severity
+		a.Title = p.us.Title
+		a.Text = p.us.Text
+		a.Args = p.us.Args
+		a.ImpactsConnectivity = p.us.ImpactsConnectivity
+		if p.us.BrokenSince != nil {
+			a.BrokenSince = *p.us.BrokenSince
+		}
+	}
+	if !a.BrokenSince.IsZero() {
+		a.UnhealthySeconds = now.Sub(a.BrokenSince).Seconds()
+	}
+	select {
+	case n.queue <- a:
+	default:
+		n.logf("dropping alert for %q: too many queued", code)
+	}
+}
+
+// sameProblem reports whether a and b describe the same problem, such that
+// alerting on b after a would be redundant.
+func sameProblem(a, b *health.UnhealthyState) bool {
+	return a.Severity == b.Severity &&
+		a.Title == b.Title &&
+		a.Text == b.Text &&
+		maps.Equal(a.Args, b.Args)
+}
+
+func severityRank(s health.Severity) int {
+	switch s {
+	case health.SeverityLow:
+		return 1
+	case health.SeverityMedium:
+		return 2
+	case health.SeverityHigh:
+		return 3
+	}
+	return 0
+}
+
+// sendLoop sends queued alerts to each sender in turn, in order.
+func (n *notifier) sendLoop() {
+	defer close(n.done)
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case a := <-n.queue:
+			for _, s := range n.senders {
+				ctx, cancel := context.WithTimeout(n.ctx, sendTimeout)
+				if err := s.send(ctx, a); err != nil {
+					n.logf("sending alert for %q to %v: %v", a.Code, s, err)
+				}
+				cancel()
+			}
+		}
+	}
+}
+
+// close stops n from alerting, abandoning any pending or queued alerts.
+func (n *notifier) close() {
+	n.mu.Lock()
+	n.closed = true
+	for _, p := range n.pending {
+		p.timer.Stop()
+	}
+	clear(n.pending)
+	n.mu.Unlock()
+
+	n.cancel()
+	<-n.done
+}
@@ -0,0 +1,152 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package healthalert
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/tstest"
+)
+
+// chanSender sends alerts to a channel.
+type chanSender chan Alert
+
+func (c chanSender) String() string { return "chan" }
+
+func (c chanSender) send(_ context.Context, a Alert) error {
+	c <- a
+	return nil
+}
+
+func TestNotifier(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := tstest.NewClock(tstest.ClockOpts{Start: start})
+	alerts := make(chanSender, 10)
+	n := newNotifier(t.Logf, clock, []sender{alerts}, health.SeverityMedium, 10*time.Second, "host")
+	defer n.close()
+
+	w := &health.Warnable{Code: "test-warning", Severity: health.SeverityMedium}
+	unhealthy := func(text string) health.Change {
+		return health.Change{
+			WarnableChanged: true,
+			Warnable:        w,
+			UnhealthyState: &health.UnhealthyState{
+				WarnableCode: w.Code,
+				Severity:     w.Severity,
+				Title:        "Test",
+				Text:         text,
+				BrokenSince:  &start,
+			},
+		}
+	}
+	healthy := health.Change{WarnableChanged: true, Warnable: w}
+
+	wantAlert := func(healthy bool, text string, unhealthyFor time.Duration) {
+		t.Helper()
+		select {
+		case a := <-alerts:
+			if a.Code != w.Code || a.Healthy != healthy || a.Text != text || a.Hostname != "host" {
+				t.Errorf("got alert %+v; want healthy=%v text=%q", a, healthy, text)
+			}
+			if got := time.Duration(a.UnhealthySeconds * float64(time.Second)); got != unhealthyFor {
+				t.Errorf("alert unhealthy for %v; want %v", got, unhealthyFor)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no alert; want healthy=%v text=%q", healthy, text)
+		}
+	}
+	wantNoAlert := func() {
+		t.Helper()
+		select {
+		case a := <-alerts:
+			t.Errorf("unexpected alert %+v", a)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// Only the state the warning settles in is alerted on.
+	n.onChange(unhealthy("first"))
+	clock.Advance(5 * time.Second)
+	n.onChange(unhealthy("second"))
+	wantNoAlert()
+	clock.Advance(5 * time.Second)
+	wantAlert(false, "second", 10*time.Second)
+
+	// Flapping back to the same state isn't alerted on again.
+	n.onChange(healthy)
+	n.onChange(unhealthy("second"))
+	clock.Advance(10 * time.Second)
+	wantNoAlert()
+
+	// Recovery is alerted on, with how long the warning was unhealthy.
+	n.onChange(healthy)
+	clock.Advance(10 * time.Second)
+	wantAlert(true, "", 30*time.Second)
+
+	// Recovering without having been alerted on isn't.
+	n.onChange(unhealthy("brief"))
+	n.onChange(healthy)
+	clock.Advance(10 * time.Second)
+	wantNoAlert()
+	n.onChange(healthy)
+	clock.Advance(10 * time.Second)
+	wantNoAlert()
+
+	// Warnings below the minimum severity aren't alerted on.
+	low := &health.Warnable{Code: "low-warning", Severity: health.SeverityLow}
+	n.onChange(health.Change{
+		WarnableChanged: true,
+		Warnable:        low,
+		UnhealthyState:  &health.UnhealthyState{WarnableCode: low.Code, Severity: low.Severity},
+	})
+	clock.Advance(10 * time.Second)
+	n.onChange(health.Change{WarnableChanged: true, Warnable: low})
+	clock.Advance(10 * time.Second)
+	wantNoAlert()
+}
+
+func TestWebhookSender(t *testing.T) {
+	got := make(chan Alert, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Alert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if a.Code == "fail" {
+			http.Error(w, "nope", http.StatusInternalServerError)
+			return
+		}
+		got <- a
+	}))
+	defer srv.Close()
+
+	var dialed atomic.Int32
+	s := newWebhookSender(srv.URL, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed.Add(1)
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	})
+	want := Alert{Code: "test-warning", Severity: health.SeverityHigh, Title: "Test", Args: health.Args{health.ArgError: "boom"}}
+	if err := s.send(context.Background(), want); err != nil {
+		t.Fatal(err)
+	}
+	if a := <-got; a.Code != want.Code || a.Args[health.ArgError] != "boom" {
+		t.Errorf("webhook got %+v; want %+v", a, want)
+	}
+	if err := s.send(context.Background(), Alert{Code: "fail"}); err == nil {
+		t.Error("send succeeded despite error response")
+	}
+	if dialed.Load() == 0 {
+		t.Error("webhook didn't use the given dialer")
+	}
+}
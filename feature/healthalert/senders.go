@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package healthalert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// webhookSender POSTs alerts as JSON to its URL.
+type webhookSender struct {
+	url    string
+	client *http.Client
+}
+
+// newWebhookSender returns a webhookSender that POSTs to url, making
+// connections with dial.
+func newWebhookSender(url string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *webhookSender {
+	return &webhookSender{
+		url: url,
+		client: &http.Client{
+			Transport: &http.Transport{DialContext: dial},
+		},
+	}
+}
+
+func (u *webhookSender) String() string { return "webhook" }
+
+func (u *webhookSender) send(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// commandSender runs the command at its path for each alert, with the
+// alert as JSON on its standard input and its main fields in the
+// environment.
+type commandSender string
+
+func (c commandSender) String() string { return "command " + string(c) }
+
+func (c commandSender) send(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	state := "unhealthy"
+	if a.Healthy {
+		state = "healthy"
+	}
+	cmd := exec.CommandContext(ctx, string(c))
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"TS_HEALTH_CODE="+string(a.Code),
+		"TS_HEALTH_STATE="+state,
+		"TS_HEALTH_SEVERITY="+string(a.Severity),
+		"TS_HEALTH_TITLE="+a.Title,
+		"TS_HEALTH_TEXT="+a.Text,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if out := strings.TrimSpace(string(out)); out != "" {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
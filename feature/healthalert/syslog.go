@@ -0,0 +1,50 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !windows && !plan9 && !js && !wasip1
+
+package healthalert
+
+import (
+	"context"
+	"fmt"
+	"log/syslog"
+
+	"tailscale.com/health"
+)
+
+// syslogSender logs alerts to the local syslog daemon.
+type syslogSender struct {
+	w *syslog.Writer
+}
+
+func newSyslogSender() (sender, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_NOTICE, "tailscaled")
+	if err != nil {
+		return nil, err
+	}
+	return syslogSender{w}, nil
+}
+
+func (s syslogSender) String() string { return "syslog" }
+
+func (s syslogSender) send(_ context.Context, a Alert) error {
+	msg := alertMessage(a)
+	switch {
+	case a.Healthy:
+		return s.w.Info(msg)
+	case a.Severity == health.SeverityHigh:
+		return s.w.Err(msg)
+	case a.Severity == health.SeverityMedium:
+		return s.w.Warning(msg)
+	}
+	return s.w.Notice(msg)
+}
+
+// alertMessage returns a one-line description of a, for syslog.
+func alertMessage(a Alert) string {
+	if a.Healthy {
+		return fmt.Sprintf("health warning %q resolved after %.0fs: %s", a.Code, a.UnhealthySeconds, a.Title)
+	}
+	return fmt.Sprintf("health warning %q (%s): %s: %s", a.Code, a.Severity, a.Title, a.Text)
+}
@@ -0,0 +1,12 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build windows || plan9 || js || wasip1
+
+package healthalert
+
+import "errors"
+
+func newSyslogSender() (sender, error) {
+	return nil, errors.New("syslog not supported on this platform")
+}
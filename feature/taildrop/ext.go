@@ -6,6 +6,7 @@
 import (
 	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -174,14 +175,61 @@ func (e *Extension) onChangeProfile(profile ipn.LoginProfileView, _ ipn.PrefsVie
 		}
 	}
 
-	e.setMgrLocked(managerOptions{
+	mgr := managerOptions{
 		Logf:           e.logf,
 		Clock:          tstime.DefaultClock{Clock: e.sb.Clock()},
 		State:          e.stateStore,
 		DirectFileMode: isDirectFileMode,
 		fileOps:        fops,
 		SendFileNotify: e.sendFileNotify,
-	}.New())
+	}.New()
+	if p, err := e.ReceivePolicy(); err != nil {
+		e.logf("reading receive policy: %v", err)
+	} else {
+		mgr.SetReceivePolicy(p)
+	}
+	e.setMgrLocked(mgr)
+}
+
+// ReceivePolicy returns the node's Taildrop receive policy.
+func (e *Extension) ReceivePolicy() (*apitype.TaildropReceivePolicy, error) {
+	p := new(apitype.TaildropReceivePolicy)
+	if e.stateStore == nil {
+		return p, nil
+	}
+	b, err := e.stateStore.ReadState(ipn.TaildropReceivePolicyKey)
+	if errors.Is(err, ipn.ErrStateNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("parsing receive policy: %w", err)
+	}
+	return p, nil
+}
+
+// SetReceivePolicy validates and stores the node's Taildrop receive policy,
+// which applies to files received from then on.
+func (e *Extension) SetReceivePolicy(p *apitype.TaildropReceivePolicy) error {
+	if err := validateReceivePolicy(p); err != nil {
+		return err
+	}
+	if e.stateStore == nil {
+		return errors.New("no state store")
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.stateStore.WriteState(ipn.TaildropReceivePolicyKey, b); err != nil {
+		return err
+	}
+	e.manager().SetReceivePolicy(p) // no-op on nil receiver
+	return nil
 }
 
 // fileRoot returns where to store Taildrop files for the given user and whether
@@ -21,14 +21,18 @@ type FileOps interface {
 
 	// Remove deletes a file or directory relative to the receiver's root.
 	// It returns [io.ErrNotExist] if the file or directory does not exist.
+	// Parent directories left empty by removing a file in a subdirectory
+	// are removed too.
 	Remove(name string) error
 
 	// Rename atomically renames oldPath to a new file named newName,
-	// returning the full new path or an error.
+	// returning the full new path or an error. The newName may be a
+	// slash-separated path relative to the receiver's root.
 	Rename(oldPath, newName string) (newPath string, err error)
 
-	// ListFiles returns just the basenames of all regular files
-	// in the root directory.
+	// ListFiles returns the names of all regular files in the root
+	// directory and its subdirectories. Names of files in subdirectories
+	// are slash-separated paths relative to the root.
 	ListFiles() ([]string, error)
 
 	// Stat returns the FileInfo for the given name or an error.
@@ -76,20 +76,29 @@ func (f fsFileOps) Remove(name string) error {
 	if err != nil {
 		return err
 	}
-	return os.Remove(path)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	// Remove the parent directories of files that were sent as part of
+	// a directory once they're empty. Removing a non-empty directory fails.
+	for dir := filepath.Dir(path); dir != filepath.Clean(f.rootDir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
 }
 
 // Rename moves the partial file into its final name.
-// newName must be a base name (not absolute or containing path separators).
+// newName must be a base name or a slash-separated path relative to the
+// root directory, as validated by joinDir.
 // It will retry up to 10 times, de-dup same-checksum files, etc.
 func (f fsFileOps) Rename(oldPath, newName string) (newPath string, err error) {
-	var dst string
-	if filepath.IsAbs(newName) || strings.ContainsRune(newName, os.PathSeparator) {
-		return "", fmt.Errorf("invalid newName %q: must not be an absolute path or contain path separators", newName)
+	dst, err := joinDir(f.rootDir, newName)
+	if err != nil {
+		return "", fmt.Errorf("invalid newName %q: %w", newName, err)
 	}
 
-	dst = filepath.Join(f.rootDir, newName)
-
 	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
 		return "", err
 	}
@@ -167,15 +176,23 @@ func sha256File(path string) (sum [sha256.Size]byte, _ error) {
 }
 
 func (f fsFileOps) ListFiles() ([]string, error) {
-	entries, err := os.ReadDir(f.rootDir)
-	if err != nil {
-		return nil, err
-	}
 	var names []string
-	for _, e := range entries {
-		if e.Type().IsRegular() {
-			names = append(names, e.Name())
+	err := filepath.WalkDir(f.rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(f.rootDir, path)
+		if err != nil {
+			return err
 		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return names, nil
 }
@@ -196,26 +213,33 @@ func (f fsFileOps) OpenReader(name string) (io.ReadCloser, error) {
 	return os.Open(path)
 }
 
-// joinDir is like [filepath.Join] but returns an error if baseName is too long,
-// is a relative path instead of a basename, or is otherwise invalid or unsafe for incoming files.
-func joinDir(dir, baseName string) (string, error) {
-	if !utf8.ValidString(baseName) ||
-		strings.TrimSpace(baseName) != baseName ||
-		len(baseName) > 255 {
-		return "", ErrInvalidFileName
-	}
-	// TODO: validate unicode normalization form too? Varies by platform.
-	clean := path.Clean(baseName)
-	if clean != baseName || clean == "." || clean == ".." {
+// joinDir is like [filepath.Join] but returns an error if name is too long,
+// or is otherwise invalid or unsafe for incoming files. The name may be a
+// base name or a slash-separated relative path, each element of which must
+// be a valid base name.
+func joinDir(dir, name string) (string, error) {
+	if len(name) > maxNameLen || strings.Count(name, "/") >= maxNameDepth {
 		return "", ErrInvalidFileName
 	}
-	for _, r := range baseName {
-		if !validFilenameRune(r) {
+	for _, baseName := range strings.Split(name, "/") {
+		if !utf8.ValidString(baseName) ||
+			strings.TrimSpace(baseName) != baseName ||
+			len(baseName) > 255 {
+			return "", ErrInvalidFileName
+		}
+		// TODO: validate unicode normalization form too? Varies by platform.
+		clean := path.Clean(baseName)
+		if clean != baseName || clean == "." || clean == ".." {
+			return "", ErrInvalidFileName
+		}
+		for _, r := range baseName {
+			if !validFilenameRune(r) {
+				return "", ErrInvalidFileName
+			}
+		}
+		if !filepath.IsLocal(baseName) {
 			return "", ErrInvalidFileName
 		}
 	}
-	if !filepath.IsLocal(baseName) {
-		return "", ErrInvalidFileName
-	}
-	return filepath.Join(dir, baseName), nil
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
 }
@@ -6,6 +6,7 @@
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -20,6 +21,7 @@
 	"time"
 
 	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/envknob"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/localapi"
@@ -35,12 +37,16 @@ func init() {
 	localapi.Register("file-put/", serveFilePut)
 	localapi.Register("files/", serveFiles)
 	localapi.Register("file-targets", serveFileTargets)
+	localapi.Register("file-receive-policy", serveFileReceivePolicy)
 }
 
 var (
 	metricFilePutCalls = clientmetric.NewCounter("localapi_file_put")
 )
 
+// disableSendZstd disables compressing files sent to peers that accept it.
+var disableSendZstd = envknob.RegisterBool("TS_DEBUG_TAILDROP_NO_ZSTD")
+
 // serveFilePut sends a file to another node.
 //
 // It's sometimes possible for clients to do this themselves, without
@@ -294,6 +300,11 @@ func singleFilePut(
 	// the full file.
 	var offset int64
 	var resumeDuration time.Duration
+	var peerZstd, peerDigest bool
+	// Hash the whole file, including any part skipped when resuming,
+	// for peers that want its digest.
+	sum := sha256.New()
+	body = io.TeeReader(body, sum)
 	remainingBody := io.Reader(body)
 	client := &http.Client{
 		Transport: h.LocalBackend().Dialer().PeerAPITransport(),
@@ -317,6 +328,7 @@ func singleFilePut(
 	case resp.StatusCode != http.StatusOK:
 		h.Logf("fetch remote hashes status code: %d", resp.StatusCode)
 	default:
+		peerZstd, peerDigest = peerPutFeatures(resp.Header)
 		resumeStart := time.Now()
 		dec := json.NewDecoder(resp.Body)
 		offset, remainingBody, err = resumeReader(body, func() (out blockChecksum, err error) {
@@ -329,6 +341,22 @@ func singleFilePut(
 		resumeDuration = time.Since(resumeStart).Round(time.Millisecond)
 	}
 
+	compress := peerZstd && !disableSendZstd()
+	if compress {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func(r io.Reader) {
+			pw.CloseWithError(zstdCopy(pw, r))
+		}(remainingBody)
+		remainingBody = pr
+	}
+	var trailer http.Header // of the request sent by the proxy below
+	if peerDigest {
+		remainingBody = &eofHookReader{r: remainingBody, onEOF: func() {
+			trailer.Set(reprDigestHeader, formatReprDigest(sum.Sum(nil)))
+		}}
+	}
+
 	outReq, err := http.NewRequestWithContext(ctx, "PUT", "http://peer/v0/put/"+outgoingFile.Name, remainingBody)
 	if err != nil {
 		http.Error(w, "bogus outreq", http.StatusInternalServerError)
@@ -344,9 +372,32 @@ func singleFilePut(
 			outReq.ContentLength -= offset
 		}
 	}
+	if compress || peerDigest {
+		// The body is chunked, either because its compressed length
+		// isn't known or to send the digest as a trailer.
+		if outReq.ContentLength >= 0 {
+			outReq.Header.Set(decodedLengthHeader, strconv.FormatInt(outReq.ContentLength, 10))
+		}
+		outReq.ContentLength = -1
+	}
+	if compress {
+		outReq.Header.Set("Content-Encoding", zstdEncoding)
+	}
+	if peerDigest {
+		outReq.Trailer = http.Header{reprDigestHeader: nil}
+	}
 
 	rp := httputil.NewSingleHostReverseProxy(dstURL)
 	rp.Transport = h.LocalBackend().Dialer().PeerAPITransport()
+	if peerDigest {
+		// The proxy sends a copy of outReq, so the digest must be set
+		// in the copy's trailer.
+		director := rp.Director
+		rp.Director = func(r *http.Request) {
+			director(r)
+			trailer = r.Trailer
+		}
+	}
 	rp.ServeHTTP(w, outReq)
 
 	outgoingFile.Finished = true
@@ -456,3 +507,44 @@ func serveFileTargets(h *localapi.Handler, w http.ResponseWriter, r *http.Reques
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(fts)
 }
+
+// serveFileReceivePolicy gets (GET) or sets (PUT) the node's Taildrop
+// receive policy, as a JSON apitype.TaildropReceivePolicy.
+func serveFileReceivePolicy(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
+	ext, ok := ipnlocal.GetExt[*Extension](h.LocalBackend())
+	if !ok {
+		http.Error(w, "misconfigured taildrop extension", http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "access denied", http.StatusForbidden)
+			return
+		}
+		p, err := ext.ReceivePolicy()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	case "PUT":
+		if !h.PermitWrite {
+			http.Error(w, "access denied", http.StatusForbidden)
+			return
+		}
+		p := new(apitype.TaildropReceivePolicy)
+		if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := ext.SetReceivePolicy(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET or PUT", http.StatusMethodNotAllowed)
+	}
+}
@@ -4,6 +4,7 @@
 package taildrop
 
 import (
+	"cmp"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,6 +14,7 @@
 	"time"
 
 	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/smallzstd"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstime"
 	"tailscale.com/util/clientmetric"
@@ -51,6 +53,22 @@ type extensionForPut interface {
 	manager() *manager
 	hasCapFileSharing() bool
 	Clock() tstime.Clock
+
+	// peerLogin returns the login name of the user of the peer making
+	// the request h, or the empty string if unknown.
+	peerLogin(h ipnlocal.PeerAPIHandler) string
+}
+
+// peerLogin implements extensionForPut.
+func (e *Extension) peerLogin(h ipnlocal.PeerAPIHandler) string {
+	if h.Peer().IsTagged() {
+		return ""
+	}
+	_, u, ok := h.LocalBackend().WhoIs("tcp", h.RemoteAddr())
+	if !ok {
+		return ""
+	}
+	return u.LoginName
 }
 
 func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w http.ResponseWriter, r *http.Request) {
@@ -79,6 +97,12 @@ func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w
 		http.Error(w, "misconfigured internals", http.StatusForbidden)
 		return
 	}
+	// Files sent as part of a directory have slash-separated names,
+	// which senders must escape as a single path segment.
+	if strings.Contains(prefix, "/") {
+		http.Error(w, ErrInvalidFileName.Error(), http.StatusBadRequest)
+		return
+	}
 	baseName, err := url.PathUnescape(prefix)
 	if err != nil {
 		http.Error(w, ErrInvalidFileName.Error(), http.StatusBadRequest)
@@ -87,6 +111,7 @@ func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w
 	enc := json.NewEncoder(w)
 	switch r.Method {
 	case "GET":
+		advertisePutFeatures(w.Header())
 		id := clientID(h.Peer().StableID())
 		if prefix == "" {
 			// List all the partial files.
@@ -138,7 +163,39 @@ func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w
 			}
 			offset = ranges[0].Start
 		}
-		n, err := taildropMgr.PutFile(clientID(fmt.Sprint(id)), baseName, r.Body, offset, r.ContentLength)
+		body, length := io.Reader(r.Body), r.ContentLength
+		switch ce := r.Header.Get("Content-Encoding"); ce {
+		case "", "identity":
+		case zstdEncoding:
+			dec, err := smallzstd.NewDecoder(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer dec.Close()
+			body, length = dec, -1
+		default:
+			http.Error(w, fmt.Sprintf("unsupported Content-Encoding %q", ce), http.StatusUnsupportedMediaType)
+			return
+		}
+		if dl, err := parseDecodedLength(r.Header); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if dl >= 0 {
+			length = dl
+		}
+		wantSum := func() ([]byte, error) {
+			// The digest may be sent as a trailer, which is only
+			// available once the body has been read to its end.
+			io.Copy(io.Discard, r.Body)
+			return parseReprDigest(cmp.Or(r.Trailer.Get(reprDigestHeader), r.Header.Get(reprDigestHeader)))
+		}
+		from := sender{
+			id:    id,
+			tags:  h.Peer().Tags().AsSlice(),
+			login: ext.peerLogin(h),
+		}
+		n, err := taildropMgr.PutFile(from, baseName, body, offset, length, wantSum)
 		switch err {
 		case nil:
 			d := ext.Clock().Since(t0).Round(time.Second / 10)
@@ -150,6 +207,14 @@ func handlePeerPutWithBackend(h ipnlocal.PeerAPIHandler, ext extensionForPut, w
 			http.Error(w, err.Error(), http.StatusBadRequest)
 		case ErrFileExists:
 			http.Error(w, err.Error(), http.StatusConflict)
+		case ErrDigestMismatch:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case ErrSenderNotAllowed:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case ErrFileTooLarge:
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case ErrQuotaExceeded:
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
 		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -5,6 +5,7 @@
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/fs"
@@ -57,6 +58,7 @@ type fakeExtension struct {
 	capFileSharing bool
 	clock          tstime.Clock
 	taildrop       *manager
+	login          string
 }
 
 func (lb *fakeExtension) manager() *manager {
@@ -66,6 +68,7 @@ func (lb *fakeExtension) Clock() tstime.Clock { return lb.clock }
 func (lb *fakeExtension) hasCapFileSharing() bool {
 	return lb.capFileSharing
 }
+func (lb *fakeExtension) peerLogin(ipnlocal.PeerAPIHandler) string { return lb.login }
 
 type peerAPITestEnv struct {
 	taildrop *manager
@@ -138,6 +141,44 @@ func fileHasContents(name string, want string) check {
 	}
 }
 
+// noFiles checks that no files, including partial ones, were left behind.
+func noFiles() check {
+	return func(t *testing.T, e *peerAPITestEnv) {
+		files, err := e.taildrop.opts.fileOps.ListFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Errorf("files left behind: %q", files)
+		}
+	}
+}
+
+// withHeader returns req with the header k set to v.
+func withHeader(req *http.Request, k, v string) *http.Request {
+	req.Header.Set(k, v)
+	return req
+}
+
+// withTrailer returns req with the trailer k set to v.
+func withTrailer(req *http.Request, k, v string) *http.Request {
+	req.Trailer = http.Header{k: {v}}
+	return req
+}
+
+func zstdReader(s string) io.Reader {
+	var buf bytes.Buffer
+	if err := zstdCopy(&buf, strings.NewReader(s)); err != nil {
+		panic(err)
+	}
+	return &buf
+}
+
+func sha256Digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return formatReprDigest(sum[:])
+}
+
 func hexAll(v string) string {
 	var sb strings.Builder
 	for i := range len(v) {
@@ -153,6 +194,8 @@ func TestHandlePeerAPI(t *testing.T) {
 		capSharing bool // self node has file sharing capability
 		debugCap   bool // self node has debug capability
 		omitRoot   bool // don't configure
+		peerLogin  string
+		policy     *apitype.TaildropReceivePolicy
 		reqs       []*http.Request
 		checks     []check
 	}{
@@ -334,6 +377,37 @@ func TestHandlePeerAPI(t *testing.T) {
 				bodyContains("invalid filename"),
 			),
 		},
+		{
+			name:       "bad_filename_encoded_empty_dir",
+			isSelf:     true,
+			capSharing: true,
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/"+hexAll("foo//bar"), nil)},
+			checks: checks(
+				httpStatus(400),
+				bodyContains("invalid filename"),
+			),
+		},
+		{
+			name:       "bad_filename_encoded_partial_dir",
+			isSelf:     true,
+			capSharing: true,
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/"+hexAll("foo.partial/bar"), nil)},
+			checks: checks(
+				httpStatus(400),
+				bodyContains("invalid filename"),
+			),
+		},
+		{
+			name:       "put_in_dir",
+			isSelf:     true,
+			capSharing: true,
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/"+hexAll("build/out/foo.bin"), strings.NewReader("baz"))},
+			checks: checks(
+				httpStatus(200),
+				bodyContains("{}"),
+				fileHasContents("build/out/foo.bin", "baz"),
+			),
+		},
 		{
 			name:       "put_spaces_and_caps",
 			isSelf:     true,
@@ -406,6 +480,84 @@ func TestHandlePeerAPI(t *testing.T) {
 				bodyContains("invalid filename"),
 			),
 		},
+		{
+			name:       "get_advertises_put_features",
+			isSelf:     true,
+			capSharing: true,
+			reqs:       []*http.Request{httptest.NewRequest("GET", "/v0/put/foo", nil)},
+			checks: checks(
+				httpStatus(200),
+				func(t *testing.T, e *peerAPITestEnv) {
+					zstd, digest := peerPutFeatures(e.rr.Result().Header)
+					if !zstd || !digest {
+						t.Errorf("peerPutFeatures = %v, %v; want true, true", zstd, digest)
+					}
+				},
+			),
+		},
+		{
+			name:       "put_zstd",
+			isSelf:     true,
+			capSharing: true,
+			reqs: []*http.Request{
+				withHeader(withHeader(httptest.NewRequest("PUT", "/v0/put/foo", zstdReader("contents")),
+					"Content-Encoding", "zstd"),
+					decodedLengthHeader, "8"),
+			},
+			checks: checks(
+				httpStatus(200),
+				fileHasContents("foo", "contents"),
+			),
+		},
+		{
+			name:       "put_zstd_wrong_length",
+			isSelf:     true,
+			capSharing: true,
+			reqs: []*http.Request{
+				withHeader(withHeader(httptest.NewRequest("PUT", "/v0/put/foo", zstdReader("contents")),
+					"Content-Encoding", "zstd"),
+					decodedLengthHeader, "9"),
+			},
+			checks: checks(
+				httpStatus(500),
+			),
+		},
+		{
+			name:       "put_unsupported_encoding",
+			isSelf:     true,
+			capSharing: true,
+			reqs: []*http.Request{
+				withHeader(httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents")), "Content-Encoding", "gzip"),
+			},
+			checks: checks(
+				httpStatus(415),
+			),
+		},
+		{
+			name:       "put_digest_trailer",
+			isSelf:     true,
+			capSharing: true,
+			reqs: []*http.Request{
+				withTrailer(httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents")), reprDigestHeader, sha256Digest("contents")),
+			},
+			checks: checks(
+				httpStatus(200),
+				fileHasContents("foo", "contents"),
+			),
+		},
+		{
+			name:       "put_digest_mismatch",
+			isSelf:     true,
+			capSharing: true,
+			reqs: []*http.Request{
+				withHeader(httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents")), reprDigestHeader, sha256Digest("other contents")),
+			},
+			checks: checks(
+				httpStatus(422),
+				bodyContains("digest"),
+				noFiles(),
+			),
+		},
 		{
 			name:       "duplicate_zero_length",
 			isSelf:     true,
@@ -472,6 +624,101 @@ func(t *testing.T, env *peerAPITestEnv) {
 				},
 			),
 		},
+		{
+			name:       "policy_sender_not_allowed",
+			isSelf:     true,
+			capSharing: true,
+			peerLogin:  "bob@example.com",
+			policy:     &apitype.TaildropReceivePolicy{AllowedSenders: []string{"alice@example.com", "tag:ci"}},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents"))},
+			checks: checks(
+				httpStatus(http.StatusForbidden),
+				bodyContains(ErrSenderNotAllowed.Error()),
+				noFiles(),
+			),
+		},
+		{
+			name:       "policy_sender_allowed",
+			isSelf:     true,
+			capSharing: true,
+			peerLogin:  "Alice@example.com",
+			policy:     &apitype.TaildropReceivePolicy{AllowedSenders: []string{"alice@example.com", "tag:ci"}},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents"))},
+			checks: checks(
+				httpStatus(http.StatusOK),
+				fileHasContents("foo", "contents"),
+			),
+		},
+		{
+			name:       "policy_file_too_large",
+			isSelf:     true,
+			capSharing: true,
+			policy:     &apitype.TaildropReceivePolicy{MaxFileSize: 4},
+			reqs:       []*http.Request{httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents"))},
+			checks: checks(
+				httpStatus(http.StatusRequestEntityTooLarge),
+				bodyContains(ErrFileTooLarge.Error()),
+				noFiles(),
+			),
+		},
+		{
+			name:       "policy_file_too_large_unknown_length",
+			isSelf:     true,
+			capSharing: true,
+			policy:     &apitype.TaildropReceivePolicy{MaxFileSize: 4},
+			reqs: []*http.Request{
+				func() *http.Request {
+					r := httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents"))
+					r.ContentLength = -1
+					return r
+				}(),
+			},
+			checks: checks(
+				httpStatus(http.StatusRequestEntityTooLarge),
+				noFiles(),
+			),
+		},
+		{
+			name:       "policy_quota_exceeded",
+			isSelf:     true,
+			capSharing: true,
+			policy:     &apitype.TaildropReceivePolicy{SenderDailyQuota: 12},
+			reqs: []*http.Request{
+				httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents")),
+				httptest.NewRequest("PUT", "/v0/put/bar", strings.NewReader("contents")),
+			},
+			checks: checks(
+				httpStatus(http.StatusTooManyRequests),
+				bodyContains(ErrQuotaExceeded.Error()),
+				fileHasContents("foo", "contents"),
+				func(t *testing.T, e *peerAPITestEnv) {
+					if got, _ := e.taildrop.WaitingFiles(); len(got) != 1 {
+						t.Errorf("WaitingFiles = %v; want only foo", got)
+					}
+				},
+			),
+		},
+		{
+			name:       "policy_sort_rules",
+			isSelf:     true,
+			capSharing: true,
+			peerLogin:  "alice@example.com",
+			policy: &apitype.TaildropReceivePolicy{
+				SortRules: []apitype.TaildropSortRule{
+					{Sender: "bob@example.com", Dir: "bob"},
+					{Extensions: []string{".log"}, Dir: "logs/{sender}"},
+				},
+			},
+			reqs: []*http.Request{
+				httptest.NewRequest("PUT", "/v0/put/foo.LOG", strings.NewReader("log")),
+				httptest.NewRequest("PUT", "/v0/put/foo.txt", strings.NewReader("txt")),
+			},
+			checks: checks(
+				httpStatus(http.StatusOK),
+				fileHasContents("logs/alice@example.com/foo.LOG", "log"),
+				fileHasContents("foo.txt", "txt"),
+			),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -497,12 +744,14 @@ func(t *testing.T, env *peerAPITestEnv) {
 				Logf:    e.logBuf.Logf,
 				fileOps: fo,
 			}.New()
+			e.taildrop.SetReceivePolicy(tt.policy)
 
 			ext := &fakeExtension{
 				logf:           e.logBuf.Logf,
 				capFileSharing: tt.capSharing,
 				clock:          &tstest.Clock{},
 				taildrop:       e.taildrop,
+				login:          tt.peerLogin,
 			}
 			e.ph = &peerAPIHandler{
 				isSelf:   tt.isSelf,
@@ -0,0 +1,255 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/util/mak"
+)
+
+var (
+	ErrSenderNotAllowed = errors.New("receiver does not accept files from this sender")
+	ErrFileTooLarge     = errors.New("file is larger than the receiver accepts")
+	ErrQuotaExceeded    = errors.New("sender exceeded its daily quota on the receiver")
+)
+
+// quotaPeriod is the period over which TaildropReceivePolicy.SenderDailyQuota
+// applies.
+const quotaPeriod = 24 * time.Hour
+
+// sender identifies the peer that a file is received from.
+type sender struct {
+	id    clientID // the peer's stable node ID
+	tags  []string // the peer's ACL tags, if any
+	login string   // the login name of the peer's user, if not tagged
+}
+
+// name returns the name of s for the "{sender}" placeholder in sort rules.
+func (s sender) name() string {
+	n := s.login
+	if len(s.tags) > 0 {
+		n = strings.TrimPrefix(s.tags[0], "tag:")
+	}
+	n = strings.Map(func(r rune) rune {
+		if !validFilenameRune(r) {
+			return '_'
+		}
+		return r
+	}, n)
+	if validateBaseName(n) != nil {
+		return "unknown"
+	}
+	return n
+}
+
+// is reports whether s is the sender named by id, which is an ACL tag or
+// a user's login name.
+func (s sender) is(id string) bool {
+	if strings.HasPrefix(id, "tag:") {
+		return slices.Contains(s.tags, id)
+	}
+	return len(s.tags) == 0 && s.login != "" && strings.EqualFold(s.login, id)
+}
+
+// senderUsage is the number of bytes received from a sender in the current
+// quota period, including bytes reserved for files still being received.
+type senderUsage struct {
+	start time.Time
+	bytes int64
+}
+
+// validateReceivePolicy reports whether p is a valid receive policy.
+func validateReceivePolicy(p *apitype.TaildropReceivePolicy) error {
+	if p.MaxFileSize < 0 || p.SenderDailyQuota < 0 {
+		return errors.New("negative size or quota")
+	}
+	for i, r := range p.SortRules {
+		if r.Dir == "" {
+			return fmt.Errorf("sort rule %d: empty Dir", i)
+		}
+		if err := validateFileName(strings.ReplaceAll(r.Dir, "{sender}", "sender")); err != nil {
+			return fmt.Errorf("sort rule %d: invalid Dir %q", i, r.Dir)
+		}
+	}
+	return nil
+}
+
+// SetReceivePolicy sets the policy that files received from now on are
+// subject to. A nil p accepts all files into the inbox.
+func (m *manager) SetReceivePolicy(p *apitype.TaildropReceivePolicy) {
+	if m == nil {
+		return
+	}
+	m.policy.Store(p)
+}
+
+// admitFile checks that a file of length bytes (-1 if unknown) starting at
+// offset may be received from s per the receive policy. If the policy limits
+// how many bytes may be read from the sender for it, it returns a limitReader
+// for that, whose r must be set.
+//
+// If the sender has a quota, the file's length is reserved against it, so
+// that concurrent transfers can't together exceed it. If its length is
+// unknown, the returned limitReader instead charges bytes against the quota
+// as they're read. The returned release func must be called with the number
+// of bytes received once the transfer ends, to return the unused part of the
+// reservation.
+func (m *manager) admitFile(s sender, offset, length int64) (_ *limitReader, release func(received int64), _ error) {
+	release = func(int64) {}
+	p := m.policy.Load()
+	if p == nil {
+		return nil, release, nil
+	}
+	if len(p.AllowedSenders) > 0 && !slices.ContainsFunc(p.AllowedSenders, s.is) {
+		return nil, nil, ErrSenderNotAllowed
+	}
+	var lim *limitReader
+	if p.MaxFileSize > 0 {
+		if offset+max(length, 0) > p.MaxFileSize {
+			return nil, nil, ErrFileTooLarge
+		}
+		lim = &limitReader{n: p.MaxFileSize - offset, err: ErrFileTooLarge}
+	}
+	if p.SenderDailyQuota > 0 {
+		m.quotaMu.Lock()
+		defer m.quotaMu.Unlock()
+		now := m.opts.Clock.Now()
+		u := m.usage[s.id]
+		if u == nil || now.Sub(u.start) >= quotaPeriod {
+			u = &senderUsage{start: now}
+			mak.Set(&m.usage, s.id, u)
+		}
+		remain := p.SenderDailyQuota - u.bytes
+		if remain <= 0 || length > remain {
+			return nil, nil, ErrQuotaExceeded
+		}
+		if length < 0 {
+			if lim == nil {
+				lim = &limitReader{n: math.MaxInt64, err: ErrFileTooLarge}
+			}
+			lim.quota = &quotaCharge{mu: &m.quotaMu, usage: u, quota: p.SenderDailyQuota}
+			return lim, release, nil
+		}
+		u.bytes += length
+		release = func(received int64) {
+			m.quotaMu.Lock()
+			defer m.quotaMu.Unlock()
+			u.bytes -= length - min(received, length)
+		}
+		if lim == nil || length < lim.n {
+			lim = &limitReader{n: length, err: ErrQuotaExceeded}
+		}
+	}
+	return lim, release, nil
+}
+
+// quotaCharge charges bytes read against a sender's quota.
+type quotaCharge struct {
+	mu    *sync.Mutex // manager.quotaMu
+	usage *senderUsage
+	quota int64
+}
+
+// take charges up to want bytes against the quota and returns how many it
+// charged, which is zero once the quota is used up.
+func (q *quotaCharge) take(want int64) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := max(min(want, q.quota-q.usage.bytes), 0)
+	q.usage.bytes += n
+	return n
+}
+
+// refund returns n bytes charged by take but not read.
+func (q *quotaCharge) refund(n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.usage.bytes -= n
+}
+
+// sortedName returns the name that the file baseName received from s is
+// stored as, per the first sort rule that matches it, if any.
+func (m *manager) sortedName(s sender, baseName string) string {
+	p := m.policy.Load()
+	if p == nil {
+		return baseName
+	}
+	for _, r := range p.SortRules {
+		if r.Sender != "" && !s.is(r.Sender) {
+			continue
+		}
+		if len(r.Extensions) > 0 && !slices.ContainsFunc(r.Extensions, func(ext string) bool {
+			return strings.HasSuffix(strings.ToLower(baseName), strings.ToLower(ext))
+		}) {
+			continue
+		}
+		name := path.Join(strings.ReplaceAll(r.Dir, "{sender}", s.name()), baseName)
+		if validateFileName(name) != nil {
+			m.opts.Logf("sort rule for %q gives invalid name; not sorting", r.Dir)
+			return baseName
+		}
+		return name
+	}
+	return baseName
+}
+
+// limitReader is like io.LimitedReader, but returns err if the underlying
+// reader has more than n bytes, and ErrQuotaExceeded if it has more than
+// quota allows.
+type limitReader struct {
+	r     io.Reader
+	n     int64        // bytes left
+	err   error        // to return once more than n bytes are read
+	quota *quotaCharge // if non-nil, charged for the bytes read
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	if lr.n <= 0 {
+		return 0, lr.rejectMore(lr.err)
+	}
+	if int64(len(p)) > lr.n {
+		p = p[:lr.n]
+	}
+	var charged int64
+	if lr.quota != nil {
+		charged = lr.quota.take(int64(len(p)))
+		if charged == 0 {
+			return 0, lr.rejectMore(ErrQuotaExceeded)
+		}
+		p = p[:charged]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	if lr.quota != nil {
+		lr.quota.refund(charged - int64(n))
+	}
+	return n, err
+}
+
+// rejectMore returns err if the underlying reader has more to read, or the
+// error from reading it otherwise.
+func (lr *limitReader) rejectMore(err error) error {
+	var b [1]byte
+	n, rerr := lr.r.Read(b[:])
+	if n > 0 {
+		return err
+	}
+	return rerr
+}
+
+// rejected reports whether err, from reading lr, means the file was
+// rejected by the receive policy.
+func (lr *limitReader) rejected(err error) bool {
+	return err == lr.err || err == ErrQuotaExceeded
+}
@@ -0,0 +1,123 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func TestValidateReceivePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  apitype.TaildropReceivePolicy
+		wantErr bool
+	}{
+		{name: "empty"},
+		{
+			name: "valid",
+			policy: apitype.TaildropReceivePolicy{
+				MaxFileSize:      1 << 30,
+				AllowedSenders:   []string{"tag:ci"},
+				SenderDailyQuota: 10 << 30,
+				SortRules: []apitype.TaildropSortRule{
+					{Extensions: []string{".log"}, Dir: "logs/{sender}"},
+				},
+			},
+		},
+		{name: "negative_size", policy: apitype.TaildropReceivePolicy{MaxFileSize: -1}, wantErr: true},
+		{name: "negative_quota", policy: apitype.TaildropReceivePolicy{SenderDailyQuota: -1}, wantErr: true},
+		{name: "empty_dir", policy: apitype.TaildropReceivePolicy{SortRules: []apitype.TaildropSortRule{{Sender: "tag:ci"}}}, wantErr: true},
+		{name: "dotdot_dir", policy: apitype.TaildropReceivePolicy{SortRules: []apitype.TaildropSortRule{{Dir: "../out"}}}, wantErr: true},
+		{name: "abs_dir", policy: apitype.TaildropReceivePolicy{SortRules: []apitype.TaildropSortRule{{Dir: "/tmp"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateReceivePolicy(&tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateReceivePolicy = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSenderName(t *testing.T) {
+	tests := []struct {
+		s    sender
+		want string
+	}{
+		{sender{login: "alice@example.com"}, "alice@example.com"},
+		{sender{tags: []string{"tag:ci", "tag:prod"}, login: "ignored@example.com"}, "ci"},
+		{sender{login: "a/b"}, "a_b"},
+		{sender{login: ".."}, "unknown"},
+		{sender{}, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := tt.s.name(); got != tt.want {
+			t.Errorf("%+v.name() = %q; want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestAdmitFileReservesQuota(t *testing.T) {
+	m := managerOptions{}.New()
+	defer m.Shutdown()
+	m.SetReceivePolicy(&apitype.TaildropReceivePolicy{SenderDailyQuota: 10})
+	s := sender{id: "n1", login: "alice@example.com"}
+
+	// Concurrent transfers can't together exceed the quota.
+	_, release1, err := m.admitFile(s, 0, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.admitFile(s, 0, 6); err != ErrQuotaExceeded {
+		t.Fatalf("second admitFile = %v; want %v", err, ErrQuotaExceeded)
+	}
+
+	// The unused part of a reservation is released.
+	release1(2)
+	_, release2, err := m.admitFile(s, 0, 8)
+	if err != nil {
+		t.Fatalf("admitFile after release: %v", err)
+	}
+	release2(8)
+	if _, _, err := m.admitFile(s, 0, 1); err != ErrQuotaExceeded {
+		t.Fatalf("admitFile over quota = %v; want %v", err, ErrQuotaExceeded)
+	}
+
+	// Files of unknown length are charged as they're read, so they don't
+	// hold up other transfers.
+	s2 := sender{id: "n2", login: "bob@example.com"}
+	lim, release3, err := m.admitFile(s2, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, release4, err := m.admitFile(s2, 0, 1)
+	if err != nil {
+		t.Fatalf("admitFile during unknown-length transfer: %v", err)
+	}
+	release4(0)
+	lim.r = strings.NewReader("abcd")
+	if b, err := io.ReadAll(lim); err != nil || string(b) != "abcd" {
+		t.Fatalf("ReadAll = %q, %v; want abcd", b, err)
+	}
+	release3(4)
+	if _, _, err := m.admitFile(s2, 0, 7); err != ErrQuotaExceeded {
+		t.Fatalf("admitFile over quota after unknown-length transfer = %v; want %v", err, ErrQuotaExceeded)
+	}
+
+	// Reading more than the rest of the quota fails.
+	lim, release5, err := m.admitFile(s2, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lim.r = strings.NewReader("0123456789")
+	if b, err := io.ReadAll(lim); err != ErrQuotaExceeded || len(b) != 6 {
+		t.Fatalf("ReadAll = %q, %v; want 6 bytes and %v", b, err, ErrQuotaExceeded)
+	}
+	release5(6)
+}
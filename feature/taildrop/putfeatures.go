@@ -0,0 +1,145 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"tailscale.com/smallzstd"
+)
+
+// Peers that support them negotiate compression and an end-to-end digest
+// of each file as follows. The sender's GET of /v0/put/<name>, made to
+// resume a partial file, returns the wantDigestHeader and acceptEncodingHeader
+// response headers. The sender's PUT then may:
+//
+//   - send the body compressed with zstd, with a Content-Encoding of "zstd";
+//   - send a reprDigestHeader trailer with the SHA-256 of the whole file,
+//     including any part of it sent before the transfer was resumed, which
+//     the receiver verifies before the file leaves its partial state.
+//
+// Either way, the body is then sent without a Content-Length, so the
+// length of the decoded content is sent in decodedLengthHeader.
+const (
+	acceptEncodingHeader = "Accept-Encoding"
+	wantDigestHeader     = "Want-Repr-Digest"
+	reprDigestHeader     = "Repr-Digest"
+	decodedLengthHeader  = "Taildrop-Decoded-Length"
+
+	zstdEncoding = "zstd"
+	wantSHA256   = "sha-256=1"
+)
+
+// ErrDigestMismatch is returned when a received file doesn't match the
+// digest its sender sent with it.
+var ErrDigestMismatch = errors.New("file content does not match its digest")
+
+// advertisePutFeatures sets the response headers that tell the sender of
+// a file which of the optional put features this node supports.
+func advertisePutFeatures(h http.Header) {
+	h.Set(acceptEncodingHeader, zstdEncoding)
+	h.Set(wantDigestHeader, wantSHA256)
+}
+
+// peerPutFeatures reports which optional put features the peer supports,
+// per the response headers of its GET of /v0/put/<name>.
+func peerPutFeatures(h http.Header) (zstd, digest bool) {
+	for _, enc := range strings.Split(h.Get(acceptEncodingHeader), ",") {
+		if strings.TrimSpace(enc) == zstdEncoding {
+			zstd = true
+		}
+	}
+	for _, want := range strings.Split(h.Get(wantDigestHeader), ",") {
+		if strings.TrimSpace(want) == wantSHA256 {
+			digest = true
+		}
+	}
+	return zstd, digest
+}
+
+// formatReprDigest returns the value of a reprDigestHeader for a SHA-256
+// digest, per RFC 9530.
+func formatReprDigest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// parseReprDigest returns the SHA-256 digest in the reprDigestHeader value
+// v, or nil if v is empty or has no SHA-256 digest.
+func parseReprDigest(v string) ([]byte, error) {
+	for _, d := range strings.Split(v, ",") {
+		b64, ok := strings.CutPrefix(strings.TrimSpace(d), "sha-256=:")
+		if !ok {
+			continue
+		}
+		b64, ok = strings.CutSuffix(b64, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s %q", reprDigestHeader, v)
+		}
+		sum, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid %s %q", reprDigestHeader, v)
+		}
+		return sum, nil
+	}
+	return nil, nil
+}
+
+// parseDecodedLength returns the value of the decodedLengthHeader in h,
+// or -1 if there is none.
+func parseDecodedLength(h http.Header) (int64, error) {
+	v := h.Get(decodedLengthHeader)
+	if v == "" {
+		return -1, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", decodedLengthHeader, v)
+	}
+	return n, nil
+}
+
+// sha256Reader returns the SHA-256 of everything read from r.
+func sha256Reader(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// zstdCopy writes the content of r to w, compressed with zstd.
+func zstdCopy(w io.Writer, r io.Reader) error {
+	zw, err := smallzstd.NewEncoder(w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// eofHookReader is a request body that calls onEOF once when it's been
+// read to its end, to set trailers that depend on the body.
+type eofHookReader struct {
+	r     io.Reader
+	onEOF func()
+}
+
+func (r *eofHookReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF && r.onEOF != nil {
+		r.onEOF()
+		r.onEOF = nil
+	}
+	return n, err
+}
@@ -4,6 +4,7 @@
 package taildrop
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"sync"
@@ -58,8 +59,11 @@ func (f *incomingFile) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
-// PutFile stores a file into [manager.Dir] from a given client id.
-// The baseName must be a base filename without any slashes.
+// PutFile stores a file into [manager.Dir] from the given sender, if the
+// receive policy allows it, under the name given by the policy's sort rules.
+// The baseName must be a base filename or, for a file sent as part of a
+// directory, a slash-separated path relative to [manager.Dir] whose parent
+// directories are created as needed.
 // The length is the expected length of content to read from r,
 // it may be negative to indicate that it is unknown.
 // It returns the length of the entire file.
@@ -70,7 +74,13 @@ func (f *incomingFile) Write(p []byte) (n int, err error) {
 // specific partial file. This allows the client to determine whether to resume
 // a partial file. While resuming, PutFile may be called again with a non-zero
 // offset to specify where to resume receiving data at.
-func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, length int64) (fileLength int64, err error) {
+//
+// If wantSum is non-nil, it's called once r has been read to its end and
+// returns the SHA-256 digest the sender sent for the whole file, or nil if
+// it sent none. The file is checked against it before it leaves its partial
+// state; on a mismatch, the partial file is removed, as it can't be resumed,
+// and ErrDigestMismatch is returned.
+func (m *manager) PutFile(from sender, baseName string, r io.Reader, offset, length int64, wantSum func() ([]byte, error)) (fileLength int64, err error) {
 
 	switch {
 	case m == nil || m.opts.fileOps == nil:
@@ -81,15 +91,26 @@ func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, len
 		return 0, ErrNotAccessible
 	}
 
-	if err := validateBaseName(baseName); err != nil {
+	if err := validateFileName(baseName); err != nil {
+		return 0, err
+	}
+	lim, releaseQuota, err := m.admitFile(from, offset, length)
+	if err != nil {
+		m.opts.Logf("put rejected by receive policy: %v", err)
 		return 0, err
 	}
+	var received int64
+	defer func() { releaseQuota(received) }()
+	if lim != nil {
+		lim.r = r
+		r = lim
+	}
 
 	// and make sure we don't delete it while uploading:
 	m.deleter.Remove(baseName)
 
 	// Create (if not already) the partial file with read-write permissions.
-	partialName := baseName + id.partialSuffix()
+	partialName := baseName + from.id.partialSuffix()
 	wc, partialPath, err := m.opts.fileOps.OpenWriter(partialName, offset, 0o666)
 	if err != nil {
 		return 0, m.redactAndLogError("Create", err)
@@ -102,7 +123,7 @@ func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, len
 	}()
 
 	// Check whether there is an in-progress transfer for the file.
-	inFileKey := incomingFileKey{id, baseName}
+	inFileKey := incomingFileKey{from.id, baseName}
 	inFile, loaded := m.incomingFiles.LoadOrInit(inFileKey, func() *incomingFile {
 		inFile := &incomingFile{
 			clock:          m.opts.Clock,
@@ -136,6 +157,15 @@ func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, len
 
 	// Copy the contents of the file to the writer.
 	copyLength, err := io.Copy(wc, r)
+	received = copyLength
+	if lim != nil && lim.rejected(err) {
+		m.opts.Logf("put rejected by receive policy: %v", err)
+		wc.Close()
+		if rmErr := m.opts.fileOps.Remove(partialName); rmErr != nil {
+			m.opts.Logf("put: removing rejected partial file: %v", redactError(rmErr))
+		}
+		return 0, err
+	}
 	if err != nil {
 		return 0, m.redactAndLogError("Copy", err)
 	}
@@ -145,6 +175,20 @@ func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, len
 	if err := wc.Close(); err != nil {
 		return 0, m.redactAndLogError("Close", err)
 	}
+	if wantSum != nil {
+		sum, err := wantSum()
+		if err != nil {
+			return 0, err
+		}
+		if sum != nil {
+			if err := m.checkPartialSum(partialName, sum); err != nil {
+				if rmErr := m.opts.fileOps.Remove(partialName); rmErr != nil {
+					m.opts.Logf("put: removing corrupt partial file: %v", redactError(rmErr))
+				}
+				return 0, err
+			}
+		}
+	}
 
 	fileLength = offset + copyLength
 
@@ -153,7 +197,7 @@ func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, len
 	inFile.mu.Unlock()
 
 	// 6) Finalize (rename/move) the partial into place via FileOps.Rename
-	finalPath, err := m.opts.fileOps.Rename(partialPath, baseName)
+	finalPath, err := m.opts.fileOps.Rename(partialPath, m.sortedName(from, baseName))
 	if err != nil {
 		return 0, m.redactAndLogError("Rename", err)
 	}
@@ -164,6 +208,25 @@ func (m *manager) PutFile(id clientID, baseName string, r io.Reader, offset, len
 	return fileLength, nil
 }
 
+// checkPartialSum checks the content of the partial file partialName against
+// the SHA-256 digest want.
+func (m *manager) checkPartialSum(partialName string, want []byte) error {
+	rc, err := m.opts.fileOps.OpenReader(partialName)
+	if err != nil {
+		return m.redactAndLogError("Verify", err)
+	}
+	defer rc.Close()
+	got, err := sha256Reader(rc)
+	if err != nil {
+		return m.redactAndLogError("Verify", err)
+	}
+	if !bytes.Equal(got, want) {
+		m.opts.Logf("put Verify error: %v", ErrDigestMismatch)
+		return ErrDigestMismatch
+	}
+	return nil
+}
+
 func (m *manager) redactAndLogError(stage string, err error) error {
 	err = redactError(err)
 	m.opts.Logf("put %s error: %v", stage, err)
@@ -6,6 +6,7 @@
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
@@ -37,7 +38,7 @@ func TestPutFile(t *testing.T) {
 			}.New()
 
 			id := clientID("0")
-			n, err := mgr.PutFile(id, "file.txt", strings.NewReader(content), 0, int64(len(content)))
+			n, err := mgr.PutFile(sender{id: id}, "file.txt", strings.NewReader(content), 0, int64(len(content)), nil)
 			if err != nil {
 				t.Fatalf("PutFile error: %v", err)
 			}
@@ -67,3 +68,53 @@ func TestPutFile(t *testing.T) {
 		})
 	}
 }
+
+func TestPutFileInDir(t *testing.T) {
+	dir := t.TempDir()
+	mgr := managerOptions{
+		Logf:           t.Logf,
+		Clock:          tstime.DefaultClock{},
+		fileOps:        must.Get(newFileOps(dir)),
+		SendFileNotify: func() {},
+	}.New()
+	defer mgr.Shutdown()
+
+	id := clientID("0")
+	for _, name := range []string{"out/a.txt", "out/sub/b.txt"} {
+		if _, err := mgr.PutFile(sender{id: id}, name, strings.NewReader(name), 0, int64(len(name)), nil); err != nil {
+			t.Fatalf("PutFile(%q): %v", name, err)
+		}
+	}
+	if _, err := mgr.PutFile(sender{id: id}, "out/../c.txt", strings.NewReader("c"), 0, 1, nil); err != ErrInvalidFileName {
+		t.Errorf("PutFile with dot-dot = %v; want %v", err, ErrInvalidFileName)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "out", "sub", "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "out/sub/b.txt" {
+		t.Errorf("file contents = %q; want %q", got, "out/sub/b.txt")
+	}
+
+	wfs, err := mgr.WaitingFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, wf := range wfs {
+		names = append(names, wf.Name)
+	}
+	if want := []string{"out/a.txt", "out/sub/b.txt"}; !slices.Equal(names, want) {
+		t.Errorf("WaitingFiles = %q; want %q", names, want)
+	}
+
+	for _, name := range names {
+		if err := mgr.DeleteFile(name); err != nil {
+			t.Fatalf("DeleteFile(%q): %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out")); !os.IsNotExist(err) {
+		t.Errorf("directory left behind after deleting its files: %v", err)
+	}
+}
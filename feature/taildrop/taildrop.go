@@ -19,10 +19,12 @@
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"unicode"
 	"unicode/utf8"
 
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/syncs"
 	"tailscale.com/tstime"
@@ -109,6 +111,12 @@ type manager struct {
 	// emptySince specifies that there were no waiting files
 	// since this value of totalReceived.
 	emptySince atomic.Int64
+
+	// policy is the receive policy, or nil to accept all files.
+	policy atomic.Pointer[apitype.TaildropReceivePolicy]
+
+	quotaMu sync.Mutex
+	usage   map[clientID]*senderUsage // by sender, for policy.SenderDailyQuota
 }
 
 // New initializes a new taildrop manager.
@@ -182,6 +190,31 @@ func validateBaseName(name string) error {
 	return nil
 }
 
+const (
+	// maxNameDepth is the maximum number of elements in a file name sent
+	// as part of a directory, such as "dir/sub/file.txt".
+	maxNameDepth = 32
+
+	// maxNameLen is the maximum length of such a name.
+	maxNameLen = 4096
+)
+
+// validateFileName validates the name of an incoming file, which is
+// either a base name or, for files sent as part of a directory, a
+// slash-separated path relative to the Taildrop directory, each element
+// of which must be a valid base name.
+func validateFileName(name string) error {
+	if len(name) > maxNameLen || strings.Count(name, "/") >= maxNameDepth {
+		return ErrInvalidFileName
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if err := validateBaseName(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // IncomingFiles returns a list of active incoming files.
 func (m *manager) IncomingFiles() []ipn.PartialFile {
 	// Make sure we always set n.IncomingFiles non-nil so it gets encoded
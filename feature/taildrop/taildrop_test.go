@@ -63,3 +63,33 @@ func TestValidateBaseName(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateFileName(t *testing.T) {
+	tests := []struct {
+		in     string
+		wantOk bool
+	}{
+		{"", false},
+		{"foo", true},
+		{"foo/bar", true},
+		{"foo/bar/😋.txt", true},
+		{"/foo", false},
+		{"foo/", false},
+		{"foo//bar", false},
+		{"./foo", false},
+		{"foo/./bar", false},
+		{"foo/../bar", false},
+		{"foo.partial/bar", false},
+		{"foo/bar.partial", false},
+		{"foo\\bar", false},
+		{strings.Repeat("a/", maxNameDepth) + "a", false},
+		{strings.Repeat("a/", maxNameDepth-1) + "a", true},
+	}
+	for _, tt := range tests {
+		err := validateFileName(tt.in)
+		gotOk := err == nil
+		if gotOk != tt.wantOk {
+			t.Errorf("validateFileName(%q) = %v, wantOk = %v", tt.in, err, tt.wantOk)
+		}
+	}
+}
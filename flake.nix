@@ -148,5 +148,5 @@
     });
   };
 }
-# nix-direnv cache busting line: sha256-8aE6dWMkTLdWRD9WnLVSzpOQQh61voEnjZAJHtbGCSs=
+# nix-direnv cache busting line: sha256-2drupMmHELGa+TSE3fPpz8vrG3DcBPUmpukyuegcuoA=
 
@@ -68,6 +68,7 @@ require (
 	github.com/mdlayher/sdnotify v1.0.0
 	github.com/miekg/dns v1.1.58
 	github.com/mitchellh/go-ps v1.0.0
+	github.com/parquet-go/parquet-go v0.25.1
 	github.com/peterbourgon/ff/v3 v3.4.0
 	github.com/pkg/errors v0.9.1
 	github.com/pkg/sftp v1.13.6
@@ -119,7 +119,7 @@ func (src *ServeConfig) Clone() *ServeConfig {
 			if v == nil {
 				dst.TCP[k] = nil
 			} else {
-				dst.TCP[k] = ptr.To(*v)
+				dst.TCP[k] = v.Clone()
 			}
 		}
 	}
@@ -181,7 +181,7 @@ func (src *ServiceConfig) Clone() *ServiceConfig {
 			if v == nil {
 				dst.TCP[k] = nil
 			} else {
-				dst.TCP[k] = ptr.To(*v)
+				dst.TCP[k] = v.Clone()
 			}
 		}
 	}
@@ -213,15 +213,18 @@ func (src *TCPPortHandler) Clone() *TCPPortHandler {
 	}
 	dst := new(TCPPortHandler)
 	*dst = *src
+	dst.TCPForwardBackends = append(src.TCPForwardBackends[:0:0], src.TCPForwardBackends...)
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _TCPPortHandlerCloneNeedsRegeneration = TCPPortHandler(struct {
-	HTTPS        bool
-	HTTP         bool
-	TCPForward   string
-	TerminateTLS string
+	HTTPS              bool
+	HTTP               bool
+	TCPForward         string
+	TerminateTLS       string
+	TCPForwardBackends []string
+	LoadBalance        string
 }{})
 
 // Clone makes a deep copy of HTTPHandler.
@@ -232,14 +235,35 @@ func (src *HTTPHandler) Clone() *HTTPHandler {
 	}
 	dst := new(HTTPHandler)
 	*dst = *src
+	dst.SetRequestHeaders = maps.Clone(src.SetRequestHeaders)
+	dst.RemoveRequestHeaders = append(src.RemoveRequestHeaders[:0:0], src.RemoveRequestHeaders...)
+	dst.SetResponseHeaders = maps.Clone(src.SetResponseHeaders)
+	dst.RemoveResponseHeaders = append(src.RemoveResponseHeaders[:0:0], src.RemoveResponseHeaders...)
+	dst.AllowCaps = append(src.AllowCaps[:0:0], src.AllowCaps...)
+	dst.AllowTags = append(src.AllowTags[:0:0], src.AllowTags...)
+	dst.AllowLogins = append(src.AllowLogins[:0:0], src.AllowLogins...)
+	dst.Backends = append(src.Backends[:0:0], src.Backends...)
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerCloneNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path                  string
+	Proxy                 string
+	Text                  string
+	Redirect              string
+	Status                int
+	KeepPrefix            bool
+	SetRequestHeaders     map[string]string
+	RemoveRequestHeaders  []string
+	SetResponseHeaders    map[string]string
+	RemoveResponseHeaders []string
+	AllowCaps             []tailcfg.PeerCapability
+	AllowTags             []string
+	AllowLogins           []string
+	Backends              []string
+	LoadBalance           string
+	HealthCheckPath       string
 }{})
 
 // Clone makes a deep copy of WebServerConfig.
@@ -256,7 +280,7 @@ func (src *WebServerConfig) Clone() *WebServerConfig {
 			if v == nil {
 				dst.Handlers[k] = nil
 			} else {
-				dst.Handlers[k] = ptr.To(*v)
+				dst.Handlers[k] = v.Clone()
 			}
 		}
 	}
@@ -807,12 +807,27 @@ func (v TCPPortHandlerView) TCPForward() string { return v.ж.TCPForward }
 // (the HTTPS mode uses ServeConfig.Web)
 func (v TCPPortHandlerView) TerminateTLS() string { return v.ж.TerminateTLS }
 
+// TCPForwardBackends optionally lists further IP:port addresses to
+// forward TCP connections to. If non-empty, connections are spread
+// across TCPForward and TCPForwardBackends according to LoadBalance,
+// skipping backends that fail health checks.
+func (v TCPPortHandlerView) TCPForwardBackends() views.Slice[string] {
+	return views.SliceOf(v.ж.TCPForwardBackends)
+}
+
+// LoadBalance is the policy used to pick a backend when
+// TCPForwardBackends is non-empty. See LoadBalanceRoundRobin and
+// LoadBalanceLeastConn. If empty, LoadBalanceRoundRobin is used.
+func (v TCPPortHandlerView) LoadBalance() string { return v.ж.LoadBalance }
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _TCPPortHandlerViewNeedsRegeneration = TCPPortHandler(struct {
-	HTTPS        bool
-	HTTP         bool
-	TCPForward   string
-	TerminateTLS string
+	HTTPS              bool
+	HTTP               bool
+	TCPForward         string
+	TerminateTLS       string
+	TCPForwardBackends []string
+	LoadBalance        string
 }{})
 
 // View returns a read-only view of HTTPHandler.
@@ -891,11 +906,89 @@ func (v HTTPHandlerView) Proxy() string { return v.ж.Proxy }
 // plaintext to serve (primarily for testing)
 func (v HTTPHandlerView) Text() string { return v.ж.Text }
 
+// Redirect is the URL to redirect requests to. Any "${REQUEST_URI}"
+// in it is replaced by the path and query of the incoming request.
+func (v HTTPHandlerView) Redirect() string { return v.ж.Redirect }
+
+// Status is the HTTP status code to respond with when serving Text or
+// Redirect. If zero, it defaults to 200 for Text and 302 for Redirect.
+// If Status is set and none of the fields above are, the handler
+// responds with just the status code.
+func (v HTTPHandlerView) Status() int { return v.ж.Status }
+
+// KeepPrefix, if true, means that Proxy requests are forwarded with
+// their full path. By default the mount point is stripped from the path.
+func (v HTTPHandlerView) KeepPrefix() bool { return v.ж.KeepPrefix }
+
+// SetRequestHeaders are headers to set on requests forwarded to Proxy,
+// replacing any existing values.
+func (v HTTPHandlerView) SetRequestHeaders() views.Map[string, string] {
+	return views.MapOf(v.ж.SetRequestHeaders)
+}
+
+// RemoveRequestHeaders are headers to remove from requests forwarded to
+// Proxy, including the Tailscale-User-* identity headers.
+func (v HTTPHandlerView) RemoveRequestHeaders() views.Slice[string] {
+	return views.SliceOf(v.ж.RemoveRequestHeaders)
+}
+
+// SetResponseHeaders are headers to set on responses, replacing any
+// existing values.
+func (v HTTPHandlerView) SetResponseHeaders() views.Map[string, string] {
+	return views.MapOf(v.ж.SetResponseHeaders)
+}
+
+// RemoveResponseHeaders are headers to remove from responses.
+func (v HTTPHandlerView) RemoveResponseHeaders() views.Slice[string] {
+	return views.SliceOf(v.ж.RemoveResponseHeaders)
+}
+
+// AllowCaps, AllowTags and AllowLogins restrict which tailnet peers may
+// use the handler. If any of them is non-empty, a request is only served
+// if the peer making it has one of the AllowCaps peer capabilities, has
+// one of the AllowTags tags, or (for untagged nodes) is logged in as one
+// of the AllowLogins users. Other requests, including all Funnel
+// requests, get a 403 Forbidden response.
+func (v HTTPHandlerView) AllowCaps() views.Slice[tailcfg.PeerCapability] {
+	return views.SliceOf(v.ж.AllowCaps)
+}
+func (v HTTPHandlerView) AllowTags() views.Slice[string]   { return views.SliceOf(v.ж.AllowTags) }
+func (v HTTPHandlerView) AllowLogins() views.Slice[string] { return views.SliceOf(v.ж.AllowLogins) }
+
+// Backends optionally lists further proxy targets, in the same forms as
+// Proxy. If non-empty, requests are spread across Proxy and Backends
+// according to LoadBalance, skipping backends that fail health checks.
+func (v HTTPHandlerView) Backends() views.Slice[string] { return views.SliceOf(v.ж.Backends) }
+
+// LoadBalance is the policy used to pick a backend when Backends is
+// non-empty. See LoadBalanceRoundRobin and LoadBalanceLeastConn. If
+// empty, LoadBalanceRoundRobin is used.
+func (v HTTPHandlerView) LoadBalance() string { return v.ж.LoadBalance }
+
+// HealthCheckPath, if non-empty, is the path that is periodically
+// requested from each of Proxy and Backends to check their health. A
+// backend is healthy if it responds with a 2xx or 3xx status. If empty,
+// backends are healthy if they accept TCP connections.
+func (v HTTPHandlerView) HealthCheckPath() string { return v.ж.HealthCheckPath }
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerViewNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path                  string
+	Proxy                 string
+	Text                  string
+	Redirect              string
+	Status                int
+	KeepPrefix            bool
+	SetRequestHeaders     map[string]string
+	RemoveRequestHeaders  []string
+	SetResponseHeaders    map[string]string
+	RemoveResponseHeaders []string
+	AllowCaps             []tailcfg.PeerCapability
+	AllowTags             []string
+	AllowLogins           []string
+	Backends              []string
+	LoadBalance           string
+	HealthCheckPath       string
 }{})
 
 // View returns a read-only view of WebServerConfig.
@@ -0,0 +1,149 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/dns/resolver"
+)
+
+// WatchDNSQueries calls fn with each DNS query answered by the internal DNS
+// forwarder that match accepts, or every query if match is nil, until ctx is
+// done or fn returns an error. match must not block.
+//
+// Matching queries are passed to fn at a limited rate. If fn falls behind,
+// queries are dropped rather than delaying their answers; either way, the
+// dropped queries are counted in the next entry.
+func (b *LocalBackend) WatchDNSQueries(ctx context.Context, match func(apitype.DNSQueryLogEntry) bool, fn func(apitype.DNSQueryLogEntry) error) error {
+	manager, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return errors.New("DNS manager not available")
+	}
+	ch := make(chan resolver.QueryLogEntry, 64)
+	dropped := 0 // only used by the watch func, which isn't called concurrently
+	var matchQuery func(resolver.QueryLogEntry) bool
+	if match != nil {
+		matchQuery = func(e resolver.QueryLogEntry) bool {
+			return match(dnsQueryLogEntry(e, b.flowPeerName))
+		}
+	}
+	unwatch := manager.Resolver().WatchQueries(matchQuery, func(e resolver.QueryLogEntry) {
+		e.Dropped += dropped
+		select {
+		case ch <- e:
+			dropped = 0
+		default:
+			dropped = e.Dropped + 1
+		}
+	})
+	defer unwatch()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e := <-ch:
+			if err := fn(dnsQueryLogEntry(e, b.flowPeerName)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// DNSQueryStats returns counts of the DNS queries answered by the internal
+// DNS forwarder.
+func (b *LocalBackend) DNSQueryStats() (*apitype.DNSQueryStatsResponse, error) {
+	manager, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return nil, errors.New("DNS manager not available")
+	}
+	byRoute, byClient := manager.Resolver().QueryStats()
+	return dnsQueryStats(byRoute, byClient, b.flowPeerName), nil
+}
+
+// dnsQueryLogEntry returns e as an API log entry, naming the peer it's from
+// with peerName.
+func dnsQueryLogEntry(e resolver.QueryLogEntry, peerName func(netip.Addr) string) apitype.DNSQueryLogEntry {
+	le := apitype.DNSQueryLogEntry{
+		Time:       e.Time,
+		From:       e.From,
+		Peer:       peerName(e.From.Addr()),
+		ViaPeerAPI: e.ViaPeerAPI,
+		Name:       e.Name,
+		Type:       dnsTypeString(e.Type),
+		Route:      e.Route,
+		Upstream:   e.Upstream,
+		Latency:    e.Latency,
+		Dropped:    e.Dropped,
+	}
+	if e.Err != nil {
+		le.Error = e.Err.Error()
+	} else {
+		le.RCode = dnsRCodeString(e.RCode)
+	}
+	return le
+}
+
+// dnsQueryStats returns the resolver's query stats as an API response,
+// combining the stats of each peer's addresses, as named by peerName.
+func dnsQueryStats(byRoute map[string]resolver.QueryStats, byClient map[netip.Addr]resolver.QueryStats, peerName func(netip.Addr) string) *apitype.DNSQueryStatsResponse {
+	res := &apitype.DNSQueryStatsResponse{
+		ByRoute: make(map[string]apitype.DNSQueryStats, len(byRoute)),
+		ByPeer:  make(map[string]apitype.DNSQueryStats, len(byClient)),
+	}
+	add := func(m map[string]apitype.DNSQueryStats, k string, s resolver.QueryStats) {
+		cur := m[k]
+		cur.Queries += s.Queries
+		cur.NXDomain += s.NXDomain
+		cur.ServFail += s.ServFail
+		cur.Errors += s.Errors
+		cur.CacheHits += s.CacheHits
+		cur.Latency += s.Latency
+		m[k] = cur
+	}
+	for route, s := range byRoute {
+		add(res.ByRoute, route, s)
+	}
+	for ip, s := range byClient {
+		name := peerName(ip)
+		if name == "" {
+			name = ip.String()
+		}
+		add(res.ByPeer, name, s)
+	}
+	return res
+}
+
+// dnsTypeString returns the name of t as it appears in zone files, like
+// "AAAA", or "TYPE65" for types without one.
+func dnsTypeString(t dnsmessage.Type) string {
+	if s, ok := strings.CutPrefix(t.String(), "Type"); ok {
+		return s
+	}
+	return "TYPE" + t.String()
+}
+
+// dnsRCodeString returns the conventional name of rc, like "NXDOMAIN".
+func dnsRCodeString(rc dnsmessage.RCode) string {
+	switch rc {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	}
+	return "RCODE" + rc.String()
+}
@@ -0,0 +1,82 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/dns/resolver"
+)
+
+func TestDNSQueryLogEntry(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	peer := netip.MustParseAddrPort("100.64.0.2:5353")
+	names := map[netip.Addr]string{peer.Addr(): "peer"}
+	peerName := func(ip netip.Addr) string { return names[ip] }
+
+	tests := []struct {
+		in   resolver.QueryLogEntry
+		want apitype.DNSQueryLogEntry
+	}{
+		{
+			in: resolver.QueryLogEntry{
+				Time: now, From: peer, Name: "example.com.", Type: dnsmessage.TypeAAAA,
+				RCode: dnsmessage.RCodeNameError, Route: "example.com.", Upstream: "10.0.0.1", Latency: time.Millisecond,
+			},
+			want: apitype.DNSQueryLogEntry{
+				Time: now, From: peer, Peer: "peer", Name: "example.com.", Type: "AAAA",
+				RCode: "NXDOMAIN", Route: "example.com.", Upstream: "10.0.0.1", Latency: time.Millisecond,
+			},
+		},
+		{
+			in: resolver.QueryLogEntry{
+				Time: now, From: netip.MustParseAddrPort("127.0.0.1:1234"), Name: "example.com.", Type: 65,
+				Err: errors.New("timeout"), Dropped: 3,
+			},
+			want: apitype.DNSQueryLogEntry{
+				Time: now, From: netip.MustParseAddrPort("127.0.0.1:1234"), Name: "example.com.", Type: "TYPE65",
+				Error: "timeout", Dropped: 3,
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := dnsQueryLogEntry(tt.in, peerName)
+		if diff := cmp.Diff(tt.want, got, cmp.Comparer(func(a, b netip.AddrPort) bool { return a == b })); diff != "" {
+			t.Errorf("entry mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestDNSQueryStats(t *testing.T) {
+	peer4 := netip.MustParseAddr("100.64.0.2")
+	peer6 := netip.MustParseAddr("fd7a:115c:a1e0::2")
+	stranger := netip.MustParseAddr("192.168.1.5")
+	names := map[netip.Addr]string{peer4: "peer", peer6: "peer"}
+	peerName := func(ip netip.Addr) string { return names[ip] }
+
+	got := dnsQueryStats(
+		map[string]resolver.QueryStats{".": {Queries: 5, NXDomain: 1}},
+		map[netip.Addr]resolver.QueryStats{
+			peer4:    {Queries: 2, CacheHits: 1},
+			peer6:    {Queries: 1, Errors: 1},
+			stranger: {Queries: 2, NXDomain: 1},
+		},
+		peerName)
+	want := &apitype.DNSQueryStatsResponse{
+		ByRoute: map[string]apitype.DNSQueryStats{".": {Queries: 5, NXDomain: 1}},
+		ByPeer: map[string]apitype.DNSQueryStats{
+			"peer":        {Queries: 3, CacheHits: 1, Errors: 1},
+			"192.168.1.5": {Queries: 2, NXDomain: 1},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("stats mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
+	"tailscale.com/util/dnsname"
+)
+
+// localDNSRecordsFile is the path of a file of DNS records for
+// 100.100.100.100 to answer, in addition to those from the netmap. It's
+// checked for changes every dnsRecordsPollInterval.
+//
+// Each line of the file is a record, as a name, a record type and its
+// value, separated by whitespace:
+//
+//	grafana.internal         CNAME  monitoring.example.ts.net
+//	db.internal              A      10.0.0.5
+//	db.internal              AAAA   fd00::5
+//	_http._tcp.web.internal  SRV    10 5 8080 web.internal
+//	web.internal             TXT    "v=1 owner=infra"
+//
+// SRV values are the priority, weight, port and target. TXT values are
+// the rest of the line, which may be a Go-style quoted string. Blank lines
+// and lines starting with '#' are ignored.
+//
+// A name with a CNAME record can't have other records. Records are only
+// answered for queries that reach 100.100.100.100; names outside the
+// tailnet's DNS routes are only sent there when it's the OS's resolver.
+var localDNSRecordsFile = envknob.RegisterString("TS_DNS_RECORDS_FILE")
+
+// dnsRecordsPollInterval is how often localDNSRecordsFile is checked for
+// changes.
+const dnsRecordsPollInterval = 5 * time.Second
+
+// localDNSRecords are DNS records from localDNSRecordsFile.
+type localDNSRecords struct {
+	hosts   map[dnsname.FQDN][]netip.Addr
+	records map[dnsname.FQDN]resolver.Records
+	n       int // number of records
+}
+
+// addTo adds the records in lr, which may be nil, to dcfg.
+func (lr *localDNSRecords) addTo(dcfg *dns.Config) {
+	if lr == nil || dcfg == nil {
+		return
+	}
+	if len(lr.hosts) > 0 && dcfg.Hosts == nil {
+		dcfg.Hosts = make(map[dnsname.FQDN][]netip.Addr, len(lr.hosts))
+	}
+	for name, ips := range lr.hosts {
+		dcfg.Hosts[name] = append(dcfg.Hosts[name], ips...)
+	}
+	if len(lr.records) > 0 {
+		dcfg.Records = lr.records
+	}
+}
+
+// parseLocalDNSRecords parses a file of DNS records in the format
+// documented at localDNSRecordsFile.
+func parseLocalDNSRecords(r io.Reader) (*localDNSRecords, error) {
+	lr := &localDNSRecords{
+		hosts:   map[dnsname.FQDN][]netip.Addr{},
+		records: map[dnsname.FQDN]resolver.Records{},
+	}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		if err := lr.parseLine(text); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		lr.n++
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for name, rec := range lr.records {
+		if rec.CNAME != "" && (len(rec.TXT) > 0 || len(rec.SRV) > 0 || len(lr.hosts[name]) > 0) {
+			return nil, fmt.Errorf("%s has a CNAME record and other records", name.WithoutTrailingDot())
+		}
+	}
+	return lr, nil
+}
+
+// cutField returns the first whitespace-separated field of s, and the
+// rest of s after the whitespace following it.
+func cutField(s string) (field, rest string) {
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimLeft(s[i:], " \t")
+}
+
+func (lr *localDNSRecords) parseLine(text string) error {
+	rawName, rest := cutField(text)
+	typ, value := cutField(rest)
+	if value == "" {
+		return errors.New("want a name, record type and value")
+	}
+	name, err := dnsname.ToFQDN(strings.ToLower(rawName))
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return errors.New("records for the root domain aren't supported")
+	}
+
+	rec := lr.records[name]
+	switch strings.ToUpper(typ) {
+	case "A", "AAAA":
+		ip, err := netip.ParseAddr(value)
+		if err != nil {
+			return err
+		}
+		if want4 := strings.EqualFold(typ, "A"); ip.Is4() != want4 || ip.Is4In6() || ip.Zone() != "" {
+			return fmt.Errorf("%s isn't a valid %s record address", value, strings.ToUpper(typ))
+		}
+		lr.hosts[name] = append(lr.hosts[name], ip)
+		return nil
+	case "CNAME":
+		if rec.CNAME != "" {
+			return fmt.Errorf("%s has more than one CNAME record", name.WithoutTrailingDot())
+		}
+		target, err := dnsname.ToFQDN(strings.ToLower(value))
+		if err != nil {
+			return err
+		}
+		rec.CNAME = target
+	case "TXT":
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return fmt.Errorf("invalid quoted TXT value: %w", err)
+			}
+		}
+		if len(value) > 255 {
+			return errors.New("TXT value is longer than 255 bytes")
+		}
+		rec.TXT = append(rec.TXT, value)
+	case "SRV":
+		f := strings.Fields(value)
+		if len(f) != 4 {
+			return errors.New("want an SRV value of priority, weight, port and target")
+		}
+		var nums [3]uint16
+		for i := range nums {
+			n, err := strconv.ParseUint(f[i], 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid SRV value: %w", err)
+			}
+			nums[i] = uint16(n)
+		}
+		target, err := dnsname.ToFQDN(strings.ToLower(f[3]))
+		if err != nil {
+			return err
+		}
+		rec.SRV = append(rec.SRV, &net.SRV{
+			Priority: nums[0],
+			Weight:   nums[1],
+			Port:     nums[2],
+			Target:   target.WithTrailingDot(),
+		})
+	default:
+		return fmt.Errorf("unsupported record type %q", typ)
+	}
+	lr.records[name] = rec
+	return nil
+}
+
+// watchLocalDNSRecordsFile loads the DNS records in the file at path, and
+// reloads them whenever the file changes, until ctx is done.
+func (b *LocalBackend) watchLocalDNSRecordsFile(ctx context.Context, path string) {
+	ticker, tickc := b.clock.NewTicker(dnsRecordsPollInterval)
+	defer ticker.Stop()
+
+	var (
+		exists   bool // whether the file existed when last checked
+		lastMod  time.Time
+		lastSize int64
+	)
+	for first := true; ; first = false {
+		fi, err := os.Stat(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if exists || first {
+				b.logf("dns records: %s doesn't exist; serving no local records", path)
+			}
+			if exists {
+				b.setLocalDNSRecords(nil)
+			}
+			exists = false
+		case err != nil:
+			b.logf("dns records: %v", err)
+		case !exists || !fi.ModTime().Equal(lastMod) || fi.Size() != lastSize:
+			exists, lastMod, lastSize = true, fi.ModTime(), fi.Size()
+			if lr, err := loadLocalDNSRecords(path); err != nil {
+				b.logf("dns records: %s: %v; keeping the previous records", path, err)
+			} else {
+				b.logf("dns records: loaded %d records from %s", lr.n, path)
+				b.setLocalDNSRecords(lr)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tickc:
+		}
+	}
+}
+
+func loadLocalDNSRecords(path string) (*localDNSRecords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseLocalDNSRecords(f)
+}
+
+// setLocalDNSRecords sets the local DNS records for 100.100.100.100 to
+// answer, and reconfigures DNS with them.
+func (b *LocalBackend) setLocalDNSRecords(lr *localDNSRecords) {
+	b.mu.Lock()
+	b.localDNSRecords = lr
+	b.mu.Unlock()
+	b.authReconfig()
+}
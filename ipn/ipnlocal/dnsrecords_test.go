@@ -0,0 +1,99 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
+	"tailscale.com/util/dnsname"
+)
+
+func TestParseLocalDNSRecords(t *testing.T) {
+	const file = `
+# Monitoring.
+Grafana.Internal         CNAME  monitoring.example.ts.net
+db.internal              A      10.0.0.5
+db.internal.             aaaa   fd00::5
+_http._tcp.web.internal  SRV    10 5 8080 web.internal
+web.internal             TXT    "v=1 owner=infra"
+web.internal             TXT    plain text
+`
+	lr, err := parseLocalDNSRecords(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lr.n != 6 {
+		t.Errorf("parsed %d records; want 6", lr.n)
+	}
+	wantHosts := map[dnsname.FQDN][]netip.Addr{
+		"db.internal.": {netip.MustParseAddr("10.0.0.5"), netip.MustParseAddr("fd00::5")},
+	}
+	if diff := cmp.Diff(wantHosts, lr.hosts, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+		t.Errorf("hosts mismatch (-want +got):\n%s", diff)
+	}
+	wantRecords := map[dnsname.FQDN]resolver.Records{
+		"grafana.internal.":        {CNAME: "monitoring.example.ts.net."},
+		"_http._tcp.web.internal.": {SRV: []*net.SRV{{Priority: 10, Weight: 5, Port: 8080, Target: "web.internal."}}},
+		"web.internal.":            {TXT: []string{"v=1 owner=infra", "plain text"}},
+	}
+	if diff := cmp.Diff(wantRecords, lr.records); diff != "" {
+		t.Errorf("records mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseLocalDNSRecordsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"missing-value", "db.internal A"},
+		{"bad-type", "db.internal MX 10 mail.internal"},
+		{"bad-ip", "db.internal A 10.0.0"},
+		{"ipv6-in-a", "db.internal A fd00::5"},
+		{"ipv4-in-aaaa", "db.internal AAAA 10.0.0.5"},
+		{"short-srv", "_x._tcp.internal SRV 10 5 web.internal"},
+		{"bad-srv-port", "_x._tcp.internal SRV 10 5 99999 web.internal"},
+		{"bad-quoted-txt", `web.internal TXT "unterminated`},
+		{"long-txt", "web.internal TXT " + strings.Repeat("x", 256)},
+		{"two-cnames", "a.internal CNAME b.internal\na.internal CNAME c.internal"},
+		{"cname-and-a", "a.internal CNAME b.internal\na.internal A 10.0.0.1"},
+		{"root", ". A 10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseLocalDNSRecords(strings.NewReader(tt.file)); err == nil {
+				t.Error("got nil error")
+			}
+		})
+	}
+}
+
+func TestLocalDNSRecordsAddTo(t *testing.T) {
+	lr, err := parseLocalDNSRecords(strings.NewReader("node.ts.net A 10.0.0.5\nweb.internal TXT hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcfg := &dns.Config{
+		Hosts: map[dnsname.FQDN][]netip.Addr{"node.ts.net.": {netip.MustParseAddr("100.64.0.1")}},
+	}
+	lr.addTo(dcfg)
+	want := &dns.Config{
+		Hosts: map[dnsname.FQDN][]netip.Addr{
+			"node.ts.net.": {netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("10.0.0.5")},
+		},
+		Records: map[dnsname.FQDN]resolver.Records{"web.internal.": {TXT: []string{"hello"}}},
+	}
+	if diff := cmp.Diff(want, dcfg, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+		t.Errorf("config mismatch (-want +got):\n%s", diff)
+	}
+
+	// A nil set of records is a no-op.
+	(*localDNSRecords)(nil).addTo(dcfg)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"net/netip"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/netlogtype"
+)
+
+// WatchFlows calls fn with the traffic through this node every time it's
+// aggregated for network logging, whether or not network logging is
+// enabled, until ctx is done or fn returns an error.
+//
+// If fn falls behind, traffic is dropped rather than blocking the data path.
+func (b *LocalBackend) WatchFlows(ctx context.Context, fn func([]apitype.Flow) error) error {
+	ch := make(chan netlogtype.Message, 16)
+	unwatch := b.e.WatchFlows(func(m netlogtype.Message) {
+		select {
+		case ch <- m:
+		default:
+		}
+	})
+	defer unwatch()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-ch:
+			if err := fn(flowsFromMessage(m, b.flowPeerName)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flowPeerName returns the name of the peer that ip is routed to, or the
+// empty string if it's this node or unknown.
+func (b *LocalBackend) flowPeerName(ip netip.Addr) string {
+	if !ip.IsValid() {
+		return ""
+	}
+	p, ok := b.e.PeerForIP(ip)
+	if !ok || p.IsSelf {
+		return ""
+	}
+	return p.Node.ComputedName()
+}
+
+// flowsFromMessage returns the traffic in m as flows, naming the peer of each
+// with peerName.
+func flowsFromMessage(m netlogtype.Message, peerName func(netip.Addr) string) []apitype.Flow {
+	var flows []apitype.Flow
+	add := func(kind string, ccs []netlogtype.ConnectionCounts) {
+		for _, cc := range ccs {
+			f := apitype.Flow{
+				Start:     m.Start,
+				End:       m.End,
+				Kind:      kind,
+				Proto:     cc.Proto,
+				Src:       cc.Src,
+				Dst:       cc.Dst,
+				TxPackets: cc.TxPackets,
+				TxBytes:   cc.TxBytes,
+				RxPackets: cc.RxPackets,
+				RxBytes:   cc.RxBytes,
+			}
+			if kind == "physical" {
+				// The source is the peer's Tailscale IP.
+				f.Peer = peerName(cc.Src.Addr())
+			} else if f.Peer = peerName(cc.Dst.Addr()); f.Peer == "" {
+				// Traffic is from this node's perspective, but when
+				// this node is a subnet router or exit node, the
+				// source is the peer.
+				f.Peer = peerName(cc.Src.Addr())
+			}
+			flows = append(flows, f)
+		}
+	}
+	add("virtual", m.VirtualTraffic)
+	add("subnet", m.SubnetTraffic)
+	add("exit", m.ExitTraffic)
+	add("physical", m.PhysicalTraffic)
+	return flows
+}
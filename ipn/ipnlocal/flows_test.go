@@ -0,0 +1,70 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+func TestFlowsFromMessage(t *testing.T) {
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	end := start.Add(5 * time.Second)
+	var (
+		self     = netip.MustParseAddr("100.64.0.1")
+		peer     = netip.MustParseAddr("100.64.0.2")
+		subnet   = netip.MustParseAddr("10.0.0.5")
+		endpoint = netip.MustParseAddrPort("203.0.113.7:41641")
+	)
+	names := map[netip.Addr]string{peer: "peer"}
+	peerName := func(ip netip.Addr) string { return names[ip] }
+
+	m := netlogtype.Message{
+		Start: start,
+		End:   end,
+		VirtualTraffic: []netlogtype.ConnectionCounts{{
+			Connection: netlogtype.Connection{Proto: ipproto.TCP, Src: netip.AddrPortFrom(self, 1234), Dst: netip.AddrPortFrom(peer, 22)},
+			Counts:     netlogtype.Counts{TxPackets: 1, TxBytes: 100, RxPackets: 2, RxBytes: 200},
+		}},
+		SubnetTraffic: []netlogtype.ConnectionCounts{{
+			// This node is a subnet router for the peer.
+			Connection: netlogtype.Connection{Proto: ipproto.UDP, Src: netip.AddrPortFrom(subnet, 53), Dst: netip.AddrPortFrom(peer, 5353)},
+			Counts:     netlogtype.Counts{TxPackets: 1, TxBytes: 60},
+		}},
+		PhysicalTraffic: []netlogtype.ConnectionCounts{{
+			Connection: netlogtype.Connection{Src: netip.AddrPortFrom(peer, 0), Dst: endpoint},
+			Counts:     netlogtype.Counts{TxPackets: 2, TxBytes: 300, RxPackets: 2, RxBytes: 400},
+		}},
+	}
+	got := flowsFromMessage(m, peerName)
+	want := []apitype.Flow{
+		{
+			Start: start, End: end, Kind: "virtual",
+			Proto: ipproto.TCP, Src: netip.AddrPortFrom(self, 1234), Dst: netip.AddrPortFrom(peer, 22),
+			TxPackets: 1, TxBytes: 100, RxPackets: 2, RxBytes: 200,
+			Peer: "peer",
+		},
+		{
+			Start: start, End: end, Kind: "subnet",
+			Proto: ipproto.UDP, Src: netip.AddrPortFrom(subnet, 53), Dst: netip.AddrPortFrom(peer, 5353),
+			TxPackets: 1, TxBytes: 60,
+			Peer: "peer",
+		},
+		{
+			Start: start, End: end, Kind: "physical",
+			Src: netip.AddrPortFrom(peer, 0), Dst: endpoint,
+			TxPackets: 2, TxBytes: 300, RxPackets: 2, RxBytes: 400,
+			Peer: "peer",
+		},
+	}
+	if diff := cmp.Diff(want, got, cmp.Comparer(func(a, b netip.AddrPort) bool { return a == b })); diff != "" {
+		t.Errorf("flows mismatch (-want +got):\n%s", diff)
+	}
+}
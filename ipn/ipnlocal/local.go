@@ -320,6 +320,10 @@ type LocalBackend struct {
 	//lint:ignore U1000 only used in Linux and Windows builds in autoupdate.go
 	offlineAutoUpdateCancel func()
 
+	// localDNSRecords are the DNS records from localDNSRecordsFile, or
+	// nil if there are none.
+	localDNSRecords *localDNSRecords
+
 	// ServeConfig fields. (also guarded by mu)
 	lastServeConfJSON mem.RO                   // last JSON that was parsed into serveConfig
 	serveConfig       ipn.ServeConfigView      // or !Valid if none
@@ -330,6 +334,7 @@ type LocalBackend struct {
 
 	serveListeners     map[netip.AddrPort]*localListener // listeners for local serve traffic
 	serveProxyHandlers sync.Map                          // string (HTTPHandler.Proxy) => *reverseProxy
+	serveBackendPools  sync.Map                          // string (backendPoolKey) => *backendPool
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -595,6 +600,10 @@ func NewLocalBackend(logf logger.Logf, logID logid.PublicID, sys *tsd.System, lo
 	ec := b.Sys().Bus.Get().Client("ipnlocal.LocalBackend")
 	b.eventSubs = ec.Monitor(b.consumeEventbusTopics(ec))
 
+	if path := localDNSRecordsFile(); path != "" {
+		b.goTracker.Go(func() { b.watchLocalDNSRecordsFile(b.ctx, path) })
+	}
+
 	return b, nil
 }
 
@@ -1231,6 +1240,7 @@ func (b *LocalBackend) UpdateStatus(sb *ipnstate.StatusBuilder) {
 		}
 		s.Health = b.health.Strings()
 		s.HaveNodeKey = b.hasNodeKeyLocked()
+		s.ServeBackendsDown = b.serveBackendsDown()
 
 		// TODO(bradfitz): move this health check into a health.Warnable
 		// and remove from here.
@@ -4791,6 +4801,9 @@ func (b *LocalBackend) reconfigAppConnectorLocked(nm *netmap.NetworkMap, prefs i
 	}()
 
 	if !prefs.AppConnector().Advertise {
+		if b.appConnector != nil {
+			b.appConnector.Close()
+		}
 		b.appConnector = nil
 		return
 	}
@@ -4810,6 +4823,9 @@ func (b *LocalBackend) reconfigAppConnectorLocked(nm *netmap.NetworkMap, prefs i
 			}
 			storeFunc = b.storeRouteInfo
 		}
+		if b.appConnector != nil {
+			b.appConnector.Close()
+		}
 		b.appConnector = appc.NewAppConnector(b.logf, b, ri, storeFunc)
 	}
 	if nm == nil {
@@ -4830,19 +4846,47 @@ func (b *LocalBackend) reconfigAppConnectorLocked(nm *netmap.NetworkMap, prefs i
 	}
 
 	var (
-		domains []string
-		routes  []netip.Prefix
+		domains     []string
+		routes      []netip.Prefix
+		routeExpiry time.Duration
+		noExpiry    bool           // some attr with domains doesn't expire routes
+		routeLimits map[string]int // by domain; 0 means unlimited
 	)
 	for _, attr := range attrs {
 		if slices.Contains(attr.Connectors, "*") || selfHasTag(attr.Connectors) {
 			domains = append(domains, attr.Domains...)
 			routes = append(routes, attr.Routes...)
+			for _, d := range attr.Domains {
+				n, seen := routeLimits[d]
+				if !seen || (n > 0 && (attr.MaxRoutesPerDomain <= 0 || attr.MaxRoutesPerDomain > n)) {
+					mak.Set(&routeLimits, d, max(attr.MaxRoutesPerDomain, 0))
+				}
+			}
+			if len(attr.Domains) == 0 {
+				continue
+			}
+			d, err := time.ParseDuration(attr.RouteExpiry)
+			if err != nil || d <= 0 {
+				if attr.RouteExpiry != "" {
+					b.logf("invalid app connector routeExpiry %q for %q: %v", attr.RouteExpiry, attr.Name, err)
+				}
+				noExpiry = true
+				continue
+			}
+			routeExpiry = max(routeExpiry, d)
 		}
 	}
+	if noExpiry {
+		routeExpiry = 0
+	}
+	// SetRouteExpiry, unlike most AppConnector methods, is safe to call
+	// with b.mu held.
+	b.appConnector.SetRouteExpiry(appc.RouteExpiry{Lifetime: routeExpiry})
 	slices.Sort(domains)
 	slices.SortFunc(routes, func(i, j netip.Prefix) int { return i.Addr().Compare(j.Addr()) })
 	domains = slices.Compact(domains)
 	routes = slices.Compact(routes)
+	b.appConnector.UpdateDomainRouteLimits(routeLimits)
 	b.appConnector.UpdateDomainsAndRoutes(domains, routes)
 }
 
@@ -4897,6 +4941,9 @@ func (b *LocalBackend) authReconfig() {
 	disableSubnetsIfPAC := cn.SelfHasCap(tailcfg.NodeAttrDisableSubnetsIfPAC)
 	dohURL, dohURLOK := cn.exitNodeCanProxyDNS(prefs.ExitNodeID())
 	dcfg := cn.dnsConfigForNetmap(prefs, b.keyExpired, b.logf, version.OS())
+	if !b.keyExpired {
+		b.localDNSRecords.addTo(dcfg)
+	}
 	// If the current node is an app connector, ensure the app connector machine is started
 	b.reconfigAppConnectorLocked(nm, prefs)
 	closing := b.shutdownCalled
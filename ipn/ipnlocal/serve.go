@@ -8,6 +8,7 @@
 package ipnlocal
 
 import (
+	"cmp"
 	"context"
 	"crypto/sha256"
 	"crypto/tls"
@@ -42,6 +43,7 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/lazy"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/views"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/ctxkey"
 	"tailscale.com/util/mak"
@@ -74,6 +76,14 @@ func init() {
 
 var serveHTTPContextKey ctxkey.Key[*serveHTTPContext]
 
+// serveHandlerContextKey is the context key for the [ipn.HTTPHandlerView]
+// of a request being proxied to a backend.
+var serveHandlerContextKey ctxkey.Key[ipn.HTTPHandlerView]
+
+// serveBackendContextKey is the context key for the load balanced backend
+// that a request is being proxied to.
+var serveBackendContextKey ctxkey.Key[pickedBackend]
+
 type serveHTTPContext struct {
 	SrcAddr       netip.AddrPort
 	ForVIPService tailcfg.ServiceName // "" means local
@@ -305,6 +315,9 @@ func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig, etag string
 		if err := config.CheckValidServicesConfig(); err != nil {
 			return err
 		}
+		if err := config.CheckValidHandlers(); err != nil {
+			return err
+		}
 	}
 
 	nm := b.NetMap()
@@ -553,13 +566,12 @@ func (b *LocalBackend) tcpHandlerForVIPService(dstAddr, srcAddr netip.AddrPort)
 	if backDst := tcph.TCPForward(); backDst != "" {
 		return func(conn net.Conn) error {
 			defer conn.Close()
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			backConn, err := b.dialer.SystemDial(ctx, "tcp", backDst)
-			cancel()
+			backConn, done, err := b.dialServeTCPBackend(tcph)
 			if err != nil {
 				b.logf("localbackend: failed to TCP proxy port %v (from %v) to %s: %v", dport, srcAddr, backDst, err)
 				return nil
 			}
+			defer done()
 			defer backConn.Close()
 			if sni := tcph.TerminateTLS(); sni != "" {
 				conn = tls.Server(conn, &tls.Config{
@@ -640,13 +652,12 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort,
 	if backDst := tcph.TCPForward(); backDst != "" {
 		return func(conn net.Conn) error {
 			defer conn.Close()
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			backConn, err := b.dialer.SystemDial(ctx, "tcp", backDst)
-			cancel()
+			backConn, done, err := b.dialServeTCPBackend(tcph)
 			if err != nil {
 				b.logf("localbackend: failed to TCP proxy port %v (from %v) to %s: %v", dport, srcAddr, backDst, err)
 				return nil
 			}
+			defer done()
 			defer backConn.Close()
 			if sni := tcph.TerminateTLS(); sni != "" {
 				conn = tls.Server(conn, &tls.Config{
@@ -806,7 +817,27 @@ func (rp *reverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.Out.Host = r.In.Host
 		addProxyForwardedHeaders(r)
 		rp.lb.addTailscaleIdentityHeaders(r)
+		if h, ok := serveHandlerContextKey.ValueOk(r.In.Context()); ok {
+			rewriteHeaders(r.Out.Header, h.SetRequestHeaders(), h.RemoveRequestHeaders())
+		}
 	}}
+	if h, ok := serveHandlerContextKey.ValueOk(r.Context()); ok {
+		p.ModifyResponse = func(res *http.Response) error {
+			rewriteHeaders(res.Header, h.SetResponseHeaders(), h.RemoveResponseHeaders())
+			return nil
+		}
+	}
+	if pb, ok := serveBackendContextKey.ValueOk(r.Context()); ok {
+		// Take load balanced backends that can't be reached out of
+		// rotation right away, rather than at their next health check.
+		p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			rp.logf("serve: proxy error: %v", err)
+			if r.Context().Err() == nil {
+				pb.pool.markDown(pb.be, err)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
 
 	// There is no way to autodetect h2c as per RFC 9113
 	// https://datatracker.ietf.org/doc/html/rfc9113#name-starting-http-2.
@@ -935,33 +966,114 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	if s := h.Text(); s != "" {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		io.WriteString(w, s)
-		return
-	}
-	if v := h.Path(); v != "" {
-		b.serveFileOrDirectory(w, r, v, mountPoint)
+	if !b.serveHandlerAllowsPeer(r, h) {
+		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
 	if v := h.Proxy(); v != "" {
+		if h.Backends().Len() > 0 {
+			pool, ok := b.httpBackendPool(h)
+			if !ok {
+				http.Error(w, "unknown proxy destination", http.StatusInternalServerError)
+				return
+			}
+			be := pool.pick()
+			if be == nil {
+				http.Error(w, errNoHealthyBackends.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			defer be.acquire()()
+			v = be.name
+			r = r.WithContext(serveBackendContextKey.WithValue(r.Context(), pickedBackend{pool, be}))
+		}
 		p, ok := b.serveProxyHandlers.Load(v)
 		if !ok {
 			http.Error(w, "unknown proxy destination", http.StatusInternalServerError)
 			return
 		}
-		h := p.(http.Handler)
+		ph := p.(http.Handler)
 		// Trim the mount point from the URL path before proxying. (#6571)
-		if r.URL.Path != "/" {
-			h = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), h)
+		if r.URL.Path != "/" && !h.KeepPrefix() {
+			ph = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), ph)
 		}
-		h.ServeHTTP(w, r)
+		// The reverse proxy applies the handler's header rewrites.
+		r = r.WithContext(serveHandlerContextKey.WithValue(r.Context(), h))
+		ph.ServeHTTP(w, r)
+		return
+	}
+
+	// Proxied responses have their headers rewritten in
+	// [reverseProxy.ServeHTTP]; everything else is done here.
+	rewriteHeaders(w.Header(), h.SetResponseHeaders(), h.RemoveResponseHeaders())
+
+	if v := h.Redirect(); v != "" {
+		code := cmp.Or(h.Status(), http.StatusFound)
+		http.Redirect(w, r, strings.ReplaceAll(v, ipn.RedirectRequestURIVar, r.URL.RequestURI()), code)
+		return
+	}
+	if s := h.Text(); s != "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if code := h.Status(); code != 0 {
+			w.WriteHeader(code)
+		}
+		io.WriteString(w, s)
+		return
+	}
+	if v := h.Path(); v != "" {
+		b.serveFileOrDirectory(w, r, v, mountPoint)
+		return
+	}
+	if code := h.Status(); code != 0 {
+		w.WriteHeader(code)
 		return
 	}
 
 	http.Error(w, "empty handler", 500)
 }
 
+// serveHandlerAllowsPeer reports whether the peer that made r may use h,
+// per h's AllowCaps, AllowTags and AllowLogins.
+func (b *LocalBackend) serveHandlerAllowsPeer(r *http.Request, h ipn.HTTPHandlerView) bool {
+	if !h.RestrictsPeers() {
+		return true
+	}
+	c, ok := serveHTTPContextKey.ValueOk(r.Context())
+	if !ok || c.Funnel != nil {
+		return false
+	}
+	node, user, ok := b.WhoIs("tcp", c.SrcAddr)
+	if !ok {
+		return false
+	}
+	if node.IsTagged() {
+		if node.Tags().ContainsFunc(func(tag string) bool {
+			return views.SliceContains(h.AllowTags(), tag)
+		}) {
+			return true
+		}
+	} else if views.SliceContains(h.AllowLogins(), user.LoginName) {
+		return true
+	}
+	if h.AllowCaps().Len() > 0 {
+		caps := b.PeerCaps(c.SrcAddr.Addr())
+		if h.AllowCaps().ContainsFunc(caps.HasCapability) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteHeaders sets the headers in set on hdr and then removes those in
+// remove from it.
+func rewriteHeaders(hdr http.Header, set views.Map[string, string], remove views.Slice[string]) {
+	for k, v := range set.All() {
+		hdr.Set(k, v)
+	}
+	for _, k := range remove.All() {
+		hdr.Del(k)
+	}
+}
+
 func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string) {
 	fi, err := os.Stat(fileOrDir)
 	if err != nil {
@@ -1114,25 +1226,23 @@ func (b *LocalBackend) setServeProxyHandlersLocked() {
 	var backends map[string]bool
 	for _, conf := range b.serveConfig.Webs() {
 		for _, h := range conf.Handlers().All() {
-			backend := h.Proxy()
-			if backend == "" {
-				// Only create proxy handlers for servers with a proxy backend.
-				continue
-			}
-			mak.Set(&backends, backend, true)
-			if _, ok := b.serveProxyHandlers.Load(backend); ok {
-				continue
-			}
+			// Only create proxy handlers for servers with a proxy backend.
+			for _, backend := range h.ProxyBackends() {
+				mak.Set(&backends, backend, true)
+				if _, ok := b.serveProxyHandlers.Load(backend); ok {
+					continue
+				}
 
-			b.logf("serve: creating a new proxy handler for %s", backend)
-			p, err := b.proxyHandlerForBackend(backend)
-			if err != nil {
-				// The backend endpoint (h.Proxy) should have been validated by expandProxyTarget
-				// in the CLI, so just log the error here.
-				b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
-				continue
+				b.logf("serve: creating a new proxy handler for %s", backend)
+				p, err := b.proxyHandlerForBackend(backend)
+				if err != nil {
+					// The backend endpoint (h.Proxy) should have been validated by expandProxyTarget
+					// in the CLI, so just log the error here.
+					b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
+					continue
+				}
+				b.serveProxyHandlers.Store(backend, p)
 			}
-			b.serveProxyHandlers.Store(backend, p)
 		}
 	}
 
@@ -1300,6 +1410,9 @@ func serveSetTCPPortsInterceptedFromNetmapAndPrefsLocked(b *LocalBackend, prefs
 		}
 	}
 
+	// Called even without a serve config, to stop health checking the
+	// backends of a previous one.
+	b.setServeBackendPoolsLocked()
 	b.setVIPServicesTCPPortsInterceptedLocked(vipServicesPorts)
 
 	return handlePorts
@@ -0,0 +1,405 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !ts_omit_serve
+
+package ipnlocal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
+)
+
+const (
+	// serveHealthCheckInterval is how often serve backends that are load
+	// balanced across are health checked.
+	serveHealthCheckInterval = 10 * time.Second
+
+	// serveHealthCheckTimeout bounds each backend health check.
+	serveHealthCheckTimeout = 3 * time.Second
+
+	// serveUnhealthyThreshold is the number of consecutive failed health
+	// checks or connection attempts after which a backend is no longer
+	// used, until it passes a health check again.
+	serveUnhealthyThreshold = 2
+)
+
+// backendPool spreads connections or requests for one serve handler across
+// its backends, per the handler's load balancing policy, and periodically
+// health checks them.
+type backendPool struct {
+	logf     logger.Logf
+	policy   string // ipn.LoadBalance*; empty means round-robin
+	backends []*poolBackend
+	cancel   context.CancelFunc
+	next     atomic.Uint64 // round-robin position
+}
+
+// poolBackend is one backend of a backendPool.
+type poolBackend struct {
+	name     string       // as configured: an HTTPHandler.Proxy value or an IP:port
+	unix     bool         // whether dialAddr is the path of a Unix socket
+	dialAddr string       // host:port or socket path to check with connects, if checkURL is empty
+	checkURL string       // if non-empty, URL to check with GET requests
+	client   *http.Client // for checkURL; nil otherwise
+
+	active atomic.Int64 // in-flight connections or requests
+
+	mu       sync.Mutex
+	failures int  // consecutive failures
+	down     bool // whether failures reached serveUnhealthyThreshold
+}
+
+// healthy reports whether be should be picked for new connections.
+func (be *poolBackend) healthy() bool {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	return !be.down
+}
+
+// pickedBackend is a backend picked from a pool for an HTTP request.
+type pickedBackend struct {
+	pool *backendPool
+	be   *poolBackend
+}
+
+// acquire records a new connection or request to be and returns the func
+// to call when it's done.
+func (be *poolBackend) acquire() (release func()) {
+	be.active.Add(1)
+	return func() { be.active.Add(-1) }
+}
+
+// backendPoolKey returns the key in LocalBackend.serveBackendPools of the
+// pool for the given backends and settings. See newBackendPool.
+func backendPoolKey(forHTTP bool, policy, healthCheckPath string, backends []string) string {
+	kind := "tcp"
+	if forHTTP {
+		kind = "http"
+	}
+	return kind + "|" + policy + "|" + healthCheckPath + "|" + strings.Join(backends, ",")
+}
+
+// newBackendPool returns a new pool for backends and starts health checking
+// them until ctx is done or the pool is closed.
+//
+// If forHTTP, backends are HTTPHandler.Proxy values and healthCheckPath, if
+// non-empty, is requested from each of them to check their health.
+// Otherwise they are TCP addresses and checked by connecting to them.
+func (b *LocalBackend) newBackendPool(ctx context.Context, forHTTP bool, policy, healthCheckPath string, backends []string) (*backendPool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &backendPool{
+		logf:   logger.WithPrefix(b.logf, "serve: "),
+		policy: policy,
+		cancel: cancel,
+	}
+	for _, name := range backends {
+		// Start one failure short of the threshold, so that backends
+		// failing their first health check aren't used.
+		be := &poolBackend{name: name, dialAddr: name, failures: serveUnhealthyThreshold - 1}
+		if path, ok := strings.CutPrefix(name, "unix:"); ok && forHTTP {
+			be.unix = true
+			be.dialAddr = path
+			if healthCheckPath != "" {
+				be.checkURL = "http://localhost" + healthCheckPath
+				be.client = &http.Client{
+					Transport: &http.Transport{
+						DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+							var d net.Dialer
+							return d.DialContext(ctx, "unix", path)
+						},
+					},
+					CheckRedirect: func(*http.Request, []*http.Request) error {
+						return http.ErrUseLastResponse
+					},
+				}
+			}
+		} else if forHTTP {
+			targetURL, insecure := expandProxyArg(name)
+			u, err := url.Parse(targetURL)
+			if err != nil {
+				cancel()
+				return nil, fmt.Errorf("invalid url %s: %w", targetURL, err)
+			}
+			be.dialAddr = u.Host
+			if u.Port() == "" {
+				port := "80"
+				if u.Scheme == "https" {
+					port = "443"
+				}
+				be.dialAddr = net.JoinHostPort(u.Hostname(), port)
+			}
+			if healthCheckPath != "" {
+				u.Path = healthCheckPath
+				u.RawQuery = ""
+				be.checkURL = u.String()
+				be.client = &http.Client{
+					Transport: &http.Transport{
+						DialContext:     b.dialer.SystemDial,
+						TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+					},
+					CheckRedirect: func(*http.Request, []*http.Request) error {
+						return http.ErrUseLastResponse
+					},
+				}
+			}
+		}
+		p.backends = append(p.backends, be)
+	}
+	b.goTracker.Go(func() { p.checkLoop(ctx, b.dialer.SystemDial) })
+	return p, nil
+}
+
+// close stops health checking the pool's backends.
+func (p *backendPool) close() {
+	p.cancel()
+	for _, be := range p.backends {
+		if be.client != nil {
+			be.client.CloseIdleConnections()
+		}
+	}
+}
+
+// pick returns the backend to use for a new connection or request, or nil
+// if none of the backends are healthy.
+func (p *backendPool) pick() *poolBackend {
+	if p.policy == ipn.LoadBalanceLeastConn {
+		var best *poolBackend
+		for _, be := range p.backends {
+			if be.healthy() && (best == nil || be.active.Load() < best.active.Load()) {
+				best = be
+			}
+		}
+		return best
+	}
+	var healthy []*poolBackend
+	for _, be := range p.backends {
+		if be.healthy() {
+			healthy = append(healthy, be)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	return healthy[(p.next.Add(1)-1)%uint64(len(healthy))]
+}
+
+// record records the result of a health check or connection attempt to be.
+func (p *backendPool) record(be *poolBackend, err error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if err == nil {
+		if be.down {
+			p.logf("backend %s is healthy again", be.name)
+		}
+		be.failures = 0
+		be.down = false
+		return
+	}
+	be.failures++
+	if !be.down && be.failures >= serveUnhealthyThreshold {
+		p.logf("backend %s is unhealthy, no longer using it: %v", be.name, err)
+		be.down = true
+	}
+}
+
+// markDown takes be out of rotation until it next passes a health check,
+// after a connection to it failed with err.
+func (p *backendPool) markDown(be *poolBackend, err error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	be.failures = max(be.failures, serveUnhealthyThreshold)
+	if !be.down {
+		p.logf("backend %s is unhealthy, no longer using it: %v", be.name, err)
+		be.down = true
+	}
+}
+
+// checkLoop health checks all of the pool's backends every
+// serveHealthCheckInterval until ctx is done.
+func (p *backendPool) checkLoop(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	t := time.NewTicker(serveHealthCheckInterval)
+	defer t.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, be := range p.backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := be.check(ctx, dial)
+				if ctx.Err() == nil {
+					p.record(be, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// check checks whether be is healthy, returning a non-nil error if not.
+func (be *poolBackend) check(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, serveHealthCheckTimeout)
+	defer cancel()
+	if be.checkURL == "" {
+		network := "tcp"
+		if be.unix {
+			var d net.Dialer
+			network, dial = "unix", d.DialContext
+		}
+		c, err := dial(ctx, network, be.dialAddr)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", be.checkURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := be.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("health check status %s", res.Status)
+	}
+	return nil
+}
+
+var errNoHealthyBackends = errors.New("no healthy backends")
+
+// serveBackendsDown returns the names of the backends, as configured, that
+// load balancing currently avoids because they're unhealthy.
+func (b *LocalBackend) serveBackendsDown() []string {
+	var down []string
+	b.serveBackendPools.Range(func(_, v any) bool {
+		for _, be := range v.(*backendPool).backends {
+			if !be.healthy() && !slices.Contains(down, be.name) {
+				down = append(down, be.name)
+			}
+		}
+		return true
+	})
+	slices.Sort(down)
+	return down
+}
+
+// httpBackendPool returns the pool for h, which must have Backends.
+func (b *LocalBackend) httpBackendPool(h ipn.HTTPHandlerView) (*backendPool, bool) {
+	p, ok := b.serveBackendPools.Load(backendPoolKey(true, h.LoadBalance(), h.HealthCheckPath(), h.ProxyBackends()))
+	if !ok {
+		return nil, false
+	}
+	return p.(*backendPool), true
+}
+
+// dialServeTCPBackend dials the backend that a connection handled by tcph
+// should be forwarded to: TCPForward, or if tcph has TCPForwardBackends, a
+// healthy one of those picked per its LoadBalance policy. The returned done
+// func must be called once the connection is finished.
+func (b *LocalBackend) dialServeTCPBackend(tcph ipn.TCPPortHandlerView) (_ net.Conn, done func(), _ error) {
+	if tcph.TCPForwardBackends().Len() == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		c, err := b.dialer.SystemDial(ctx, "tcp", tcph.TCPForward())
+		return c, func() {}, err
+	}
+	v, ok := b.serveBackendPools.Load(backendPoolKey(false, tcph.LoadBalance(), "", tcph.ForwardBackends()))
+	if !ok {
+		return nil, nil, errors.New("unknown backend pool")
+	}
+	p := v.(*backendPool)
+	// Try each backend at most once, so that connections don't fail
+	// because of backends that went down since they were last checked.
+	var lastErr error = errNoHealthyBackends
+	for range p.backends {
+		be := p.pick()
+		if be == nil {
+			break
+		}
+		release := be.acquire()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		c, err := b.dialer.SystemDial(ctx, "tcp", be.name)
+		cancel()
+		if err == nil {
+			p.record(be, nil)
+			return c, release, nil
+		}
+		release()
+		lastErr = fmt.Errorf("%s: %w", be.name, err)
+		p.markDown(be, err)
+	}
+	return nil, nil, lastErr
+}
+
+// setServeBackendPoolsLocked ensures there is a backendPool for each handler
+// in serveConfig that has several backends, and closes pools that are no
+// longer used. It must be called after setServeProxyHandlersLocked.
+func (b *LocalBackend) setServeBackendPoolsLocked() {
+	var keep map[string]bool
+	ensure := func(forHTTP bool, policy, healthCheckPath string, backends []string) {
+		key := backendPoolKey(forHTTP, policy, healthCheckPath, backends)
+		mak.Set(&keep, key, true)
+		if _, ok := b.serveBackendPools.Load(key); ok {
+			return
+		}
+		b.logf("serve: load balancing across %v", backends)
+		p, err := b.newBackendPool(b.ctx, forHTTP, policy, healthCheckPath, backends)
+		if err != nil {
+			b.logf("[unexpected] could not create backend pool for %v: %v", backends, err)
+			return
+		}
+		b.serveBackendPools.Store(key, p)
+	}
+	if b.serveConfig.Valid() {
+		for _, conf := range b.serveConfig.Webs() {
+			for _, h := range conf.Handlers().All() {
+				if h.Backends().Len() > 0 {
+					ensure(true, h.LoadBalance(), h.HealthCheckPath(), h.ProxyBackends())
+				}
+			}
+		}
+		ensureTCP := func(tcph ipn.TCPPortHandlerView) {
+			if tcph.TCPForwardBackends().Len() > 0 {
+				ensure(false, tcph.LoadBalance(), "", tcph.ForwardBackends())
+			}
+		}
+		for _, tcph := range b.serveConfig.TCPs() {
+			ensureTCP(tcph)
+		}
+		for _, svc := range b.serveConfig.Services().All() {
+			for _, tcph := range svc.TCP().All() {
+				ensureTCP(tcph)
+			}
+		}
+	}
+
+	b.serveBackendPools.Range(func(key, value any) bool {
+		if !keep[key.(string)] {
+			b.serveBackendPools.Delete(key)
+			value.(*backendPool).close()
+		}
+		return true
+	})
+}
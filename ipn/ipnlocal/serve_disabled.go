@@ -27,6 +27,7 @@ func (b *LocalBackend) DeleteForegroundSession(sessionID string) error {
 type funnelFlow = struct{}
 
 func (*LocalBackend) hasIngressEnabledLocked() bool         { return false }
+func (*LocalBackend) serveBackendsDown() []string           { return nil }
 func (*LocalBackend) shouldWireInactiveIngressLocked() bool { return false }
 
 func (b *LocalBackend) vipServicesFromPrefsLocked(prefs ipn.PrefsView) []*tailcfg.VIPService {
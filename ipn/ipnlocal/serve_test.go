@@ -15,6 +15,8 @@
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
@@ -22,7 +24,9 @@
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -767,6 +771,474 @@ type headerCheck struct {
 	}
 }
 
+func TestServeHTTPHandlerRewrites(t *testing.T) {
+	b := newTestBackend(t)
+
+	// Start test serve endpoint that echoes the request path and headers.
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			for key, val := range r.Header {
+				w.Header().Add(key, strings.Join(val, ","))
+			}
+			w.Header().Set("X-Backend", "yes")
+			io.WriteString(w, r.URL.Path)
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/old/":   {Redirect: "https://example.com/new" + ipn.RedirectRequestURIVar, Status: http.StatusMovedPermanently},
+				"/gone":   {Status: http.StatusGone},
+				"/teapot": {Text: "short and stout", Status: http.StatusTeapot, SetResponseHeaders: map[string]string{"X-Tea": "earl-grey"}},
+				"/app/": {
+					Proxy:                 testServ.URL,
+					KeepPrefix:            true,
+					SetRequestHeaders:     map[string]string{"X-Mount": "app"},
+					RemoveRequestHeaders:  []string{"Tailscale-User-Login"},
+					SetResponseHeaders:    map[string]string{"X-Served-By": "tailscale"},
+					RemoveResponseHeaders: []string{"X-Backend"},
+				},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		wantCode    int
+		wantBody    string
+		wantHeaders map[string]string
+	}{
+		{
+			name:        "redirect",
+			path:        "/old/page",
+			wantCode:    http.StatusMovedPermanently,
+			wantHeaders: map[string]string{"Location": "https://example.com/new/old/page"},
+		},
+		{
+			name:     "status-only",
+			path:     "/gone",
+			wantCode: http.StatusGone,
+		},
+		{
+			name:        "text-with-status",
+			path:        "/teapot",
+			wantCode:    http.StatusTeapot,
+			wantBody:    "short and stout",
+			wantHeaders: map[string]string{"X-Tea": "earl-grey"},
+		},
+		{
+			name:     "proxy-with-rewrites",
+			path:     "/app/foo",
+			wantCode: http.StatusOK,
+			wantBody: "/app/foo",
+			wantHeaders: map[string]string{
+				"X-Mount":              "app",
+				"Tailscale-User-Login": "",
+				"Tailscale-User-Name":  "Some One",
+				"X-Served-By":          "tailscale",
+				"X-Backend":            "",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				URL: &url.URL{Path: tt.path},
+				TLS: &tls.ConnectionState{ServerName: "example.ts.net"},
+			}
+			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+			}))
+
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+
+			res := w.Result()
+			if res.StatusCode != tt.wantCode {
+				t.Errorf("status = %d; want %d", res.StatusCode, tt.wantCode)
+			}
+			if tt.wantBody != "" {
+				if got := w.Body.String(); got != tt.wantBody {
+					t.Errorf("body = %q; want %q", got, tt.wantBody)
+				}
+			}
+			for k, want := range tt.wantHeaders {
+				if got := res.Header.Get(k); got != want {
+					t.Errorf("header %q = %q; want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestServeConfigInvalidHandlers(t *testing.T) {
+	b := newTestBackend(t)
+
+	web := func(h *ipn.HTTPHandler) map[ipn.HostPort]*ipn.WebServerConfig {
+		return map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{"/": h}},
+		}
+	}
+	tests := []struct {
+		name string
+		conf *ipn.ServeConfig
+	}{
+		{"bad-status", &ipn.ServeConfig{Web: web(&ipn.HTTPHandler{Text: "hi", Status: 42})}},
+		{"text-and-redirect", &ipn.ServeConfig{Web: web(&ipn.HTTPHandler{Text: "hi", Redirect: "https://example.com/"})}},
+		{"path-with-status", &ipn.ServeConfig{Web: web(&ipn.HTTPHandler{Path: "/tmp", Status: http.StatusOK})}},
+		{"tcp-backends-without-forward", &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{
+			443: {TCPForwardBackends: []string{"127.0.0.1:8443"}},
+		}}},
+		{"service", &ipn.ServeConfig{Services: map[tailcfg.ServiceName]*ipn.ServiceConfig{
+			"svc:foo": {
+				TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+				Web: web(&ipn.HTTPHandler{Status: 1000}),
+			},
+		}}},
+		{"foreground", &ipn.ServeConfig{Foreground: map[string]*ipn.ServeConfig{
+			"session": {Web: web(&ipn.HTTPHandler{Redirect: "https://example.com/", Status: http.StatusOK})},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := b.SetServeConfig(tt.conf, ""); err == nil {
+				t.Error("SetServeConfig succeeded; want error")
+			}
+		})
+	}
+	if b.ServeConfig().Valid() {
+		t.Error("invalid serve config was stored")
+	}
+
+	// Handlers that were accepted before their options were checked, such
+	// as empty ones, must still be accepted.
+	legacy := &ipn.ServeConfig{Web: map[ipn.HostPort]*ipn.WebServerConfig{
+		"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+			"/empty": {},
+			"/both":  {Path: "/tmp", Text: "hi"},
+		}},
+	}}
+	if err := b.SetServeConfig(legacy, ""); err != nil {
+		t.Errorf("SetServeConfig with legacy handlers: %v", err)
+	}
+}
+
+func TestServeHTTPHandlerAllowPeers(t *testing.T) {
+	b := newTestBackend(t)
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/open":   {Text: "open"},
+				"/logins": {Text: "logins", AllowLogins: []string{"someone@example.com"}},
+				"/tags":   {Text: "tags", AllowTags: []string{"tag:server"}},
+				"/caps":   {Text: "caps", AllowCaps: []tailcfg.PeerCapability{"example.com/cap/admin"}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		user     = "100.150.151.152"
+		tagged   = "100.150.151.153"
+		stranger = "100.160.161.162"
+	)
+	tests := []struct {
+		path     string
+		srcIP    string
+		wantCode int
+	}{
+		{"/open", stranger, http.StatusOK},
+		{"/logins", user, http.StatusOK},
+		{"/logins", tagged, http.StatusForbidden}, // tagged nodes have no login
+		{"/logins", stranger, http.StatusForbidden},
+		{"/tags", tagged, http.StatusOK},
+		{"/tags", user, http.StatusForbidden},
+		{"/caps", user, http.StatusForbidden},
+		{"/caps", tagged, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path+"/"+tt.srcIP, func(t *testing.T) {
+			req := &http.Request{
+				URL: &url.URL{Path: tt.path},
+				TLS: &tls.ConnectionState{ServerName: "example.ts.net"},
+			}
+			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.AddrPortFrom(netip.MustParseAddr(tt.srcIP), 1234),
+			}))
+
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+			if got := w.Result().StatusCode; got != tt.wantCode {
+				t.Errorf("status = %d; want %d", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestServeHTTPLoadBalancing(t *testing.T) {
+	b := newTestBackend(t)
+
+	newBackend := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	one, two := newBackend("one"), newBackend("two")
+	dead := newBackend("dead")
+	dead.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {
+					Proxy:           one.URL,
+					Backends:        []string{dead.URL, two.URL},
+					HealthCheckPath: "/healthz",
+				},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	pool, ok := b.httpBackendPool(conf.Web["example.ts.net:443"].Handlers["/"].View())
+	if !ok {
+		t.Fatal("no backend pool")
+	}
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		if pool.backends[1].healthy() {
+			return errors.New("dead backend still healthy")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]int{}
+	for range 4 {
+		req := &http.Request{
+			URL: &url.URL{Path: "/"},
+			TLS: &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+			DestPort: 443,
+			SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+		}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+		}
+		got[w.Body.String()]++
+	}
+	if want := map[string]int{"one": 2, "two": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("requests per backend = %v; want %v", got, want)
+	}
+}
+
+func TestServeHTTPProxyErrorMarksBackendDown(t *testing.T) {
+	b := newTestBackend(t)
+
+	newBackend := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	one, two := newBackend("one"), newBackend("two")
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: one.URL, Backends: []string{two.URL}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	pool, ok := b.httpBackendPool(conf.Web["example.ts.net:443"].Handlers["/"].View())
+	if !ok {
+		t.Fatal("no backend pool")
+	}
+	// Wait for the first health checks, after which two goes away. It must
+	// be taken out of rotation by the first request proxied to it, long
+	// before the next health check.
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		for _, be := range pool.backends {
+			be.mu.Lock()
+			failures := be.failures
+			be.mu.Unlock()
+			if failures != 0 {
+				return fmt.Errorf("%s not checked yet", be.name)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	two.Close()
+
+	var codes []int
+	for range 4 {
+		req := &http.Request{
+			URL: &url.URL{Path: "/"},
+			TLS: &tls.ConnectionState{ServerName: "example.ts.net"},
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+			DestPort: 443,
+			SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+		}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		codes = append(codes, w.Code)
+	}
+	if want := []int{http.StatusOK, http.StatusBadGateway, http.StatusOK, http.StatusOK}; !slices.Equal(codes, want) {
+		t.Errorf("status codes = %v; want %v", codes, want)
+	}
+	if got, want := b.serveBackendsDown(), []string{two.URL}; !slices.Equal(got, want) {
+		t.Errorf("serveBackendsDown = %q; want %q", got, want)
+	}
+}
+
+func TestServeResetClosesBackendPools(t *testing.T) {
+	b := newTestBackend(t)
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:1", Backends: []string{"http://127.0.0.1:2"}},
+			}},
+		},
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			8443: {TCPForward: "127.0.0.1:3", TCPForwardBackends: []string{"127.0.0.1:4"}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	var pools []*backendPool
+	b.serveBackendPools.Range(func(_, value any) bool {
+		pools = append(pools, value.(*backendPool))
+		return true
+	})
+	if len(pools) != 2 {
+		t.Fatalf("got %d backend pools; want 2", len(pools))
+	}
+	var closed atomic.Int32
+	for _, p := range pools {
+		cancel := p.cancel
+		p.cancel = func() {
+			closed.Add(1)
+			cancel()
+		}
+	}
+
+	if err := b.SetServeConfig(nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := closed.Load(); got != 2 {
+		t.Errorf("closed %d backend pools after reset; want 2", got)
+	}
+	b.serveBackendPools.Range(func(key, _ any) bool {
+		t.Errorf("backend pool %q remains after reset", key)
+		return true
+	})
+}
+
+func TestBackendPoolUnixSocket(t *testing.T) {
+	b := newTestBackend(t)
+	sock := filepath.Join(t.TempDir(), "s")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("can't listen on Unix socket: %v", err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := b.newBackendPool(ctx, true, "", "", []string{"unix:" + sock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+	be := p.backends[0]
+	if err := be.check(ctx, b.dialer.SystemDial); err != nil {
+		t.Errorf("check with listening socket: %v", err)
+	}
+	ln.Close()
+	if err := be.check(ctx, b.dialer.SystemDial); err == nil {
+		t.Error("check with closed socket succeeded")
+	}
+}
+
+func TestBackendPoolPick(t *testing.T) {
+	newPool := func(policy string) *backendPool {
+		return &backendPool{
+			logf:   t.Logf,
+			policy: policy,
+			backends: []*poolBackend{
+				{name: "a"},
+				{name: "b"},
+				{name: "c"},
+			},
+		}
+	}
+	pickName := func(p *backendPool) string {
+		if be := p.pick(); be != nil {
+			return be.name
+		}
+		return ""
+	}
+
+	rr := newPool(ipn.LoadBalanceRoundRobin)
+	rr.markDown(rr.backends[1], errors.New("down"))
+	var got []string
+	for range 4 {
+		got = append(got, pickName(rr))
+	}
+	if want := []string{"a", "c", "a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("round-robin picks = %q; want %q", got, want)
+	}
+
+	lc := newPool(ipn.LoadBalanceLeastConn)
+	lc.backends[0].acquire()
+	lc.backends[1].acquire()
+	if got := pickName(lc); got != "c" {
+		t.Errorf("least-conn pick = %q; want c", got)
+	}
+	lc.markDown(lc.backends[2], errors.New("down"))
+	if got := pickName(lc); got != "a" {
+		t.Errorf("least-conn pick = %q; want a", got)
+	}
+	for _, be := range lc.backends {
+		lc.markDown(be, errors.New("down"))
+	}
+	if got := pickName(lc); got != "" {
+		t.Errorf("pick with no healthy backends = %q; want none", got)
+	}
+	lc.record(lc.backends[1], nil)
+	if got := pickName(lc); got != "b" {
+		t.Errorf("pick after recovery = %q; want b", got)
+	}
+}
+
 func Test_reverseProxyConfiguration(t *testing.T) {
 	b := newTestBackend(t)
 	type test struct {
@@ -85,6 +85,11 @@ type Status struct {
 	// version of the Tailscale client that's available. Depending on
 	// the platform and client settings, it may not be available.
 	ClientVersion *tailcfg.ClientVersion
+
+	// ServeBackendsDown lists the load balanced serve backends, as written
+	// in the serve config, that are currently not used because they failed
+	// health checks or connection attempts.
+	ServeBackendsDown []string `json:",omitempty"`
 }
 
 // TKAKey describes a key trusted by network lock.
@@ -83,6 +83,7 @@
 	"debug-bus-graph":              (*Handler).serveEventBusGraph,
 	"debug-derp-region":            (*Handler).serveDebugDERPRegion,
 	"debug-dial-types":             (*Handler).serveDebugDialTypes,
+	"debug-flows":                  (*Handler).serveDebugFlows,
 	"debug-log":                    (*Handler).serveDebugLog,
 	"debug-packet-filter-matches":  (*Handler).serveDebugPacketFilterMatches,
 	"debug-packet-filter-rules":    (*Handler).serveDebugPacketFilterRules,
@@ -91,8 +92,10 @@
 	"dev-set-state-store":          (*Handler).serveDevSetStateStore,
 	"dial":                         (*Handler).serveDial,
 	"disconnect-control":           (*Handler).disconnectControl,
+	"dns-log":                      (*Handler).serveDNSLog,
 	"dns-osconfig":                 (*Handler).serveDNSOSConfig,
 	"dns-query":                    (*Handler).serveDNSQuery,
+	"dns-stats":                    (*Handler).serveDNSStats,
 	"goroutines":                   (*Handler).serveGoroutines,
 	"handle-push-message":          (*Handler).serveHandlePushMessage,
 	"id-token":                     (*Handler).serveIDToken,
@@ -1167,6 +1170,51 @@ func (h *Handler) serveDebugPeerEndpointChanges(w http.ResponseWriter, r *http.R
 	e.Encode(chs)
 }
 
+// serveDebugFlows streams the traffic through this node, as a JSON
+// apitype.Flow per connection every time it's aggregated. If the "peer"
+// parameter is set, only flows with the peer of that name or IP address are
+// sent.
+func (h *Handler) serveDebugFlows(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != httpm.GET {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	match := func(apitype.Flow) bool { return true }
+	if peer := r.FormValue("peer"); peer != "" {
+		if ip, err := netip.ParseAddr(peer); err == nil {
+			match = func(f apitype.Flow) bool { return f.Src.Addr() == ip || f.Dst.Addr() == ip }
+		} else {
+			match = func(f apitype.Flow) bool { return strings.EqualFold(f.Peer, peer) }
+		}
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	enc := json.NewEncoder(w)
+	h.b.WatchFlows(r.Context(), func(flows []apitype.Flow) error {
+		for _, fl := range flows {
+			if !match(fl) {
+				continue
+			}
+			if err := enc.Encode(fl); err != nil {
+				return err
+			}
+		}
+		f.Flush()
+		return nil
+	})
+}
+
 // InUseOtherUserIPNStream reports whether r is a request for the watch-ipn-bus
 // handler. If so, it writes an ipn.Notify InUseOtherUser message to the user
 // and returns true. Otherwise it returns false, in which case it doesn't write
@@ -2015,6 +2063,71 @@ func (h *Handler) serveDNSQuery(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// serveDNSLog streams the DNS queries answered by the internal DNS
+// forwarder, as a JSON apitype.DNSQueryLogEntry per query. If the "peer"
+// parameter is set, only queries from the peer of that name or IP address
+// are sent.
+func (h *Handler) serveDNSLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != httpm.GET {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Require write access for privacy reasons.
+	if !h.PermitWrite {
+		http.Error(w, "dns-log access denied", http.StatusForbidden)
+		return
+	}
+	var match func(apitype.DNSQueryLogEntry) bool // nil to match all
+	if peer := r.FormValue("peer"); peer != "" {
+		if ip, err := netip.ParseAddr(peer); err == nil {
+			match = func(e apitype.DNSQueryLogEntry) bool { return e.From.Addr() == ip }
+		} else {
+			match = func(e apitype.DNSQueryLogEntry) bool { return strings.EqualFold(e.Peer, peer) }
+		}
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	enc := json.NewEncoder(w)
+	err := h.b.WatchDNSQueries(r.Context(), match, func(e apitype.DNSQueryLogEntry) error {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		f.Flush()
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		h.logf("dns-log: %v", err)
+	}
+}
+
+// serveDNSStats serves counts of the DNS queries answered by the internal
+// DNS forwarder, as a DNSQueryStatsResponse JSON object.
+func (h *Handler) serveDNSStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != httpm.GET {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Require write access for privacy reasons.
+	if !h.PermitWrite {
+		http.Error(w, "dns-stats access denied", http.StatusForbidden)
+		return
+	}
+	res, err := h.b.DNSQueryStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
 // dnsMessageTypeForString returns the dnsmessage.Type for the given string.
 // For example, DNSMessageTypeForString("A") returns dnsmessage.TypeA.
 func dnsMessageTypeForString(s string) (t dnsmessage.Type, err error) {
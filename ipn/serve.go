@@ -149,6 +149,57 @@ type TCPPortHandler struct {
 	// SNI name with this value. It is only used if TCPForward is non-empty.
 	// (the HTTPS mode uses ServeConfig.Web)
 	TerminateTLS string `json:",omitempty"`
+
+	// TCPForwardBackends optionally lists further IP:port addresses to
+	// forward TCP connections to. If non-empty, connections are spread
+	// across TCPForward and TCPForwardBackends according to LoadBalance,
+	// skipping backends that fail health checks.
+	TCPForwardBackends []string `json:",omitempty"`
+
+	// LoadBalance is the policy used to pick a backend when
+	// TCPForwardBackends is non-empty. See LoadBalanceRoundRobin and
+	// LoadBalanceLeastConn. If empty, LoadBalanceRoundRobin is used.
+	LoadBalance string `json:",omitempty"`
+}
+
+// Load balancing policies for TCPPortHandler.LoadBalance and
+// HTTPHandler.LoadBalance.
+const (
+	// LoadBalanceRoundRobin sends each new connection or request to the
+	// next healthy backend in turn.
+	LoadBalanceRoundRobin = "round-robin"
+
+	// LoadBalanceLeastConn sends each new connection or request to the
+	// healthy backend with the fewest in-flight connections or requests.
+	LoadBalanceLeastConn = "least-conn"
+)
+
+func checkLoadBalance(policy string) error {
+	switch policy {
+	case "", LoadBalanceRoundRobin, LoadBalanceLeastConn:
+		return nil
+	}
+	return fmt.Errorf("unknown load balancing policy %q", policy)
+}
+
+// CheckValid reports whether h is a valid handler.
+func (h *TCPPortHandler) CheckValid() error {
+	if len(h.TCPForwardBackends) > 0 && h.TCPForward == "" {
+		return errors.New("TCPForwardBackends may only be set with TCPForward")
+	}
+	if h.LoadBalance != "" && len(h.TCPForwardBackends) == 0 {
+		return errors.New("LoadBalance may only be set with TCPForwardBackends")
+	}
+	return checkLoadBalance(h.LoadBalance)
+}
+
+// ForwardBackends returns all the addresses h forwards TCP connections to:
+// TCPForward followed by TCPForwardBackends.
+func (v TCPPortHandlerView) ForwardBackends() []string {
+	if v.TCPForward() == "" {
+		return nil
+	}
+	return append([]string{v.TCPForward()}, v.ж.TCPForwardBackends...)
 }
 
 // HTTPHandler is either a path or a proxy to serve.
@@ -160,8 +211,144 @@ type HTTPHandler struct {
 
 	Text string `json:",omitempty"` // plaintext to serve (primarily for testing)
 
+	// Redirect is the URL to redirect requests to. Any "${REQUEST_URI}"
+	// in it is replaced by the path and query of the incoming request.
+	Redirect string `json:",omitempty"`
+
+	// Status is the HTTP status code to respond with when serving Text or
+	// Redirect. If zero, it defaults to 200 for Text and 302 for Redirect.
+	// It must be a final response code, 200-599, or 300-399 for Redirect.
+	// If Status is set and none of the fields above are, the handler
+	// responds with just the status code.
+	Status int `json:",omitempty"`
+
+	// KeepPrefix, if true, means that Proxy requests are forwarded with
+	// their full path. By default the mount point is stripped from the path.
+	KeepPrefix bool `json:",omitempty"`
+
+	// SetRequestHeaders are headers to set on requests forwarded to Proxy,
+	// replacing any existing values.
+	SetRequestHeaders map[string]string `json:",omitempty"`
+
+	// RemoveRequestHeaders are headers to remove from requests forwarded to
+	// Proxy, including the Tailscale-User-* identity headers.
+	RemoveRequestHeaders []string `json:",omitempty"`
+
+	// SetResponseHeaders are headers to set on responses, replacing any
+	// existing values.
+	SetResponseHeaders map[string]string `json:",omitempty"`
+
+	// RemoveResponseHeaders are headers to remove from responses.
+	RemoveResponseHeaders []string `json:",omitempty"`
+
+	// AllowCaps, AllowTags and AllowLogins restrict which tailnet peers may
+	// use the handler. If any of them is non-empty, a request is only served
+	// if the peer making it has one of the AllowCaps peer capabilities, has
+	// one of the AllowTags tags, or (for untagged nodes) is logged in as one
+	// of the AllowLogins users. Other requests, including all Funnel
+	// requests, get a 403 Forbidden response.
+	AllowCaps   []tailcfg.PeerCapability `json:",omitempty"`
+	AllowTags   []string                 `json:",omitempty"`
+	AllowLogins []string                 `json:",omitempty"`
+
+	// Backends optionally lists further proxy targets, in the same forms as
+	// Proxy. If non-empty, requests are spread across Proxy and Backends
+	// according to LoadBalance, skipping backends that fail health checks.
+	Backends []string `json:",omitempty"`
+
+	// LoadBalance is the policy used to pick a backend when Backends is
+	// non-empty. See LoadBalanceRoundRobin and LoadBalanceLeastConn. If
+	// empty, LoadBalanceRoundRobin is used.
+	LoadBalance string `json:",omitempty"`
+
+	// HealthCheckPath, if non-empty, is the path that is periodically
+	// requested from each of Proxy and Backends to check their health. A
+	// backend is healthy if it responds with a 2xx or 3xx status. If empty,
+	// backends are healthy if they accept TCP connections.
+	HealthCheckPath string `json:",omitempty"`
+
 	// TODO(bradfitz): bool to not enumerate directories? TTL on mapping for
-	// temporary ones? Error codes? Redirects?
+	// temporary ones?
+}
+
+// RedirectRequestURIVar is the placeholder in HTTPHandler.Redirect that is
+// replaced by the request URI.
+const RedirectRequestURIVar = "${REQUEST_URI}"
+
+// CheckValid reports whether h is a valid handler.
+func (h *HTTPHandler) CheckValid() error {
+	n := 0
+	for _, v := range []string{h.Path, h.Proxy, h.Text, h.Redirect} {
+		if v != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one of Path, Proxy, Text or Redirect may be set")
+	}
+	if n == 0 && h.Status == 0 {
+		return errors.New("empty handler")
+	}
+	return h.checkOptions()
+}
+
+// checkOptions is like CheckValid, but only checks the fields beyond Path,
+// Proxy and Text. Handlers that only use those were never checked when
+// set, so serve configs holding, say, an empty handler must remain valid.
+func (h *HTTPHandler) checkOptions() error {
+	if h.Redirect != "" && (h.Path != "" || h.Proxy != "" || h.Text != "") {
+		return errors.New("Redirect may not be set with Path, Proxy or Text")
+	}
+	if h.Status != 0 {
+		if h.Path != "" || h.Proxy != "" {
+			return errors.New("Status may not be set with Path or Proxy")
+		}
+		if h.Status < 200 || h.Status > 599 {
+			return fmt.Errorf("invalid status code %d; must be 200-599", h.Status)
+		}
+		if h.Redirect != "" && (h.Status < 300 || h.Status > 399) {
+			return fmt.Errorf("invalid redirect status code %d; must be 300-399", h.Status)
+		}
+		if h.Text != "" && (h.Status == 204 || h.Status == 304) {
+			return fmt.Errorf("status code %d may not be set with Text, as its responses have no body", h.Status)
+		}
+	}
+	if h.KeepPrefix && h.Proxy == "" {
+		return errors.New("KeepPrefix may only be set with Proxy")
+	}
+	if (len(h.SetRequestHeaders) > 0 || len(h.RemoveRequestHeaders) > 0) && h.Proxy == "" {
+		return errors.New("request headers may only be modified with Proxy")
+	}
+	for _, tag := range h.AllowTags {
+		if err := tailcfg.CheckTag(tag); err != nil {
+			return err
+		}
+	}
+	if len(h.Backends) > 0 && h.Proxy == "" {
+		return errors.New("Backends may only be set with Proxy")
+	}
+	if (h.LoadBalance != "" || h.HealthCheckPath != "") && len(h.Backends) == 0 {
+		return errors.New("LoadBalance and HealthCheckPath may only be set with Backends")
+	}
+	if h.HealthCheckPath != "" && !strings.HasPrefix(h.HealthCheckPath, "/") {
+		return fmt.Errorf("HealthCheckPath %q must start with /", h.HealthCheckPath)
+	}
+	return checkLoadBalance(h.LoadBalance)
+}
+
+// ProxyBackends returns all the proxy targets of h: Proxy followed by
+// Backends.
+func (v HTTPHandlerView) ProxyBackends() []string {
+	if v.Proxy() == "" {
+		return nil
+	}
+	return append([]string{v.Proxy()}, v.ж.Backends...)
+}
+
+// RestrictsPeers reports whether v only allows some peers to use it.
+// See HTTPHandler.AllowCaps.
+func (v HTTPHandlerView) RestrictsPeers() bool {
+	return v.AllowCaps().Len() > 0 || v.AllowTags().Len() > 0 || v.AllowLogins().Len() > 0
 }
 
 // WebHandlerExists reports whether if the ServeConfig Web handler exists for
@@ -817,6 +1004,60 @@ func (v ServeConfigView) HasFunnelForTarget(target HostPort) bool {
 	return false
 }
 
+// CheckValidHandlers reports whether any of the TCP port and HTTP handlers
+// of sc, its Services or its Foreground configs are invalid. Unlike
+// HTTPHandler.CheckValid, it doesn't check how HTTP handlers combine Path,
+// Proxy and Text, which was never checked when configs were set, so that
+// previously accepted configs, such as those with empty handlers, remain
+// valid.
+func (sc *ServeConfig) CheckValidHandlers() error {
+	if err := checkValidHandlers(sc.TCP, sc.Web); err != nil {
+		return err
+	}
+	for svcName, svc := range sc.Services {
+		if svc == nil {
+			continue
+		}
+		if err := checkValidHandlers(svc.TCP, svc.Web); err != nil {
+			return fmt.Errorf("service %q: %w", svcName, err)
+		}
+	}
+	for _, fg := range sc.Foreground {
+		if fg == nil {
+			continue
+		}
+		if err := fg.CheckValidHandlers(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkValidHandlers(tcp map[uint16]*TCPPortHandler, web map[HostPort]*WebServerConfig) error {
+	for port, h := range tcp {
+		if h == nil {
+			continue
+		}
+		if err := h.CheckValid(); err != nil {
+			return fmt.Errorf("TCP port %d: %w", port, err)
+		}
+	}
+	for hp, wsc := range web {
+		if wsc == nil {
+			continue
+		}
+		for mount, h := range wsc.Handlers {
+			if h == nil {
+				continue
+			}
+			if err := h.checkOptions(); err != nil {
+				return fmt.Errorf("handler for %s%s: %w", hp, mount, err)
+			}
+		}
+	}
+	return nil
+}
+
 // CheckValidServicesConfig reports whether the ServeConfig has
 // invalid service configurations.
 func (sc *ServeConfig) CheckValidServicesConfig() error {
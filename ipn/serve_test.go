@@ -383,3 +383,46 @@ func TestIsFunnelOn(t *testing.T) {
 		})
 	}
 }
+
+func TestHTTPHandlerCheckValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       HTTPHandler
+		wantErr bool
+	}{
+		{"proxy", HTTPHandler{Proxy: "http://127.0.0.1:3000"}, false},
+		{"text", HTTPHandler{Text: "hi"}, false},
+		{"text-status", HTTPHandler{Text: "nope", Status: 403}, false},
+		{"redirect", HTTPHandler{Redirect: "https://example.com/"}, false},
+		{"redirect-status", HTTPHandler{Redirect: "https://example.com/", Status: 308}, false},
+		{"status-only", HTTPHandler{Status: 410}, false},
+		{"proxy-rewrites", HTTPHandler{Proxy: "3000", KeepPrefix: true, SetRequestHeaders: map[string]string{"A": "b"}}, false},
+		{"allow-peers", HTTPHandler{Text: "hi", AllowTags: []string{"tag:ops"}, AllowLogins: []string{"alice@example.com"}}, false},
+		{"backends", HTTPHandler{Proxy: "3000", Backends: []string{"3001"}, LoadBalance: LoadBalanceLeastConn, HealthCheckPath: "/healthz"}, false},
+		{"empty", HTTPHandler{}, true},
+		{"two-targets", HTTPHandler{Text: "hi", Proxy: "3000"}, true},
+		{"redirect-bad-status", HTTPHandler{Redirect: "https://example.com/", Status: 200}, true},
+		{"proxy-status", HTTPHandler{Proxy: "3000", Status: 404}, true},
+		{"bad-status", HTTPHandler{Status: 42}, true},
+		{"informational-status", HTTPHandler{Text: "hi", Status: 101}, true},
+		{"no-content-text", HTTPHandler{Text: "hi", Status: 204}, true},
+		{"not-modified-text", HTTPHandler{Text: "hi", Status: 304}, true},
+		{"no-content-only", HTTPHandler{Status: 204}, false},
+		{"status-too-large", HTTPHandler{Status: 600}, true},
+		{"keep-prefix-text", HTTPHandler{Text: "hi", KeepPrefix: true}, true},
+		{"backends-text", HTTPHandler{Text: "hi", Backends: []string{"3001"}}, true},
+		{"bad-load-balance", HTTPHandler{Proxy: "3000", Backends: []string{"3001"}, LoadBalance: "random"}, true},
+		{"load-balance-no-backends", HTTPHandler{Proxy: "3000", LoadBalance: LoadBalanceRoundRobin}, true},
+		{"bad-health-check-path", HTTPHandler{Proxy: "3000", Backends: []string{"3001"}, HealthCheckPath: "healthz"}, true},
+		{"bad-allow-tag", HTTPHandler{Text: "hi", AllowTags: []string{"ops"}}, true},
+		{"request-headers-text", HTTPHandler{Text: "hi", RemoveRequestHeaders: []string{"A"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.h.CheckValid()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckValid() = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -58,6 +58,11 @@
 	// has ever been received (even if partially).
 	// Any non-empty value indicates that at least one file has been received.
 	TaildropReceivedKey = StateKey("_taildrop-received")
+
+	// TaildropReceivePolicyKey is the key under which the node's Taildrop
+	// receive policy is stored. The value is a JSON-encoded
+	// apitype.TaildropReceivePolicy.
+	TaildropReceivePolicyKey = StateKey("_taildrop-receive-policy")
 )
 
 // CurrentProfileID returns the StateKey that stores the
@@ -45,6 +45,10 @@ type Config struct {
 	// it to resolve, you also need to add appropriate routes to
 	// Routes.
 	Hosts map[dnsname.FQDN][]netip.Addr
+	// Records maps DNS FQDNs to their records other than addresses,
+	// such as CNAME, TXT and SRV records. Like Hosts, they're
+	// resolved locally by 100.100.100.100.
+	Records map[dnsname.FQDN]resolver.Records
 	// OnlyIPv6, if true, uses the IPv6 service IP (for MagicDNS)
 	// instead of the IPv4 version (100.100.100.100).
 	OnlyIPv6 bool
@@ -113,8 +117,8 @@ func (c Config) hasDefaultIPResolversOnly() bool {
 	return true
 }
 
-// hasHostsWithoutSplitDNSRoutes reports whether c contains any Host entries
-// that aren't covered by a SplitDNS route suffix.
+// hasHostsWithoutSplitDNSRoutes reports whether c contains any Host or
+// Records entries that aren't covered by a SplitDNS route suffix.
 func (c Config) hasHostsWithoutSplitDNSRoutes() bool {
 	// TODO(bradfitz): this could be more efficient, but we imagine
 	// the number of SplitDNS routes and/or hosts will be small.
@@ -123,6 +127,11 @@ func (c Config) hasHostsWithoutSplitDNSRoutes() bool {
 			return true
 		}
 	}
+	for host := range c.Records {
+		if !c.hasSplitDNSRouteForHost(host) {
+			return true
+		}
+	}
 	return false
 }
 
@@ -226,6 +226,27 @@ func TestManager(t *testing.T) {
 				Routes: upstreams(".", "1.1.1.1", "9.9.9.9"),
 			},
 		},
+		{
+			// Like hosts-with-global-dns-uses-quad100, but for local
+			// records other than addresses.
+			name:  "records-with-global-dns-uses-quad100",
+			split: true,
+			in: Config{
+				DefaultResolvers: mustRes("1.1.1.1", "9.9.9.9"),
+				Records: map[dnsname.FQDN]resolver.Records{
+					"foo.tld.": {CNAME: "bar.tld."},
+				},
+			},
+			os: OSConfig{
+				Nameservers: mustIPs("100.100.100.100"),
+			},
+			rs: resolver.Config{
+				Routes: upstreams(".", "1.1.1.1", "9.9.9.9"),
+				Records: map[dnsname.FQDN]resolver.Records{
+					"foo.tld.": {CNAME: "bar.tld."},
+				},
+			},
+		},
 		{
 			// This is the above hosts-with-global-dns-uses-quad100 test but
 			// verifying that if global DNS servers aren't set (the 1.1.1.1 and
@@ -0,0 +1,283 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/envknob"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/util/lru"
+)
+
+const (
+	// maxCacheEntries is the maximum number of responses the forwarder
+	// caches.
+	maxCacheEntries = 2048
+
+	// maxCacheTTL caps how long a response is cached, regardless of the
+	// TTLs in it. It's also the cap on negative caching suggested by RFC
+	// 2308 section 5.
+	maxCacheTTL = time.Hour
+
+	// minUDPSize is the largest UDP response all clients accept, per RFC
+	// 1035 section 4.2.1, and the smallest EDNS UDP payload size per RFC
+	// 6891 section 6.2.5.
+	minUDPSize = 512
+)
+
+var disableResponseCache = envknob.RegisterBool("TS_DNS_FORWARD_NO_CACHE")
+
+// cacheKey identifies a cached response.
+type cacheKey struct {
+	name     dnsname.FQDN
+	typ      dns.Type
+	route    string // the route's suffix, or the upstreams if given explicitly
+	dnssecOK bool   // whether the query had the EDNS DO bit set
+	edns     bool   // whether the query had an OPT record
+	udpSize  uint16 // the query's EDNS UDP payload size, if edns
+}
+
+// maxResponseSize returns the size of the largest response that may be
+// cached under k, which is the largest a client sending the query over UDP
+// accepts.
+func (k cacheKey) maxResponseSize() int {
+	if !k.edns {
+		return minUDPSize
+	}
+	return min(max(int(k.udpSize), minUDPSize), maxResponseBytes)
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	res     []byte
+	expires time.Time
+	stored  time.Time
+}
+
+// responseCache caches responses from upstream resolvers, honoring the
+// TTLs in them, and negative responses per RFC 2308.
+//
+// The zero value is ready for use.
+type responseCache struct {
+	now func() time.Time // or nil for time.Now
+
+	mu      sync.Mutex
+	entries lru.Cache[cacheKey, cacheEntry]
+}
+
+func (c *responseCache) timeNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// routeKey returns the route part of the cache key for queries to rs.
+// route is the suffix of the route rs is for, or empty if rs was given
+// explicitly.
+func routeKey(route dnsname.FQDN, rs []resolverAndDelay) string {
+	if route != "" {
+		return string(route)
+	}
+	var sb strings.Builder
+	for i, r := range rs {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(r.name.Addr)
+	}
+	return sb.String()
+}
+
+// queryCacheKey returns the key to cache the response to query under, and
+// whether its response may be cached at all.
+func queryCacheKey(query []byte, route string) (k cacheKey, ok bool) {
+	var p dns.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response || h.OpCode != 0 {
+		return k, false
+	}
+	q, err := p.Question()
+	if err != nil || q.Class != dns.ClassINET {
+		return k, false
+	}
+	if _, err := p.Question(); err != dns.ErrSectionDone {
+		// Only cache the common case of one question.
+		return k, false
+	}
+	name, err := dnsname.ToFQDN(rawNameToLower(q.Name.Data[:q.Name.Length]))
+	if err != nil {
+		return k, false
+	}
+	k = cacheKey{name: name, typ: q.Type, route: route}
+	if err := p.SkipAllAnswers(); err != nil {
+		return k, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return k, false
+	}
+	for {
+		rh, err := p.AdditionalHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return k, false
+		}
+		if rh.Type == dns.TypeOPT {
+			k.dnssecOK = rh.DNSSECAllowed()
+			k.edns = true
+			k.udpSize = uint16(rh.Class)
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return k, false
+		}
+	}
+	return k, true
+}
+
+// cacheTTL returns how long the response msg may be cached for, or zero if
+// it may not be.
+func cacheTTL(msg *dns.Message) time.Duration {
+	if msg.Truncated {
+		return 0
+	}
+	switch msg.RCode {
+	case dns.RCodeSuccess, dns.RCodeNameError:
+	default:
+		return 0
+	}
+
+	ttl := uint32(maxCacheTTL / time.Second)
+	if msg.RCode == dns.RCodeNameError || len(msg.Answers) == 0 {
+		// A negative response is cached per the SOA record in its
+		// authority section, per RFC 2308 section 5, and not at all
+		// without one.
+		var soa *dns.SOAResource
+		for _, rr := range msg.Authorities {
+			if r, ok := rr.Body.(*dns.SOAResource); ok {
+				soa = r
+				ttl = min(ttl, rr.Header.TTL, r.MinTTL)
+				break
+			}
+		}
+		if soa == nil {
+			return 0
+		}
+	}
+	for _, sec := range [][]dns.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, rr := range sec {
+			if rr.Header.Type == dns.TypeOPT {
+				// Its TTL holds EDNS flags.
+				continue
+			}
+			ttl = min(ttl, rr.Header.TTL)
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// get returns the cached response to query, which has cache key k, if
+// there's one that hasn't expired.
+func (c *responseCache) get(k cacheKey, query []byte) (res []byte, ok bool) {
+	now := c.timeNow()
+	c.mu.Lock()
+	ent, ok := c.entries.GetOk(k)
+	if ok && !now.Before(ent.expires) {
+		c.entries.Delete(k)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		metricDNSFwdCacheMiss.Add(1)
+		return nil, false
+	}
+
+	var msg dns.Message
+	if err := msg.Unpack(ent.res); err != nil {
+		metricDNSFwdCacheMiss.Add(1)
+		return nil, false
+	}
+	var qp dns.Parser
+	qh, err := qp.Start(query)
+	if err != nil {
+		metricDNSFwdCacheMiss.Add(1)
+		return nil, false
+	}
+	q, err := qp.Question()
+	if err != nil {
+		metricDNSFwdCacheMiss.Add(1)
+		return nil, false
+	}
+
+	// Answer as the upstream would have: to this query's ID and
+	// question (which may differ in case), with TTLs reduced by how long
+	// the response has been cached.
+	msg.ID = qh.ID
+	msg.RecursionDesired = qh.RecursionDesired
+	msg.CheckingDisabled = qh.CheckingDisabled
+	msg.Questions = []dns.Question{q}
+	age := uint32(now.Sub(ent.stored) / time.Second)
+	for _, sec := range [][]dns.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range sec {
+			if h := &sec[i].Header; h.Type != dns.TypeOPT {
+				h.TTL -= min(h.TTL, age)
+			}
+		}
+	}
+	res, err = msg.Pack()
+	if err != nil {
+		metricDNSFwdCacheMiss.Add(1)
+		return nil, false
+	}
+	metricDNSFwdCacheHit.Add(1)
+	return res, true
+}
+
+// put caches the response res under key k, if it may be cached.
+func (c *responseCache) put(k cacheKey, res []byte) {
+	if len(res) > k.maxResponseSize() {
+		// Don't serve responses to TCP queries, or to queries with a
+		// larger EDNS UDP payload size, to UDP clients that can't take
+		// them.
+		return
+	}
+	var msg dns.Message
+	if err := msg.Unpack(res); err != nil {
+		return
+	}
+	ttl := cacheTTL(&msg)
+	if ttl <= 0 {
+		return
+	}
+	now := c.timeNow()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.MaxEntries = maxCacheEntries
+	c.entries.Set(k, cacheEntry{
+		res:     bytes.Clone(res),
+		stored:  now,
+		expires: now.Add(ttl),
+	})
+	metricDNSFwdCacheStore.Add(1)
+}
+
+// flush removes all cached responses.
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Clear()
+}
+
+// len returns the number of cached responses, including expired ones.
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Len()
+}
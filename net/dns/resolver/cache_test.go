@@ -0,0 +1,256 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+// makeCacheTestResponse returns a response to a query for name, with an A
+// record with the given TTL if ttl is non-negative, and an SOA record with
+// the given TTL and minimum if soaTTL is non-negative.
+func makeCacheTestResponse(tb testing.TB, name string, rcode dns.RCode, ttl, soaTTL int) []byte {
+	tb.Helper()
+	b := dns.NewBuilder(nil, dns.Header{Response: true, RCode: rcode, RecursionAvailable: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dns.Question{Name: dns.MustNewName(name), Type: dns.TypeA, Class: dns.ClassINET})
+	b.StartAnswers()
+	if ttl >= 0 {
+		b.AResource(dns.ResourceHeader{Name: dns.MustNewName(name), Class: dns.ClassINET, TTL: uint32(ttl)},
+			dns.AResource{A: [4]byte{127, 0, 0, 1}})
+	}
+	b.StartAuthorities()
+	if soaTTL >= 0 {
+		b.SOAResource(dns.ResourceHeader{Name: dns.MustNewName("example.com."), Class: dns.ClassINET, TTL: uint32(soaTTL)},
+			dns.SOAResource{
+				NS:     dns.MustNewName("ns.example.com."),
+				MBox:   dns.MustNewName("hostmaster.example.com."),
+				MinTTL: uint32(soaTTL),
+			})
+	}
+	res, err := b.Finish()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return res
+}
+
+// answerTTL returns the TTL of the first answer or, if there are none,
+// authority in res, and res's DNS ID.
+func answerTTL(tb testing.TB, res []byte) (ttl uint32, id uint16) {
+	tb.Helper()
+	var msg dns.Message
+	if err := msg.Unpack(res); err != nil {
+		tb.Fatal(err)
+	}
+	if len(msg.Answers) > 0 {
+		return msg.Answers[0].Header.TTL, msg.ID
+	}
+	if len(msg.Authorities) > 0 {
+		return msg.Authorities[0].Header.TTL, msg.ID
+	}
+	tb.Fatal("no records in response")
+	return 0, 0
+}
+
+func TestResponseCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := &responseCache{now: func() time.Time { return now }}
+
+	query := makeTestRequest(t, "Example.COM.")
+	k, ok := queryCacheKey(query, ".")
+	if !ok {
+		t.Fatal("query not cacheable")
+	}
+	if want := (cacheKey{name: "example.com.", typ: dns.TypeA, route: "."}); k != want {
+		t.Fatalf("cache key = %+v; want %+v", k, want)
+	}
+	if _, ok := c.get(k, query); ok {
+		t.Fatal("hit in empty cache")
+	}
+
+	// TTLs count down, and the response matches the query's ID.
+	c.put(k, makeCacheTestResponse(t, "example.com.", dns.RCodeSuccess, 60, -1))
+	now = now.Add(10 * time.Second)
+	query[0], query[1] = 0x12, 0x34
+	res, ok := c.get(k, query)
+	if !ok {
+		t.Fatal("miss after put")
+	}
+	if ttl, id := answerTTL(t, res); ttl != 50 || id != 0x1234 {
+		t.Errorf("got TTL %d, ID %#x; want 50, 0x1234", ttl, id)
+	}
+	now = now.Add(50 * time.Second)
+	if _, ok := c.get(k, query); ok {
+		t.Error("hit after TTL expired")
+	}
+
+	// Negative responses are cached per the SOA record, if any.
+	nx := cacheKey{name: "nx.example.com.", typ: dns.TypeA, route: "."}
+	c.put(nx, makeCacheTestResponse(t, "nx.example.com.", dns.RCodeNameError, -1, 30))
+	now = now.Add(29 * time.Second)
+	if res, ok := c.get(nx, makeTestRequest(t, "nx.example.com.")); !ok {
+		t.Error("NXDOMAIN not cached")
+	} else if ttl, _ := answerTTL(t, res); ttl != 1 {
+		t.Errorf("NXDOMAIN SOA TTL = %d; want 1", ttl)
+	}
+	now = now.Add(time.Second)
+	if _, ok := c.get(nx, makeTestRequest(t, "nx.example.com.")); ok {
+		t.Error("NXDOMAIN cached for longer than SOA minimum")
+	}
+
+	for _, tt := range []struct {
+		name string
+		res  []byte
+	}{
+		{"nxdomain-without-soa", makeCacheTestResponse(t, "x.example.com.", dns.RCodeNameError, -1, -1)},
+		{"nodata-without-soa", makeCacheTestResponse(t, "x.example.com.", dns.RCodeSuccess, -1, -1)},
+		{"servfail", makeCacheTestResponse(t, "x.example.com.", dns.RCodeServerFailure, -1, 30)},
+		{"zero-ttl", makeCacheTestResponse(t, "x.example.com.", dns.RCodeSuccess, 0, -1)},
+	} {
+		k := cacheKey{name: dnsname.FQDN(tt.name + "."), typ: dns.TypeA, route: "."}
+		c.put(k, tt.res)
+		if _, ok := c.get(k, query); ok {
+			t.Errorf("%s response was cached", tt.name)
+		}
+	}
+
+	// TTLs are capped.
+	c.put(k, makeCacheTestResponse(t, "example.com.", dns.RCodeSuccess, 86400, -1))
+	now = now.Add(maxCacheTTL)
+	if _, ok := c.get(k, query); ok {
+		t.Errorf("hit after %v", maxCacheTTL)
+	}
+}
+
+func TestQueryCacheKeyDNSSECOK(t *testing.T) {
+	b := dns.NewBuilder(nil, dns.Header{RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dns.Question{Name: dns.MustNewName("example.com."), Type: dns.TypeA, Class: dns.ClassINET})
+	b.StartAdditionals()
+	var rh dns.ResourceHeader
+	if err := rh.SetEDNS0(1232, dns.RCodeSuccess, true); err != nil {
+		t.Fatal(err)
+	}
+	b.OPTResource(rh, dns.OPTResource{})
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, ok := queryCacheKey(query, ".")
+	if !ok || !k.dnssecOK || !k.edns || k.udpSize != 1232 {
+		t.Errorf("got key %+v, %v; want DNSSEC OK and EDNS size 1232", k, ok)
+	}
+}
+
+func TestResponseCacheUDPSize(t *testing.T) {
+	// A response too large for a plain UDP query.
+	b := dns.NewBuilder(nil, dns.Header{Response: true, RecursionAvailable: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dns.Question{Name: dns.MustNewName("example.com."), Type: dns.TypeA, Class: dns.ClassINET})
+	b.StartAnswers()
+	for i := range 50 {
+		b.AResource(dns.ResourceHeader{Name: dns.MustNewName("example.com."), Class: dns.ClassINET, TTL: 60},
+			dns.AResource{A: [4]byte{192, 0, 2, byte(i)}})
+	}
+	res, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) <= minUDPSize {
+		t.Fatalf("response is %d bytes; want more than %d", len(res), minUDPSize)
+	}
+
+	var c responseCache
+	plain := cacheKey{name: "example.com.", typ: dns.TypeA, route: "."}
+	c.put(plain, res)
+	if _, ok := c.get(plain, makeTestRequest(t, "example.com.")); ok {
+		t.Error("response larger than 512 bytes cached for a query without EDNS")
+	}
+	edns := cacheKey{name: "example.com.", typ: dns.TypeA, route: ".", edns: true, udpSize: 1232}
+	c.put(edns, res)
+	if _, ok := c.get(edns, makeTestRequest(t, "example.com.")); !ok {
+		t.Error("response not cached for a query with EDNS size 1232")
+	}
+	if _, ok := c.get(plain, makeTestRequest(t, "example.com.")); ok {
+		t.Error("response to an EDNS query served to a query without EDNS")
+	}
+}
+
+func TestForwarderCache(t *testing.T) {
+	var upstreamQueries atomic.Int32
+	response := makeCacheTestResponse(t, "example.com.", dns.RCodeSuccess, 60, -1)
+	port := runDNSServer(t, nil, response, func(isTCP bool, _ []byte) {
+		upstreamQueries.Add(1)
+	})
+
+	fwd := newTestForwarder(t)
+	rr := resolverAndDelay{name: &dnstype.Resolver{Addr: fmt.Sprintf("127.0.0.1:%d", port)}}
+	query := func() {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		rpkt := packet{
+			bs:     makeTestRequest(t, "example.com."),
+			family: "udp",
+			addr:   netip.MustParseAddrPort("127.0.0.1:12345"),
+		}
+		rchan := make(chan packet, 1)
+		if err := fwd.forwardWithDestChan(ctx, rpkt, rchan, rr); err != nil {
+			t.Fatal(err)
+		}
+		if res := <-rchan; len(res.bs) == 0 {
+			t.Fatal("empty response")
+		}
+	}
+	query()
+	query()
+	if got := upstreamQueries.Load(); got != 1 {
+		t.Errorf("upstream got %d queries; want 1", got)
+	}
+}
+
+func TestForwarderCacheFlush(t *testing.T) {
+	fwd := newTestForwarder(t)
+	routes := func(addr string) map[dnsname.FQDN][]*dnstype.Resolver {
+		return map[dnsname.FQDN][]*dnstype.Resolver{
+			".": {{Addr: addr}},
+		}
+	}
+	put := func() {
+		fwd.cache.put(cacheKey{name: "example.com.", typ: dns.TypeA, route: "."},
+			makeCacheTestResponse(t, "example.com.", dns.RCodeSuccess, 60, -1))
+	}
+
+	fwd.setRoutes(routes("10.0.0.1"))
+	put()
+	fwd.setRoutes(routes("10.0.0.1"))
+	if fwd.cache.len() != 1 {
+		t.Error("cache flushed when routes didn't change")
+	}
+	fwd.setRoutes(routes("10.0.0.2"))
+	if fwd.cache.len() != 0 {
+		t.Error("cache not flushed when routes changed")
+	}
+
+	// Queries for the same name via different routes are cached separately.
+	put()
+	k, _ := queryCacheKey(makeTestRequest(t, "example.com."), routeKey("", []resolverAndDelay{
+		{name: &dnstype.Resolver{Addr: "10.0.0.3"}},
+	}))
+	if _, ok := fwd.cache.get(k, makeTestRequest(t, "example.com.")); ok {
+		t.Error("hit for another route")
+	}
+}
@@ -0,0 +1,1643 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/envknob"
+	"tailscale.com/health"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/lru"
+)
+
+// dnssecValidate is whether the forwarder validates the DNSSEC signatures
+// of responses to queries forwarded via the default route, or to resolvers
+// given explicitly, such as for peers using this node as an exit node.
+// Queries matched by split DNS routes aren't validated, as they're usually
+// for private names that the public DNS says don't exist.
+//
+// Responses that fail validation are replaced with SERVFAIL. Validated
+// responses have the AD bit set if the query had the DO or AD bit set, and
+// DNSSEC records are removed from responses to queries without the DO bit.
+// Queries with the CD bit set aren't validated.
+//
+// If the resolvers don't return DNSSEC records at all, such that the root
+// zone's keys or the DS records of its delegations can't be validated,
+// responses are passed on as insecure, without the AD bit, and the
+// dnssecStripped health warning is raised. Once a zone's keys have been
+// validated, responses from it without signatures or proofs of
+// nonexistence are bogus.
+var dnssecValidate = envknob.RegisterBool("TS_DNS_DNSSEC_VALIDATE")
+
+// DNSSEC record types, which dnsmessage doesn't know about.
+const (
+	typeDNAME  dns.Type = 39
+	typeDS     dns.Type = 43
+	typeRRSIG  dns.Type = 46
+	typeNSEC   dns.Type = 47
+	typeDNSKEY dns.Type = 48
+	typeNSEC3  dns.Type = 50
+)
+
+// DNSSEC algorithm numbers, from
+// https://www.iana.org/assignments/dns-sec-alg-numbers.
+const (
+	algRSASHA256       = 8
+	algRSASHA512       = 10
+	algECDSAP256SHA256 = 13
+	algECDSAP384SHA384 = 14
+	algED25519         = 15
+)
+
+// DS digest types.
+const (
+	digestSHA1   = 1
+	digestSHA256 = 2
+	digestSHA384 = 4
+)
+
+const (
+	dnskeyFlagZone   = 0x0100
+	dnskeyFlagRevoke = 0x0080
+	nsec3FlagOptOut  = 0x01
+	nsec3HashSHA1    = 1
+
+	// ednsFlagDNSSECOK is the DO bit of an OPT record's TTL.
+	ednsFlagDNSSECOK = 0x8000
+
+	// maxNSEC3Iterations is the most NSEC3 hash iterations that proofs of
+	// nonexistence are validated with. Zones using more are treated as
+	// unsigned, per RFC 9276 section 3.2.
+	maxNSEC3Iterations = 100
+
+	// maxDNSSECCacheEntries is the most names that the zones found by
+	// walking the chain of trust are cached for.
+	maxDNSSECCacheEntries = 512
+)
+
+// rootTrustAnchors are the DS records of the root zone's key signing keys,
+// KSK-2017 and KSK-2024, as published at
+// https://data.iana.org/root-anchors/root-anchors.xml.
+var rootTrustAnchors = []dsRecord{
+	{
+		keyTag:     20326,
+		alg:        algRSASHA256,
+		digestType: digestSHA256,
+		digest:     mustDecodeHex("E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"),
+	},
+	{
+		keyTag:     38696,
+		alg:        algRSASHA256,
+		digestType: digestSHA256,
+		digest:     mustDecodeHex("683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16"),
+	},
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// dnssecStripped is raised when DNSSEC validation is enabled and the
+// upstream resolvers don't return DNSSEC records for the root zone, so
+// responses can't be validated and are passed on as insecure. It's cleared
+// when a response is validated.
+var dnssecStripped = health.Register(&health.Warnable{
+	Code:      "dns-dnssec-stripped",
+	Title:     "DNSSEC records missing",
+	Severity:  health.SeverityMedium,
+	DependsOn: []*health.Warnable{dnsForwarderFailing},
+	Text: func(args health.Args) string {
+		return fmt.Sprintf("The DNS servers %s don't return DNSSEC records, so DNS responses can't be validated. Responses are used without validation.", args[health.ArgDNSServers])
+	},
+})
+
+// errDNSSECStripped is returned by validation when the resolvers don't
+// return the signatures of the root zone's keys or of its delegations, so
+// they don't return DNSSEC records at all.
+var errDNSSECStripped = errors.New("DNSSEC records missing for a signed zone")
+
+// errUnsigned is returned by validation when records from a zone whose keys
+// have been validated have no signatures, or a negative response from one
+// has no proof of nonexistence. Such responses are bogus.
+var errUnsigned = errors.New("missing signatures from a signed zone")
+
+// dnssecValidator validates the DNSSEC signatures of forwarded responses,
+// walking the chain of trust from the root zone's keys to the keys of the
+// zones they're from.
+type dnssecValidator struct {
+	logf    logger.Logf      // rate limited
+	anchors []dsRecord       // DS records of the root zone's trusted keys
+	now     func() time.Time // or nil for time.Now
+
+	mu    sync.Mutex
+	zones lru.Cache[zoneCacheKey, zoneCacheEntry]
+}
+
+func newDNSSECValidator(logf logger.Logf, anchors []dsRecord) *dnssecValidator {
+	return &dnssecValidator{
+		logf:    logger.RateLimitedFn(logf, time.Minute, 2, 100),
+		anchors: anchors,
+	}
+}
+
+func (v *dnssecValidator) timeNow() time.Time {
+	if v.now != nil {
+		return v.now()
+	}
+	return time.Now()
+}
+
+// dnssecZone is a signed zone whose keys have been validated.
+type dnssecZone struct {
+	name string // the zone's apex
+	keys []*dnskey
+}
+
+// zoneCacheKey identifies a name whose enclosing zone was found via the
+// resolvers of a route.
+type zoneCacheKey struct {
+	route string
+	name  string
+}
+
+// zoneCacheEntry is the enclosing zone of a name.
+type zoneCacheEntry struct {
+	zone        *dnssecZone // or nil if the name is in an unsigned zone
+	nonexistent bool        // the name was proven not to exist
+	expires     time.Time
+}
+
+// dnssecQuery is a query forwarded with DNSSEC validation.
+type dnssecQuery struct {
+	query    packet // as received from the client
+	upstream []byte // query to forward, with the DO bit set
+
+	hasOPT   bool // the query had an OPT record
+	dnssecOK bool // the query had the DO bit set
+	ad       bool // the query had the AD bit set
+}
+
+// checkingDisabledFlagSet reports whether the DNS packet has the CD bit
+// set, asking for responses that haven't been validated.
+func checkingDisabledFlagSet(pkt []byte) bool {
+	return len(pkt) >= headerBytes && pkt[3]&0x10 != 0
+}
+
+// newDNSSECQuery returns the query to forward for query, setting the DO
+// bit so that upstreams include the records needed to validate responses.
+func newDNSSECQuery(query packet) (*dnssecQuery, error) {
+	var msg dns.Message
+	if err := msg.Unpack(query.bs); err != nil {
+		return nil, err
+	}
+	dq := &dnssecQuery{query: query, ad: msg.AuthenticData}
+	for i := range msg.Additionals {
+		if h := &msg.Additionals[i].Header; h.Type == dns.TypeOPT {
+			dq.hasOPT, dq.dnssecOK = true, h.DNSSECAllowed()
+			h.TTL |= ednsFlagDNSSECOK
+		}
+	}
+	if !dq.hasOPT {
+		var h dns.ResourceHeader
+		if err := h.SetEDNS0(maxResponseBytes, dns.RCodeSuccess, true); err != nil {
+			return nil, err
+		}
+		msg.Additionals = append(msg.Additionals, dns.Resource{Header: h, Body: &dns.OPTResource{}})
+	}
+	var err error
+	dq.upstream, err = msg.Pack()
+	return dq, err
+}
+
+// response returns the response to send to the client for msg, the
+// upstream's response to dq, without the DNSSEC records and EDNS flags that
+// the client didn't ask for. secure is whether msg was validated.
+func (dq *dnssecQuery) response(msg *dns.Message, secure bool) ([]byte, error) {
+	msg.AuthenticData = secure && (dq.dnssecOK || dq.ad)
+	if msg.Truncated {
+		// An incomplete response can't be validated, so only pass
+		// on that it was truncated for the client to retry over TCP.
+		msg.Answers, msg.Authorities = nil, nil
+		msg.Additionals = slices.DeleteFunc(msg.Additionals, func(rr dns.Resource) bool {
+			return rr.Header.Type != dns.TypeOPT
+		})
+	}
+	if !dq.dnssecOK {
+		var qtype dns.Type
+		if len(msg.Questions) > 0 {
+			qtype = msg.Questions[0].Type
+		}
+		unrequested := func(rr dns.Resource) bool {
+			switch rr.Header.Type {
+			case typeRRSIG, typeNSEC, typeNSEC3:
+				return rr.Header.Type != qtype
+			}
+			return false
+		}
+		msg.Answers = slices.DeleteFunc(msg.Answers, unrequested)
+		msg.Authorities = slices.DeleteFunc(msg.Authorities, unrequested)
+		msg.Additionals = slices.DeleteFunc(msg.Additionals, unrequested)
+	}
+	for i := range msg.Additionals {
+		if h := &msg.Additionals[i].Header; h.Type == dns.TypeOPT && !dq.dnssecOK {
+			h.TTL &^= ednsFlagDNSSECOK
+		}
+	}
+	if !dq.hasOPT {
+		msg.Additionals = slices.DeleteFunc(msg.Additionals, func(rr dns.Resource) bool {
+			return rr.Header.Type == dns.TypeOPT
+		})
+	}
+	return msg.Pack()
+}
+
+// validateDNSSEC validates res, the upstream's response to dq, which was
+// forwarded to resolvers for route. It returns the response to send to the
+// client, which is SERVFAIL if res failed validation.
+func (f *forwarder) validateDNSSEC(ctx context.Context, dq *dnssecQuery, res []byte, route string, resolvers []resolverAndDelay) ([]byte, error) {
+	var msg dns.Message
+	if err := msg.Unpack(res); err != nil {
+		return nil, err
+	}
+	if msg.Truncated {
+		return dq.response(&msg, false)
+	}
+
+	up := &dnssecUpstream{f: f, route: route, resolvers: resolvers}
+	secure, err := f.dnssec.validate(ctx, up, &msg)
+	if errors.Is(err, errDNSSECStripped) {
+		// The resolvers don't return DNSSEC records at all, so failing
+		// would break every lookup. Pass the response on as insecure
+		// instead, and warn that it wasn't validated. Responses without
+		// signatures from zones below are bogus, as errUnsigned.
+		var resolverAddrs []string
+		for _, rr := range resolvers {
+			resolverAddrs = append(resolverAddrs, rr.name.Addr)
+		}
+		f.health.SetUnhealthy(dnssecStripped, health.Args{health.ArgDNSServers: strings.Join(resolverAddrs, ",")})
+		if verboseDNSForward() {
+			f.dnssec.logf("dnssec: can't validate: %v", err)
+		}
+		metricDNSFwdDNSSECInsecure.Add(1)
+		return dq.response(&msg, false)
+	}
+	if err != nil {
+		metricDNSFwdDNSSECBogus.Add(1)
+		if verboseDNSForward() {
+			f.dnssec.logf("dnssec: validation failed: %v", err)
+		} else {
+			f.dnssec.logf("dnssec: response failed validation; returning SERVFAIL")
+		}
+		sf, err := servfailResponse(dq.query)
+		if err != nil {
+			return nil, err
+		}
+		return sf.bs, nil
+	}
+	if secure {
+		metricDNSFwdDNSSECSecure.Add(1)
+		f.health.SetHealthy(dnssecStripped)
+	} else {
+		metricDNSFwdDNSSECInsecure.Add(1)
+	}
+	return dq.response(&msg, secure)
+}
+
+// validate validates the DNSSEC signatures of msg, querying up for the
+// keys needed. It reports whether msg is secure, having been entirely
+// validated, or returns an error if it's bogus or couldn't be validated.
+// Responses from unsigned zones are neither.
+func (v *dnssecValidator) validate(ctx context.Context, up *dnssecUpstream, msg *dns.Message) (secure bool, err error) {
+	if len(msg.Questions) != 1 {
+		return false, nil
+	}
+	if msg.RCode != dns.RCodeSuccess && msg.RCode != dns.RCodeNameError {
+		return false, nil
+	}
+	q := msg.Questions[0]
+	switch q.Type {
+	case dns.TypeALL, typeRRSIG:
+		// Responses to these needn't have whole RRsets.
+		return false, nil
+	}
+	qname := canonicalName(q.Name)
+	answers, err := groupRRsets(msg.Answers)
+	if err != nil {
+		return false, err
+	}
+	authority, err := groupRRsets(msg.Authorities)
+	if err != nil {
+		return false, err
+	}
+	now := v.timeNow()
+
+	secure = true
+	type wildcardAnswer struct {
+		name, closestEncloser string
+		zone                  *dnssecZone
+	}
+	var wildcards []wildcardAnswer
+	for _, set := range answers {
+		z, nonexistent, err := v.zoneFor(ctx, up, zoneNameFor(set.name, set.typ))
+		if err != nil {
+			return false, err
+		}
+		if z == nil {
+			secure = false
+			continue
+		}
+		if len(set.sigs) == 0 {
+			if set.typ == dns.TypeCNAME && synthesizedFromDNAME(answers, set) {
+				// The DNAME it was synthesized from is validated
+				// instead.
+				continue
+			}
+			if nonexistent {
+				return false, fmt.Errorf("%s %v: unsigned answer for a name proven not to exist", set.name, set.typ)
+			}
+			return false, fmt.Errorf("%s %v: %w", set.name, set.typ, errUnsigned)
+		}
+		ce, err := verifyRRset(set, z.name, z.keys, now)
+		if err != nil {
+			return false, fmt.Errorf("%s %v: %w", set.name, set.typ, err)
+		}
+		if ce != "" {
+			wildcards = append(wildcards, wildcardAnswer{set.name, ce, z})
+		}
+	}
+
+	target := qname
+	if q.Type != dns.TypeCNAME {
+		target = cnameTarget(answers, qname)
+	}
+	answered := slices.ContainsFunc(answers, func(set *rrset) bool {
+		return set.name == target && set.typ == q.Type
+	})
+	if msg.RCode == dns.RCodeNameError || !answered {
+		z, _, err := v.zoneFor(ctx, up, zoneNameFor(target, q.Type))
+		if err != nil {
+			return false, err
+		}
+		if z == nil {
+			return false, nil
+		}
+		d, err := newDenial(authority, z, now)
+		if err != nil {
+			return false, err
+		}
+		var insecure bool
+		if msg.RCode == dns.RCodeNameError {
+			insecure, err = d.nameError(target)
+		} else {
+			insecure, err = d.noData(target, q.Type)
+		}
+		if err != nil {
+			return false, err
+		}
+		if insecure {
+			secure = false
+		}
+	}
+
+	for _, w := range wildcards {
+		d, err := newDenial(authority, w.zone, now)
+		if err != nil {
+			return false, err
+		}
+		insecure, err := d.wildcardExpansion(w.name, w.closestEncloser)
+		if err != nil {
+			return false, err
+		}
+		if insecure {
+			secure = false
+		}
+	}
+	return secure, nil
+}
+
+// zoneFor returns the signed zone enclosing name, walking down the chain of
+// trust from the root and querying up for the DS and DNSKEY records of the
+// zones on the way. It returns a nil zone if name is in an unsigned zone.
+// nonexistent is whether name, or one of its ancestors, was proven not to
+// exist while walking.
+func (v *dnssecValidator) zoneFor(ctx context.Context, up *dnssecUpstream, name string) (zone *dnssecZone, nonexistent bool, err error) {
+	z, err := v.rootZone(ctx, up)
+	if err != nil || z == nil {
+		return nil, false, err
+	}
+	labels := nameLabels(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		n := strings.Join(labels[i:], ".") + "."
+		ent, ok := v.cachedZone(up.route, n)
+		if !ok {
+			var ttl uint32
+			ent, ttl, err = v.delegation(ctx, up, z, n)
+			if err != nil {
+				return nil, false, err
+			}
+			v.cacheZone(up.route, n, ent, ttl)
+		}
+		if ent.zone == nil || ent.nonexistent {
+			return ent.zone, ent.nonexistent, nil
+		}
+		z = ent.zone
+	}
+	return z, false, nil
+}
+
+// rootZone returns the root zone, with its keys validated with the trust
+// anchors, or nil if none of the trust anchors use supported algorithms.
+func (v *dnssecValidator) rootZone(ctx context.Context, up *dnssecUpstream) (*dnssecZone, error) {
+	if ent, ok := v.cachedZone(up.route, "."); ok {
+		return ent.zone, nil
+	}
+	msg, err := up.query(ctx, ".", typeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := zoneKeys(".", msg, v.anchors, v.timeNow())
+	if err != nil {
+		return nil, err
+	}
+	var ent zoneCacheEntry
+	if keys != nil {
+		ent.zone = &dnssecZone{name: ".", keys: keys}
+	}
+	v.cacheZone(up.route, ".", ent, minTTL(msg))
+	return ent.zone, nil
+}
+
+// delegation returns the zone that n is in, given that its parent is in
+// the signed zone z. It queries for n's DS records to find whether n is
+// the apex of a signed zone, an unsigned zone, or still in z.
+func (v *dnssecValidator) delegation(ctx context.Context, up *dnssecUpstream, z *dnssecZone, n string) (_ zoneCacheEntry, ttl uint32, _ error) {
+	now := v.timeNow()
+	// An unsigned response to a DS lookup in the root zone means the
+	// resolvers don't return DNSSEC records at all. Further down, it means
+	// the response is forged.
+	unsignedErr := func(err error) error {
+		if z.name == "." && errors.Is(err, errUnsigned) {
+			return fmt.Errorf("%w: %w", errDNSSECStripped, err)
+		}
+		return err
+	}
+	msg, err := up.query(ctx, n, typeDS)
+	if err != nil {
+		return zoneCacheEntry{}, 0, err
+	}
+	ttl = minTTL(msg)
+	answers, err := groupRRsets(msg.Answers)
+	if err != nil {
+		return zoneCacheEntry{}, 0, err
+	}
+	authority, err := groupRRsets(msg.Authorities)
+	if err != nil {
+		return zoneCacheEntry{}, 0, err
+	}
+
+	switch msg.RCode {
+	case dns.RCodeSuccess:
+	case dns.RCodeNameError:
+		d, err := newDenial(authority, z, now)
+		if err != nil {
+			return zoneCacheEntry{}, 0, unsignedErr(err)
+		}
+		insecure, err := d.nameError(n)
+		if err != nil {
+			return zoneCacheEntry{}, 0, err
+		}
+		if insecure {
+			return zoneCacheEntry{}, ttl, nil
+		}
+		return zoneCacheEntry{zone: z, nonexistent: true}, ttl, nil
+	default:
+		return zoneCacheEntry{}, 0, fmt.Errorf("querying %s DS: %v", n, msg.RCode)
+	}
+
+	if set := findRRset(answers, n, typeDS); set != nil {
+		if len(set.sigs) == 0 {
+			return zoneCacheEntry{}, 0, unsignedErr(fmt.Errorf("%s DS: %w", n, errUnsigned))
+		}
+		if _, err := verifyRRset(set, z.name, z.keys, now); err != nil {
+			return zoneCacheEntry{}, 0, fmt.Errorf("%s DS: %w", n, err)
+		}
+		var ds []dsRecord
+		for _, rr := range set.rrs {
+			if r, err := parseDS(rr); err == nil {
+				ds = append(ds, r)
+			}
+		}
+		keyMsg, err := up.query(ctx, n, typeDNSKEY)
+		if err != nil {
+			return zoneCacheEntry{}, 0, err
+		}
+		keys, err := zoneKeys(n, keyMsg, ds, now)
+		if err != nil {
+			return zoneCacheEntry{}, 0, err
+		}
+		ttl = min(ttl, minTTL(keyMsg))
+		if keys == nil {
+			return zoneCacheEntry{}, ttl, nil
+		}
+		return zoneCacheEntry{zone: &dnssecZone{name: n, keys: keys}}, ttl, nil
+	}
+	if set := findRRset(answers, n, dns.TypeCNAME); set != nil {
+		// An alias can't be a zone's apex.
+		if len(set.sigs) == 0 {
+			return zoneCacheEntry{}, 0, fmt.Errorf("%s CNAME: %w", n, errUnsigned)
+		}
+		if _, err := verifyRRset(set, z.name, z.keys, now); err != nil {
+			return zoneCacheEntry{}, 0, fmt.Errorf("%s CNAME: %w", n, err)
+		}
+		return zoneCacheEntry{zone: z}, ttl, nil
+	}
+
+	d, err := newDenial(authority, z, now)
+	if err != nil {
+		return zoneCacheEntry{}, 0, unsignedErr(err)
+	}
+	if types, ok := d.typesAt(n); ok {
+		switch {
+		case typeBitmapHas(types, typeDS):
+			return zoneCacheEntry{}, 0, fmt.Errorf("%s DS: denied by a record listing DS", n)
+		case typeBitmapHas(types, dns.TypeNS) && !typeBitmapHas(types, dns.TypeSOA):
+			// A delegation to an unsigned zone.
+			return zoneCacheEntry{}, ttl, nil
+		}
+		return zoneCacheEntry{zone: z}, ttl, nil
+	}
+	insecure, err := d.noData(n, typeDS)
+	if err != nil {
+		return zoneCacheEntry{}, 0, err
+	}
+	if insecure {
+		return zoneCacheEntry{}, ttl, nil
+	}
+	return zoneCacheEntry{zone: z}, ttl, nil
+}
+
+func (v *dnssecValidator) cachedZone(route, name string) (zoneCacheEntry, bool) {
+	now := v.timeNow()
+	k := zoneCacheKey{route, name}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	ent, ok := v.zones.GetOk(k)
+	if ok && !now.Before(ent.expires) {
+		v.zones.Delete(k)
+		return zoneCacheEntry{}, false
+	}
+	return ent, ok
+}
+
+func (v *dnssecValidator) cacheZone(route, name string, ent zoneCacheEntry, ttl uint32) {
+	d := min(time.Duration(ttl)*time.Second, maxCacheTTL)
+	if d <= 0 {
+		return
+	}
+	ent.expires = v.timeNow().Add(d)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.zones.MaxEntries = maxDNSSECCacheEntries
+	v.zones.Set(zoneCacheKey{route, name}, ent)
+}
+
+// dnssecUpstream sends the DS and DNSKEY queries needed to validate a
+// response to the resolvers it came from.
+type dnssecUpstream struct {
+	f         *forwarder
+	route     string
+	resolvers []resolverAndDelay
+}
+
+// query queries the upstream resolvers in turn for the records of name
+// with type typ, with the DO and CD bits set, until one responds.
+func (up *dnssecUpstream) query(ctx context.Context, name string, typ dns.Type) (*dns.Message, error) {
+	qname, err := dns.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	b := dns.NewBuilder(nil, dns.Header{
+		ID:               uint16(rand.Uint32()),
+		RecursionDesired: true,
+		CheckingDisabled: true,
+	})
+	b.StartQuestions()
+	b.Question(dns.Question{Name: qname, Type: typ, Class: dns.ClassINET})
+	b.StartAdditionals()
+	var opt dns.ResourceHeader
+	opt.SetEDNS0(maxResponseBytes, dns.RCodeSuccess, true)
+	b.OPTResource(opt, dns.OPTResource{})
+	pkt, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	firstErr := errors.New("no upstream resolvers")
+	for i, rr := range up.resolvers {
+		res, err := up.send(ctx, pkt, "udp", rr)
+		if err == nil && truncatedFlagSet(res) {
+			res, err = up.send(ctx, pkt, "tcp", rr)
+		}
+		if err == nil {
+			var msg dns.Message
+			if err = msg.Unpack(res); err == nil {
+				if len(msg.Questions) == 1 && canonicalName(msg.Questions[0].Name) == name && msg.Questions[0].Type == typ {
+					return &msg, nil
+				}
+				err = errors.New("response doesn't match query")
+			}
+		}
+		if i == 0 {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("querying %s %v: %w", name, typ, firstErr)
+}
+
+func (up *dnssecUpstream) send(ctx context.Context, pkt []byte, family string, rr resolverAndDelay) ([]byte, error) {
+	fq := &forwardQuery{
+		txid:           getTxID(pkt),
+		packet:         pkt,
+		family:         family,
+		closeOnCtxDone: new(closePool),
+	}
+	// Unlike forwardWithDestChan, nothing else closes the connection
+	// to interrupt reading from it when ctx is done.
+	stop := context.AfterFunc(ctx, func() { fq.closeOnCtxDone.Close() })
+	defer stop()
+	defer fq.closeOnCtxDone.Close()
+	return up.f.send(ctx, fq, rr)
+}
+
+// minTTL returns the lowest TTL of the records in msg.
+func minTTL(msg *dns.Message) uint32 {
+	ttl := uint32(maxCacheTTL / time.Second)
+	for _, sec := range [][]dns.Resource{msg.Answers, msg.Authorities} {
+		for _, rr := range sec {
+			ttl = min(ttl, rr.Header.TTL)
+		}
+	}
+	return ttl
+}
+
+// rrset is a set of records of one name and type, and their signatures.
+type rrset struct {
+	name string // lowercase and fully qualified
+	typ  dns.Type
+	rrs  []dns.Resource
+	sigs []*rrsig
+}
+
+// groupRRsets groups the records of a message section into RRsets, with
+// their signatures, in the order they first appear.
+func groupRRsets(rrs []dns.Resource) ([]*rrset, error) {
+	var sets []*rrset
+	get := func(name string, typ dns.Type) *rrset {
+		if set := findRRset(sets, name, typ); set != nil {
+			return set
+		}
+		set := &rrset{name: name, typ: typ}
+		sets = append(sets, set)
+		return set
+	}
+	for _, rr := range rrs {
+		if rr.Header.Type == dns.TypeOPT || rr.Header.Class != dns.ClassINET {
+			continue
+		}
+		name := canonicalName(rr.Header.Name)
+		if rr.Header.Type == typeRRSIG {
+			u, ok := rr.Body.(*dns.UnknownResource)
+			if !ok {
+				return nil, errors.New("invalid RRSIG record")
+			}
+			sig, err := parseRRSIG(u.Data)
+			if err != nil {
+				return nil, err
+			}
+			set := get(name, sig.typeCovered)
+			set.sigs = append(set.sigs, sig)
+			continue
+		}
+		set := get(name, rr.Header.Type)
+		set.rrs = append(set.rrs, rr)
+	}
+	return slices.DeleteFunc(sets, func(set *rrset) bool { return len(set.rrs) == 0 }), nil
+}
+
+func findRRset(sets []*rrset, name string, typ dns.Type) *rrset {
+	for _, set := range sets {
+		if set.name == name && set.typ == typ {
+			return set
+		}
+	}
+	return nil
+}
+
+// zoneNameFor returns the name to find the zone of records of name with
+// type typ by. DS records are in the parent zone of the name they're for.
+func zoneNameFor(name string, typ dns.Type) string {
+	if typ == typeDS && name != "." {
+		_, parent, _ := strings.Cut(name, ".")
+		if parent == "" {
+			return "."
+		}
+		return parent
+	}
+	return name
+}
+
+// cnameTarget returns the name that the CNAME records in answers alias
+// name to, or name if there are none.
+func cnameTarget(answers []*rrset, name string) string {
+	for range answers {
+		set := findRRset(answers, name, dns.TypeCNAME)
+		if set == nil {
+			break
+		}
+		name = canonicalName(set.rrs[0].Body.(*dns.CNAMEResource).CNAME)
+	}
+	return name
+}
+
+// synthesizedFromDNAME reports whether set is a CNAME record synthesized
+// from a signed DNAME record in answers, per RFC 6672 section 5.3.3.
+func synthesizedFromDNAME(answers []*rrset, set *rrset) bool {
+	cname := canonicalName(set.rrs[0].Body.(*dns.CNAMEResource).CNAME)
+	for _, dname := range answers {
+		if dname.typ != typeDNAME || len(dname.sigs) == 0 || dname.name == set.name || !isSubdomain(set.name, dname.name) {
+			continue
+		}
+		u, ok := dname.rrs[0].Body.(*dns.UnknownResource)
+		if !ok {
+			continue
+		}
+		target, _, err := readWireName(u.Data)
+		if err != nil {
+			continue
+		}
+		prefix := strings.TrimSuffix(set.name, dname.name)
+		if target == "." {
+			target = ""
+		}
+		if prefix+target == cname {
+			return true
+		}
+	}
+	return false
+}
+
+// rrsig is a parsed RRSIG record.
+type rrsig struct {
+	typeCovered dns.Type
+	alg         uint8
+	labels      uint8
+	origTTL     uint32
+	expiration  uint32
+	inception   uint32
+	keyTag      uint16
+	signer      string
+
+	// signedPrefix is the record's data, in canonical form, up to its
+	// signature: the start of the data it signs.
+	signedPrefix []byte
+	signature    []byte
+}
+
+// rrsigFixedBytes is the size of an RRSIG record's fields before the
+// signer's name.
+const rrsigFixedBytes = 18
+
+func parseRRSIG(data []byte) (*rrsig, error) {
+	if len(data) < rrsigFixedBytes {
+		return nil, errors.New("RRSIG record too short")
+	}
+	signer, n, err := readWireName(data[rrsigFixedBytes:])
+	if err != nil {
+		return nil, err
+	}
+	return &rrsig{
+		typeCovered:  dns.Type(binary.BigEndian.Uint16(data[0:2])),
+		alg:          data[2],
+		labels:       data[3],
+		origTTL:      binary.BigEndian.Uint32(data[4:8]),
+		expiration:   binary.BigEndian.Uint32(data[8:12]),
+		inception:    binary.BigEndian.Uint32(data[12:16]),
+		keyTag:       binary.BigEndian.Uint16(data[16:18]),
+		signer:       signer,
+		signedPrefix: appendNameWire(slices.Clone(data[:rrsigFixedBytes]), signer),
+		signature:    data[rrsigFixedBytes+n:],
+	}, nil
+}
+
+// validAt reports whether now is in the signature's validity period, using
+// serial number arithmetic per RFC 4034 section 3.1.5.
+func (s *rrsig) validAt(now time.Time) bool {
+	t := uint32(now.Unix())
+	return int32(t-s.inception) >= 0 && int32(s.expiration-t) >= 0
+}
+
+// signedData returns the data that s signs for set, whose records have
+// the name owner, per RFC 4034 section 3.1.8.1.
+func (s *rrsig) signedData(set *rrset, owner string) ([]byte, error) {
+	rdatas := make([][]byte, 0, len(set.rrs))
+	for _, rr := range set.rrs {
+		rd, err := canonicalRData(rr)
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rd)
+	}
+	slices.SortFunc(rdatas, bytes.Compare)
+	rdatas = slices.CompactFunc(rdatas, bytes.Equal)
+
+	ownerWire := appendNameWire(nil, owner)
+	data := slices.Clone(s.signedPrefix)
+	for _, rd := range rdatas {
+		data = append(data, ownerWire...)
+		data = binary.BigEndian.AppendUint16(data, uint16(set.typ))
+		data = binary.BigEndian.AppendUint16(data, uint16(dns.ClassINET))
+		data = binary.BigEndian.AppendUint32(data, s.origTTL)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rd)))
+		data = append(data, rd...)
+	}
+	return data, nil
+}
+
+// verifyRRset verifies that set has a signature that's currently valid,
+// made by one of the keys of zone. If the records were synthesized from a
+// wildcard, it returns the closest encloser of the wildcard: the name that
+// the wildcard's "*" label is prepended to.
+func verifyRRset(set *rrset, zone string, keys []*dnskey, now time.Time) (closestEncloser string, err error) {
+	if !isSubdomain(set.name, zone) {
+		return "", fmt.Errorf("records aren't in zone %s", zone)
+	}
+	labels := nameLabels(set.name)
+	err = errors.New("no signature by a key of zone " + zone)
+	for _, sig := range set.sigs {
+		if sig.signer != zone || sig.typeCovered != set.typ {
+			continue
+		}
+		if !sig.validAt(now) {
+			err = errors.New("signature expired or not yet valid")
+			continue
+		}
+		owner, ce := set.name, ""
+		switch n := int(sig.labels); {
+		case n > len(labels):
+			err = errors.New("signature has too many labels")
+			continue
+		case n == len(labels)-1 && labels[0] == "*":
+			// The wildcard itself.
+		case n < len(labels):
+			ce = strings.Join(labels[len(labels)-n:], ".") + "."
+			owner = wildcardName(ce)
+		}
+		data, dataErr := sig.signedData(set, owner)
+		if dataErr != nil {
+			return "", dataErr
+		}
+		for _, k := range keys {
+			if k.tag != sig.keyTag || k.alg != sig.alg {
+				continue
+			}
+			if err = verifySignature(k.alg, k.key, data, sig.signature); err == nil {
+				return ce, nil
+			}
+		}
+	}
+	return "", err
+}
+
+// verifySignature verifies sig, a signature of data made by a key with
+// the public key key, with DNSSEC algorithm alg.
+func verifySignature(alg uint8, key, data, sig []byte) error {
+	switch alg {
+	case algRSASHA256, algRSASHA512:
+		pub, err := parseRSAKey(key)
+		if err != nil {
+			return err
+		}
+		h := crypto.SHA256
+		if alg == algRSASHA512 {
+			h = crypto.SHA512
+		}
+		return rsa.VerifyPKCS1v15(pub, h, hashOf(h.New(), data), sig)
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		curve, h := elliptic.P256(), crypto.SHA256
+		if alg == algECDSAP384SHA384 {
+			curve, h = elliptic.P384(), crypto.SHA384
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(curve, append([]byte{4}, key...))
+		if err != nil {
+			return err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, hashOf(h.New(), data), r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case algED25519:
+		if len(key) != ed25519.PublicKeySize {
+			return errors.New("invalid Ed25519 key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key), data, sig) {
+			return errors.New("invalid Ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported DNSSEC algorithm %d", alg)
+}
+
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case algRSASHA256, algRSASHA512, algECDSAP256SHA256, algECDSAP384SHA384, algED25519:
+		return true
+	}
+	return false
+}
+
+func hashOf(h hash.Hash, data []byte) []byte {
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// parseRSAKey parses an RSA public key in the format of RFC 3110 section 2.
+func parseRSAKey(key []byte) (*rsa.PublicKey, error) {
+	if len(key) < 1 {
+		return nil, errors.New("invalid RSA key")
+	}
+	elen := int(key[0])
+	key = key[1:]
+	if elen == 0 {
+		if len(key) < 2 {
+			return nil, errors.New("invalid RSA key")
+		}
+		elen = int(binary.BigEndian.Uint16(key))
+		key = key[2:]
+	}
+	if elen == 0 || elen > 4 || len(key) <= elen {
+		return nil, errors.New("unsupported RSA key exponent")
+	}
+	var e int
+	for _, b := range key[:elen] {
+		e = e<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(key[elen:]), E: e}, nil
+}
+
+// dnskey is a parsed DNSKEY record.
+type dnskey struct {
+	flags uint16
+	alg   uint8
+	key   []byte // public key
+	tag   uint16
+	rdata []byte
+}
+
+func parseDNSKEY(rr dns.Resource) (*dnskey, error) {
+	u, ok := rr.Body.(*dns.UnknownResource)
+	if !ok || len(u.Data) < 4 {
+		return nil, errors.New("invalid DNSKEY record")
+	}
+	return &dnskey{
+		flags: binary.BigEndian.Uint16(u.Data[0:2]),
+		alg:   u.Data[3],
+		key:   u.Data[4:],
+		tag:   keyTag(u.Data),
+		rdata: u.Data,
+	}, nil
+}
+
+// keyTag returns the key tag of the DNSKEY record with data rdata, per RFC
+// 4034 appendix B.
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+// dsRecord is a parsed DS record.
+type dsRecord struct {
+	keyTag     uint16
+	alg        uint8
+	digestType uint8
+	digest     []byte
+}
+
+func parseDS(rr dns.Resource) (dsRecord, error) {
+	u, ok := rr.Body.(*dns.UnknownResource)
+	if !ok || len(u.Data) < 5 {
+		return dsRecord{}, errors.New("invalid DS record")
+	}
+	return dsRecord{
+		keyTag:     binary.BigEndian.Uint16(u.Data[0:2]),
+		alg:        u.Data[2],
+		digestType: u.Data[3],
+		digest:     u.Data[4:],
+	}, nil
+}
+
+// digestHash returns the hash that DS records of digest type t use, or
+// nil if it's unsupported.
+func digestHash(t uint8) hash.Hash {
+	switch t {
+	case digestSHA1:
+		return sha1.New()
+	case digestSHA256:
+		return sha256.New()
+	case digestSHA384:
+		return sha512.New384()
+	}
+	return nil
+}
+
+// matches reports whether ds is for k, a key of zone.
+func (ds dsRecord) matches(zone string, k *dnskey) bool {
+	h := digestHash(ds.digestType)
+	if h == nil || k.tag != ds.keyTag || k.alg != ds.alg {
+		return false
+	}
+	h.Write(appendNameWire(nil, zone))
+	h.Write(k.rdata)
+	return bytes.Equal(h.Sum(nil), ds.digest)
+}
+
+// zoneKeys returns the keys of zone from msg, the response to a query for
+// its DNSKEY records, if they're signed by a key that one of ds is for. It
+// returns no keys and no error if ds has no records for keys with
+// supported algorithms and digest types, in which case the zone is treated
+// as unsigned, per RFC 4035 section 5.2.
+func zoneKeys(zone string, msg *dns.Message, ds []dsRecord, now time.Time) ([]*dnskey, error) {
+	if !slices.ContainsFunc(ds, func(ds dsRecord) bool {
+		return supportedAlgorithm(ds.alg) && digestHash(ds.digestType) != nil
+	}) {
+		return nil, nil
+	}
+	answers, err := groupRRsets(msg.Answers)
+	if err != nil {
+		return nil, err
+	}
+	set := findRRset(answers, zone, typeDNSKEY)
+	if set == nil {
+		return nil, fmt.Errorf("%s has no DNSKEY records", zone)
+	}
+	if len(set.sigs) == 0 {
+		if zone == "." {
+			return nil, fmt.Errorf("%s DNSKEY: %w", zone, errDNSSECStripped)
+		}
+		return nil, fmt.Errorf("%s DNSKEY: %w", zone, errUnsigned)
+	}
+	var keys []*dnskey
+	for _, rr := range set.rrs {
+		k, err := parseDNSKEY(rr)
+		if err != nil || k.flags&dnskeyFlagZone == 0 || k.flags&dnskeyFlagRevoke != 0 {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	err = fmt.Errorf("%s DNSKEY: no key matches a DS record", zone)
+	for _, d := range ds {
+		for _, k := range keys {
+			if !d.matches(zone, k) {
+				continue
+			}
+			if _, err = verifyRRset(set, zone, []*dnskey{k}, now); err == nil {
+				return keys, nil
+			}
+			err = fmt.Errorf("%s DNSKEY: %w", zone, err)
+		}
+	}
+	return nil, err
+}
+
+// nsecRecord is a parsed NSEC record.
+type nsecRecord struct {
+	owner string
+	next  string
+	types []byte // type bitmap
+}
+
+// nsec3Record is a parsed NSEC3 record.
+type nsec3Record struct {
+	hash       []byte // of the owner name
+	flags      uint8
+	iterations uint16
+	salt       []byte
+	next       []byte // hash of the next owner name
+	types      []byte // type bitmap
+}
+
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+func parseNSEC3(owner string, data []byte) (*nsec3Record, error) {
+	label, _, _ := strings.Cut(owner, ".")
+	ownerHash, err := base32Hex.DecodeString(strings.ToUpper(label))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NSEC3 owner name: %w", err)
+	}
+	if len(data) < 5 {
+		return nil, errors.New("NSEC3 record too short")
+	}
+	r := &nsec3Record{
+		hash:       ownerHash,
+		flags:      data[1],
+		iterations: binary.BigEndian.Uint16(data[2:4]),
+	}
+	if data[0] != nsec3HashSHA1 {
+		return nil, fmt.Errorf("unsupported NSEC3 hash algorithm %d", data[0])
+	}
+	data = data[4:]
+	saltLen := int(data[0])
+	if len(data) < 1+saltLen+1 {
+		return nil, errors.New("NSEC3 record too short")
+	}
+	r.salt, data = data[1:1+saltLen], data[1+saltLen:]
+	hashLen := int(data[0])
+	if len(data) < 1+hashLen {
+		return nil, errors.New("NSEC3 record too short")
+	}
+	r.next, r.types = data[1:1+hashLen], data[1+hashLen:]
+	return r, nil
+}
+
+// hashName returns the NSEC3 hash of name with r's parameters, per RFC
+// 5155 section 5.
+func (r *nsec3Record) hashName(name string) []byte {
+	h := sha1.New()
+	h.Write(appendNameWire(nil, name))
+	h.Write(r.salt)
+	sum := h.Sum(nil)
+	for range r.iterations {
+		h.Reset()
+		h.Write(sum)
+		h.Write(r.salt)
+		sum = h.Sum(sum[:0])
+	}
+	return sum
+}
+
+// denial is the validated NSEC and NSEC3 records of a response's authority
+// section, which prove that names or records don't exist.
+type denial struct {
+	zone  string
+	nsec  []nsecRecord
+	nsec3 []*nsec3Record
+
+	// insecure is whether the NSEC3 records use too many iterations to
+	// be validated.
+	insecure bool
+}
+
+var errNoDenial = errors.New("no valid proof of nonexistence")
+
+// newDenial returns the proofs of nonexistence in authority, a response's
+// authority section, from zone z.
+func newDenial(authority []*rrset, z *dnssecZone, now time.Time) (*denial, error) {
+	d := &denial{zone: z.name}
+	signed := false
+	for _, set := range authority {
+		switch set.typ {
+		case dns.TypeSOA, typeNSEC, typeNSEC3:
+		default:
+			continue
+		}
+		if !isSubdomain(set.name, z.name) {
+			continue
+		}
+		if len(set.sigs) == 0 {
+			continue
+		}
+		signed = true
+		if _, err := verifyRRset(set, z.name, z.keys, now); err != nil {
+			return nil, fmt.Errorf("%s %v: %w", set.name, set.typ, err)
+		}
+		for _, rr := range set.rrs {
+			u, ok := rr.Body.(*dns.UnknownResource)
+			if !ok {
+				continue
+			}
+			switch set.typ {
+			case typeNSEC:
+				next, n, err := readWireName(u.Data)
+				if err != nil {
+					return nil, err
+				}
+				d.nsec = append(d.nsec, nsecRecord{owner: set.name, next: next, types: u.Data[n:]})
+			case typeNSEC3:
+				r, err := parseNSEC3(set.name, u.Data)
+				if err != nil {
+					return nil, err
+				}
+				if r.iterations > maxNSEC3Iterations {
+					d.insecure = true
+				}
+				d.nsec3 = append(d.nsec3, r)
+			}
+		}
+	}
+	if !signed {
+		return nil, fmt.Errorf("negative response: %w", errUnsigned)
+	}
+	return d, nil
+}
+
+// typesAt returns the type bitmap of the NSEC or NSEC3 record for name, if
+// there is one.
+func (d *denial) typesAt(name string) (types []byte, ok bool) {
+	for _, r := range d.nsec {
+		if r.owner == name {
+			return r.types, true
+		}
+	}
+	for _, r := range d.nsec3 {
+		if bytes.Equal(r.hash, r.hashName(name)) {
+			return r.types, true
+		}
+	}
+	return nil, false
+}
+
+// nsecCovering returns the NSEC record proving that name doesn't exist, if
+// there is one.
+func (d *denial) nsecCovering(name string) *nsecRecord {
+	if !isSubdomain(name, d.zone) {
+		return nil
+	}
+	for i, r := range d.nsec {
+		if canonicalCompare(r.owner, name) >= 0 {
+			continue
+		}
+		// The last NSEC record of a zone points back to its apex.
+		if canonicalCompare(name, r.next) < 0 || canonicalCompare(r.next, r.owner) <= 0 {
+			return &d.nsec[i]
+		}
+	}
+	return nil
+}
+
+// nsec3Covering returns the NSEC3 record proving that name doesn't exist,
+// if there is one.
+func (d *denial) nsec3Covering(name string) *nsec3Record {
+	for _, r := range d.nsec3 {
+		h := r.hashName(name)
+		if bytes.Compare(r.hash, r.next) < 0 {
+			if bytes.Compare(r.hash, h) < 0 && bytes.Compare(h, r.next) < 0 {
+				return r
+			}
+		} else if bytes.Compare(r.hash, h) < 0 || bytes.Compare(h, r.next) < 0 {
+			// The last NSEC3 record of a zone wraps around.
+			return r
+		}
+	}
+	return nil
+}
+
+// nsecClosestEncloser returns the closest encloser of name, which the NSEC
+// record r proves doesn't exist: the longest of its ancestors that does.
+func nsecClosestEncloser(name string, r *nsecRecord) string {
+	a, b := commonSuffix(name, r.owner), commonSuffix(name, r.next)
+	if len(b) > len(a) {
+		return b
+	}
+	return a
+}
+
+// nsec3ClosestEncloser returns the closest encloser of name proven by NSEC3
+// records, and the next closer name: the closest encloser's child that's
+// an ancestor of name, or name.
+func (d *denial) nsec3ClosestEncloser(name string) (closestEncloser, nextCloser string, ok bool) {
+	labels := nameLabels(name)
+	for i := 1; i <= len(labels); i++ {
+		ce := strings.Join(labels[i:], ".") + "."
+		if !isSubdomain(ce, d.zone) {
+			break
+		}
+		if _, ok := d.typesAt(ce); ok {
+			return ce, strings.Join(labels[i-1:], ".") + ".", true
+		}
+	}
+	return "", "", false
+}
+
+// nameError checks the proof that name doesn't exist, per RFC 4035 section
+// 5.4 and RFC 5155 section 8.4. insecure is whether the proof is from an
+// NSEC3 record with the opt-out flag, so that name may be in an unsigned
+// zone.
+func (d *denial) nameError(name string) (insecure bool, err error) {
+	if d.insecure {
+		return true, nil
+	}
+	if len(d.nsec3) > 0 {
+		ce, nc, ok := d.nsec3ClosestEncloser(name)
+		if !ok {
+			return false, fmt.Errorf("%s: %w: no closest encloser", name, errNoDenial)
+		}
+		r := d.nsec3Covering(nc)
+		if r == nil {
+			return false, fmt.Errorf("%s: %w: next closer name not covered", name, errNoDenial)
+		}
+		if r.flags&nsec3FlagOptOut != 0 {
+			return true, nil
+		}
+		if d.nsec3Covering(wildcardName(ce)) == nil {
+			return false, fmt.Errorf("%s: %w: wildcard not covered", name, errNoDenial)
+		}
+		return false, nil
+	}
+	r := d.nsecCovering(name)
+	if r == nil {
+		return false, fmt.Errorf("%s: %w", name, errNoDenial)
+	}
+	if isSubdomain(r.next, name) {
+		return false, fmt.Errorf("%s: denied, but is an empty non-terminal", name)
+	}
+	if d.nsecCovering(wildcardName(nsecClosestEncloser(name, r))) == nil {
+		return false, fmt.Errorf("%s: %w: wildcard not covered", name, errNoDenial)
+	}
+	return false, nil
+}
+
+// noData checks the proof that name has no records of type typ, per RFC
+// 4035 section 5.4 and RFC 5155 section 8.5 to 8.7. insecure is whether
+// the proof is from an NSEC3 record with the opt-out flag, so that name
+// may be the apex of an unsigned zone.
+func (d *denial) noData(name string, typ dns.Type) (insecure bool, err error) {
+	if d.insecure {
+		return true, nil
+	}
+	lacks := func(types []byte) bool {
+		return !typeBitmapHas(types, typ) && !typeBitmapHas(types, dns.TypeCNAME)
+	}
+	if types, ok := d.typesAt(name); ok {
+		if !lacks(types) {
+			return false, fmt.Errorf("%s %v: denied by a record listing it", name, typ)
+		}
+		return false, nil
+	}
+	if len(d.nsec3) > 0 {
+		if ce, nc, ok := d.nsec3ClosestEncloser(name); ok {
+			if r := d.nsec3Covering(nc); r != nil {
+				if typ == typeDS && r.flags&nsec3FlagOptOut != 0 {
+					return true, nil
+				}
+				if types, ok := d.typesAt(wildcardName(ce)); ok && lacks(types) {
+					return false, nil
+				}
+			}
+		}
+		return false, fmt.Errorf("%s %v: %w", name, typ, errNoDenial)
+	}
+	if r := d.nsecCovering(name); r != nil {
+		if isSubdomain(r.next, name) {
+			// name is an empty non-terminal.
+			return false, nil
+		}
+		if types, ok := d.typesAt(wildcardName(nsecClosestEncloser(name, r))); ok && lacks(types) {
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("%s %v: %w", name, typ, errNoDenial)
+}
+
+// wildcardExpansion checks the proof that there's no closer match for
+// name than the wildcard at closestEncloser that its records were
+// synthesized from, per RFC 4035 section 5.3.4 and RFC 5155 section 8.8.
+func (d *denial) wildcardExpansion(name, closestEncloser string) (insecure bool, err error) {
+	if d.insecure {
+		return true, nil
+	}
+	if len(d.nsec3) > 0 {
+		labels := nameLabels(name)
+		n := len(nameLabels(closestEncloser)) + 1
+		nc := strings.Join(labels[len(labels)-n:], ".") + "."
+		if r := d.nsec3Covering(nc); r != nil {
+			return r.flags&nsec3FlagOptOut != 0, nil
+		}
+	} else if d.nsecCovering(name) != nil {
+		return false, nil
+	}
+	return false, fmt.Errorf("%s: %w: wildcard answer without proof", name, errNoDenial)
+}
+
+// typeBitmapHas reports whether the NSEC or NSEC3 type bitmap types has
+// typ, per RFC 4034 section 4.1.2.
+func typeBitmapHas(types []byte, typ dns.Type) bool {
+	window, bit := byte(typ>>8), byte(typ)
+	for len(types) >= 2 {
+		w, n := types[0], int(types[1])
+		types = types[2:]
+		if n == 0 || n > 32 || n > len(types) {
+			return false
+		}
+		if w == window {
+			i := int(bit / 8)
+			return i < n && types[i]&(0x80>>(bit%8)) != 0
+		}
+		types = types[n:]
+	}
+	return false
+}
+
+// canonicalRData returns the data of rr in canonical form, per RFC 4034
+// section 6.2: uncompressed, with the names in it lowercase.
+func canonicalRData(rr dns.Resource) ([]byte, error) {
+	if u, ok := rr.Body.(*dns.UnknownResource); ok {
+		data := slices.Clone(u.Data)
+		if u.Type == typeDNAME {
+			// Uncompressed, so only lowercasing is needed.
+			for i, c := range data {
+				if 'A' <= c && c <= 'Z' {
+					data[i] = c - 'A' + 'a'
+				}
+			}
+		}
+		return data, nil
+	}
+
+	// Pack the record alone, with the root as its name, without
+	// compression.
+	b := dns.NewBuilder(nil, dns.Header{})
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	h := dns.ResourceHeader{Name: dns.MustNewName("."), Class: rr.Header.Class}
+	var err error
+	switch body := rr.Body.(type) {
+	case *dns.AResource:
+		err = b.AResource(h, *body)
+	case *dns.AAAAResource:
+		err = b.AAAAResource(h, *body)
+	case *dns.TXTResource:
+		err = b.TXTResource(h, *body)
+	case *dns.NSResource:
+		err = b.NSResource(h, dns.NSResource{NS: lowerName(body.NS)})
+	case *dns.CNAMEResource:
+		err = b.CNAMEResource(h, dns.CNAMEResource{CNAME: lowerName(body.CNAME)})
+	case *dns.PTRResource:
+		err = b.PTRResource(h, dns.PTRResource{PTR: lowerName(body.PTR)})
+	case *dns.MXResource:
+		err = b.MXResource(h, dns.MXResource{Pref: body.Pref, MX: lowerName(body.MX)})
+	case *dns.SRVResource:
+		r := *body
+		r.Target = lowerName(r.Target)
+		err = b.SRVResource(h, r)
+	case *dns.SOAResource:
+		r := *body
+		r.NS, r.MBox = lowerName(r.NS), lowerName(r.MBox)
+		err = b.SOAResource(h, r)
+	default:
+		return nil, fmt.Errorf("unsupported record type %v", rr.Header.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	// Skip the root name, type, class, TTL and data length.
+	return msg[headerBytes+1+10:], nil
+}
+
+func lowerName(n dns.Name) dns.Name {
+	for i, c := range n.Data[:n.Length] {
+		if 'A' <= c && c <= 'Z' {
+			n.Data[i] = c - 'A' + 'a'
+		}
+	}
+	return n
+}
+
+// canonicalName returns n, lowercase.
+func canonicalName(n dns.Name) string {
+	return rawNameToLower(n.Data[:n.Length])
+}
+
+// appendNameWire appends the uncompressed wire format of name, which is
+// fully qualified, to b.
+func appendNameWire(b []byte, name string) []byte {
+	for _, label := range nameLabels(name) {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readWireName reads an uncompressed name in wire format from the start of
+// b, returning it lowercase and fully qualified, and its length in b.
+func readWireName(b []byte) (name string, n int, err error) {
+	var sb strings.Builder
+	for {
+		if n >= len(b) {
+			return "", 0, errors.New("name too short")
+		}
+		l := int(b[n])
+		n++
+		if l == 0 {
+			break
+		}
+		if l > 63 || n+l > len(b) {
+			return "", 0, errors.New("invalid name")
+		}
+		sb.WriteString(rawNameToLower(b[n : n+l]))
+		sb.WriteByte('.')
+		n += l
+	}
+	if sb.Len() == 0 {
+		return ".", n, nil
+	}
+	return sb.String(), n, nil
+}
+
+// nameLabels returns the labels of name, which is fully qualified.
+func nameLabels(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// isSubdomain reports whether name is zone or one of its descendants.
+func isSubdomain(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// wildcardName returns the name of the wildcard whose closest encloser
+// is ce.
+func wildcardName(ce string) string {
+	if ce == "." {
+		return "*."
+	}
+	return "*." + ce
+}
+
+// commonSuffix returns the longest name that's an ancestor of, or equal
+// to, both a and b.
+func commonSuffix(a, b string) string {
+	al, bl := nameLabels(a), nameLabels(b)
+	n := 0
+	for n < len(al) && n < len(bl) && al[len(al)-1-n] == bl[len(bl)-1-n] {
+		n++
+	}
+	if n == 0 {
+		return "."
+	}
+	return strings.Join(al[len(al)-n:], ".") + "."
+}
+
+// canonicalCompare compares the lowercase names a and b in the canonical
+// order of RFC 4034 section 6.1.
+func canonicalCompare(a, b string) int {
+	al, bl := nameLabels(a), nameLabels(b)
+	for i, j := len(al)-1, len(bl)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(al[i], bl[j]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(al), len(bl))
+}
@@ -0,0 +1,795 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+)
+
+const testDNSSECTTL = 300
+
+func testHeader(name string, typ dns.Type) dns.ResourceHeader {
+	return dns.ResourceHeader{Name: dns.MustNewName(name), Type: typ, Class: dns.ClassINET, TTL: testDNSSECTTL}
+}
+
+// testSigner signs the records of a test zone with an ECDSA P-256 key.
+type testSigner struct {
+	zone   string
+	key    *ecdsa.PrivateKey
+	dnskey []byte // DNSKEY record data
+	tag    uint16
+}
+
+func newTestSigner(tb testing.TB, zone string) *testSigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pub, err := key.PublicKey.Bytes()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	// A key signing and zone signing key, without the uncompressed
+	// point's 0x04 prefix.
+	rdata := append([]byte{0x01, 0x01, 3, algECDSAP256SHA256}, pub[1:]...)
+	return &testSigner{zone: zone, key: key, dnskey: rdata, tag: keyTag(rdata)}
+}
+
+func (s *testSigner) dnskeyRecord() dns.Resource {
+	return dns.Resource{
+		Header: testHeader(s.zone, typeDNSKEY),
+		Body:   &dns.UnknownResource{Type: typeDNSKEY, Data: s.dnskey},
+	}
+}
+
+func (s *testSigner) ds() dsRecord {
+	h := sha256.New()
+	h.Write(appendNameWire(nil, s.zone))
+	h.Write(s.dnskey)
+	return dsRecord{keyTag: s.tag, alg: algECDSAP256SHA256, digestType: digestSHA256, digest: h.Sum(nil)}
+}
+
+func (s *testSigner) dsRecord() dns.Resource {
+	ds := s.ds()
+	data := binary.BigEndian.AppendUint16(nil, ds.keyTag)
+	data = append(data, ds.alg, ds.digestType)
+	data = append(data, ds.digest...)
+	return dns.Resource{
+		Header: testHeader(s.zone, typeDS),
+		Body:   &dns.UnknownResource{Type: typeDS, Data: data},
+	}
+}
+
+// sign returns an RRSIG record for rrs, an RRset with the name owner,
+// which is a wildcard if the records are synthesized from one.
+func (s *testSigner) sign(tb testing.TB, owner string, rrs []dns.Resource) dns.Resource {
+	tb.Helper()
+	labels := nameLabels(owner)
+	if len(labels) > 0 && labels[0] == "*" {
+		labels = labels[1:]
+	}
+	now := uint32(time.Now().Unix())
+	typ := rrs[0].Header.Type
+	prefix := binary.BigEndian.AppendUint16(nil, uint16(typ))
+	prefix = append(prefix, algECDSAP256SHA256, byte(len(labels)))
+	prefix = binary.BigEndian.AppendUint32(prefix, testDNSSECTTL)
+	prefix = binary.BigEndian.AppendUint32(prefix, now+3600)
+	prefix = binary.BigEndian.AppendUint32(prefix, now-3600)
+	prefix = binary.BigEndian.AppendUint16(prefix, s.tag)
+	prefix = appendNameWire(prefix, s.zone)
+
+	sig := &rrsig{origTTL: testDNSSECTTL, signedPrefix: prefix}
+	data, err := sig.signedData(&rrset{name: owner, typ: typ, rrs: rrs}, owner)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+	r, ss, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		tb.Fatal(err)
+	}
+	prefix = append(prefix, r.FillBytes(make([]byte, 32))...)
+	prefix = append(prefix, ss.FillBytes(make([]byte, 32))...)
+	return dns.Resource{
+		Header: testHeader(canonicalName(rrs[0].Header.Name), typeRRSIG),
+		Body:   &dns.UnknownResource{Type: typeRRSIG, Data: prefix},
+	}
+}
+
+// testZone is a zone served by a testDNSSECUpstream.
+type testZone struct {
+	name   string
+	signer *testSigner // or nil if the zone is unsigned
+	rrs    map[string][]dns.Resource
+}
+
+func newTestZone(tb testing.TB, name string, signed bool) *testZone {
+	z := &testZone{name: name, rrs: map[string][]dns.Resource{}}
+	if signed {
+		z.signer = newTestSigner(tb, name)
+		z.add(z.signer.dnskeyRecord())
+	}
+	child := func(label string) dns.Name {
+		if name == "." {
+			return dns.MustNewName(label + ".")
+		}
+		return dns.MustNewName(label + "." + name)
+	}
+	z.add(dns.Resource{Header: testHeader(name, dns.TypeSOA), Body: &dns.SOAResource{
+		NS:     child("ns"),
+		MBox:   child("hostmaster"),
+		Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: testDNSSECTTL,
+	}})
+	return z
+}
+
+func (z *testZone) add(rr dns.Resource) {
+	name := canonicalName(rr.Header.Name)
+	z.rrs[name] = append(z.rrs[name], rr)
+}
+
+func (z *testZone) addA(name string, ip string) {
+	z.add(dns.Resource{Header: testHeader(name, dns.TypeA), Body: &dns.AResource{A: netip.MustParseAddr(ip).As4()}})
+}
+
+// delegate adds a delegation to child, with a DS record if it's signed.
+func (z *testZone) delegate(child *testZone) {
+	z.add(dns.Resource{Header: testHeader(child.name, dns.TypeNS), Body: &dns.NSResource{NS: dns.MustNewName("ns." + child.name)}})
+	if child.signer != nil {
+		z.add(child.signer.dsRecord())
+	}
+}
+
+// finish adds the zone's chain of NSEC records, if it's signed.
+func (z *testZone) finish() {
+	if z.signer == nil {
+		return
+	}
+	names := slices.SortedFunc(func(yield func(string) bool) {
+		for name := range z.rrs {
+			if !yield(name) {
+				return
+			}
+		}
+	}, canonicalCompare)
+	for i, name := range names {
+		next := names[(i+1)%len(names)]
+		types := []dns.Type{typeNSEC, typeRRSIG}
+		for _, rr := range z.rrs[name] {
+			if !slices.Contains(types, rr.Header.Type) {
+				types = append(types, rr.Header.Type)
+			}
+		}
+		data := appendNameWire(nil, next)
+		data = append(data, testTypeBitmap(types)...)
+		z.add(dns.Resource{Header: testHeader(name, typeNSEC), Body: &dns.UnknownResource{Type: typeNSEC, Data: data}})
+	}
+}
+
+func testTypeBitmap(types []dns.Type) []byte {
+	slices.Sort(types)
+	var out []byte
+	for len(types) > 0 {
+		window := byte(types[0] >> 8)
+		var bm [32]byte
+		n := 0
+		for len(types) > 0 && byte(types[0]>>8) == window {
+			bit := byte(types[0])
+			bm[bit/8] |= 0x80 >> (bit % 8)
+			n = max(n, int(bit/8)+1)
+			types = types[1:]
+		}
+		out = append(out, window, byte(n))
+		out = append(out, bm[:n]...)
+	}
+	return out
+}
+
+func (z *testZone) records(name string, typ dns.Type) []dns.Resource {
+	return slices.DeleteFunc(slices.Clone(z.rrs[name]), func(rr dns.Resource) bool {
+		return rr.Header.Type != typ
+	})
+}
+
+// nsecCovering returns the NSEC record whose owner name precedes name.
+func (z *testZone) nsecCovering(name string) []dns.Resource {
+	var last []dns.Resource
+	for owner := range z.rrs {
+		if canonicalCompare(owner, name) < 0 && (last == nil || canonicalCompare(canonicalName(last[0].Header.Name), owner) < 0) {
+			last = z.records(owner, typeNSEC)
+		}
+	}
+	return last
+}
+
+// testDNSSECUpstream is a recursive resolver for test zones.
+type testDNSSECUpstream struct {
+	tb    testing.TB
+	zones []*testZone
+
+	// strip is whether to remove DNSSEC records from responses.
+	strip atomic.Bool
+
+	// tamper is a name whose A records are changed after signing.
+	tamper string
+
+	// unsign is a name whose responses have their DNSSEC records removed.
+	unsign string
+}
+
+func (u *testDNSSECUpstream) zone(name string) *testZone {
+	var best *testZone
+	for _, z := range u.zones {
+		if isSubdomain(name, z.name) && (best == nil || len(z.name) > len(best.name)) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (u *testDNSSECUpstream) respond(req []byte) []byte {
+	var q dns.Message
+	if err := q.Unpack(req); err != nil {
+		u.tb.Error(err)
+		return nil
+	}
+	question := q.Questions[0]
+	name, typ := canonicalName(question.Name), question.Type
+	z := u.zone(zoneNameFor(name, typ))
+	resp := dns.Message{
+		Header: dns.Header{
+			ID:                 q.ID,
+			Response:           true,
+			RecursionDesired:   q.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: q.Questions,
+	}
+	add := func(sec *[]dns.Resource, owner string, rrs []dns.Resource) {
+		if len(rrs) == 0 {
+			return
+		}
+		*sec = append(*sec, rrs...)
+		if z.signer != nil && rrs[0].Header.Type != dns.TypeNS {
+			*sec = append(*sec, z.signer.sign(u.tb, owner, rrs))
+		}
+	}
+	// addNegative adds the SOA record and the NSEC records proving
+	// there are no records for the name, and either the wildcard that
+	// would match it or the lack of one.
+	addNegative := func(wildcard string) {
+		add(&resp.Authorities, z.name, z.records(z.name, dns.TypeSOA))
+		if z.signer == nil {
+			return
+		}
+		if _, ok := z.rrs[name]; ok {
+			add(&resp.Authorities, name, z.records(name, typeNSEC))
+			return
+		}
+		covering := z.nsecCovering(name)
+		add(&resp.Authorities, canonicalName(covering[0].Header.Name), covering)
+		if _, ok := z.rrs[wildcard]; ok {
+			add(&resp.Authorities, wildcard, z.records(wildcard, typeNSEC))
+		} else if wc := z.nsecCovering(wildcard); wildcard != "" && canonicalName(wc[0].Header.Name) != canonicalName(covering[0].Header.Name) {
+			add(&resp.Authorities, canonicalName(wc[0].Header.Name), wc)
+		}
+	}
+	_, parent, _ := strings.Cut(name, ".")
+	wildcard := wildcardName(cmp.Or(parent, "."))
+	emptyNonTerminal := slices.ContainsFunc(slices.Collect(maps.Keys(z.rrs)), func(n string) bool {
+		return n != name && isSubdomain(n, name)
+	})
+
+	switch {
+	case len(z.records(name, typ)) > 0:
+		add(&resp.Answers, name, z.records(name, typ))
+	case len(z.records(name, dns.TypeCNAME)) > 0:
+		cname := z.records(name, dns.TypeCNAME)
+		add(&resp.Answers, name, cname)
+		target := canonicalName(cname[0].Body.(*dns.CNAMEResource).CNAME)
+		add(&resp.Answers, target, z.records(target, typ))
+	case z.rrs[name] != nil || emptyNonTerminal:
+		addNegative("")
+	case len(z.records(wildcard, typ)) > 0:
+		wc := z.records(wildcard, typ)
+		for _, rr := range wc {
+			rr.Header.Name = question.Name
+			resp.Answers = append(resp.Answers, rr)
+		}
+		sig := z.signer.sign(u.tb, wildcard, wc)
+		sig.Header.Name = question.Name
+		resp.Answers = append(resp.Answers, sig)
+		covering := z.nsecCovering(name)
+		add(&resp.Authorities, canonicalName(covering[0].Header.Name), covering)
+	case z.rrs[wildcard] != nil:
+		addNegative(wildcard)
+	default:
+		resp.RCode = dns.RCodeNameError
+		addNegative(wildcard)
+	}
+
+	if u.strip.Load() || name == u.unsign {
+		for _, sec := range []*[]dns.Resource{&resp.Answers, &resp.Authorities} {
+			*sec = slices.DeleteFunc(*sec, func(rr dns.Resource) bool {
+				return rr.Header.Type == typeRRSIG || rr.Header.Type == typeNSEC
+			})
+		}
+	}
+	if name == u.tamper {
+		for i, rr := range resp.Answers {
+			if a, ok := rr.Body.(*dns.AResource); ok {
+				tampered := *a
+				tampered.A[3]++
+				resp.Answers[i].Body = &tampered
+			}
+		}
+	}
+	for _, rr := range q.Additionals {
+		if rr.Header.Type == dns.TypeOPT {
+			resp.Additionals = append(resp.Additionals, rr)
+		}
+	}
+	res, err := resp.Pack()
+	if err != nil {
+		u.tb.Error(err)
+	}
+	return res
+}
+
+// run serves the upstream over UDP on localhost, returning its address.
+func (u *testDNSSECUpstream) run() string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		u.tb.Fatal(err)
+	}
+	u.tb.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			if res := u.respond(buf[:n]); res != nil {
+				conn.WriteToUDPAddrPort(res, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// newTestDNSSECUpstream returns an upstream for a signed root zone with a
+// signed zone "example." and an unsigned zone "insecure.", and the trust
+// anchor for the root zone. Its answers for bad.example. fail validation,
+// and those for unsigned.example. have no DNSSEC records.
+func newTestDNSSECUpstream(tb testing.TB) (*testDNSSECUpstream, dsRecord) {
+	root := newTestZone(tb, ".", true)
+	example := newTestZone(tb, "example.", true)
+	insecure := newTestZone(tb, "insecure.", false)
+	root.delegate(example)
+	root.delegate(insecure)
+
+	example.addA("www.example.", "192.0.2.1")
+	example.addA("bad.example.", "192.0.2.2")
+	example.addA("unsigned.example.", "192.0.2.5")
+	example.addA("*.wild.example.", "192.0.2.3")
+	example.add(dns.Resource{Header: testHeader("alias.example.", dns.TypeCNAME), Body: &dns.CNAMEResource{CNAME: dns.MustNewName("WWW.example.")}})
+	insecure.addA("host.insecure.", "192.0.2.4")
+	for _, z := range []*testZone{root, example, insecure} {
+		z.finish()
+	}
+	u := &testDNSSECUpstream{
+		tb:     tb,
+		zones:  []*testZone{root, example, insecure},
+		tamper: "bad.example.",
+		unsign: "unsigned.example.",
+	}
+	return u, root.signer.ds()
+}
+
+// makeDNSSECTestRequest returns a query for name with type typ, with an OPT
+// record with the DO bit set if dnssecOK.
+func makeDNSSECTestRequest(tb testing.TB, name string, typ dns.Type, dnssecOK, cd bool) []byte {
+	tb.Helper()
+	b := dns.NewBuilder(nil, dns.Header{ID: 1234, RecursionDesired: true, CheckingDisabled: cd})
+	b.StartQuestions()
+	b.Question(dns.Question{Name: dns.MustNewName(name), Type: typ, Class: dns.ClassINET})
+	if dnssecOK {
+		b.StartAdditionals()
+		var h dns.ResourceHeader
+		h.SetEDNS0(1232, dns.RCodeSuccess, true)
+		b.OPTResource(h, dns.OPTResource{})
+	}
+	req, err := b.Finish()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return req
+}
+
+func TestForwarderDNSSEC(t *testing.T) {
+	upstream, anchor := newTestDNSSECUpstream(t)
+	addr := upstream.run()
+
+	fwd := newTestForwarder(t)
+	fwd.dnssec = newDNSSECValidator(t.Logf, []dsRecord{anchor})
+	rr := resolverAndDelay{name: &dnstype.Resolver{Addr: addr}}
+
+	query := func(t *testing.T, req []byte) *dns.Message {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		rchan := make(chan packet, 1)
+		rpkt := packet{bs: req, family: "udp", addr: netip.MustParseAddrPort("127.0.0.1:12345")}
+		if err := fwd.forwardWithDestChan(ctx, rpkt, rchan, rr); err != nil {
+			t.Fatal(err)
+		}
+		var msg dns.Message
+		if err := msg.Unpack((<-rchan).bs); err != nil {
+			t.Fatal(err)
+		}
+		return &msg
+	}
+	hasType := func(rrs []dns.Resource, typ dns.Type) bool {
+		return slices.ContainsFunc(rrs, func(rr dns.Resource) bool { return rr.Header.Type == typ })
+	}
+
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    dns.Type
+		dnssecOK bool
+		cd       bool
+		wantCode dns.RCode
+		wantAD   bool
+		wantN    int // answers of type qtype
+	}{
+		{name: "secure", qname: "www.example.", qtype: dns.TypeA, dnssecOK: true, wantAD: true, wantN: 1},
+		{name: "secure-no-do", qname: "www.example.", qtype: dns.TypeA, wantN: 1},
+		{name: "cname", qname: "alias.example.", qtype: dns.TypeA, dnssecOK: true, wantAD: true, wantN: 1},
+		{name: "wildcard", qname: "x.wild.example.", qtype: dns.TypeA, dnssecOK: true, wantAD: true, wantN: 1},
+		{name: "nxdomain", qname: "missing.example.", qtype: dns.TypeA, dnssecOK: true, wantCode: dns.RCodeNameError, wantAD: true},
+		{name: "nodata", qname: "www.example.", qtype: dns.TypeAAAA, dnssecOK: true, wantAD: true},
+		{name: "ds", qname: "example.", qtype: typeDS, dnssecOK: true, wantAD: true, wantN: 1},
+		{name: "insecure", qname: "host.insecure.", qtype: dns.TypeA, dnssecOK: true, wantN: 1},
+		{name: "bogus", qname: "bad.example.", qtype: dns.TypeA, dnssecOK: true, wantCode: dns.RCodeServerFailure},
+		{name: "unsigned-answer", qname: "unsigned.example.", qtype: dns.TypeA, dnssecOK: true, wantCode: dns.RCodeServerFailure},
+		{name: "unsigned-nodata", qname: "unsigned.example.", qtype: dns.TypeAAAA, dnssecOK: true, wantCode: dns.RCodeServerFailure},
+		{name: "checking-disabled", qname: "bad.example.", qtype: dns.TypeA, dnssecOK: true, cd: true, wantN: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := query(t, makeDNSSECTestRequest(t, tt.qname, tt.qtype, tt.dnssecOK, tt.cd))
+			if msg.RCode != tt.wantCode {
+				t.Errorf("rcode = %v; want %v", msg.RCode, tt.wantCode)
+			}
+			if msg.AuthenticData != tt.wantAD {
+				t.Errorf("AD = %v; want %v", msg.AuthenticData, tt.wantAD)
+			}
+			var n int
+			for _, rr := range msg.Answers {
+				if rr.Header.Type == tt.qtype {
+					n++
+				}
+			}
+			if n != tt.wantN {
+				t.Errorf("got %d %v answers; want %d", n, tt.qtype, tt.wantN)
+			}
+			if got := hasType(msg.Answers, typeRRSIG) || hasType(msg.Authorities, typeRRSIG); got && !tt.dnssecOK {
+				t.Error("got RRSIG records without DO bit")
+			}
+			if got := hasType(msg.Additionals, dns.TypeOPT); got != tt.dnssecOK && tt.wantCode != dns.RCodeServerFailure {
+				t.Errorf("got OPT record = %v; want %v", got, tt.dnssecOK)
+			}
+		})
+	}
+	if fwd.health.IsUnhealthy(dnssecStripped) {
+		t.Error("stripped DNSSEC warning raised by bogus response")
+	}
+
+	// Once the keys of a signed zone have been validated, responses
+	// from it without DNSSEC records are bogus, not insecure.
+	upstream.strip.Store(true)
+	fwd.cache.flush()
+	if msg := query(t, makeDNSSECTestRequest(t, "host.insecure.", dns.TypeA, false, false)); msg.RCode != dns.RCodeSuccess {
+		t.Errorf("insecure rcode with stripping upstream = %v; want success", msg.RCode)
+	}
+	if msg := query(t, makeDNSSECTestRequest(t, "www.example.", dns.TypeA, true, false)); msg.RCode != dns.RCodeServerFailure {
+		t.Errorf("signed name with stripping upstream: rcode %v; want %v", msg.RCode, dns.RCodeServerFailure)
+	}
+	if fwd.health.IsUnhealthy(dnssecStripped) {
+		t.Error("stripped DNSSEC warning raised for a zone with validated keys")
+	}
+	upstream.strip.Store(false)
+	fwd.cache.flush()
+	if msg := query(t, makeDNSSECTestRequest(t, "www.example.", dns.TypeA, true, false)); !msg.AuthenticData {
+		t.Error("response not authenticated after upstream stopped stripping")
+	}
+}
+
+func TestForwarderDNSSECStripped(t *testing.T) {
+	// With a resolver that has stripped DNSSEC records from the start,
+	// even the root zone's keys can't be validated.
+	upstream, anchor := newTestDNSSECUpstream(t)
+	upstream.strip.Store(true)
+	addr := upstream.run()
+
+	fwd := newTestForwarder(t)
+	fwd.dnssec = newDNSSECValidator(t.Logf, []dsRecord{anchor})
+	rr := resolverAndDelay{name: &dnstype.Resolver{Addr: addr}}
+
+	for _, name := range []string{"www.example.", "host.insecure.", "bad.example."} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		rchan := make(chan packet, 1)
+		rpkt := packet{
+			bs:     makeDNSSECTestRequest(t, name, dns.TypeA, true, false),
+			family: "udp",
+			addr:   netip.MustParseAddrPort("127.0.0.1:12345"),
+		}
+		if err := fwd.forwardWithDestChan(ctx, rpkt, rchan, rr); err != nil {
+			t.Fatal(err)
+		}
+		var msg dns.Message
+		if err := msg.Unpack((<-rchan).bs); err != nil {
+			t.Fatal(err)
+		}
+		if msg.RCode != dns.RCodeSuccess || msg.AuthenticData || len(msg.Answers) != 1 {
+			t.Errorf("%s: rcode %v, AD %v, %d answers; want success without AD and 1 answer", name, msg.RCode, msg.AuthenticData, len(msg.Answers))
+		}
+	}
+	if !fwd.health.IsUnhealthy(dnssecStripped) {
+		t.Error("stripped DNSSEC warning not raised")
+	}
+}
+
+func TestVerifySignatureAlgorithms(t *testing.T) {
+	data := []byte("signed data")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 3110 section 2: exponent length, exponent, modulus.
+	rsaPub := append([]byte{3, 1, 0, 1}, rsaKey.N.Bytes()...)
+	signRSA := func(h crypto.Hash) []byte {
+		digest := hashOf(h.New(), data)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, h, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	ecdsaKey := func(curve elliptic.Curve, h crypto.Hash) (pub, sig []byte) {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := key.PublicKey.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, key, hashOf(h.New(), data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		return b[1:], sig
+	}
+	p256Pub, p256Sig := ecdsaKey(elliptic.P256(), crypto.SHA256)
+	p384Pub, p384Sig := ecdsaKey(elliptic.P384(), crypto.SHA384)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		alg      uint8
+		key, sig []byte
+	}{
+		{"RSASHA256", algRSASHA256, rsaPub, signRSA(crypto.SHA256)},
+		{"RSASHA512", algRSASHA512, rsaPub, signRSA(crypto.SHA512)},
+		{"ECDSAP256SHA256", algECDSAP256SHA256, p256Pub, p256Sig},
+		{"ECDSAP384SHA384", algECDSAP384SHA384, p384Pub, p384Sig},
+		{"ED25519", algED25519, edPub, ed25519.Sign(edKey, data)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !supportedAlgorithm(tt.alg) {
+				t.Errorf("algorithm %d not supported", tt.alg)
+			}
+			if err := verifySignature(tt.alg, tt.key, data, tt.sig); err != nil {
+				t.Errorf("valid signature: %v", err)
+			}
+			if err := verifySignature(tt.alg, tt.key, []byte("other data"), tt.sig); err == nil {
+				t.Error("signature of other data verified")
+			}
+		})
+	}
+	const algRSASHA1 = 5
+	if err := verifySignature(algRSASHA1, rsaPub, data, signRSA(crypto.SHA256)); err == nil {
+		t.Error("RSASHA1 signature verified")
+	}
+}
+
+func TestNSEC3Denial(t *testing.T) {
+	// A zone example. with the names example., a.example. and
+	// *.w.example., the last making w.example. an empty non-terminal.
+	params := &nsec3Record{iterations: 1, salt: []byte{0xab, 0xcd}}
+	types := map[string][]dns.Type{
+		"example.":     {dns.TypeSOA, dns.TypeNS, typeDNSKEY},
+		"a.example.":   {dns.TypeA},
+		"w.example.":   nil,
+		"*.w.example.": {dns.TypeA},
+	}
+	newDenial := func(optOut bool) *denial {
+		var recs []*nsec3Record
+		for name, ts := range types {
+			r := *params
+			r.hash = params.hashName(name)
+			r.types = testTypeBitmap(slices.Clone(ts))
+			if optOut {
+				r.flags = nsec3FlagOptOut
+			}
+			recs = append(recs, &r)
+		}
+		slices.SortFunc(recs, func(a, b *nsec3Record) int { return bytes.Compare(a.hash, b.hash) })
+		for i, r := range recs {
+			r.next = recs[(i+1)%len(recs)].hash
+		}
+		return &denial{zone: "example.", nsec3: recs}
+	}
+
+	d := newDenial(false)
+	if insecure, err := d.nameError("missing.example."); err != nil || insecure {
+		t.Errorf("nameError = %v, %v; want secure proof", insecure, err)
+	}
+	if _, err := d.nameError("a.example."); err == nil {
+		t.Error("nameError for existing name succeeded")
+	}
+	if insecure, err := d.noData("a.example.", dns.TypeAAAA); err != nil || insecure {
+		t.Errorf("noData = %v, %v; want secure proof", insecure, err)
+	}
+	if _, err := d.noData("a.example.", dns.TypeA); err == nil {
+		t.Error("noData for existing type succeeded")
+	}
+	if insecure, err := d.noData("w.example.", dns.TypeA); err != nil || insecure {
+		t.Errorf("noData for empty non-terminal = %v, %v; want secure proof", insecure, err)
+	}
+	if insecure, err := d.wildcardExpansion("x.w.example.", "w.example."); err != nil || insecure {
+		t.Errorf("wildcardExpansion = %v, %v; want secure proof", insecure, err)
+	}
+	if _, err := d.wildcardExpansion("a.example.", "example."); err == nil {
+		t.Error("wildcardExpansion for existing name succeeded")
+	}
+	if _, err := d.noData("unsigned.example.", typeDS); err == nil {
+		t.Error("noData for DS of unlisted name succeeded without opt-out")
+	}
+
+	// With opt-out, unlisted names may be unsigned delegations, so the
+	// proofs only show that they're insecure.
+	d = newDenial(true)
+	if insecure, err := d.nameError("missing.example."); err != nil || !insecure {
+		t.Errorf("opt-out nameError = %v, %v; want insecure", insecure, err)
+	}
+	if insecure, err := d.noData("unsigned.example.", typeDS); err != nil || !insecure {
+		t.Errorf("opt-out noData for DS = %v, %v; want insecure", insecure, err)
+	}
+	if insecure, err := d.noData("a.example.", dns.TypeAAAA); err != nil || insecure {
+		t.Errorf("opt-out noData for listed name = %v, %v; want secure proof", insecure, err)
+	}
+
+	// Too many iterations are treated as unsigned, per RFC 9276.
+	d = newDenial(false)
+	d.insecure = true
+	if insecure, err := d.nameError("missing.example."); err != nil || !insecure {
+		t.Errorf("nameError with too many iterations = %v, %v; want insecure", insecure, err)
+	}
+}
+
+func TestSynthesizedFromDNAME(t *testing.T) {
+	dname := func(owner, target string, signed bool) *rrset {
+		set := &rrset{name: owner, typ: typeDNAME, rrs: []dns.Resource{{
+			Header: testHeader(owner, typeDNAME),
+			Body:   &dns.UnknownResource{Type: typeDNAME, Data: appendNameWire(nil, target)},
+		}}}
+		if signed {
+			set.sigs = []*rrsig{{typeCovered: typeDNAME}}
+		}
+		return set
+	}
+	cname := func(owner, target string) *rrset {
+		return &rrset{name: owner, typ: dns.TypeCNAME, rrs: []dns.Resource{{
+			Header: testHeader(owner, dns.TypeCNAME),
+			Body:   &dns.CNAMEResource{CNAME: dns.MustNewName(target)},
+		}}}
+	}
+	tests := []struct {
+		name  string
+		dname *rrset
+		cname *rrset
+		want  bool
+	}{
+		{"synthesized", dname("old.example.", "new.example.", true), cname("www.old.example.", "www.new.example."), true},
+		{"to-root", dname("old.example.", ".", true), cname("www.old.example.", "www."), true},
+		{"unsigned-dname", dname("old.example.", "new.example.", false), cname("www.old.example.", "www.new.example."), false},
+		{"other-target", dname("old.example.", "new.example.", true), cname("www.old.example.", "www.evil.example."), false},
+		{"dname-owner", dname("old.example.", "new.example.", true), cname("old.example.", "new.example."), false},
+		{"not-below", dname("old.example.", "new.example.", true), cname("www.other.example.", "www.new.example."), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := synthesizedFromDNAME([]*rrset{tt.dname, tt.cname}, tt.cname); got != tt.want {
+				t.Errorf("synthesizedFromDNAME = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSSECNameOrder(t *testing.T) {
+	// From RFC 4034 section 6.1.
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"z.a.example.",
+		"zabc.a.example.",
+		"z.example.",
+		"\001.z.example.",
+		"*.z.example.",
+		"\200.z.example.",
+	}
+	for i := range names {
+		for j := range names {
+			want := fmt.Sprint(max(-1, min(1, i-j)))
+			if got := fmt.Sprint(canonicalCompare(names[i], names[j])); got != want {
+				t.Errorf("canonicalCompare(%q, %q) = %s; want %s", names[i], names[j], got, want)
+			}
+		}
+	}
+}
+
+func TestTypeBitmapHas(t *testing.T) {
+	// From RFC 4034 section 4.3: A MX RRSIG NSEC TYPE1234.
+	bm := []byte{
+		0x00, 0x06, 0x40, 0x01, 0x00, 0x00, 0x00, 0x03,
+		0x04, 0x1b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x20,
+	}
+	for _, typ := range []dns.Type{dns.TypeA, dns.TypeMX, typeRRSIG, typeNSEC, 1234} {
+		if !typeBitmapHas(bm, typ) {
+			t.Errorf("%v not in bitmap", typ)
+		}
+	}
+	for _, typ := range []dns.Type{dns.TypeNS, dns.TypeAAAA, typeDS, 1235} {
+		if typeBitmapHas(bm, typ) {
+			t.Errorf("%v in bitmap", typ)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/net/dnscache"
+	"tailscale.com/net/sockstats"
+	"tailscale.com/net/tlsdial"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// dotPort is the default port of DNS-over-TLS servers, per RFC 7858.
+	dotPort = 853
+
+	// dotIdleConnTimeout is how long to keep idle connections open to
+	// DNS-over-TLS servers. See dohIdleConnTimeout for why it's short.
+	dotIdleConnTimeout = dohIdleConnTimeout
+
+	// dotMaxInFlight is the maximum number of queries that may be
+	// pipelined on a single DNS-over-TLS connection at once.
+	dotMaxInFlight = 1024
+)
+
+var (
+	errDoTConnIdle     = errors.New("DNS-over-TLS connection closed while idle")
+	errDoTTooManyQuery = errors.New("too many in-flight DNS-over-TLS queries")
+)
+
+// parseDoTResolver parses a "tls://" resolver into the name to verify the
+// server's certificate against and the addresses to dial it at.
+//
+// The address is either "tls://ip[:port]", or "tls://hostname[:port]" with
+// the hostname's IP addresses in r.BootstrapResolution. Hostnames aren't
+// otherwise resolved, as the system resolver may well be this one.
+func parseDoTResolver(r *dnstype.Resolver) (serverName string, addrs []netip.AddrPort, err error) {
+	hostPort, ok := strings.CutPrefix(r.Addr, "tls://")
+	if !ok {
+		return "", nil, fmt.Errorf("not a tls:// resolver: %q", r.Addr)
+	}
+	hostPort = strings.TrimSuffix(hostPort, "/")
+	host, port := hostPort, uint16(dotPort)
+	if ip, err := netip.ParseAddr(strings.Trim(hostPort, "[]")); err == nil {
+		host = ip.String()
+	} else if h, p, err := net.SplitHostPort(hostPort); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || n == 0 {
+			return "", nil, fmt.Errorf("invalid port in tls:// resolver %q", r.Addr)
+		}
+		host, port = h, uint16(n)
+	}
+	if host == "" || strings.ContainsAny(host, "/?#@") {
+		return "", nil, fmt.Errorf("invalid tls:// resolver %q", r.Addr)
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.String(), []netip.AddrPort{netip.AddrPortFrom(ip, port)}, nil
+	}
+	if len(r.BootstrapResolution) == 0 {
+		return "", nil, fmt.Errorf("tls:// resolver %q needs an IP address or bootstrap resolution", r.Addr)
+	}
+	for _, ip := range r.BootstrapResolution {
+		addrs = append(addrs, netip.AddrPortFrom(ip, port))
+	}
+	return strings.TrimSuffix(host, "."), addrs, nil
+}
+
+// getDoTUpstream returns the DNS-over-TLS upstream for the "tls://" resolver
+// r, creating it if needed.
+func (f *forwarder) getDoTUpstream(r *dnstype.Resolver) (*dotUpstream, error) {
+	serverName, addrs, err := parseDoTResolver(r)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if u, ok := f.dotUpstreams[r.Addr]; ok {
+		if u.serverName == serverName && slices.Equal(u.addrs, addrs) {
+			return u, nil
+		}
+		// Its bootstrap resolution changed; start over.
+		u.close()
+	}
+	u := &dotUpstream{
+		f:          f,
+		serverName: serverName,
+		addrs:      addrs,
+	}
+	if f.dotUpstreams == nil {
+		f.dotUpstreams = map[string]*dotUpstream{}
+	}
+	f.dotUpstreams[r.Addr] = u
+	return u, nil
+}
+
+// sendDoT sends packet to the DNS-over-TLS server named by the "tls://"
+// resolver r, reusing an open connection to it if there's one.
+func (f *forwarder) sendDoT(ctx context.Context, r *dnstype.Resolver, packet []byte) ([]byte, error) {
+	ctx = sockstats.WithSockStats(ctx, sockstats.LabelDNSForwarderDoT, f.logf)
+	metricDNSFwdDoT.Add(1)
+
+	u, err := f.getDoTUpstream(r)
+	if err != nil {
+		metricDNSFwdErrorType.Add(1)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tcpQueryTimeout)
+	defer cancel()
+
+	var res []byte
+	for {
+		c, reused, err := u.conn(ctx)
+		if err != nil {
+			metricDNSFwdDoTErrorDial.Add(1)
+			return nil, err
+		}
+		res, err = c.roundTrip(ctx, packet)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// Servers may close connections that they consider idle before
+		// we do, so retry once on a new connection if a reused one
+		// failed.
+		if !reused || !c.isBroken() {
+			return nil, err
+		}
+	}
+
+	rcode := getRCode(res)
+	// don't forward transient errors back to the client when the server fails
+	if rcode == dns.RCodeServerFailure {
+		f.logf("sendDoT: response code indicating server failure: %d", rcode)
+		metricDNSFwdDoTErrorServer.Add(1)
+		return nil, errServerFailure
+	}
+	if truncatedFlagSet(res) {
+		metricDNSFwdTruncated.Add(1)
+	}
+	metricDNSFwdDoTSuccess.Add(1)
+	return res, nil
+}
+
+// dotUpstream is a DNS-over-TLS server that queries are pipelined to over
+// a single connection, which is redialed as needed.
+type dotUpstream struct {
+	f          *forwarder
+	serverName string           // to verify the server's certificate against
+	addrs      []netip.AddrPort // to dial; all have the same port
+
+	mu     sync.Mutex // guards the following, and is held while dialing
+	c      *dotConn   // or nil
+	closed bool
+}
+
+// conn returns an open connection to u, dialing one if needed. reused
+// reports whether the connection was already open.
+func (u *dotUpstream) conn(ctx context.Context) (c *dotConn, reused bool, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		return nil, false, net.ErrClosed
+	}
+	if u.c != nil && !u.c.isBroken() {
+		return u.c, true, nil
+	}
+	u.c = nil
+
+	ips := make([]netip.Addr, len(u.addrs))
+	for i, ipp := range u.addrs {
+		ips[i] = ipp.Addr()
+	}
+	dial := dnscache.Dialer(u.f.getDialerType(), &dnscache.Resolver{
+		SingleHost:             u.serverName,
+		SingleHostStaticResult: ips,
+		Logf:                   u.f.logf,
+	})
+	port := strconv.Itoa(int(u.addrs[0].Port()))
+	tc, err := dial(ctx, "tcp", net.JoinHostPort(u.serverName, port))
+	if err != nil {
+		return nil, false, err
+	}
+	tlsConn := tls.Client(tc, u.tlsConfig())
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		tc.Close()
+		return nil, false, err
+	}
+	u.c = newDoTConn(u.f.logf, tlsConn)
+	return u.c, false, nil
+}
+
+// tlsConfig returns the TLS config to connect to u with.
+func (u *dotUpstream) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		ServerName: u.serverName,
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"dot"},
+	}
+	var conf *tls.Config
+	if roots := u.f.dotRootCAsForTest; roots != nil {
+		conf = base
+		conf.RootCAs = roots
+	} else {
+		conf = tlsdial.Config(u.f.health, base)
+	}
+
+	// Neither crypto/tls nor tlsdial verify the server's certificate
+	// against an IP address ServerName, as it isn't sent with SNI, so
+	// always verify the name or IP address here.
+	verify := conf.VerifyConnection
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no certificate from DNS-over-TLS server")
+		}
+		return cs.PeerCertificates[0].VerifyHostname(u.serverName)
+	}
+	return conf
+}
+
+// close closes u's connection, if any, and stops it from dialing new ones.
+func (u *dotUpstream) close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	if u.c != nil {
+		u.c.close(net.ErrClosed)
+		u.c = nil
+	}
+}
+
+// dotConn is a connection to a DNS-over-TLS server that pipelines queries,
+// per RFC 7766 section 6.2.1.1. Queries are sent with DNS IDs unique to
+// the connection, so that responses can be matched to them regardless of
+// their original IDs or the order the server responds in.
+type dotConn struct {
+	logf logger.Logf
+	conn net.Conn
+
+	writeMu sync.Mutex // serializes writes to conn
+
+	mu      sync.Mutex // guards the following
+	err     error      // non-nil once the connection is broken
+	nextID  uint16
+	pending map[uint16]chan []byte // by DNS ID on the wire
+	idle    *time.Timer            // closes the connection once idle
+}
+
+func newDoTConn(logf logger.Logf, conn net.Conn) *dotConn {
+	c := &dotConn{
+		logf:    logf,
+		conn:    conn,
+		pending: map[uint16]chan []byte{},
+	}
+	c.idle = time.AfterFunc(dotIdleConnTimeout, c.closeIfIdle)
+	go c.readLoop()
+	return c
+}
+
+// isBroken reports whether c can no longer be used.
+func (c *dotConn) isBroken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// close closes c, failing any in-flight queries with err.
+func (c *dotConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(err)
+}
+
+func (c *dotConn) closeLocked(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.idle.Stop()
+	c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *dotConn) closeIfIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		c.closeLocked(errDoTConnIdle)
+	}
+}
+
+// roundTrip sends the query packet on c and returns the response to it,
+// with the DNS ID of packet.
+func (c *dotConn) roundTrip(ctx context.Context, packet []byte) ([]byte, error) {
+	if len(packet) < headerBytes || len(packet) > 0xffff {
+		return nil, fmt.Errorf("invalid DNS query length %d", len(packet))
+	}
+	origID := binary.BigEndian.Uint16(packet)
+
+	ch := make(chan []byte, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	if len(c.pending) >= dotMaxInFlight {
+		c.mu.Unlock()
+		return nil, errDoTTooManyQuery
+	}
+	id := c.nextID
+	for c.pending[id] != nil {
+		id++
+	}
+	c.nextID = id + 1
+	c.pending[id] = ch
+	c.idle.Stop()
+	c.mu.Unlock()
+	defer c.release(id, ch)
+
+	msg := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(msg, uint16(len(packet)))
+	copy(msg[2:], packet)
+	binary.BigEndian.PutUint16(msg[2:], id)
+	if err := c.write(ctx, msg); err != nil {
+		metricDNSFwdDoTErrorWrite.Add(1)
+		return nil, err
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return nil, c.err
+		}
+		binary.BigEndian.PutUint16(res, origID)
+		return res, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// The server isn't responding; don't keep using the
+			// connection.
+			c.close(ctx.Err())
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// release forgets the in-flight query with the given DNS ID, and starts
+// the idle timer if it was the last.
+func (c *dotConn) release(id uint16, ch chan []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[id] == ch {
+		delete(c.pending, id)
+	}
+	if len(c.pending) == 0 && c.err == nil {
+		c.idle.Reset(dotIdleConnTimeout)
+	}
+}
+
+// write writes msg to c, closing c if the write fails, as a partial write
+// leaves the stream unusable.
+func (c *dotConn) write(ctx context.Context, msg []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(tcpQueryTimeout)
+	}
+	c.conn.SetWriteDeadline(deadline)
+	if _, err := c.conn.Write(msg); err != nil {
+		c.close(err)
+		return err
+	}
+	return nil
+}
+
+// readLoop reads responses from c and hands them to the queries waiting
+// for them, until c is closed.
+func (c *dotConn) readLoop() {
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(c.conn, length[:]); err != nil {
+			c.readFailed(err)
+			return
+		}
+		res := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(c.conn, res); err != nil {
+			c.readFailed(err)
+			return
+		}
+		if len(res) < headerBytes {
+			c.readFailed(fmt.Errorf("DNS-over-TLS response too short (%d bytes)", len(res)))
+			return
+		}
+		id := binary.BigEndian.Uint16(res)
+		c.mu.Lock()
+		if ch, ok := c.pending[id]; ok {
+			delete(c.pending, id)
+			ch <- res
+		}
+		// Otherwise the query was abandoned; drop its response.
+		c.mu.Unlock()
+	}
+}
+
+func (c *dotConn) readFailed(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		// Closed by us.
+		return
+	}
+	if len(c.pending) > 0 {
+		metricDNSFwdDoTErrorRead.Add(1)
+	}
+	c.closeLocked(err)
+}
@@ -0,0 +1,308 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tstest"
+	"tailscale.com/types/dnstype"
+)
+
+func TestParseDoTResolver(t *testing.T) {
+	tests := []struct {
+		addr       string
+		bootstrap  []netip.Addr
+		serverName string
+		addrs      []netip.AddrPort
+		wantErr    bool
+	}{
+		{
+			addr:       "tls://10.0.0.1",
+			serverName: "10.0.0.1",
+			addrs:      []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:853")},
+		},
+		{
+			addr:       "tls://10.0.0.1:8853",
+			serverName: "10.0.0.1",
+			addrs:      []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:8853")},
+		},
+		{
+			addr:       "tls://[fd00::1]",
+			serverName: "fd00::1",
+			addrs:      []netip.AddrPort{netip.MustParseAddrPort("[fd00::1]:853")},
+		},
+		{
+			addr:       "tls://fd00::1",
+			serverName: "fd00::1",
+			addrs:      []netip.AddrPort{netip.MustParseAddrPort("[fd00::1]:853")},
+		},
+		{
+			addr:       "tls://[fd00::1]:8853",
+			serverName: "fd00::1",
+			addrs:      []netip.AddrPort{netip.MustParseAddrPort("[fd00::1]:8853")},
+		},
+		{
+			addr:       "tls://dns.corp.example:8853",
+			bootstrap:  []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")},
+			serverName: "dns.corp.example",
+			addrs: []netip.AddrPort{
+				netip.MustParseAddrPort("10.0.0.1:8853"),
+				netip.MustParseAddrPort("[fd00::1]:8853"),
+			},
+		},
+		{addr: "tls://dns.corp.example", wantErr: true},
+		{addr: "tls://10.0.0.1:0", wantErr: true},
+		{addr: "tls://10.0.0.1:bogus", wantErr: true},
+		{addr: "tls://", wantErr: true},
+		{addr: "tls://dns.corp.example/path", bootstrap: []netip.Addr{netip.MustParseAddr("10.0.0.1")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			serverName, addrs, err := parseDoTResolver(&dnstype.Resolver{Addr: tt.addr, BootstrapResolution: tt.bootstrap})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; want error: %v", err, tt.wantErr)
+			}
+			if serverName != tt.serverName || !reflect.DeepEqual(addrs, tt.addrs) {
+				t.Errorf("got %q, %v; want %q, %v", serverName, addrs, tt.serverName, tt.addrs)
+			}
+		})
+	}
+}
+
+// testDoTCert returns a self-signed certificate for ip.
+func testDoTCert(tb testing.TB, ip netip.Addr) tls.Certificate {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{ip.AsSlice()},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// runDoTServer runs a DNS-over-TLS server with the given certificate. It
+// reads batch queries from a connection before answering them, in reverse
+// order, with an A record of 127.0.0.1 for the queried name. It returns
+// the server's address and a func returning how many connections it has
+// accepted, and closes each connection after it's answered closeAfter
+// queries on it, if non-zero.
+func runDoTServer(tb testing.TB, cert tls.Certificate, batch, closeAfter int) (netip.AddrPort, func() int) {
+	logf := tstest.WhileTestRunningLogger(tb)
+	ln, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var accepted atomic.Int32
+
+	readQuery := func(conn net.Conn) ([]byte, error) {
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		q := make([]byte, length)
+		_, err := io.ReadFull(conn, q)
+		return q, err
+	}
+	answer := func(q []byte) []byte {
+		var p dns.Parser
+		h, err := p.Start(q)
+		if err != nil {
+			tb.Error(err)
+			return nil
+		}
+		question, err := p.Question()
+		if err != nil {
+			tb.Error(err)
+			return nil
+		}
+		res := makeTestResponse(tb, question.Name.String(), dns.RCodeSuccess, netip.MustParseAddr("127.0.0.1"))
+		binary.BigEndian.PutUint16(res, h.ID)
+		msg := binary.BigEndian.AppendUint16(nil, uint16(len(res)))
+		return append(msg, res...)
+	}
+	handleConn := func(conn net.Conn) {
+		defer conn.Close()
+		for answered := 0; closeAfter == 0 || answered < closeAfter; {
+			var qs [][]byte
+			for range batch {
+				q, err := readQuery(conn)
+				if err != nil {
+					logf("reading query: %v", err)
+					return
+				}
+				qs = append(qs, q)
+			}
+			for i := len(qs) - 1; i >= 0; i-- {
+				if _, err := conn.Write(answer(qs[i])); err != nil {
+					logf("writing response: %v", err)
+					return
+				}
+				answered++
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handleConn(conn)
+			}()
+		}
+	}()
+	tb.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	return netip.MustParseAddrPort(ln.Addr().String()), func() int { return int(accepted.Load()) }
+}
+
+// answerName returns the name of the first answer in res.
+func answerName(tb testing.TB, res []byte) string {
+	tb.Helper()
+	var p dns.Parser
+	if _, err := p.Start(res); err != nil {
+		tb.Fatal(err)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		tb.Fatal(err)
+	}
+	h, err := p.AnswerHeader()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return h.Name.String()
+}
+
+func TestForwarderDoT(t *testing.T) {
+	cert := testDoTCert(t, netip.MustParseAddr("127.0.0.1"))
+	addr, accepted := runDoTServer(t, cert, 2, 0)
+	fwd := newTestForwarder(t)
+	fwd.dotRootCAsForTest = x509.NewCertPool()
+	fwd.dotRootCAsForTest.AddCert(cert.Leaf)
+	r := &dnstype.Resolver{Addr: "tls://" + addr.String()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Queries with the same DNS ID are pipelined on one connection, and
+	// matched to their out of order responses.
+	domains := []string{"a.example.com.", "b.example.com."}
+	var wg sync.WaitGroup
+	for _, domain := range domains {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := makeTestRequest(t, domain)
+			binary.BigEndian.PutUint16(req, someDNSID)
+			res, err := fwd.sendDoT(ctx, r, req)
+			if err != nil {
+				t.Errorf("%s: %v", domain, err)
+				return
+			}
+			if id := binary.BigEndian.Uint16(res); id != someDNSID {
+				t.Errorf("%s: response DNS ID = %d; want %d", domain, id, someDNSID)
+			}
+			if got := answerName(t, res); got != domain {
+				t.Errorf("response for %s is for %s", domain, got)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := accepted(); got != 1 {
+		t.Errorf("server accepted %d connections; want 1", got)
+	}
+
+}
+
+func TestForwarderDoTRedial(t *testing.T) {
+	cert := testDoTCert(t, netip.MustParseAddr("127.0.0.1"))
+	addr, accepted := runDoTServer(t, cert, 1, 1)
+	fwd := newTestForwarder(t)
+	fwd.dotRootCAsForTest = x509.NewCertPool()
+	fwd.dotRootCAsForTest.AddCert(cert.Leaf)
+	r := &dnstype.Resolver{Addr: "tls://" + addr.String()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i, domain := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		res, err := fwd.sendDoT(ctx, r, makeTestRequest(t, domain))
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if got := answerName(t, res); got != domain {
+			t.Errorf("response for %s is for %s", domain, got)
+		}
+	}
+	if got := accepted(); got != 3 {
+		t.Errorf("server accepted %d connections; want 3", got)
+	}
+}
+
+func TestForwarderDoTVerify(t *testing.T) {
+	cert := testDoTCert(t, netip.MustParseAddr("127.0.0.2"))
+	addr, _ := runDoTServer(t, cert, 1, 0)
+	r := &dnstype.Resolver{Addr: "tls://" + addr.String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The certificate chains to a trusted root, but isn't for the IP.
+	fwd := newTestForwarder(t)
+	fwd.dotRootCAsForTest = x509.NewCertPool()
+	fwd.dotRootCAsForTest.AddCert(cert.Leaf)
+	if _, err := fwd.sendDoT(ctx, r, makeTestRequest(t, "a.example.com.")); err == nil {
+		t.Error("query succeeded with certificate for another IP")
+	}
+
+	// The certificate doesn't chain to a trusted root.
+	other := testDoTCert(t, netip.MustParseAddr("127.0.0.1"))
+	addr, _ = runDoTServer(t, other, 1, 0)
+	r = &dnstype.Resolver{Addr: "tls://" + addr.String()}
+	if _, err := fwd.sendDoT(ctx, r, makeTestRequest(t, "a.example.com.")); err == nil {
+		t.Error("query succeeded with untrusted certificate")
+	}
+}
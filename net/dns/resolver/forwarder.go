@@ -8,16 +8,19 @@
 	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
 	"runtime"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -225,12 +228,27 @@ type forwarder struct {
 
 	controlKnobs *controlknobs.Knobs // or nil
 
+	cache responseCache
+
+	// dnssec, if non-nil, validates the DNSSEC signatures of responses
+	// to queries forwarded via the default route or to explicit
+	// resolvers.
+	dnssec *dnssecValidator
+
+	// dotRootCAsForTest, if non-nil, are the only roots trusted for
+	// DNS-over-TLS servers.
+	dotRootCAsForTest *x509.CertPool
+
 	ctx       context.Context    // good until Close
 	ctxCancel context.CancelFunc // closes ctx
 
 	mu sync.Mutex // guards following
 
-	dohClient map[string]*http.Client // urlBase -> client
+	dohClient    map[string]*http.Client // urlBase -> client
+	dotUpstreams map[string]*dotUpstream // "tls://" resolver address -> upstream
+
+	// routesBySuffix is the configuration that routes was last set from.
+	routesBySuffix map[dnsname.FQDN][]*dnstype.Resolver
 
 	// routes are per-suffix resolvers to use, with
 	// the most specific routes first.
@@ -259,12 +277,20 @@ func newForwarder(logf logger.Logf, netMon *netmon.Monitor, linkSel ForwardLinkS
 		health:       health,
 		controlKnobs: knobs,
 	}
+	if dnssecValidate() {
+		f.dnssec = newDNSSECValidator(f.logf, rootTrustAnchors)
+	}
 	f.ctx, f.ctxCancel = context.WithCancel(context.Background())
 	return f
 }
 
 func (f *forwarder) Close() error {
 	f.ctxCancel()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, u := range f.dotUpstreams {
+		u.close()
+	}
 	return nil
 }
 
@@ -386,10 +412,20 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]*dnstype.Resolve
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if !maps.EqualFunc(f.routesBySuffix, routesBySuffix, resolversEqual) {
+		// Cached responses may be from upstreams that no longer
+		// answer for their names.
+		f.cache.flush()
+	}
+	f.routesBySuffix = routesBySuffix
 	f.routes = routes
 	f.cloudHostFallback = cloudHostFallback
 }
 
+func resolversEqual(a, b []*dnstype.Resolver) bool {
+	return slices.EqualFunc(a, b, (*dnstype.Resolver).Equal)
+}
+
 var stdNetPacketListener nettype.PacketListenerWithNetIP = nettype.MakePacketListenerWithNetIP(new(net.ListenConfig))
 
 func (f *forwarder) packetListener(ip netip.Addr) (nettype.PacketListenerWithNetIP, error) {
@@ -541,8 +577,10 @@ func (f *forwarder) send(ctx context.Context, fq *forwardQuery, rr resolverAndDe
 		return nil, fmt.Errorf("arbitrary https:// resolvers not supported yet")
 	}
 	if strings.HasPrefix(rr.name.Addr, "tls://") {
-		metricDNSFwdErrorType.Add(1)
-		return nil, fmt.Errorf("tls:// resolvers not supported yet")
+		// Unlike DoH upgraded from a well-known provider's IP, there's
+		// no plain DNS fallback for a DoT resolver, as it was chosen
+		// explicitly.
+		return f.sendDoT(ctx, rr.name, fq.packet)
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -856,16 +894,24 @@ func (f *forwarder) sendTCP(ctx context.Context, fq *forwardQuery, rr resolverAn
 
 // resolvers returns the resolvers to use for domain.
 func (f *forwarder) resolvers(domain dnsname.FQDN) []resolverAndDelay {
+	_, rs := f.route(domain)
+	return rs
+}
+
+// route returns the suffix of the route for domain and its resolvers. The
+// suffix is empty if there's no such route, in which case the resolvers
+// are the cloud host fallback ones, if any.
+func (f *forwarder) route(domain dnsname.FQDN) (suffix dnsname.FQDN, rs []resolverAndDelay) {
 	f.mu.Lock()
 	routes := f.routes
 	cloudHostFallback := f.cloudHostFallback
 	f.mu.Unlock()
 	for _, route := range routes {
 		if route.Suffix == "." || route.Suffix.Contains(domain) {
-			return route.Resolvers
+			return route.Suffix, route.Resolvers
 		}
 	}
-	return cloudHostFallback // or nil if no fallback
+	return "", cloudHostFallback // or nil if no fallback
 }
 
 // GetUpstreamResolvers returns the resolvers that would be used to resolve
@@ -948,8 +994,9 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 
 	clampEDNSSize(query.bs, maxResponseBytes)
 
+	var routeSuffix dnsname.FQDN
 	if len(resolvers) == 0 {
-		resolvers = f.resolvers(domain)
+		routeSuffix, resolvers = f.route(domain)
 		if len(resolvers) == 0 {
 			metricDNSFwdErrorNoUpstream.Add(1)
 			f.health.SetUnhealthy(dnsForwarderFailing, health.Args{health.ArgDNSServers: ""})
@@ -970,6 +1017,33 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 		}
 	}
 
+	route := routeKey(routeSuffix, resolvers)
+	cacheKey, cacheable := queryCacheKey(query.bs, route)
+	cacheable = cacheable && !disableResponseCache()
+
+	var dq *dnssecQuery
+	if f.dnssec != nil && (routeSuffix == "" || routeSuffix == ".") {
+		if checkingDisabledFlagSet(query.bs) {
+			// The client asked for a response that isn't validated,
+			// which mustn't be served to others from the cache.
+			cacheable = false
+		} else if dq, err = newDNSSECQuery(query); err != nil {
+			return err
+		}
+	}
+
+	if cacheable {
+		if res, ok := f.cache.get(cacheKey, query.bs); ok {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("waiting to send cached response: %w", ctx.Err())
+			case responseChan <- packet{bs: res, family: query.family, addr: query.addr, route: route, upstream: upstreamCache}:
+				metricDNSFwdSuccess.Add(1)
+				return nil
+			}
+		}
+	}
+
 	fq := &forwardQuery{
 		txid:           getTxID(query.bs),
 		packet:         query.bs,
@@ -977,6 +1051,9 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 		closeOnCtxDone: new(closePool),
 	}
 	defer fq.closeOnCtxDone.Close()
+	if dq != nil {
+		fq.packet = dq.upstream
+	}
 
 	if verboseDNSForward() {
 		domainSha256 := sha256.Sum256([]byte(domain))
@@ -984,7 +1061,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 		f.logf("request(%d, %v, %d, %s) %d...", fq.txid, typ, len(domain), domainSig, len(fq.packet))
 	}
 
-	resc := make(chan []byte, 1) // it's fine buffered or not
+	resc := make(chan packet, 1) // it's fine buffered or not
 	errc := make(chan error, 1)  // it's fine buffered or not too
 	for i := range resolvers {
 		go func(rr *resolverAndDelay) {
@@ -1007,7 +1084,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 				return
 			}
 			select {
-			case resc <- resb:
+			case resc <- packet{bs: resb, family: query.family, addr: query.addr, route: route, upstream: rr.name.Addr}:
 			case <-ctx.Done():
 			}
 		}(&resolvers[i])
@@ -1018,13 +1095,21 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 	for {
 		select {
 		case v := <-resc:
+			if dq != nil {
+				if v.bs, err = f.validateDNSSEC(ctx, dq, v.bs, route, resolvers); err != nil {
+					return err
+				}
+			}
+			if cacheable {
+				f.cache.put(cacheKey, v.bs)
+			}
 			select {
 			case <-ctx.Done():
 				metricDNSFwdErrorContext.Add(1)
 				return fmt.Errorf("waiting to send response: %w", ctx.Err())
-			case responseChan <- packet{v, query.family, query.addr}:
+			case responseChan <- v:
 				if verboseDNSForward() {
-					f.logf("response(%d, %v, %d) = %d, nil", fq.txid, typ, len(domain), len(v))
+					f.logf("response(%d, %v, %d) = %d, nil", fq.txid, typ, len(domain), len(v.bs))
 				}
 				metricDNSFwdSuccess.Add(1)
 				f.health.SetHealthy(dnsForwarderFailing)
@@ -1042,6 +1127,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 						f.logf("building servfail response: %v", err)
 						return firstErr
 					}
+					res.route = route
 
 					select {
 					case <-ctx.Done():
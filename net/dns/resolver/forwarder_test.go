@@ -453,18 +453,23 @@ func makeLargeResponse(tb testing.TB, domain string) (request, response []byte)
 	return
 }
 
-func runTestQuery(tb testing.TB, request []byte, modify func(*forwarder), ports ...uint16) ([]byte, error) {
+// newTestForwarder returns a forwarder for tests, closed when tb ends.
+func newTestForwarder(tb testing.TB) *forwarder {
 	logf := tstest.WhileTestRunningLogger(tb)
 	bus := eventbustest.NewBus(tb)
 	netMon, err := netmon.New(bus, logf)
 	if err != nil {
 		tb.Fatal(err)
 	}
-
 	var dialer tsdial.Dialer
 	dialer.SetNetMon(netMon)
-
 	fwd := newForwarder(logf, netMon, nil, &dialer, health.NewTracker(bus), nil)
+	tb.Cleanup(func() { fwd.Close() })
+	return fwd
+}
+
+func runTestQuery(tb testing.TB, request []byte, modify func(*forwarder), ports ...uint16) ([]byte, error) {
+	fwd := newTestForwarder(tb)
 	if modify != nil {
 		modify(fwd)
 	}
@@ -483,7 +488,7 @@ func runTestQuery(tb testing.TB, request []byte, modify func(*forwarder), ports
 	rchan := make(chan packet, 1)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	tb.Cleanup(cancel)
-	err = fwd.forwardWithDestChan(ctx, rpkt, rchan, resolvers...)
+	err := fwd.forwardWithDestChan(ctx, rpkt, rchan, resolvers...)
 	select {
 	case res := <-rchan:
 		return res.bs, err
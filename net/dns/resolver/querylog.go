@@ -0,0 +1,253 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"maps"
+	"net/netip"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/envknob"
+	"tailscale.com/tstime/rate"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/set"
+)
+
+const (
+	// upstreamCache is the QueryLogEntry.Upstream of queries answered
+	// from the forwarder's cache.
+	upstreamCache = "cache"
+
+	// upstreamSystem is the QueryLogEntry.Upstream of peer queries
+	// answered with the operating system's resolver.
+	upstreamSystem = "system"
+
+	// queryLogRate and queryLogBurst limit how many queries are logged
+	// per second, to the daemon's log and to each watcher.
+	queryLogRate  = 100
+	queryLogBurst = 200
+
+	// maxQueryStatsClients is the maximum number of clients that query
+	// stats are kept for. Queries from clients beyond those are only
+	// counted per route.
+	maxQueryStatsClients = 1024
+)
+
+// logDNSQueries is whether to log every query to the daemon's log, subject
+// to the same rate limit as watchers. As the daemon's log may be uploaded,
+// query names and client addresses are logged as hashes, as with
+// verboseDNSForward; watchers get them in full.
+var logDNSQueries = envknob.RegisterBool("TS_DEBUG_DNS_QUERY_LOG")
+
+// QueryLogEntry is a DNS query answered by a Resolver, as passed to the
+// funcs registered with [Resolver.WatchQueries].
+type QueryLogEntry struct {
+	// Time is when the query arrived.
+	Time time.Time
+
+	// From is the address the query came from.
+	From netip.AddrPort
+
+	// ViaPeerAPI is whether the query came from a peer using this node
+	// as an exit node or app connector, rather than to 100.100.100.100.
+	ViaPeerAPI bool
+
+	Name  string // lowercase and fully qualified
+	Type  dns.Type
+	RCode dns.RCode // of the response, if Err is nil
+
+	// Route is the route that the query was forwarded by: the suffix of
+	// a configured route, or the addresses of the resolvers it was
+	// forwarded to otherwise. It's empty if the query was answered
+	// locally.
+	Route string
+
+	// Upstream is the address of the resolver that answered the query,
+	// "cache" if it was answered from the forwarder's cache, "system" if
+	// answered by the operating system's resolver, or empty if it was
+	// answered locally.
+	Upstream string
+
+	// Latency is how long the query took to answer.
+	Latency time.Duration
+
+	// Err is the error answering the query, if there was no response.
+	Err error
+
+	// Dropped is how many queries before this one weren't passed to
+	// the watcher, as they were being logged too quickly.
+	Dropped int
+}
+
+// QueryStats are counts of DNS queries answered by a Resolver.
+type QueryStats struct {
+	Queries   uint64        // total queries
+	NXDomain  uint64        // queries answered with NXDOMAIN
+	ServFail  uint64        // queries answered with SERVFAIL
+	Errors    uint64        // queries that weren't answered
+	CacheHits uint64        // queries answered from the forwarder's cache
+	Latency   time.Duration // total latency of all queries
+}
+
+func (s *QueryStats) add(e *QueryLogEntry) {
+	s.Queries++
+	switch {
+	case e.Err != nil:
+		s.Errors++
+	case e.RCode == dns.RCodeNameError:
+		s.NXDomain++
+	case e.RCode == dns.RCodeServerFailure:
+		s.ServFail++
+	}
+	if e.Upstream == upstreamCache {
+		s.CacheHits++
+	}
+	s.Latency += e.Latency
+}
+
+// queryLog keeps stats on the queries a Resolver answers and passes them
+// to watchers.
+//
+// The zero value is ready for use.
+type queryLog struct {
+	mu       sync.Mutex
+	watchers set.HandleSet[*queryWatcher]
+	lim      *rate.Limiter // for the daemon's log; or nil until first needed
+	byRoute  map[string]QueryStats
+	byClient map[netip.Addr]QueryStats
+}
+
+// queryWatcher is a func registered with [Resolver.WatchQueries].
+type queryWatcher struct {
+	match   func(QueryLogEntry) bool // or nil to match all queries
+	fn      func(QueryLogEntry)
+	lim     *rate.Limiter
+	dropped int // matching queries not passed to fn since the last one that was
+}
+
+// newQueryWatcher returns a queryWatcher calling fn with the queries that
+// match accepts, or all if match is nil.
+func newQueryWatcher(match func(QueryLogEntry) bool, fn func(QueryLogEntry)) *queryWatcher {
+	return &queryWatcher{
+		match: match,
+		fn:    fn,
+		lim:   rate.NewLimiter(queryLogRate, queryLogBurst),
+	}
+}
+
+// record passes e to w.fn if it matches and w isn't being rate limited.
+// Queries that don't match don't count against w's rate limit.
+func (w *queryWatcher) record(e QueryLogEntry) {
+	if w.match != nil && !w.match(e) {
+		return
+	}
+	if !w.lim.Allow() {
+		w.dropped++
+		return
+	}
+	e.Dropped, w.dropped = w.dropped, 0
+	w.fn(e)
+}
+
+// record counts the query e and passes it to watchers and, if enabled,
+// logf, subject to their rate limits.
+func (l *queryLog) record(logf logger.Logf, e QueryLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.byRoute == nil {
+		l.byRoute = map[string]QueryStats{}
+		l.byClient = map[netip.Addr]QueryStats{}
+	}
+	s := l.byRoute[e.Route]
+	s.add(&e)
+	l.byRoute[e.Route] = s
+	client := e.From.Addr()
+	if s, ok := l.byClient[client]; ok || len(l.byClient) < maxQueryStatsClients {
+		s.add(&e)
+		l.byClient[client] = s
+	}
+
+	for _, w := range l.watchers {
+		w.record(e)
+	}
+	if !logDNSQueries() {
+		return
+	}
+	if l.lim == nil {
+		l.lim = rate.NewLimiter(queryLogRate, queryLogBurst)
+	}
+	if l.lim.Allow() {
+		rcode := e.RCode.String()
+		if e.Err != nil {
+			rcode = e.Err.Error()
+		}
+		logf("query from %s: %d %s %v via %q (%q) = %s in %v", logSig(e.From.Addr().String()), len(e.Name), logSig(e.Name), e.Type, e.Route, e.Upstream, rcode, e.Latency.Round(time.Millisecond))
+	}
+}
+
+// logSig returns a short hash of s for logging in place of s.
+func logSig(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return base64.RawStdEncoding.EncodeToString(sum[:3])
+}
+
+// WatchQueries calls fn with each DNS query r answers that match accepts,
+// or every query if match is nil, until the returned func is called.
+// Neither func may block.
+//
+// Matching queries are passed to fn at a limited rate, with
+// [QueryLogEntry.Dropped] reporting how many were skipped. Each watcher has
+// a rate limit of its own, which queries that don't match don't count
+// against.
+func (r *Resolver) WatchQueries(match func(QueryLogEntry) bool, fn func(QueryLogEntry)) (unwatch func()) {
+	l := &r.queryLog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.watchers.Add(newQueryWatcher(match, fn))
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.watchers, h)
+	}
+}
+
+// QueryStats returns counts of the DNS queries r has answered, by the route
+// they were forwarded by (see [QueryLogEntry.Route]) and by the address of
+// the client that sent them.
+func (r *Resolver) QueryStats() (byRoute map[string]QueryStats, byClient map[netip.Addr]QueryStats) {
+	l := &r.queryLog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return maps.Clone(l.byRoute), maps.Clone(l.byClient)
+}
+
+// logQuery records the query q from from, which was received at start and
+// answered with res or failed with err.
+func (r *Resolver) logQuery(start time.Time, q []byte, from netip.AddrPort, viaPeerAPI bool, res packet, err error) {
+	name, typ, nerr := nameFromQuery(q)
+	if nerr != nil {
+		// Not a query worth logging.
+		return
+	}
+	e := QueryLogEntry{
+		Time:       start,
+		From:       from,
+		ViaPeerAPI: viaPeerAPI,
+		Name:       string(name),
+		Type:       typ,
+		Route:      res.route,
+		Upstream:   res.upstream,
+		Latency:    time.Since(start),
+		Err:        err,
+	}
+	if err == nil {
+		e.RCode = getRCode(res.bs)
+	}
+	r.queryLog.record(r.logf, e)
+}
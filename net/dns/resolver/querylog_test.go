@@ -0,0 +1,132 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/envknob"
+	"tailscale.com/types/logger"
+)
+
+func TestQueryLog(t *testing.T) {
+	var l queryLog
+	var got []QueryLogEntry
+	l.watchers.Add(newQueryWatcher(nil, func(e QueryLogEntry) { got = append(got, e) }))
+
+	client := netip.MustParseAddrPort("100.64.0.2:5353")
+	other := netip.MustParseAddrPort("100.64.0.3:5353")
+	entries := []QueryLogEntry{
+		{From: client, Name: "a.example.com.", Type: dns.TypeA, Route: "example.com.", Upstream: "10.0.0.1", Latency: time.Millisecond},
+		{From: client, Name: "a.example.com.", Type: dns.TypeA, Route: "example.com.", Upstream: upstreamCache, Latency: time.Millisecond},
+		{From: client, Name: "b.example.com.", Type: dns.TypeA, Route: "example.com.", RCode: dns.RCodeNameError, Latency: time.Millisecond},
+		{From: other, Name: "test.", Type: dns.TypeAAAA, Route: ".", RCode: dns.RCodeServerFailure, Latency: time.Millisecond},
+		{From: other, Name: "test.", Type: dns.TypeAAAA, Route: ".", Err: errors.New("timeout"), Latency: time.Millisecond},
+	}
+	for _, e := range entries {
+		l.record(logger.Discard, e)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("watcher got %d entries; want %d", len(got), len(entries))
+	}
+
+	wantRoute := map[string]QueryStats{
+		"example.com.": {Queries: 3, NXDomain: 1, CacheHits: 1, Latency: 3 * time.Millisecond},
+		".":            {Queries: 2, ServFail: 1, Errors: 1, Latency: 2 * time.Millisecond},
+	}
+	for route, want := range wantRoute {
+		if got := l.byRoute[route]; got != want {
+			t.Errorf("stats for route %q = %+v; want %+v", route, got, want)
+		}
+	}
+	if got := l.byClient[client.Addr()].Queries; got != 3 {
+		t.Errorf("client %v made %d queries; want 3", client.Addr(), got)
+	}
+	if got := l.byClient[other.Addr()].Queries; got != 2 {
+		t.Errorf("client %v made %d queries; want 2", other.Addr(), got)
+	}
+}
+
+func TestQueryLogDaemonLog(t *testing.T) {
+	envknob.Setenv("TS_DEBUG_DNS_QUERY_LOG", "true")
+	defer envknob.Setenv("TS_DEBUG_DNS_QUERY_LOG", "")
+
+	var logs []string
+	logf := func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }
+	var l queryLog
+	l.record(logf, QueryLogEntry{From: netip.MustParseAddrPort("100.64.0.2:5353"), Name: "secret.example.com.", Type: dns.TypeA})
+	if len(logs) != 1 {
+		t.Fatalf("got %d log lines; want 1", len(logs))
+	}
+	for _, s := range []string{"secret", "100.64.0.2"} {
+		if strings.Contains(logs[0], s) {
+			t.Errorf("log line %q contains %q", logs[0], s)
+		}
+	}
+}
+
+func TestQueryLogRateLimit(t *testing.T) {
+	var l queryLog
+	var got []QueryLogEntry
+	l.watchers.Add(newQueryWatcher(nil, func(e QueryLogEntry) { got = append(got, e) }))
+
+	e := QueryLogEntry{From: netip.MustParseAddrPort("100.64.0.2:5353"), Name: "example.com.", Type: dns.TypeA}
+	const n = queryLogBurst + 10
+	for range n {
+		l.record(logger.Discard, e)
+	}
+	if len(got) >= n {
+		t.Fatalf("watcher got all %d entries; want some dropped", n)
+	}
+	if got := l.byRoute[""].Queries; got != n {
+		t.Errorf("counted %d queries; want %d", got, n)
+	}
+
+	// The next entry passed to the watcher reports how many were dropped.
+	passed := len(got)
+	for len(got) == passed {
+		time.Sleep(10 * time.Millisecond)
+		l.record(logger.Discard, e)
+	}
+	last := got[len(got)-1]
+	if last.Dropped == 0 {
+		t.Errorf("entry after rate limiting has Dropped = 0")
+	}
+	sent := 0
+	for _, e := range got {
+		sent += 1 + e.Dropped
+	}
+	if total := int(l.byRoute[""].Queries); sent != total {
+		t.Errorf("watcher got %d entries, including dropped; want %d", sent, total)
+	}
+}
+
+func TestQueryLogRateLimitAfterMatch(t *testing.T) {
+	var l queryLog
+	client := netip.MustParseAddrPort("100.64.0.2:5353")
+	other := netip.MustParseAddrPort("100.64.0.3:5353")
+	var got []QueryLogEntry
+	l.watchers.Add(newQueryWatcher(
+		func(e QueryLogEntry) bool { return e.From == client },
+		func(e QueryLogEntry) { got = append(got, e) },
+	))
+
+	// Another client's queries don't use up the watcher's rate limit.
+	for range queryLogBurst + 10 {
+		l.record(logger.Discard, QueryLogEntry{From: other, Name: "example.com.", Type: dns.TypeA})
+	}
+	l.record(logger.Discard, QueryLogEntry{From: client, Name: "example.com.", Type: dns.TypeA})
+	if len(got) != 1 {
+		t.Fatalf("watcher got %d entries; want 1", len(got))
+	}
+	if got[0].From != client || got[0].Dropped != 0 {
+		t.Errorf("watcher got %+v; want client's query, with none dropped", got[0])
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"net"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+// maxCNAMEChain is the most CNAME records followed when answering a query
+// for a name with local records.
+const maxCNAMEChain = 8
+
+// Records are the records of a name answered locally, other than its
+// addresses, which are in [Config.Hosts].
+type Records struct {
+	// CNAME, if non-empty, is the canonical name that the name is an
+	// alias of. A name with a CNAME record has no other records.
+	CNAME dnsname.FQDN
+
+	// TXT are the name's TXT records, each with one string.
+	TXT []string
+
+	// SRV are the name's SRV records.
+	SRV []*net.SRV
+}
+
+// respondRecords returns the response to the query resp is for, if its
+// name has local records. ok reports whether it does.
+//
+// CNAME records are followed to the records of their targets if those are
+// also answered locally. Otherwise, only the CNAME records are returned,
+// for the client to resolve the target itself.
+func (r *Resolver) respondRecords(name dnsname.FQDN, resp *response) (res []byte, ok bool, err error) {
+	r.mu.Lock()
+	records := r.records
+	hosts := r.hostToIP
+	r.mu.Unlock()
+
+	if _, ok := records[name]; !ok {
+		return nil, false, nil
+	}
+	metricDNSResolveLocalRecords.Add(1)
+
+	resp.Header.Response = true
+	resp.Header.Authoritative = true
+	resp.Header.RCode = dns.RCodeSuccess
+	if resp.Header.RecursionDesired {
+		resp.Header.RecursionAvailable = true
+	}
+	builder := dns.NewBuilder(nil, resp.Header)
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, true, err
+	}
+	if err := builder.Question(resp.Question); err != nil {
+		return nil, true, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, true, err
+	}
+
+	typ := resp.Question.Type
+	qname := resp.Question.Name
+	for range maxCNAMEChain {
+		rec := records[name]
+		if rec.CNAME != "" {
+			if err := marshalCNAME(qname, rec.CNAME.WithTrailingDot(), &builder); err != nil {
+				return nil, true, err
+			}
+			if typ == dns.TypeCNAME {
+				break
+			}
+			name = rec.CNAME
+			if qname, err = dns.NewName(name.WithTrailingDot()); err != nil {
+				return nil, true, err
+			}
+			continue
+		}
+
+		switch typ {
+		case dns.TypeA, dns.TypeAAAA, dns.TypeALL:
+			for _, ip := range hosts[name] {
+				if (typ == dns.TypeA && !ip.Is4()) || (typ == dns.TypeAAAA && !ip.Is6()) {
+					continue
+				}
+				if err := marshalIP(qname, ip, &builder); err != nil {
+					return nil, true, err
+				}
+			}
+		}
+		switch typ {
+		case dns.TypeTXT, dns.TypeALL:
+			if err := marshalTXT(qname, rec.TXT, &builder); err != nil {
+				return nil, true, err
+			}
+		}
+		switch typ {
+		case dns.TypeSRV, dns.TypeALL:
+			if err := marshalSRV(qname, rec.SRV, &builder); err != nil {
+				return nil, true, err
+			}
+		}
+		break
+	}
+	res, err = builder.Finish()
+	return res, true, err
+}
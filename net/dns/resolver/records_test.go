@@ -0,0 +1,140 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+// answerStrings returns the answers in res as strings of the form
+// "name TYPE value".
+func answerStrings(tb testing.TB, res []byte) (dns.RCode, []string) {
+	tb.Helper()
+	var msg dns.Message
+	if err := msg.Unpack(res); err != nil {
+		tb.Fatal(err)
+	}
+	var answers []string
+	for _, rr := range msg.Answers {
+		var v string
+		switch b := rr.Body.(type) {
+		case *dns.AResource:
+			v = netip.AddrFrom4(b.A).String()
+		case *dns.AAAAResource:
+			v = netip.AddrFrom16(b.AAAA).String()
+		case *dns.CNAMEResource:
+			v = b.CNAME.String()
+		case *dns.TXTResource:
+			v = fmt.Sprint(b.TXT)
+		case *dns.SRVResource:
+			v = fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target)
+		default:
+			v = rr.Body.GoString()
+		}
+		answers = append(answers, fmt.Sprintf("%s %s %s", rr.Header.Name, rr.Header.Type, v))
+	}
+	return msg.RCode, answers
+}
+
+func TestRespondRecords(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+
+	cfg := Config{
+		Hosts: map[dnsname.FQDN][]netip.Addr{
+			"node.ipn.dev.": {netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")},
+			"web.internal.": {netip.MustParseAddr("10.0.0.5")},
+		},
+		LocalDomains: []dnsname.FQDN{"ipn.dev."},
+		Records: map[dnsname.FQDN]Records{
+			"grafana.internal.":        {CNAME: "node.ipn.dev."},
+			"alias.internal.":          {CNAME: "grafana.internal."},
+			"external.internal.":       {CNAME: "example.com."},
+			"web.internal.":            {TXT: []string{"v=1 owner=infra"}},
+			"_http._tcp.web.internal.": {SRV: []*net.SRV{{Priority: 10, Weight: 5, Port: 8080, Target: "web.internal."}}},
+		},
+	}
+	r.SetConfig(cfg)
+
+	tests := []struct {
+		name  string
+		qname dnsname.FQDN
+		qtype dns.Type
+		want  []string
+	}{
+		{
+			name: "cname-to-host", qname: "grafana.internal.", qtype: dns.TypeA,
+			want: []string{
+				"grafana.internal. TypeCNAME node.ipn.dev.",
+				"node.ipn.dev. TypeA 100.64.0.1",
+			},
+		},
+		{
+			name: "cname-chain", qname: "alias.internal.", qtype: dns.TypeAAAA,
+			want: []string{
+				"alias.internal. TypeCNAME grafana.internal.",
+				"grafana.internal. TypeCNAME node.ipn.dev.",
+				"node.ipn.dev. TypeAAAA fd7a:115c:a1e0::1",
+			},
+		},
+		{
+			name: "cname-query", qname: "alias.internal.", qtype: dns.TypeCNAME,
+			want: []string{"alias.internal. TypeCNAME grafana.internal."},
+		},
+		{
+			name: "cname-external", qname: "external.internal.", qtype: dns.TypeA,
+			want: []string{"external.internal. TypeCNAME example.com."},
+		},
+		{
+			name: "txt", qname: "web.internal.", qtype: dns.TypeTXT,
+			want: []string{"web.internal. TypeTXT [v=1 owner=infra]"},
+		},
+		{
+			name: "a-with-txt", qname: "web.internal.", qtype: dns.TypeA,
+			want: []string{"web.internal. TypeA 10.0.0.5"},
+		},
+		{
+			name: "srv", qname: "_http._tcp.web.internal.", qtype: dns.TypeSRV,
+			want: []string{"_http._tcp.web.internal. TypeSRV 10 5 8080 web.internal."},
+		},
+		{
+			name: "no-records-of-type", qname: "_http._tcp.web.internal.", qtype: dns.TypeA,
+		},
+		{
+			name: "uppercase", qname: "WEB.Internal.", qtype: dns.TypeTXT,
+			want: []string{"WEB.Internal. TypeTXT [v=1 owner=infra]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := syncRespond(r, dnspacket(tt.qname, tt.qtype, noEdns))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rcode, got := answerStrings(t, res)
+			if rcode != dns.RCodeSuccess {
+				t.Errorf("rcode = %v; want success", rcode)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("answers = %q; want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Names without local records are still resolved as before.
+	res, err := syncRespond(r, dnspacket("missing.ipn.dev.", dns.TypeA, noEdns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode, _ := answerStrings(t, res); rcode != dns.RCodeNameError {
+		t.Errorf("rcode for missing name = %v; want NXDOMAIN", rcode)
+	}
+}
@@ -58,6 +58,13 @@ type packet struct {
 	bs     []byte
 	family string         // either "tcp" or "udp"
 	addr   netip.AddrPort // src for a request, dst for a response
+
+	// For a forwarded response, route is the route the query was
+	// forwarded by (see routeKey), and upstream is the address of the
+	// resolver that answered, upstreamCache, or empty if the forwarder
+	// answered itself.
+	route    string
+	upstream string
 }
 
 // Config is a resolver configuration.
@@ -77,6 +84,9 @@ type Config struct {
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
+	// Records maps FQDNs to their records other than addresses, which
+	// are in Hosts, for names with such records.
+	Records map[dnsname.FQDN]Records
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -211,11 +221,14 @@ type Resolver struct {
 	// closed signals all goroutines to stop.
 	closed chan struct{}
 
+	queryLog queryLog
+
 	// mu guards the following fields from being updated while used.
 	mu           sync.Mutex
 	localDomains []dnsname.FQDN
 	hostToIP     map[dnsname.FQDN][]netip.Addr
 	ipToHost     map[netip.Addr]dnsname.FQDN
+	records      map[dnsname.FQDN]Records
 }
 
 type ForwardLinkSelector interface {
@@ -273,6 +286,7 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	r.localDomains = cfg.LocalDomains
 	r.hostToIP = cfg.Hosts
 	r.ipToHost = reverse
+	r.records = cfg.Records
 	return nil
 }
 
@@ -303,6 +317,7 @@ func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from net
 		return nil, net.ErrClosed
 	default:
 	}
+	start := time.Now()
 
 	out, err := r.respond(bs)
 	if err == errNotOurName {
@@ -310,13 +325,17 @@ func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from net
 		ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
 		defer close(responses)
 		defer cancel()
-		err = r.forwarder.forwardWithDestChan(ctx, packet{bs, family, from}, responses)
+		err = r.forwarder.forwardWithDestChan(ctx, packet{bs: bs, family: family, addr: from}, responses)
 		if err != nil {
+			r.logQuery(start, bs, from, false, packet{}, err)
 			return nil, err
 		}
-		return (<-responses).bs, nil
+		res := <-responses
+		r.logQuery(start, bs, from, false, res, nil)
+		return res.bs, nil
 	}
 
+	r.logQuery(start, bs, from, false, packet{bs: out}, err)
 	return out, err
 }
 
@@ -358,10 +377,17 @@ func (r *Resolver) HandlePeerDNSQuery(ctx context.Context, q []byte, from netip.
 	if resp == nil {
 		return nil, errors.New("bad query")
 	}
+	start := time.Now()
+	logged := packet{upstream: upstreamSystem} // unless forwarded
+	defer func() {
+		logged.bs = res
+		r.logQuery(start, q, from, true, logged, err)
+	}()
 	name := resp.Question.Name.String()
 	if !allowName(name) {
 		metricDNSExitProxyErrorName.Add(1)
 		resp.Header.RCode = dns.RCodeRefused
+		logged.upstream = ""
 		return marshalResponse(resp)
 	}
 
@@ -399,7 +425,7 @@ func (r *Resolver) HandlePeerDNSQuery(ctx context.Context, q []byte, from netip.
 			}}
 		}
 
-		err = r.forwarder.forwardWithDestChan(ctx, packet{q, "tcp", from}, ch, resolvers...)
+		err = r.forwarder.forwardWithDestChan(ctx, packet{bs: q, family: "tcp", addr: from}, ch, resolvers...)
 		if err != nil {
 			metricDNSExitProxyErrorForward.Add(1)
 			return nil, err
@@ -408,6 +434,7 @@ func (r *Resolver) HandlePeerDNSQuery(ctx context.Context, q []byte, from netip.
 	select {
 	case p, ok := <-ch:
 		if ok {
+			logged = p
 			return p.bs, nil
 		}
 		panic("unexpected close chan")
@@ -1284,6 +1311,10 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 		return r.respondReverse(query, name, parser.response())
 	}
 
+	if res, ok, err := r.respondRecords(name, parser.response()); ok {
+		return res, err
+	}
+
 	ip, rcode := r.resolveLocal(name, parser.Question.Type)
 	if rcode == dns.RCodeRefused {
 		return nil, errNotOurName // sentinel error return value: it requests forwarding
@@ -1375,6 +1406,21 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSFwdDoHErrorTransport = clientmetric.NewCounter("dns_query_fwd_doh_error_transport")
 	metricDNSFwdDoHErrorBody      = clientmetric.NewCounter("dns_query_fwd_doh_error_body")
 
+	metricDNSFwdDoT            = clientmetric.NewCounter("dns_query_fwd_dot")
+	metricDNSFwdDoTErrorDial   = clientmetric.NewCounter("dns_query_fwd_dot_error_dial")
+	metricDNSFwdDoTErrorWrite  = clientmetric.NewCounter("dns_query_fwd_dot_error_write")
+	metricDNSFwdDoTErrorRead   = clientmetric.NewCounter("dns_query_fwd_dot_error_read")
+	metricDNSFwdDoTErrorServer = clientmetric.NewCounter("dns_query_fwd_dot_error_server")
+	metricDNSFwdDoTSuccess     = clientmetric.NewCounter("dns_query_fwd_dot_success")
+
+	metricDNSFwdCacheHit   = clientmetric.NewCounter("dns_query_fwd_cache_hit")
+	metricDNSFwdCacheMiss  = clientmetric.NewCounter("dns_query_fwd_cache_miss")
+	metricDNSFwdCacheStore = clientmetric.NewCounter("dns_query_fwd_cache_store")
+
+	metricDNSFwdDNSSECSecure   = clientmetric.NewCounter("dns_query_fwd_dnssec_secure")
+	metricDNSFwdDNSSECInsecure = clientmetric.NewCounter("dns_query_fwd_dnssec_insecure")
+	metricDNSFwdDNSSECBogus    = clientmetric.NewCounter("dns_query_fwd_dnssec_bogus")
+
 	metricDNSResolveLocal             = clientmetric.NewCounter("dns_resolve_local")
 	metricDNSResolveLocalErrorOnion   = clientmetric.NewCounter("dns_resolve_local_error_onion")
 	metricDNSResolveLocalErrorMissing = clientmetric.NewCounter("dns_resolve_local_error_missing")
@@ -1387,6 +1433,7 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSResolveLocalNoAll        = clientmetric.NewCounter("dns_resolve_local_no_all")
 	metricDNSResolveNotImplType       = clientmetric.NewCounter("dns_resolve_local_not_impl_type")
 	metricDNSResolveNoRecordType      = clientmetric.NewCounter("dns_resolve_local_no_record_type")
+	metricDNSResolveLocalRecords      = clientmetric.NewCounter("dns_resolve_local_records")
 
 	metricDNSReverseMissBonjour = clientmetric.NewCounter("dns_reverse_miss_bonjour")
 	metricDNSReverseMissOther   = clientmetric.NewCounter("dns_reverse_miss_other")
@@ -0,0 +1,180 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package sessionrecording
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// CastEvent is an event in an asciicast v2 recording, following its
+// CastHeader.
+type CastEvent struct {
+	// Time is the number of seconds since the start of the recording.
+	Time float64
+
+	// Code is the event type: "o" for output, "i" for input, "r" for
+	// a terminal resize, or FileEventCode for a file operation.
+	Code string
+
+	// Data is the output or input, or the new size as "COLSxROWS".
+	Data string
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Events are encoded as
+// [time, code, data] arrays.
+func (e *CastEvent) UnmarshalJSON(b []byte) error {
+	var ev []json.RawMessage
+	if err := json.Unmarshal(b, &ev); err != nil {
+		return err
+	}
+	if len(ev) != 3 {
+		return fmt.Errorf("cast event has %d elements; want 3", len(ev))
+	}
+	if err := json.Unmarshal(ev[0], &e.Time); err != nil {
+		return fmt.Errorf("cast event time: %w", err)
+	}
+	if err := json.Unmarshal(ev[1], &e.Code); err != nil {
+		return fmt.Errorf("cast event code: %w", err)
+	}
+	if err := json.Unmarshal(ev[2], &e.Data); err != nil {
+		return fmt.Errorf("cast event data: %w", err)
+	}
+	return nil
+}
+
+// FileEventCode is the code of cast events that record file operations in
+// SFTP and SCP sessions. Their data is a JSON-encoded FileEvent.
+const FileEventCode = "f"
+
+// FileEvent is a file operation in an SFTP or SCP session.
+type FileEvent struct {
+	// Op is the operation: "open", "read", "write", "setstat", "rename",
+	// "link", "symlink", "remove", "mkdir" or "rmdir".
+	//
+	// For SFTP, "read" and "write" are recorded when the file is closed,
+	// with the total bytes read or written through that handle.
+	Op string `json:"op"`
+
+	// Path is the path of the file, as named by the client.
+	//
+	// For SCP, it is the path given to scp on the server, which may be
+	// the file's directory rather than the file itself; see Name.
+	Path string `json:"path"`
+
+	// Name is, for SCP, the file's name as sent by the side sending it,
+	// relative to Path if Path is a directory.
+	Name string `json:"name,omitempty"`
+
+	// NewPath is the new path for "rename", the new link for "link", and
+	// the link's target for "symlink".
+	NewPath string `json:"newPath,omitempty"`
+
+	// Write is whether the file was opened for writing, for "open".
+	Write bool `json:"write,omitempty"`
+
+	// Bytes is the number of bytes read or written, for "read" and "write".
+	Bytes int64 `json:"bytes,omitempty"`
+
+	// Error, if non-empty, is why the operation failed or was denied.
+	Error string `json:"error,omitempty"`
+}
+
+// CastReader reads an asciicast v2 recording, as written by Tailscale SSH and
+// the Kubernetes API server proxy.
+type CastReader struct {
+	// Header is the recording's header.
+	Header CastHeader
+
+	dec *json.Decoder
+}
+
+// NewCastReader reads the header of the recording in r and returns a
+// CastReader for its events.
+func NewCastReader(r io.Reader) (*CastReader, error) {
+	cr := &CastReader{dec: json.NewDecoder(r)}
+	if err := cr.dec.Decode(&cr.Header); err != nil {
+		return nil, fmt.Errorf("reading cast header: %w", err)
+	}
+	if cr.Header.Version != 2 {
+		return nil, fmt.Errorf("unsupported cast version %d", cr.Header.Version)
+	}
+	return cr, nil
+}
+
+// Next returns the next event in the recording. It returns io.EOF at the end
+// of the recording, and io.ErrUnexpectedEOF if the recording was cut off in
+// the middle of an event.
+func (cr *CastReader) Next() (CastEvent, error) {
+	var ev CastEvent
+	err := cr.dec.Decode(&ev)
+	return ev, err
+}
+
+// ReplayOptions are the options for Replay.
+type ReplayOptions struct {
+	// Speed is how many times faster than recorded to play back the
+	// recording. Zero means 1.
+	Speed float64
+
+	// MaxIdle, if positive, is the longest to wait between two events,
+	// before applying Speed. Longer pauses in the recording are shortened
+	// to it.
+	MaxIdle time.Duration
+}
+
+// Replay writes the output events read from cr to w at the times they were
+// recorded, adjusted per opts. It returns nil at the end of the recording, or
+// the context's error if ctx is done first.
+func Replay(ctx context.Context, w io.Writer, cr *CastReader, opts ReplayOptions) error {
+	return replay(ctx, w, cr, opts, sleep)
+}
+
+func replay(ctx context.Context, w io.Writer, cr *CastReader, opts ReplayOptions, sleep func(context.Context, time.Duration) error) error {
+	speed := opts.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	var last float64 // time of the previous event, in seconds
+	for {
+		ev, err := cr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		d := time.Duration((ev.Time - last) * float64(time.Second))
+		last = ev.Time
+		if opts.MaxIdle > 0 && d > opts.MaxIdle {
+			d = opts.MaxIdle
+		}
+		if d > 0 {
+			if err := sleep(ctx, time.Duration(float64(d)/speed)); err != nil {
+				return err
+			}
+		}
+		if ev.Code != "o" {
+			continue
+		}
+		if _, err := io.WriteString(w, ev.Data); err != nil {
+			return err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package sessionrecording
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCast = `{"version":2,"width":80,"height":24,"timestamp":1700000000,"srcNode":"laptop.tail-scale.ts.net","srcNodeID":"n1","srcNodeUser":"alice@example.com","env":{"TERM":"xterm"},"sshUser":"root","localUser":"root","connectionID":"c1"}
+[0.5,"o","hello "]
+[0.75,"i","x"]
+[1.5,"o","world"]
+[61.5,"r","100x40"]
+[61.5,"o","\r\n"]
+`
+
+func TestCastReader(t *testing.T) {
+	cr, err := NewCastReader(strings.NewReader(testCast))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Header.SrcNodeUser != "alice@example.com" || cr.Header.Width != 80 {
+		t.Errorf("unexpected header: %+v", cr.Header)
+	}
+	var got []CastEvent
+	for {
+		ev, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ev)
+	}
+	want := []CastEvent{
+		{0.5, "o", "hello "},
+		{0.75, "i", "x"},
+		{1.5, "o", "world"},
+		{61.5, "r", "100x40"},
+		{61.5, "o", "\r\n"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %+v; want %+v", got, want)
+	}
+
+	if _, err := NewCastReader(strings.NewReader(`{"version":1}`)); err == nil {
+		t.Error("NewCastReader accepted version 1")
+	}
+	cr, err = NewCastReader(strings.NewReader(testCast[:len(testCast)-4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for err == nil {
+		_, err = cr.Next()
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated cast: got %v; want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       ReplayOptions
+		wantSleeps []time.Duration
+	}{
+		{
+			name:       "default",
+			wantSleeps: []time.Duration{500 * time.Millisecond, 250 * time.Millisecond, 750 * time.Millisecond, 60 * time.Second},
+		},
+		{
+			name:       "speed",
+			opts:       ReplayOptions{Speed: 2},
+			wantSleeps: []time.Duration{250 * time.Millisecond, 125 * time.Millisecond, 375 * time.Millisecond, 30 * time.Second},
+		},
+		{
+			name:       "max_idle",
+			opts:       ReplayOptions{Speed: 2, MaxIdle: 2 * time.Second},
+			wantSleeps: []time.Duration{250 * time.Millisecond, 125 * time.Millisecond, 375 * time.Millisecond, time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr, err := NewCastReader(strings.NewReader(testCast))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sleeps []time.Duration
+			var out strings.Builder
+			err = replay(context.Background(), &out, cr, tt.opts, func(_ context.Context, d time.Duration) error {
+				sleeps = append(sleeps, d)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := out.String(), "hello world\r\n"; got != want {
+				t.Errorf("output = %q; want %q", got, want)
+			}
+			if !reflect.DeepEqual(sleeps, tt.wantSleeps) {
+				t.Errorf("sleeps = %v; want %v", sleeps, tt.wantSleeps)
+			}
+		})
+	}
+}
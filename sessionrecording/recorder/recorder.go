@@ -0,0 +1,254 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package recorder implements a session recording server, which receives
+// the recordings that Tailscale SSH and the Kubernetes API server proxy
+// upload with [sessionrecording.ConnectToRecorder].
+package recorder
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"tailscale.com/sessionrecording"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/rands"
+)
+
+// Storage stores recordings.
+type Storage interface {
+	// Create starts storing a new recording as name, a relative
+	// slash-separated path ending in ".cast". The recording is complete
+	// once the returned writer is closed.
+	Create(ctx context.Context, name string) (io.WriteCloser, error)
+}
+
+// DirStorage is a Storage that stores recordings as files under the named
+// local directory.
+type DirStorage string
+
+// Create implements Storage.
+func (d DirStorage) Create(_ context.Context, name string) (io.WriteCloser, error) {
+	rel := filepath.FromSlash(name)
+	if !filepath.IsLocal(rel) {
+		return nil, fmt.Errorf("invalid recording name %q", name)
+	}
+	p := filepath.Join(string(d), rel)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+// Server is an http.Handler that receives recordings and stores them in
+// Storage. It implements both the original protocol, on "/record", and
+// version 2, on "/v2/record", which uses HTTP/2 without TLS and
+// acknowledges the data received.
+//
+// Recordings are named after the node they're from and when they started,
+// per their header.
+type Server struct {
+	// Storage is where recordings are stored. It must be non-nil.
+	Storage Storage
+
+	// Logf, if non-nil, is where the server logs. If nil, it uses
+	// log.Printf.
+	Logf logger.Logf
+
+	// AckInterval is how often to acknowledge the data received with
+	// version 2 of the protocol. Clients give up on recorders that don't
+	// acknowledge for 30 seconds. Zero means one second.
+	AckInterval time.Duration
+
+	initOnce sync.Once
+	handler  http.Handler
+}
+
+// maxHeaderSize is the longest recording header that Server accepts.
+const maxHeaderSize = 64 << 10
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.initOnce.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /record", s.serveV1)
+		// Clients probe for version 2 support before using it, and
+		// require the response to be over HTTP/2.
+		mux.HandleFunc("HEAD /v2/record", func(http.ResponseWriter, *http.Request) {})
+		mux.HandleFunc("POST /v2/record", s.serveV2)
+		s.handler = h2c.NewHandler(mux, &http2.Server{})
+	})
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// serveV1 receives a recording as the request body, after the client has
+// received a "100 Continue" response, and responds once it's stored.
+func (s *Server) serveV1(w http.ResponseWriter, r *http.Request) {
+	var n atomic.Int64
+	if err := s.store(r.Context(), r.Body, &n); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// v2ResponseFrame is the JSON object that version 2 of the protocol streams
+// in the response.
+type v2ResponseFrame struct {
+	// Ack is the number of bytes received so far.
+	Ack int64 `json:"ack,omitempty"`
+	// Error is set in the last frame if storing the recording failed.
+	Error string `json:"error,omitempty"`
+}
+
+// serveV2 receives a recording as the request body, while sending frames
+// with the number of bytes received in the response.
+func (s *Server) serveV2(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor < 2 {
+		http.Error(w, "HTTP/2 required", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	// Send the response headers now, as the client doesn't start
+	// uploading until it has them.
+	w.WriteHeader(http.StatusOK)
+	http.NewResponseController(w).Flush()
+
+	var n atomic.Int64
+	done := make(chan error, 1)
+	go func() {
+		done <- s.store(r.Context(), r.Body, &n)
+	}()
+
+	interval := s.AckInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	enc := json.NewEncoder(w)
+	for {
+		var frame v2ResponseFrame
+		select {
+		case err := <-done:
+			frame.Ack = n.Load()
+			if err != nil {
+				frame.Error = err.Error()
+			}
+			enc.Encode(frame)
+			return
+		case <-t.C:
+			frame.Ack = n.Load()
+		}
+		if err := enc.Encode(frame); err != nil {
+			// The client went away; wait for the upload to fail
+			// before returning, so it doesn't read a finished
+			// request's body.
+			<-done
+			return
+		}
+		http.NewResponseController(w).Flush()
+	}
+}
+
+// store stores the recording read from body, adding the number of bytes
+// written to storage to n as it goes.
+//
+// If the upload is cut off, the recording is stored up to that point, as
+// clients may cut it off at the end of a session.
+func (s *Server) store(ctx context.Context, body io.Reader, n *atomic.Int64) error {
+	br := bufio.NewReaderSize(body, maxHeaderSize)
+	header, err := br.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return errors.New("recording header too long")
+		}
+		if len(header) == 0 {
+			return fmt.Errorf("reading recording header: %w", err)
+		}
+	}
+	name := recordingName(header, time.Now())
+
+	// Store what was received even if the client goes away.
+	wc, err := s.Storage.Create(context.WithoutCancel(ctx), name)
+	if err != nil {
+		s.logf("recorder: creating %s: %v", name, err)
+		return errors.New("failed to store recording")
+	}
+	cw := &countingWriter{w: wc, n: n}
+	_, err = cw.Write(header)
+	if err == nil {
+		_, err = io.Copy(cw, br)
+	}
+	if cerr := wc.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.logf("recorder: %s: stored %d bytes; %v", name, n.Load(), err)
+		return err
+	}
+	s.logf("recorder: %s: stored %d bytes", name, n.Load())
+	return nil
+}
+
+// recordingName returns the name to store the recording with the given
+// header line as. If the header is invalid, the recording is still stored,
+// under "unknown".
+func recordingName(header []byte, now time.Time) string {
+	node, start := "unknown", now
+	var h sessionrecording.CastHeader
+	if json.Unmarshal(header, &h) == nil {
+		if validNodeName(h.SrcNode) {
+			node = h.SrcNode
+		}
+		if h.Timestamp > 0 {
+			start = time.Unix(h.Timestamp, 0)
+		}
+	}
+	return path.Join(node, start.UTC().Format("20060102T150405Z")+"-"+rands.HexString(8)+".cast")
+}
+
+// validNodeName reports whether n is safe to use as a directory name.
+func validNodeName(n string) bool {
+	if n == "" || len(n) > 253 || strings.HasPrefix(n, ".") {
+		return false
+	}
+	for _, r := range n {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// countingWriter is an io.Writer that counts the bytes written to w in n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
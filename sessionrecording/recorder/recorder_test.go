@@ -0,0 +1,172 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package recorder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/sessionrecording"
+)
+
+const testRecording = `{"version":2,"width":80,"height":24,"timestamp":1700000000,"srcNode":"laptop.example.ts.net"}
+[0.1,"o","hello\r\n"]
+[0.2,"o","world\r\n"]
+`
+
+// recordings returns the contents of the files under dir by their
+// slash-separated relative paths.
+func recordings(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	got := map[string]string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		got[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func checkRecording(t *testing.T, dir string) {
+	t.Helper()
+	got := recordings(t, dir)
+	if len(got) != 1 {
+		t.Fatalf("got %d recordings; want 1: %v", len(got), got)
+	}
+	for name, contents := range got {
+		if !strings.HasPrefix(name, "laptop.example.ts.net/20231114T221320Z-") || !strings.HasSuffix(name, ".cast") {
+			t.Errorf("recording name = %q", name)
+		}
+		if contents != testRecording {
+			t.Errorf("recording = %q; want %q", contents, testRecording)
+		}
+	}
+}
+
+func newTestServer(t *testing.T, st Storage) netip.AddrPort {
+	srv := httptest.NewServer(&Server{
+		Storage:     st,
+		Logf:        t.Logf,
+		AckInterval: 10 * time.Millisecond,
+	})
+	t.Cleanup(srv.Close)
+	return netip.MustParseAddrPort(srv.Listener.Addr().String())
+}
+
+func TestServerV2(t *testing.T) {
+	dir := t.TempDir()
+	ap := newTestServer(t, DirStorage(dir))
+
+	var d net.Dialer
+	wc, _, errc, err := sessionrecording.ConnectToRecorder(context.Background(), []netip.AddrPort{ap}, d.DialContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write the recording in pieces, with pauses longer than the ack
+	// interval.
+	for line := range strings.Lines(testRecording) {
+		if _, err := io.WriteString(wc, line); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for upload to finish")
+	}
+	checkRecording(t, dir)
+}
+
+func TestServerV1(t *testing.T) {
+	dir := t.TempDir()
+	ap := newTestServer(t, DirStorage(dir))
+
+	req, err := http.NewRequest("POST", "http://"+ap.String()+"/record", strings.NewReader(testRecording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Expect", "100-continue")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %v", resp.Status)
+	}
+	checkRecording(t, dir)
+}
+
+type failingStorage struct{}
+
+func (failingStorage) Create(context.Context, string) (io.WriteCloser, error) {
+	return nil, errors.New("disk full")
+}
+
+func TestServerStorageError(t *testing.T) {
+	ap := newTestServer(t, failingStorage{})
+
+	var d net.Dialer
+	wc, _, errc, err := sessionrecording.ConnectToRecorder(context.Background(), []netip.AddrPort{ap}, d.DialContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wc.Close()
+	io.WriteString(wc, testRecording)
+	select {
+	case err := <-errc:
+		if err == nil || !strings.Contains(err.Error(), "failed to store recording") {
+			t.Fatalf("upload error = %v; want storage failure", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for upload to fail")
+	}
+}
+
+func TestRecordingName(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		header     string
+		wantPrefix string
+	}{
+		{`{"version":2,"timestamp":1700000000,"srcNode":"laptop.example.ts.net"}`, "laptop.example.ts.net/20231114T221320Z-"},
+		{`{"version":2,"srcNode":"../etc"}`, "unknown/20260102T030405Z-"},
+		{`{"version":2,"srcNode":"a/b"}`, "unknown/20260102T030405Z-"},
+		{`not json`, "unknown/20260102T030405Z-"},
+	}
+	for _, tt := range tests {
+		got := recordingName([]byte(tt.header), now)
+		if !strings.HasPrefix(got, tt.wantPrefix) || !strings.HasSuffix(got, ".cast") {
+			t.Errorf("recordingName(%q) = %q; want %q prefix", tt.header, got, tt.wantPrefix)
+		}
+	}
+}
@@ -0,0 +1,571 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build (linux && !android) || (darwin && !ios) || freebsd || openbsd || plan9
+
+package tailssh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"tailscale.com/sessionrecording"
+	"tailscale.com/types/logger"
+)
+
+// errReadOnly is the error recorded for file operations denied because the
+// session's file transfers are read-only.
+const errReadOnly = "denied: file transfers are read-only"
+
+// fileAuditor logs the file operations of an SFTP or SCP session to the
+// local log and, if the session is recorded, to the recording.
+//
+// Its readOnly mode is best-effort: it covers the SFTP subsystem and legacy
+// SCP run as the session's command, not shells or other commands that write
+// files themselves.
+type fileAuditor struct {
+	logf     logger.Logf
+	rec      *recording // or nil
+	readOnly bool       // deny operations that write files
+}
+
+// emit records ev. It only returns an error if writing to the recording
+// failed and the recording does not fail open.
+func (a *fileAuditor) emit(ev sessionrecording.FileEvent) error {
+	j, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	a.logf("%s", j)
+	if a.rec == nil {
+		return nil
+	}
+	if err := a.rec.writeEvent(sessionrecording.FileEventCode, string(j)); err != nil && !a.rec.failOpen {
+		return err
+	}
+	return nil
+}
+
+// SFTP packet types and constants, from draft-ietf-secsh-filexfer-02
+// (SFTP version 3, as implemented by OpenSSH and github.com/pkg/sftp).
+const (
+	sftpInit     = 1
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRename   = 18
+	sftpSymlink  = 20
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpExtended = 200
+
+	sftpOpenWrite  = 0x02
+	sftpOpenAppend = 0x04
+	sftpOpenCreat  = 0x08
+	sftpOpenTrunc  = 0x10
+
+	sftpStatusOK               = 0
+	sftpStatusPermissionDenied = 3
+
+	// sftpMaxPacket is the largest SFTP packet accepted, the same as
+	// OpenSSH's sftp-server.
+	sftpMaxPacket = 256 << 10
+)
+
+// sftpAuditor is a fileAuditor for the SFTP protocol. It decodes the packets
+// copied between the client and the SFTP server run by the incubator, and
+// answers requests denied by the read-only mode itself.
+type sftpAuditor struct {
+	*fileAuditor
+
+	mu       sync.Mutex // guards writes to toClient and the following
+	toClient io.Writer
+	pending  map[uint32]sftpRequest // by request ID
+	handles  map[string]*sftpFile   // open file handles
+}
+
+// sftpRequest is an SFTP request awaiting its response.
+type sftpRequest struct {
+	typ    byte
+	handle string                     // for sftpRead and sftpWrite
+	n      int64                      // bytes sent, for sftpWrite
+	ev     sessionrecording.FileEvent // if Op != "", to emit on response
+}
+
+// sftpFile is an open file handle.
+type sftpFile struct {
+	path          string
+	read, written int64
+}
+
+func newSFTPAuditor(a *fileAuditor, toClient io.Writer) *sftpAuditor {
+	return &sftpAuditor{
+		fileAuditor: a,
+		toClient:    toClient,
+		pending:     make(map[uint32]sftpRequest),
+		handles:     make(map[string]*sftpFile),
+	}
+}
+
+// requestWriter returns a writer for the stream of requests from the client,
+// which it passes on to the server in w.
+func (a *sftpAuditor) requestWriter(w io.Writer) io.Writer {
+	return &sftpPacketWriter{handle: func(pkt []byte) error {
+		deny, err := a.request(pkt)
+		if err != nil || deny {
+			return err
+		}
+		_, err = w.Write(pkt)
+		return err
+	}}
+}
+
+// responseWriter returns a writer for the stream of responses from the
+// server, which it passes on to the client.
+func (a *sftpAuditor) responseWriter() io.Writer {
+	return &sftpPacketWriter{handle: func(pkt []byte) error {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if err := a.responseLocked(pkt); err != nil {
+			return err
+		}
+		_, err := a.toClient.Write(pkt)
+		return err
+	}}
+}
+
+// request audits the request packet pkt. It reports whether the request was
+// denied and answered, so must not be passed to the server.
+func (a *sftpAuditor) request(pkt []byte) (deny bool, err error) {
+	d := sftpDecoder{b: pkt[4:]}
+	typ := d.byte()
+	if typ == sftpInit {
+		return false, nil
+	}
+	id := d.uint32()
+	req := sftpRequest{typ: typ}
+	writes := true
+	switch typ {
+	case sftpOpen:
+		req.ev.Op = "open"
+		req.ev.Path = d.string()
+		req.ev.Write = d.uint32()&(sftpOpenWrite|sftpOpenAppend|sftpOpenCreat|sftpOpenTrunc) != 0
+		writes = req.ev.Write
+	case sftpClose:
+		writes = false
+		if err := a.closeHandle(d.string()); err != nil {
+			return false, err
+		}
+	case sftpRead:
+		writes = false
+		req.handle = d.string()
+	case sftpWrite:
+		req.handle = d.string()
+		d.uint64() // offset
+		req.n = int64(len(d.bytes()))
+	case sftpSetstat:
+		req.ev = sessionrecording.FileEvent{Op: "setstat", Path: d.string()}
+	case sftpFsetstat:
+		req.ev = sessionrecording.FileEvent{Op: "setstat", Path: a.handlePath(d.string())}
+	case sftpRemove:
+		req.ev = sessionrecording.FileEvent{Op: "remove", Path: d.string()}
+	case sftpMkdir:
+		req.ev = sessionrecording.FileEvent{Op: "mkdir", Path: d.string()}
+	case sftpRmdir:
+		req.ev = sessionrecording.FileEvent{Op: "rmdir", Path: d.string()}
+	case sftpRename:
+		req.ev = sessionrecording.FileEvent{Op: "rename", Path: d.string(), NewPath: d.string()}
+	case sftpSymlink:
+		// OpenSSH, which everyone follows, sends the target first,
+		// contrary to the draft.
+		target := d.string()
+		req.ev = sessionrecording.FileEvent{Op: "symlink", Path: d.string(), NewPath: target}
+	case sftpExtended:
+		switch d.string() {
+		case "posix-rename@openssh.com":
+			req.ev = sessionrecording.FileEvent{Op: "rename", Path: d.string(), NewPath: d.string()}
+		case "hardlink@openssh.com":
+			req.ev = sessionrecording.FileEvent{Op: "link", Path: d.string(), NewPath: d.string()}
+		case "lsetstat@openssh.com":
+			req.ev = sessionrecording.FileEvent{Op: "setstat", Path: d.string()}
+		case "copy-data":
+			// Writes to a handle, which can't be open for writing
+			// if read-only.
+		default:
+			writes = false
+		}
+	default:
+		writes = false
+	}
+	if d.failed {
+		// Let the server deal with the malformed request.
+		return false, nil
+	}
+	if a.readOnly && writes {
+		if req.ev.Op == "" {
+			req.ev = sessionrecording.FileEvent{Op: "write", Path: a.handlePath(req.handle)}
+		}
+		req.ev.Error = errReadOnly
+		if err := a.emit(req.ev); err != nil {
+			return true, err
+		}
+		return true, a.writeStatus(id, sftpStatusPermissionDenied, "file transfers are read-only")
+	}
+	if req.ev.Op != "" || req.handle != "" || typ == sftpOpen {
+		a.mu.Lock()
+		a.pending[id] = req
+		a.mu.Unlock()
+	}
+	return false, nil
+}
+
+// responseLocked audits the response packet pkt.
+func (a *sftpAuditor) responseLocked(pkt []byte) error {
+	d := sftpDecoder{b: pkt[4:]}
+	typ := d.byte()
+	id := d.uint32()
+	req, ok := a.pending[id]
+	if !ok || d.failed {
+		return nil
+	}
+	delete(a.pending, id)
+	switch typ {
+	case sftpHandle:
+		if h := d.string(); !d.failed && req.typ == sftpOpen {
+			a.handles[h] = &sftpFile{path: req.ev.Path}
+		}
+	case sftpData:
+		if f := a.handles[req.handle]; f != nil && req.typ == sftpRead {
+			f.read += int64(len(d.bytes()))
+		}
+	case sftpStatus:
+		code := d.uint32()
+		if code == sftpStatusOK {
+			if f := a.handles[req.handle]; f != nil && req.typ == sftpWrite {
+				f.written += req.n
+			}
+			break
+		}
+		if msg := d.string(); msg != "" {
+			req.ev.Error = msg
+		} else {
+			req.ev.Error = "status " + strconv.FormatUint(uint64(code), 10)
+		}
+	}
+	if req.ev.Op == "" {
+		return nil
+	}
+	return a.emit(req.ev)
+}
+
+// handlePath returns the path of the file open as handle, if known.
+func (a *sftpAuditor) handlePath(handle string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if f := a.handles[handle]; f != nil {
+		return f.path
+	}
+	return ""
+}
+
+// closeHandle records the bytes read and written through handle, which is
+// being closed.
+func (a *sftpAuditor) closeHandle(handle string) error {
+	a.mu.Lock()
+	f := a.handles[handle]
+	delete(a.handles, handle)
+	a.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	return a.emitTotals(f)
+}
+
+func (a *sftpAuditor) emitTotals(f *sftpFile) error {
+	if f.read > 0 {
+		if err := a.emit(sessionrecording.FileEvent{Op: "read", Path: f.path, Bytes: f.read}); err != nil {
+			return err
+		}
+	}
+	if f.written > 0 {
+		return a.emit(sessionrecording.FileEvent{Op: "write", Path: f.path, Bytes: f.written})
+	}
+	return nil
+}
+
+// finish records the bytes read and written through handles that were not
+// closed before the session ended.
+func (a *sftpAuditor) finish() {
+	a.mu.Lock()
+	var files []*sftpFile
+	for _, f := range a.handles {
+		files = append(files, f)
+	}
+	clear(a.handles)
+	a.mu.Unlock()
+	for _, f := range files {
+		a.emitTotals(f)
+	}
+}
+
+// writeStatus sends a status response to the client.
+func (a *sftpAuditor) writeStatus(id, code uint32, msg string) error {
+	var b []byte
+	b = binary.BigEndian.AppendUint32(b, 0) // length; set below
+	b = append(b, sftpStatus)
+	b = binary.BigEndian.AppendUint32(b, id)
+	b = binary.BigEndian.AppendUint32(b, code)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(msg)))
+	b = append(b, msg...)
+	b = binary.BigEndian.AppendUint32(b, 0) // language tag
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err := a.toClient.Write(b)
+	return err
+}
+
+// sftpPacketWriter is an io.Writer that splits the SFTP stream written to it
+// into packets, and passes each, including its length, to handle.
+type sftpPacketWriter struct {
+	handle func(pkt []byte) error
+	buf    []byte
+}
+
+func (w *sftpPacketWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	rest := w.buf
+	for len(rest) >= 4 {
+		n := binary.BigEndian.Uint32(rest)
+		if n == 0 || n > sftpMaxPacket {
+			return 0, fmt.Errorf("invalid SFTP packet length %d", n)
+		}
+		if uint32(len(rest)-4) < n {
+			break
+		}
+		if err := w.handle(rest[:4+n]); err != nil {
+			return 0, err
+		}
+		rest = rest[4+n:]
+	}
+	w.buf = w.buf[:copy(w.buf, rest)]
+	return len(p), nil
+}
+
+// sftpDecoder decodes the fields of an SFTP packet. If it runs out of data,
+// it returns zero values and sets failed.
+type sftpDecoder struct {
+	b      []byte
+	failed bool
+}
+
+func (d *sftpDecoder) fail() {
+	d.failed = true
+	d.b = nil
+}
+
+func (d *sftpDecoder) byte() byte {
+	if len(d.b) < 1 {
+		d.fail()
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *sftpDecoder) uint32() uint32 {
+	if len(d.b) < 4 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *sftpDecoder) uint64() uint64 {
+	if len(d.b) < 8 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+// bytes returns the next string field without copying it.
+func (d *sftpDecoder) bytes() []byte {
+	n := d.uint32()
+	if uint32(len(d.b)) < n {
+		d.fail()
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *sftpDecoder) string() string {
+	return string(d.bytes())
+}
+
+// parseSCPCommand reports whether args run scp in legacy mode, and if so,
+// whether it receives files ("scp -t") rather than sending them ("scp -f"),
+// and the paths it is given.
+func parseSCPCommand(args []string) (sink bool, paths []string, ok bool) {
+	if len(args) < 2 || path.Base(args[0]) != "scp" {
+		return false, nil, false
+	}
+	var source bool
+	for i, arg := range args[1:] {
+		if arg == "--" {
+			paths = append(paths, args[i+2:]...)
+			break
+		}
+		if flags, ok := strings.CutPrefix(arg, "-"); ok && flags != "" {
+			sink = sink || strings.ContainsRune(flags, 't')
+			source = source || strings.ContainsRune(flags, 'f')
+			continue
+		}
+		paths = append(paths, arg)
+	}
+	if sink == source || len(paths) == 0 {
+		return false, nil, false
+	}
+	return sink, paths, true
+}
+
+// scpAuditor is a fileAuditor for the legacy SCP protocol, which scp uses
+// with -O and before OpenSSH 9.0. It is an io.Writer that decodes the stream
+// from the side sending files: the client for "scp -t" and the server for
+// "scp -f".
+type scpAuditor struct {
+	*fileAuditor
+	op    string   // "write" for "scp -t", "read" for "scp -f"
+	paths []string // the paths given to scp
+	dirs  []string // directories entered with "D" messages
+
+	line      []byte                     // partial control message
+	remain    int64                      // bytes left of the file being sent
+	afterData bool                       // whether the file's status byte is next
+	ev        sessionrecording.FileEvent // the file being sent
+}
+
+// scpMaxLine is the longest SCP control message accepted.
+const scpMaxLine = 64 << 10
+
+func newSCPAuditor(a *fileAuditor, sink bool, paths []string) *scpAuditor {
+	op := "read"
+	if sink {
+		op = "write"
+	}
+	return &scpAuditor{fileAuditor: a, op: op, paths: paths}
+}
+
+func (a *scpAuditor) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if a.remain > 0 {
+			k := min(int64(len(p)), a.remain)
+			a.remain -= k
+			p = p[k:]
+			continue
+		}
+		if a.afterData {
+			// The sender follows the file with a zero byte, or an
+			// error message if it failed to read it all.
+			a.afterData = false
+			if p[0] == 0 {
+				p = p[1:]
+			} else {
+				a.ev.Error = "sender failed to read file"
+			}
+			if err := a.emit(a.ev); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			a.line = append(a.line, p...)
+			if len(a.line) > scpMaxLine {
+				return 0, errors.New("SCP control message too long")
+			}
+			break
+		}
+		a.line = append(a.line, p[:i]...)
+		p = p[i+1:]
+		a.control(string(a.line))
+		a.line = a.line[:0]
+	}
+	return n, nil
+}
+
+// control handles the SCP control message line, without its newline.
+func (a *scpAuditor) control(line string) {
+	if line == "" {
+		return
+	}
+	switch line[0] {
+	case 'C':
+		// "C<mode> <size> <name>"
+		f := strings.SplitN(line, " ", 3)
+		if len(f) != 3 {
+			return
+		}
+		size, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil || size < 0 {
+			return
+		}
+		a.ev = sessionrecording.FileEvent{
+			Op:    a.op,
+			Path:  a.path(f[2]),
+			Name:  path.Join(append(a.dirs, f[2])...),
+			Bytes: size,
+		}
+		a.remain = size
+		a.afterData = true
+	case 'D':
+		// "D<mode> 0 <name>"
+		if f := strings.SplitN(line, " ", 3); len(f) == 3 {
+			a.dirs = append(a.dirs, f[2])
+		}
+	case 'E':
+		if len(a.dirs) > 0 {
+			a.dirs = a.dirs[:len(a.dirs)-1]
+		}
+	}
+}
+
+// path returns the path given to scp that the file name being sent is in.
+func (a *scpAuditor) path(name string) string {
+	if a.op == "read" {
+		top := name
+		if len(a.dirs) > 0 {
+			top = a.dirs[0]
+		}
+		for _, p := range a.paths {
+			if path.Base(p) == top {
+				return p
+			}
+		}
+	}
+	return a.paths[0]
+}
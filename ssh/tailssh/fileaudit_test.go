@@ -0,0 +1,306 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build (linux && !android) || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"tailscale.com/sessionrecording"
+)
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// recordedFileEvents returns the file events in the cast events written to
+// out.
+func recordedFileEvents(t *testing.T, out string) []sessionrecording.FileEvent {
+	t.Helper()
+	var evs []sessionrecording.FileEvent
+	for line := range strings.Lines(out) {
+		var ce sessionrecording.CastEvent
+		if err := json.Unmarshal([]byte(line), &ce); err != nil {
+			t.Fatalf("bad cast event %q: %v", line, err)
+		}
+		if ce.Code != sessionrecording.FileEventCode {
+			t.Errorf("unexpected cast event code %q", ce.Code)
+			continue
+		}
+		var ev sessionrecording.FileEvent
+		if err := json.Unmarshal([]byte(ce.Data), &ev); err != nil {
+			t.Fatal(err)
+		}
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+// newAuditedSFTP returns an SFTP client connected to an SFTP server through
+// an sftpAuditor, and the buffer the auditor records to.
+func newAuditedSFTP(t *testing.T, readOnly bool) (*sftp.Client, *sftpAuditor, *syncBuffer) {
+	out := new(syncBuffer)
+	fa := &fileAuditor{
+		logf:     t.Logf,
+		rec:      &recording{start: time.Now(), failOpen: true, out: nopWriteCloser{out}},
+		readOnly: readOnly,
+	}
+	c2sR, c2sW := io.Pipe() // client to auditor
+	srvInR, srvInW := io.Pipe()
+	srvOutR, srvOutW := io.Pipe()
+	s2cR, s2cW := io.Pipe() // auditor to client
+	sa := newSFTPAuditor(fa, s2cW)
+	go func() {
+		io.Copy(sa.requestWriter(srvInW), c2sR)
+		srvInW.Close()
+	}()
+	go func() {
+		io.Copy(sa.responseWriter(), srvOutR)
+		s2cW.Close()
+	}()
+
+	srv, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{srvInR, srvOutW})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		srv.Serve()
+		srvOutW.Close()
+	}()
+	c, err := sftp.NewClientPipe(s2cR, c2sW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		srv.Close()
+		for _, p := range []*io.PipeReader{c2sR, srvInR, srvOutR, s2cR} {
+			p.Close()
+		}
+	})
+	return c, sa, out
+}
+
+func TestSFTPAuditor(t *testing.T) {
+	dir := t.TempDir()
+	foo := filepath.Join(dir, "foo")
+	bar := filepath.Join(dir, "bar")
+	c, _, out := newAuditedSFTP(t, false)
+
+	f, err := c.Create(foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = c.Open(foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "hello, world" {
+		t.Fatalf("ReadAll = %q, %v", b, err)
+	}
+	f.Close()
+	if err := c.PosixRename(foo, bar); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Remove(foo); err == nil {
+		t.Fatal("Remove of renamed file succeeded")
+	}
+	if err := c.Remove(bar); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	got := recordedFileEvents(t, out.String())
+	for i := range got {
+		if got[i].Error != "" {
+			got[i].Error = "error"
+		}
+	}
+	want := []sessionrecording.FileEvent{
+		{Op: "open", Path: foo, Write: true},
+		{Op: "write", Path: foo, Bytes: 12},
+		{Op: "open", Path: foo},
+		{Op: "read", Path: foo, Bytes: 12},
+		{Op: "rename", Path: foo, NewPath: bar},
+		{Op: "remove", Path: foo, Error: "error"},
+		{Op: "remove", Path: bar},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestSFTPAuditorReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	foo := filepath.Join(dir, "foo")
+	if err := os.WriteFile(foo, []byte("contents"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, _, out := newAuditedSFTP(t, true)
+
+	if _, err := c.Create(filepath.Join(dir, "new")); !os.IsPermission(err) {
+		t.Errorf("Create = %v; want permission error", err)
+	}
+	if _, err := c.OpenFile(foo, os.O_WRONLY|os.O_APPEND); !os.IsPermission(err) {
+		t.Errorf("OpenFile for append = %v; want permission error", err)
+	}
+	if err := c.Remove(foo); !os.IsPermission(err) {
+		t.Errorf("Remove = %v; want permission error", err)
+	}
+	if err := c.Mkdir(filepath.Join(dir, "d")); !os.IsPermission(err) {
+		t.Errorf("Mkdir = %v; want permission error", err)
+	}
+	if err := c.Chmod(foo, 0666); !os.IsPermission(err) {
+		t.Errorf("Chmod = %v; want permission error", err)
+	}
+	f, err := c.Open(foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "contents" {
+		t.Fatalf("ReadAll = %q, %v", b, err)
+	}
+	f.Close()
+	c.Close()
+
+	if b, err := os.ReadFile(foo); err != nil || string(b) != "contents" {
+		t.Errorf("file after read-only session = %q, %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); !os.IsNotExist(err) {
+		t.Errorf("new file was created: %v", err)
+	}
+	got := recordedFileEvents(t, out.String())
+	want := []sessionrecording.FileEvent{
+		{Op: "open", Path: filepath.Join(dir, "new"), Write: true, Error: errReadOnly},
+		{Op: "open", Path: foo, Write: true, Error: errReadOnly},
+		{Op: "remove", Path: foo, Error: errReadOnly},
+		{Op: "rmdir", Path: foo, Error: errReadOnly}, // sftp.Client.Remove tries both
+		{Op: "mkdir", Path: filepath.Join(dir, "d"), Error: errReadOnly},
+		{Op: "setstat", Path: foo, Error: errReadOnly},
+		{Op: "open", Path: foo},
+		{Op: "read", Path: foo, Bytes: 8},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParseSCPCommand(t *testing.T) {
+	tests := []struct {
+		args      []string
+		wantSink  bool
+		wantPaths []string
+		wantOK    bool
+	}{
+		{args: []string{"scp", "-t", "--", "/tmp/x"}, wantSink: true, wantPaths: []string{"/tmp/x"}, wantOK: true},
+		{args: []string{"/usr/bin/scp", "-v", "-r", "-t", "."}, wantSink: true, wantPaths: []string{"."}, wantOK: true},
+		{args: []string{"scp", "-pf", "a", "b"}, wantPaths: []string{"a", "b"}, wantOK: true},
+		{args: []string{"scp", "a", "b"}},
+		{args: []string{"scp", "-t"}},
+		{args: []string{"ls", "-t", "x"}},
+		{args: nil},
+	}
+	for _, tt := range tests {
+		sink, paths, ok := parseSCPCommand(tt.args)
+		if sink != tt.wantSink || !reflect.DeepEqual(paths, tt.wantPaths) || ok != tt.wantOK {
+			t.Errorf("parseSCPCommand(%q) = %v, %q, %v; want %v, %q, %v", tt.args, sink, paths, ok, tt.wantSink, tt.wantPaths, tt.wantOK)
+		}
+	}
+}
+
+func TestSCPAuditor(t *testing.T) {
+	tests := []struct {
+		name   string
+		sink   bool
+		paths  []string
+		stream string
+		want   []sessionrecording.FileEvent
+	}{
+		{
+			name:   "upload",
+			sink:   true,
+			paths:  []string{"/tmp"},
+			stream: "T1700000000 0 1700000000 0\nC0644 5 a.txt\nhello\x00C0600 0 empty\n\x00",
+			want: []sessionrecording.FileEvent{
+				{Op: "write", Path: "/tmp", Name: "a.txt", Bytes: 5},
+				{Op: "write", Path: "/tmp", Name: "empty"},
+			},
+		},
+		{
+			name:   "upload_recursive",
+			sink:   true,
+			paths:  []string{"."},
+			stream: "D0755 0 dir\nD0755 0 sub\nC0644 3 x\nabc\x00E\nC0644 4 y\n\nyz\n\x00E\n",
+			want: []sessionrecording.FileEvent{
+				{Op: "write", Path: ".", Name: "dir/sub/x", Bytes: 3},
+				{Op: "write", Path: ".", Name: "dir/y", Bytes: 4},
+			},
+		},
+		{
+			name:   "download",
+			paths:  []string{"/etc/hosts", "/etc/passwd"},
+			stream: "C0644 2 passwd\nxy\x00C0644 3 hosts\nxyz\x01scp: /etc/hosts: read error\n",
+			want: []sessionrecording.FileEvent{
+				{Op: "read", Path: "/etc/passwd", Name: "passwd", Bytes: 2},
+				{Op: "read", Path: "/etc/hosts", Name: "hosts", Bytes: 3, Error: "sender failed to read file"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := new(syncBuffer)
+			a := newSCPAuditor(&fileAuditor{
+				logf: t.Logf,
+				rec:  &recording{start: time.Now(), failOpen: true, out: nopWriteCloser{out}},
+			}, tt.sink, tt.paths)
+			// Write a byte at a time to exercise partial messages.
+			for i := range len(tt.stream) {
+				if _, err := a.Write([]byte{tt.stream[i]}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := recordedFileEvents(t, out.String()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events:\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -32,6 +32,7 @@
 	gossh "golang.org/x/crypto/ssh"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/localapi"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
@@ -51,6 +52,9 @@
 	sshDisableSFTP       = envknob.RegisterBool("TS_SSH_DISABLE_SFTP")
 	sshDisableForwarding = envknob.RegisterBool("TS_SSH_DISABLE_FORWARDING")
 	sshDisablePTY        = envknob.RegisterBool("TS_SSH_DISABLE_PTY")
+	sshAuditFiles        = envknob.RegisterBool("TS_SSH_AUDIT_FILE_TRANSFERS")
+	sshRecordLocally     = envknob.RegisterBool("TS_SSH_RECORD_LOCALLY")
+	debugLogSSH          = envknob.RegisterBool("TS_DEBUG_LOG_SSH") // deprecated alias of TS_SSH_RECORD_LOCALLY
 
 	// errTerminal is an empty gossh.PartialSuccessError (with no 'Next'
 	// authentication methods that may proceed), which results in the SSH
@@ -117,6 +121,7 @@ func init() {
 
 		return srv, nil
 	})
+	localapi.Register("ssh-recordings-dir", serveSSHRecordingsDir)
 }
 
 // attachSessionToConnIfNotShutdown ensures that srv is not shutdown before
@@ -929,6 +934,7 @@ func (ss *sshSession) run() {
 	ss.DisablePTYEmulation()
 
 	var rec *recording // or nil if disabled
+	auditFiles := ss.shouldAuditFiles()
 	if ss.Subsystem() != "sftp" {
 		if err := ss.handleSSHAgentForwarding(ss, lu); err != nil {
 			ss.logf("agent forwarding failed: %v", err)
@@ -936,25 +942,51 @@ func (ss *sshSession) run() {
 			// TODO(maisem/bradfitz): add a way to close all session resources
 			defer ss.agentListener.Close()
 		}
+	}
+	// SFTP sessions are only recorded if their file operations are
+	// audited, as their output is just the protocol.
+	if ss.shouldRecord() && (ss.Subsystem() != "sftp" || auditFiles) {
+		var err error
+		rec, err = ss.startNewRecording()
+		if err != nil {
+			var uve userVisibleError
+			if errors.As(err, &uve) {
+				fmt.Fprintf(ss, "%s\r\n", uve.SSHTerminationMessage())
+			} else {
+				fmt.Fprintf(ss, "can't start new recording\r\n")
+			}
+			ss.logf("startNewRecording: %v", err)
+			ss.Exit(1)
+			return
+		}
+		ss.logf("startNewRecording: <nil>")
+		if rec != nil {
+			defer rec.Close()
+		}
+	}
 
-		if ss.shouldRecord() {
-			var err error
-			rec, err = ss.startNewRecording()
-			if err != nil {
-				var uve userVisibleError
-				if errors.As(err, &uve) {
-					fmt.Fprintf(ss, "%s\r\n", uve.SSHTerminationMessage())
-				} else {
-					fmt.Fprintf(ss, "can't start new recording\r\n")
-				}
-				ss.logf("startNewRecording: %v", err)
+	var (
+		sftpA   *sftpAuditor
+		scpA    *scpAuditor
+		scpSink bool
+	)
+	if auditFiles {
+		fa := &fileAuditor{
+			logf:     logger.WithPrefix(ss.logf, "file audit: "),
+			rec:      rec,
+			readOnly: ss.conn.finalAction.FileTransferReadOnly,
+		}
+		if ss.Subsystem() == "sftp" {
+			sftpA = newSFTPAuditor(fa, ss)
+			defer sftpA.finish()
+		} else if sink, paths, ok := parseSCPCommand(ss.Command()); ok {
+			if sink && fa.readOnly {
+				fa.emit(sessionrecording.FileEvent{Op: "write", Path: paths[0], Error: errReadOnly})
+				fmt.Fprintf(ss.Stderr(), "scp: file transfers are read-only\r\n")
 				ss.Exit(1)
 				return
 			}
-			ss.logf("startNewRecording: <nil>")
-			if rec != nil {
-				defer rec.Close()
-			}
+			scpA, scpSink = newSCPAuditor(fa, sink, paths), sink
 		}
 	}
 
@@ -973,10 +1005,22 @@ func (ss *sshSession) run() {
 	}
 	go ss.killProcessOnContextDone()
 
+	// The stdin and stdout writers wrap the process's pipes, which only
+	// exist once it's launched.
+	stdin, stdout := rec.writer("i", ss.wrStdin), rec.writer("o", ss)
+	switch {
+	case sftpA != nil:
+		stdin, stdout = sftpA.requestWriter(ss.wrStdin), sftpA.responseWriter()
+	case scpA != nil && scpSink:
+		stdin = io.MultiWriter(scpA, stdin)
+	case scpA != nil:
+		stdout = io.MultiWriter(scpA, stdout)
+	}
+
 	var processDone atomic.Bool
 	go func() {
 		defer ss.wrStdin.Close()
-		if _, err := io.Copy(rec.writer("i", ss.wrStdin), ss); err != nil {
+		if _, err := io.Copy(stdin, ss); err != nil {
 			logf("stdin copy: %v", err)
 			ss.cancelCtx(err)
 		}
@@ -990,7 +1034,7 @@ func (ss *sshSession) run() {
 	}
 	go func() {
 		defer ss.rdStdout.Close()
-		_, err := io.Copy(rec.writer("o", ss), ss.rdStdout)
+		_, err := io.Copy(stdout, ss.rdStdout)
 		if err != nil && !errors.Is(err, io.EOF) {
 			isErrBecauseProcessExited := processDone.Load() && errors.Is(err, syscall.EIO)
 			if !isErrBecauseProcessExited {
@@ -1052,10 +1096,41 @@ func (ss *sshSession) run() {
 	return
 }
 
-// recordSSHToLocalDisk is a deprecated dev knob to allow recording SSH sessions
-// to local storage. It is only used if there is no recording configured by the
-// coordination server. This will be removed in the future.
-var recordSSHToLocalDisk = envknob.RegisterBool("TS_DEBUG_LOG_SSH")
+// recordSSHToLocalDisk reports whether to record SSH sessions to the
+// recordingsDir of the var root, as set with TS_SSH_RECORD_LOCALLY. It is only
+// used if there is no recording configured by the coordination server, or if
+// none of the configured recorders can be reached and the session would
+// otherwise fail open unrecorded. The recordings can be listed and replayed
+// with "tailscale debug ssh-recordings".
+func recordSSHToLocalDisk() bool {
+	return sshRecordLocally() || debugLogSSH()
+}
+
+// recordingsDir returns the directory sessions are recorded to on local disk,
+// given the var root.
+func recordingsDir(varRoot string) string {
+	return filepath.Join(varRoot, "ssh-sessions")
+}
+
+// serveSSHRecordingsDir is the LocalAPI handler that returns the directory
+// sessions are recorded to on local disk, for "tailscale debug
+// ssh-recordings".
+func serveSSHRecordingsDir(h *localapi.Handler, w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	varRoot := h.LocalBackend().TailscaleVarRoot()
+	if varRoot == "" {
+		http.Error(w, "no var root for recording storage", http.StatusNotFound)
+		return
+	}
+	io.WriteString(w, recordingsDir(varRoot))
+}
 
 // recorders returns the list of recorders to use for this session.
 // If the final action has a non-empty list of recorders, that list is
@@ -1073,6 +1148,12 @@ func (ss *sshSession) shouldRecord() bool {
 	return len(recs) > 0 || recordSSHToLocalDisk()
 }
 
+// shouldAuditFiles reports whether to log the file operations of SFTP and
+// legacy SCP sessions, which is required to make them read-only.
+func (ss *sshSession) shouldAuditFiles() bool {
+	return sshAuditFiles() || ss.conn.finalAction.FileTransferReadOnly
+}
+
 type sshConnInfo struct {
 	// sshUser is the requested local SSH username ("root", "alice", etc).
 	sshUser string
@@ -1220,7 +1301,7 @@ func (ss *sshSession) openFileForRecording(now time.Time) (_ io.WriteCloser, err
 	if varRoot == "" {
 		return nil, errors.New("no var root for recording storage")
 	}
-	dir := filepath.Join(varRoot, "ssh-sessions")
+	dir := recordingsDir(varRoot)
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
@@ -1297,42 +1378,52 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 					msg:   onFailure.RejectSessionWithMessage,
 				}
 			}
-			ss.logf("recording: error starting recording (failing open): %v", err)
-			return nil, nil
+			if !recordSSHToLocalDisk() {
+				ss.logf("recording: error starting recording (failing open): %v", err)
+				return nil, nil
+			}
+			ss.logf("recording: error starting recording (recording to local disk): %v", err)
+			if rec.out, err = ss.openFileForRecording(now); err != nil {
+				ss.logf("recording: error opening local recording (failing open): %v", err)
+				return nil, nil
+			}
+			localRecording = true
 		}
-		go func() {
-			err := <-errChan
-			if err == nil {
-				select {
-				case <-ss.ctx.Done():
-					// Success.
-					ss.logf("recording: finished uploading recording")
-					return
-				default:
-					err = errors.New("recording upload ended before the SSH session")
+		if !localRecording {
+			go func() {
+				err := <-errChan
+				if err == nil {
+					select {
+					case <-ss.ctx.Done():
+						// Success.
+						ss.logf("recording: finished uploading recording")
+						return
+					default:
+						err = errors.New("recording upload ended before the SSH session")
+					}
 				}
-			}
-			if onFailure != nil && onFailure.NotifyURL != "" && len(attempts) > 0 {
-				lastAttempt := attempts[len(attempts)-1]
-				lastAttempt.FailureMessage = err.Error()
+				if onFailure != nil && onFailure.NotifyURL != "" && len(attempts) > 0 {
+					lastAttempt := attempts[len(attempts)-1]
+					lastAttempt.FailureMessage = err.Error()
 
-				eventType := tailcfg.SSHSessionRecordingFailed
-				if onFailure.TerminateSessionWithMessage != "" {
-					eventType = tailcfg.SSHSessionRecordingTerminated
-				}
+					eventType := tailcfg.SSHSessionRecordingFailed
+					if onFailure.TerminateSessionWithMessage != "" {
+						eventType = tailcfg.SSHSessionRecordingTerminated
+					}
 
-				ss.notifyControl(ctx, nodeKey, eventType, attempts, onFailure.NotifyURL)
-			}
-			if onFailure != nil && onFailure.TerminateSessionWithMessage != "" {
-				ss.logf("recording: error uploading recording (closing session): %v", err)
-				ss.cancelCtx(userVisibleError{
-					error: err,
-					msg:   onFailure.TerminateSessionWithMessage,
-				})
-				return
-			}
-			ss.logf("recording: error uploading recording (failing open): %v", err)
-		}()
+					ss.notifyControl(ctx, nodeKey, eventType, attempts, onFailure.NotifyURL)
+				}
+				if onFailure != nil && onFailure.TerminateSessionWithMessage != "" {
+					ss.logf("recording: error uploading recording (closing session): %v", err)
+					ss.cancelCtx(userVisibleError{
+						error: err,
+						msg:   onFailure.TerminateSessionWithMessage,
+					})
+					return
+				}
+				ss.logf("recording: error uploading recording (failing open): %v", err)
+			}()
+		}
 	}
 
 	ch := sessionrecording.CastHeader{
@@ -1358,6 +1449,9 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 		SrcNodeID:    ss.conn.info.node.StableID(),
 		ConnectionID: ss.conn.connID,
 	}
+	if sub := ss.Subsystem(); sub != "" {
+		ch.Command = sub
+	}
 	if !ss.conn.info.node.IsTagged() {
 		ch.SrcNodeUser = ss.conn.info.uprof.LoginName
 		ch.SrcNodeUserID = ss.conn.info.node.User()
@@ -1497,6 +1591,16 @@ func (w *loggingWriter) Write(p []byte) (n int, err error) {
 	return w.w.Write(p)
 }
 
+// writeEvent records an event with the given code and data.
+func (r *recording) writeEvent(code, data string) error {
+	j, err := json.Marshal([]any{time.Since(r.start).Seconds(), code, data})
+	if err != nil {
+		return err
+	}
+	j = append(j, '\n')
+	return loggingWriter{r: r}.writeCastLine(j)
+}
+
 func (w loggingWriter) writeCastLine(j []byte) error {
 	w.r.mu.Lock()
 	defer w.r.mu.Unlock()
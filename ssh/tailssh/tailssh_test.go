@@ -1219,6 +1219,111 @@ func TestSSH(t *testing.T) {
 			t.Errorf("got %q; want %q", got, str)
 		}
 	})
+
+}
+
+// TestSSHRecordedAuditedStdin tests that stdin reaches the process in a
+// session that is both recorded and has its file transfers audited.
+func TestSSHRecordedAuditedStdin(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	if cibuild.On() {
+		t.Skip("Skipping for now; see https://github.com/tailscale/tailscale/issues/4051")
+	}
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("no ssh client")
+	}
+	recorded := make(chan []byte, 1)
+	recordingServer := mockRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		recorded <- b
+	})
+
+	action := &tailcfg.SSHAction{
+		Accept: true,
+		Recorders: []netip.AddrPort{
+			must.Get(netip.ParseAddrPort(recordingServer.Listener.Addr().String())),
+		},
+		FileTransferReadOnly: true,
+	}
+	srv := &server{
+		logf: tstest.WhileTestRunningLogger(t),
+		lb: &localState{
+			sshEnabled:   true,
+			matchingRule: newSSHRule(action),
+		},
+	}
+	defer srv.Shutdown()
+	sc, err := srv.newConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.insecureSkipTailscaleAuth = true
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.localUser = must.Get(userLookup(u.Username))
+	sc.info = &sshConnInfo{
+		sshUser: "test",
+		src:     netip.MustParseAddrPort("1.2.3.4:32342"),
+		dst:     netip.MustParseAddrPort("1.2.3.5:22"),
+		node:    (&tailcfg.Node{}).View(),
+		uprof:   tailcfg.UserProfile{},
+	}
+	sc.action0 = action
+	sc.finalAction = action
+	sc.Handler = func(s ssh.Session) {
+		sc.newSSHSession(s).run()
+	}
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go sc.HandleConn(c)
+		}
+	}()
+
+	cmd := exec.Command("ssh",
+		"-F", "none",
+		"-p", fmt.Sprint(ln.Addr().(*net.TCPAddr).Port),
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"user@127.0.0.1", "cat")
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+	const str = "foo\nbar\n"
+	cmd.Stdin = strings.NewReader(str)
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err, errBuf.String())
+	}
+	if got := outBuf.String(); got != str {
+		t.Errorf("got %q; want %q", got, str)
+	}
+
+	select {
+	case rec := <-recorded:
+		if !bytes.Contains(rec, []byte(`"o","foo\nbar\n"`)) {
+			t.Errorf("recording lacks the session's output:\n%s", rec)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for recording")
+	}
 }
 
 func parseEnv(out []byte) map[string]string {
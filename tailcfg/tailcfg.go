@@ -172,7 +172,8 @@
 //   - 125: 2025-08-11: dnstype.Resolver adds UseWithExitNode field.
 //   - 126: 2025-09-17: Client uses seamless key renewal unless disabled by control (tailscale/corp#31479)
 //   - 127: 2025-09-19: can handle C2N /debug/netmap.
-const CurrentCapabilityVersion CapabilityVersion = 127
+//   - 128: 2026-10-16: Client understands SSHAction.FileTransferReadOnly.
+const CurrentCapabilityVersion CapabilityVersion = 128
 
 // ID is an integer ID for a user, node, or login allocated by the
 // control plane.
@@ -2918,6 +2919,17 @@ type SSHAction struct {
 	// OnRecorderFailure is the action to take if recording fails.
 	// If nil, the default action is to fail open.
 	OnRecordingFailure *SSHRecorderFailureAction `json:"onRecordingFailure,omitempty"`
+
+	// FileTransferReadOnly, if true, means that SFTP and SCP in accepted
+	// connections may only read files, and not create, modify, rename or
+	// remove them.
+	//
+	// This is best-effort. SFTP sessions are checked request by request,
+	// but SCP is only recognized when it's the session's command, so
+	// "sh -c 'scp -t ...'" is not caught. Nor does it restrict what shells
+	// or other commands run in the session can do, so it only makes file
+	// transfers read-only for users who can't otherwise run commands.
+	FileTransferReadOnly bool `json:"fileTransferReadOnly,omitempty"`
 }
 
 // SSHRecorderFailureAction is the action to take if recording fails.
@@ -551,6 +551,7 @@ func (src *SSHAction) Clone() *SSHAction {
 	AllowRemotePortForwarding bool
 	Recorders                 []netip.AddrPort
 	OnRecordingFailure        *SSHRecorderFailureAction
+	FileTransferReadOnly      bool
 }{})
 
 // Clone makes a deep copy of SSHPrincipal.
@@ -2139,6 +2139,17 @@ func (v SSHActionView) OnRecordingFailure() views.ValuePointer[SSHRecorderFailur
 	return views.ValuePointerOf(v.ж.OnRecordingFailure)
 }
 
+// FileTransferReadOnly, if true, means that SFTP and SCP in accepted
+// connections may only read files, and not create, modify, rename or
+// remove them.
+//
+// This is best-effort. SFTP sessions are checked request by request,
+// but SCP is only recognized when it's the session's command, so
+// "sh -c 'scp -t ...'" is not caught. Nor does it restrict what shells
+// or other commands run in the session can do, so it only makes file
+// transfers read-only for users who can't otherwise run commands.
+func (v SSHActionView) FileTransferReadOnly() bool { return v.ж.FileTransferReadOnly }
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _SSHActionViewNeedsRegeneration = SSHAction(struct {
 	Message                   string
@@ -2151,6 +2162,7 @@ func (v SSHActionView) OnRecordingFailure() views.ValuePointer[SSHRecorderFailur
 	AllowRemotePortForwarding bool
 	Recorders                 []netip.AddrPort
 	OnRecordingFailure        *SSHRecorderFailureAction
+	FileTransferReadOnly      bool
 }{})
 
 // View returns a read-only view of SSHPrincipal.
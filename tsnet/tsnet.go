@@ -13,6 +13,7 @@
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"math"
 	"net"
 	"net/http"
@@ -49,6 +50,7 @@
 	"tailscale.com/net/proxymux"
 	"tailscale.com/net/socks5"
 	"tailscale.com/net/tsdial"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsd"
 	"tailscale.com/types/bools"
 	"tailscale.com/types/logger"
@@ -154,8 +156,14 @@ type Server struct {
 	logtail          *logtail.Logger
 	logid            logid.PublicID
 
+	svcMu            sync.Mutex                    // serializes updates to the serve config and advertised services
+	serveConfigReset bool                          // whether Up has cleared the persisted serve config; guarded by svcMu
+	servicePorts     map[serviceListenKey]struct{} // port handlers added to the serve config by updateServices; guarded by svcMu
+	servicesAdded    set.Set[tailcfg.ServiceName]  // services added to AdvertiseServices by updateServices; guarded by svcMu
+
 	mu                  sync.Mutex
 	listeners           map[listenKey]*listener
+	serviceListeners    map[serviceListenKey]*listener
 	fallbackTCPHandlers set.HandleSet[FallbackTCPHandler]
 	dialer              *tsdial.Dialer
 	closed              bool
@@ -362,8 +370,8 @@ func (s *Server) Up(ctx context.Context) (*ipnstate.Status, error) {
 		if n.ErrMessage != nil {
 			return nil, fmt.Errorf("tsnet.Up: backend: %s", *n.ErrMessage)
 		}
-		if s := n.State; s != nil {
-			if *s == ipn.Running {
+		if st := n.State; st != nil {
+			if *st == ipn.Running {
 				status, err := lc.Status(ctx)
 				if err != nil {
 					return nil, fmt.Errorf("tsnet.Up: %w", err)
@@ -372,10 +380,7 @@ func (s *Server) Up(ctx context.Context) (*ipnstate.Status, error) {
 					return nil, errors.New("tsnet.Up: running, but no ip")
 				}
 
-				// Clear the persisted serve config state to prevent stale configuration
-				// from code changes. This is a temporary workaround until we have a better
-				// way to handle this. (2023-03-11)
-				if err := lc.SetServeConfig(ctx, new(ipn.ServeConfig)); err != nil {
+				if err := s.resetServeConfig(ctx); err != nil {
 					return nil, fmt.Errorf("tsnet.Up: %w", err)
 				}
 
@@ -908,6 +913,9 @@ func (s *Server) getTCPHandlerForFunnelFlow(src netip.AddrPort, dstPort uint16)
 
 func (s *Server) getTCPHandlerForFlow(src, dst netip.AddrPort) (handler func(net.Conn), intercept bool) {
 	ln, ok := s.listenerForDstAddr("tcp", dst, false)
+	if !ok {
+		ln, ok = s.serviceListenerForDstAddr(dst)
+	}
 	if !ok {
 		s.mu.Lock()
 		defer s.mu.Unlock()
@@ -1194,6 +1202,221 @@ func (s *Server) ListenFunnel(network, addr string, opts ...FunnelOption) (net.L
 	return tls.NewListener(ln, tlsConfig), nil
 }
 
+// ListenService advertises this node as a host of the Tailscale Service
+// named name (of the form "svc:dns-label") and returns a listener for TCP
+// connections to port on the Service's VIP addresses.
+//
+// It will start the server and wait for it to be running if needed. The
+// node must be permitted by the tailnet policy to host the Service (which
+// requires it to be tagged; see AdvertiseTags) before connections arrive.
+//
+// The RemoteAddr of accepted connections is the Tailscale IP of the
+// connecting peer, which can be passed to [local.Client.WhoIs].
+//
+// Closing the listener stops serving port. Once no ports of a Service have
+// open listeners, the node stops advertising the Service.
+//
+// It returns an error if port already has a handler in the serve config,
+// configured by another client such as "tailscale serve".
+func (s *Server) ListenService(name string, port uint16) (net.Listener, error) {
+	svcName := tailcfg.ServiceName(name)
+	if err := svcName.Validate(); err != nil {
+		return nil, fmt.Errorf("tsnet: %w", err)
+	}
+	if port == 0 {
+		return nil, errors.New("tsnet: invalid port 0")
+	}
+	if _, err := s.Up(context.Background()); err != nil {
+		return nil, err
+	}
+
+	key := serviceListenKey{svcName, port}
+	ln := &listener{
+		s:      s,
+		svcKey: key,
+		addr:   net.JoinHostPort(name, strconv.Itoa(int(port))),
+
+		closedc: make(chan struct{}),
+		conn:    make(chan net.Conn),
+	}
+	s.mu.Lock()
+	if _, ok := s.serviceListeners[key]; ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("tsnet: listener already open for %s, port %d", name, port)
+	}
+	mak.Set(&s.serviceListeners, key, ln)
+	s.mu.Unlock()
+
+	inUse, err := s.updateServices()
+	if err != nil || inUse.Contains(key) {
+		s.mu.Lock()
+		ln.closeLocked()
+		s.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("tsnet: advertising %s: %w", name, err)
+		}
+		return nil, fmt.Errorf("tsnet: %s port %d already has a serve handler", name, port)
+	}
+	return ln, nil
+}
+
+// resetServeConfig clears the serve config persisted by a previous run of
+// the server, the first time it's called.
+//
+// This prevents stale configuration from code changes. It's a temporary
+// workaround until we have a better way to handle this. (2023-03-11)
+func (s *Server) resetServeConfig(ctx context.Context) error {
+	s.svcMu.Lock()
+	defer s.svcMu.Unlock()
+	if s.serveConfigReset {
+		return nil
+	}
+	if err := s.localClient.SetServeConfig(ctx, new(ipn.ServeConfig)); err != nil {
+		return err
+	}
+	s.serveConfigReset = true
+	return nil
+}
+
+// maxServeConfigAttempts is how many times updateServices tries to update
+// the serve config when it's changed concurrently by someone else.
+const maxServeConfigAttempts = 5
+
+// updateServices updates the serve config and advertised services of the
+// LocalBackend to match the open service listeners.
+//
+// Ports of open service listeners are added to the Services of the serve
+// config, and ports of closed ones removed. Those ports have no serve
+// handler, so their connections fall through to getTCPHandlerForFlow. The
+// rest of the serve config, such as the AllowFunnel entries added by
+// ListenFunnel or handlers configured by other clients, is left as is.
+// Likewise, only the services that updateServices itself added to the
+// AdvertiseServices prefs are ever removed from them.
+//
+// It returns the listeners whose ports already have a handler configured by
+// another client, which would get their connections. Those listeners are
+// ignored, and ListenService closes them.
+func (s *Server) updateServices() (inUse set.Set[serviceListenKey], _ error) {
+	s.svcMu.Lock()
+	defer s.svcMu.Unlock()
+
+	ctx := context.Background()
+	var listened set.Set[tailcfg.ServiceName]
+	for attempt := 1; ; attempt++ {
+		sc, err := s.localClient.GetServeConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		var ports map[serviceListenKey]struct{}
+		ports, inUse = s.setServicePortsLocked(sc)
+		listened = make(set.Set[tailcfg.ServiceName])
+		for k := range s.serviceListeners {
+			if !inUse.Contains(k) {
+				listened.Add(k.name)
+			}
+		}
+		s.mu.Unlock()
+		err = s.localClient.SetServeConfig(ctx, sc)
+		if err == nil {
+			s.servicePorts = ports
+			break
+		}
+		if !local.IsPreconditionsFailedError(err) || attempt == maxServeConfigAttempts {
+			return nil, err
+		}
+	}
+
+	cur := s.lb.Prefs().AdvertiseServices().AsSlice()
+	var names []string
+	for _, name := range cur {
+		svc := tailcfg.ServiceName(name)
+		if s.servicesAdded.Contains(svc) && !listened.Contains(svc) {
+			continue
+		}
+		names = append(names, name)
+	}
+	added := make(set.Set[tailcfg.ServiceName])
+	for _, svc := range slices.Sorted(maps.Keys(listened)) {
+		if !slices.Contains(cur, svc.String()) {
+			names = append(names, svc.String())
+			added.Add(svc)
+		} else if s.servicesAdded.Contains(svc) {
+			added.Add(svc)
+		}
+	}
+	s.servicesAdded = added
+	if slices.Equal(names, cur) {
+		return inUse, nil
+	}
+	_, err := s.lb.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:                ipn.Prefs{AdvertiseServices: names},
+		AdvertiseServicesSet: true,
+	})
+	return inUse, err
+}
+
+// setServicePortsLocked updates the Services of sc to intercept the ports
+// of the open service listeners, and no longer intercept the ports that
+// were added for listeners that have since been closed. Ports that already
+// have a handler, configured by another client, are left alone. It returns
+// the ports whose handlers it added and that are still in sc, and the
+// listeners whose ports have another client's handler.
+//
+// s.mu and s.svcMu must be held.
+func (s *Server) setServicePortsLocked(sc *ipn.ServeConfig) (ports map[serviceListenKey]struct{}, inUse set.Set[serviceListenKey]) {
+	ports = make(map[serviceListenKey]struct{})
+	inUse = make(set.Set[serviceListenKey])
+	for k := range s.servicePorts {
+		if _, ok := s.serviceListeners[k]; ok {
+			ports[k] = struct{}{}
+			continue
+		}
+		svc, ok := sc.Services[k.name]
+		if !ok {
+			continue
+		}
+		delete(svc.TCP, k.port)
+		if len(svc.TCP) == 0 && len(svc.Web) == 0 && !svc.Tun {
+			delete(sc.Services, k.name)
+		}
+	}
+	for k := range s.serviceListeners {
+		svc, ok := sc.Services[k.name]
+		if !ok {
+			svc = new(ipn.ServiceConfig)
+			mak.Set(&sc.Services, k.name, svc)
+		}
+		if _, ok := svc.TCP[k.port]; !ok {
+			mak.Set(&svc.TCP, k.port, new(ipn.TCPPortHandler))
+			ports[k] = struct{}{}
+		} else if _, ok := s.servicePorts[k]; !ok {
+			inUse.Add(k)
+		}
+	}
+	return ports, inUse
+}
+
+// serviceListenerForDstAddr returns the service listener for the provided
+// destination, if dst is a port of a VIP address of a Service hosted by
+// this node.
+func (s *Server) serviceListenerForDstAddr(dst netip.AddrPort) (_ *listener, ok bool) {
+	s.mu.Lock()
+	n := len(s.serviceListeners)
+	s.mu.Unlock()
+	if n == 0 {
+		return nil, false
+	}
+	svcName, ok := s.lb.NetMap().GetIPVIPServiceMap()[dst.Addr()]
+	if !ok {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ln, ok := s.serviceListeners[serviceListenKey{svcName, dst.Port()}]
+	return ln, ok
+}
+
 type listenOn string
 
 const (
@@ -1337,9 +1560,16 @@ type listenKey struct {
 	funnel  bool
 }
 
+// serviceListenKey identifies a listener for a Tailscale Service port.
+type serviceListenKey struct {
+	name tailcfg.ServiceName
+	port uint16
+}
+
 type listener struct {
 	s       *Server
 	keys    []listenKey
+	svcKey  serviceListenKey // or zero value if not a service listener
 	addr    string
 	conn    chan net.Conn // unbuffered, never closed
 	closedc chan struct{} // closed on [listener.Close]
@@ -1359,8 +1589,14 @@ func (ln *listener) Addr() net.Addr { return addr{ln} }
 
 func (ln *listener) Close() error {
 	ln.s.mu.Lock()
-	defer ln.s.mu.Unlock()
-	return ln.closeLocked()
+	err := ln.closeLocked()
+	ln.s.mu.Unlock()
+	if err == nil && ln.svcKey.name != "" {
+		if _, err := ln.s.updateServices(); err != nil {
+			ln.s.logf("tsnet: updating services after closing %s listener: %v", ln.svcKey.name, err)
+		}
+	}
+	return err
 }
 
 // closeLocked closes the listener.
@@ -1374,6 +1610,9 @@ func (ln *listener) closeLocked() error {
 			delete(ln.s.listeners, key)
 		}
 	}
+	if v, ok := ln.s.serviceListeners[ln.svcKey]; ok && v == ln {
+		delete(ln.s.serviceListeners, ln.svcKey)
+	}
 	close(ln.closedc)
 	ln.closed = true
 	return nil
@@ -1397,5 +1636,11 @@ func (ln *listener) Server() *Server { return ln.s }
 
 type addr struct{ ln *listener }
 
-func (a addr) Network() string { return a.ln.keys[0].network }
-func (a addr) String() string  { return a.ln.addr }
+func (a addr) Network() string {
+	if len(a.ln.keys) == 0 {
+		return "tcp" // service listener
+	}
+	return a.ln.keys[0].network
+}
+
+func (a addr) String() string { return a.ln.addr }
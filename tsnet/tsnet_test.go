@@ -13,6 +13,7 @@
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -27,6 +28,7 @@
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -1315,3 +1317,192 @@ func TestDeps(t *testing.T) {
 		},
 	}.Check(t)
 }
+
+func TestListenService(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	controlURL, c := startControl(t)
+	s1, _, s1PubKey := startServer(t, ctx, controlURL, "s1")
+	s2, _, _ := startServer(t, ctx, controlURL, "s2")
+
+	if _, err := s1.ListenService("foo", 80); err == nil {
+		t.Fatal("ListenService with invalid name succeeded")
+	}
+
+	const svcName = tailcfg.ServiceName("svc:foo")
+	vip := netip.MustParseAddr("100.100.50.1")
+	mappings := must.Get(json.Marshal(tailcfg.ServiceIPMappings{svcName: {vip}}))
+	c.SetNodeCapMap(s1PubKey, tailcfg.NodeCapMap{
+		tailcfg.NodeAttrServiceHost: []tailcfg.RawMessage{tailcfg.RawMessage(mappings)},
+	})
+	c.SetSubnetRoutes(s1PubKey, []netip.Prefix{netip.PrefixFrom(vip, 32)})
+	if _, err := s2.lb.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:       ipn.Prefs{RouteAll: true},
+		RouteAllSet: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitForCondition(t, "VIP mapping in s1 netmap", 10*time.Second, func() bool {
+		_, ok := s1.lb.NetMap().GetIPVIPServiceMap()[vip]
+		return ok
+	})
+
+	ln, err := s1.ListenService(svcName.String(), 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if _, err := s1.ListenService(svcName.String(), 80); err == nil {
+		t.Fatal("second ListenService on same port succeeded")
+	}
+	if got := s1.lb.Prefs().AdvertiseServices().AsSlice(); !slices.Equal(got, []string{svcName.String()}) {
+		t.Errorf("AdvertiseServices = %q; want [%q]", got, svcName)
+	}
+
+	w, err := s2.Dial(ctx, "tcp", netip.AddrPortFrom(vip, 80).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	want := "hello"
+	if _, err := io.WriteString(w, want); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadAtLeast(r, got, len(got)); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	lc1, err := s1.LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	who, err := lc1.WhoIs(ctx, r.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if who.Node.ComputedName != "s2" {
+		t.Errorf("WhoIs(%v) = %q; want s2", r.RemoteAddr(), who.Node.ComputedName)
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s1.lb.Prefs().AdvertiseServices().Len(); got != 0 {
+		t.Errorf("after Close, AdvertiseServices has %d entries; want 0", got)
+	}
+}
+
+func TestListenServiceKeepsOtherServices(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	controlURL, _ := startControl(t)
+	s1, _, _ := startServer(t, ctx, controlURL, "s1")
+	lc := must.Get(s1.LocalClient())
+
+	// Another serve client hosts svc:bar, and forwards port 443 of svc:foo.
+	const foo, bar = tailcfg.ServiceName("svc:foo"), tailcfg.ServiceName("svc:bar")
+	fwd := &ipn.TCPPortHandler{TCPForward: "127.0.0.1:8443"}
+	if err := lc.SetServeConfig(ctx, &ipn.ServeConfig{Services: map[tailcfg.ServiceName]*ipn.ServiceConfig{
+		foo: {TCP: map[uint16]*ipn.TCPPortHandler{443: fwd}},
+		bar: {TCP: map[uint16]*ipn.TCPPortHandler{443: fwd}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.lb.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:                ipn.Prefs{AdvertiseServices: []string{bar.String()}},
+		AdvertiseServicesSet: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ln80 := must.Get(s1.ListenService(foo.String(), 80))
+	// Port 443 of svc:foo is forwarded, so a listener would get nothing.
+	if ln, err := s1.ListenService(foo.String(), 443); err == nil {
+		ln.Close()
+		t.Error("ListenService on a port with another client's handler succeeded")
+	}
+	if got, want := s1.lb.Prefs().AdvertiseServices().AsSlice(), []string{bar.String(), foo.String()}; !slices.Equal(got, want) {
+		t.Errorf("AdvertiseServices = %q; want %q", got, want)
+	}
+
+	if err := ln80.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s1.lb.Prefs().AdvertiseServices().AsSlice(), []string{bar.String()}; !slices.Equal(got, want) {
+		t.Errorf("after Close, AdvertiseServices = %q; want %q", got, want)
+	}
+	sc := s1.lb.ServeConfig()
+	for _, svc := range []tailcfg.ServiceName{foo, bar} {
+		sv, ok := sc.Services().GetOk(svc)
+		if !ok {
+			t.Errorf("after Close, serve config lacks %s", svc)
+			continue
+		}
+		h, ok := sv.TCP().GetOk(443)
+		if !ok || h.TCPForward() != fwd.TCPForward {
+			t.Errorf("after Close, %s port 443 handler = %v, %v; want the forward", svc, h, ok)
+		}
+	}
+	if _, ok := sc.Services().Get(foo).TCP().GetOk(80); ok {
+		t.Errorf("after Close, %s still has a port 80 handler", foo)
+	}
+}
+
+func TestListenServiceWithFunnel(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	controlURL, _ := startControl(t)
+	s1, _, _ := startServer(t, ctx, controlURL, "s1")
+
+	funnelLn, err := s1.ListenFunnel("tcp", ":443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer funnelLn.Close()
+
+	const funnelHP = ipn.HostPort("s1.tail-scale.ts.net:443")
+	const svcName = tailcfg.ServiceName("svc:foo")
+	checkServeConfig := func(wantService bool) {
+		t.Helper()
+		sc := s1.lb.ServeConfig()
+		if !sc.AllowFunnel().Get(funnelHP) {
+			t.Errorf("AllowFunnel[%q] = false; want true", funnelHP)
+		}
+		if _, ok := sc.Services().GetOk(svcName); ok != wantService {
+			t.Errorf("serve config has %s = %v; want %v", svcName, ok, wantService)
+		}
+	}
+
+	ln, err := s1.ListenService(svcName.String(), 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkServeConfig(true)
+
+	// Up doesn't clear the serve config after the first time.
+	if _, err := s1.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkServeConfig(true)
+
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkServeConfig(false)
+}
@@ -64,7 +64,9 @@ type AppConnectorAttr struct {
 	// Name is the name of this collection of domains.
 	Name string `json:"name,omitempty"`
 	// Domains enumerates the domains serviced by the specified app connectors.
-	// Domains can be of the form: example.com, or *.example.com.
+	// Domains can be of the form: example.com, or *.example.com, or a
+	// pattern such as *.s3.*.amazonaws.com, *.{slack,slack-edge}.com or
+	// re:<regexp>.
 	Domains []string `json:"domains,omitempty"`
 	// Routes enumerates the predetermined routes to be advertised by the specified app connectors.
 	Routes []netip.Prefix `json:"routes,omitempty"`
@@ -72,4 +74,17 @@ type AppConnectorAttr struct {
 	// These can either be "*" to match any advertising connector, or a
 	// tag of the form tag:<tag-name>.
 	Connectors []string `json:"connectors,omitempty"`
+	// RouteExpiry, if non-empty, is how long a route learned from a DNS
+	// lookup of one of Domains is kept after the TTL of the DNS record it
+	// was last seen in runs out, as a Go duration string such as "72h".
+	// If empty, routes are kept until their domain is no longer serviced.
+	// A connector only expires routes if all of its attributes with
+	// Domains set RouteExpiry, and then uses the longest.
+	RouteExpiry string `json:"routeExpiry,omitempty"`
+	// MaxRoutesPerDomain, if positive, limits how many routes learned from
+	// DNS are advertised for each of Domains. The limit of a wildcard
+	// domain or pattern covers the routes of all the names it matches.
+	// If several attributes list the same domain, the largest limit
+	// applies, and none if any of them has no limit.
+	MaxRoutesPerDomain int `json:"maxRoutesPerDomain,omitempty"`
 }
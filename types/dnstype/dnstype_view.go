@@ -94,7 +94,9 @@ func (v *ResolverView) UnmarshalJSONFrom(dec *jsontext.Decoder) error {
 //     known ahead of time, so bootstrap DNS resolution is not required.
 //   - "http://node-address:port/path" for DNS over HTTP over WireGuard. This
 //     is implemented in the PeerAPI for exit nodes and app connectors.
-//   - [TODO] "tls://resolver.com" for DNS over TCP+TLS
+//   - "tls://resolver.com[:port]" or "tls://ip[:port]" for DNS over TCP+TLS.
+//     The port defaults to 853. A hostname must be accompanied by its
+//     BootstrapResolution, as it's not otherwise resolved.
 func (v ResolverView) Addr() string { return v.ж.Addr }
 
 // BootstrapResolution is an optional suggested resolution for the
@@ -104,7 +106,7 @@ func (v ResolverView) Addr() string { return v.ж.Addr }
 // look up the DoT/DoH server using their local "classic" DNS
 // resolver.
 //
-// As of 2022-09-08, BootstrapResolution is not yet used.
+// As of 2026-10, BootstrapResolution is only used for DoT resolvers.
 func (v ResolverView) BootstrapResolution() views.Slice[netip.Addr] {
 	return views.SliceOf(v.ж.BootstrapResolution)
 }
@@ -0,0 +1,299 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netlogtype"
+)
+
+// IPFIX information elements used in IPFIXSink's templates.
+// See https://www.iana.org/assignments/ipfix/ipfix.xhtml.
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowDirection            = 61
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+)
+
+const (
+	ipfixVersion         = 10
+	ipfixTemplateSetID   = 2
+	ipfixMessageHeaderSz = 16
+	ipfixSetHeaderSz     = 4
+
+	// ipfixMaxMessageSize is the largest IPFIX message IPFIXSink sends,
+	// to avoid IP fragmentation.
+	ipfixMaxMessageSize = 1400
+
+	// ipfixTemplateInterval is how often IPFIXSink resends its templates,
+	// as UDP collectors may miss them or restart.
+	ipfixTemplateInterval = time.Minute
+
+	// ipfixTemplateBase is the ID of the first of IPFIXSink's templates.
+	// There is one for each combination of source and destination address
+	// families; see ipfixTemplateID.
+	ipfixTemplateBase = 256
+)
+
+// ipfixTemplateID returns the ID of the template for a record with the
+// given address families.
+func ipfixTemplateID(src6, dst6 bool) uint16 {
+	id := uint16(ipfixTemplateBase)
+	if src6 {
+		id += 2
+	}
+	if dst6 {
+		id++
+	}
+	return id
+}
+
+// ipfixField is a field in an IPFIX template.
+type ipfixField struct {
+	id, length uint16
+}
+
+// ipfixTemplateFields returns the fields of the template with the given
+// address families, in the order that records are encoded.
+func ipfixTemplateFields(src6, dst6 bool) []ipfixField {
+	srcAddr := ipfixField{ieSourceIPv4Address, 4}
+	if src6 {
+		srcAddr = ipfixField{ieSourceIPv6Address, 16}
+	}
+	dstAddr := ipfixField{ieDestinationIPv4Address, 4}
+	if dst6 {
+		dstAddr = ipfixField{ieDestinationIPv6Address, 16}
+	}
+	return []ipfixField{
+		{ieFlowStartMilliseconds, 8},
+		{ieFlowEndMilliseconds, 8},
+		{ieProtocolIdentifier, 1},
+		srcAddr,
+		{ieSourceTransportPort, 2},
+		dstAddr,
+		{ieDestinationTransportPort, 2},
+		{ieFlowDirection, 1},
+		{iePacketDeltaCount, 8},
+		{ieOctetDeltaCount, 8},
+	}
+}
+
+// ipfixRecord is a data record for one direction of a connection's traffic.
+type ipfixRecord struct {
+	start, end     time.Time
+	proto          ipproto.Proto
+	src, dst       netip.AddrPort
+	egress         bool
+	packets, bytes uint64
+}
+
+// families returns whether the record's source and destination are
+// encoded as IPv6 addresses. Exit traffic may have no addresses, which are
+// encoded as unspecified addresses of the other's family.
+func (r *ipfixRecord) families() (src6, dst6 bool) {
+	src, dst := r.src.Addr(), r.dst.Addr()
+	switch {
+	case !src.IsValid():
+		return dst.Is6(), dst.Is6()
+	case !dst.IsValid():
+		return src.Is6(), src.Is6()
+	}
+	return src.Is6(), dst.Is6()
+}
+
+// size returns the encoded size of the record.
+func (r *ipfixRecord) size() int {
+	n := 0
+	src6, dst6 := r.families()
+	for _, f := range ipfixTemplateFields(src6, dst6) {
+		n += int(f.length)
+	}
+	return n
+}
+
+func appendIPFIXAddr(b []byte, a netip.Addr, is6 bool) []byte {
+	switch {
+	case !a.IsValid() && is6:
+		return append(b, make([]byte, 16)...)
+	case !a.IsValid():
+		return append(b, make([]byte, 4)...)
+	case is6:
+		a16 := a.As16()
+		return append(b, a16[:]...)
+	}
+	a4 := a.As4()
+	return append(b, a4[:]...)
+}
+
+func (r *ipfixRecord) append(b []byte) []byte {
+	src6, dst6 := r.families()
+	b = binary.BigEndian.AppendUint64(b, uint64(r.start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.end.UnixMilli()))
+	b = append(b, byte(r.proto))
+	b = appendIPFIXAddr(b, r.src.Addr(), src6)
+	b = binary.BigEndian.AppendUint16(b, r.src.Port())
+	b = appendIPFIXAddr(b, r.dst.Addr(), dst6)
+	b = binary.BigEndian.AppendUint16(b, r.dst.Port())
+	var dir byte // 0 is ingress, 1 is egress
+	if r.egress {
+		dir = 1
+	}
+	b = append(b, dir)
+	b = binary.BigEndian.AppendUint64(b, r.packets)
+	b = binary.BigEndian.AppendUint64(b, r.bytes)
+	return b
+}
+
+// IPFIXSink is a Sink that exports traffic as IPFIX (RFC 7011) flow records
+// to a collector over UDP.
+//
+// Each connection's transmitted and received traffic are exported as
+// separate records, with flowDirection egress and ingress respectively, and
+// the addresses of the packets in that direction. Physical traffic has
+// protocol 0, the peer's Tailscale IP as the local address, and its
+// endpoint as the remote address.
+type IPFIXSink struct {
+	logf logger.Logf
+	conn net.Conn
+
+	mu            sync.Mutex
+	seq           uint32    // number of data records sent
+	lastTemplates time.Time // when templates were last sent
+}
+
+// NewIPFIXSink returns an IPFIXSink that exports to the collector at addr,
+// in host:port form.
+func NewIPFIXSink(logf logger.Logf, addr string) (*IPFIXSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &IPFIXSink{logf: logf, conn: conn}, nil
+}
+
+// Record implements Sink.
+func (s *IPFIXSink) Record(m netlogtype.Message) {
+	var recs [4][]ipfixRecord // by template ID, less ipfixTemplateBase
+	add := func(traffic []netlogtype.ConnectionCounts) {
+		for _, cc := range traffic {
+			tx := ipfixRecord{start: m.Start, end: m.End, proto: cc.Proto, src: cc.Src, dst: cc.Dst, egress: true, packets: cc.TxPackets, bytes: cc.TxBytes}
+			rx := ipfixRecord{start: m.Start, end: m.End, proto: cc.Proto, src: cc.Dst, dst: cc.Src, packets: cc.RxPackets, bytes: cc.RxBytes}
+			for _, r := range []ipfixRecord{tx, rx} {
+				if r.packets == 0 && r.bytes == 0 {
+					continue
+				}
+				i := ipfixTemplateID(r.families()) - ipfixTemplateBase
+				recs[i] = append(recs[i], r)
+			}
+		}
+	}
+	add(m.VirtualTraffic)
+	add(m.SubnetTraffic)
+	add(m.ExitTraffic)
+	add(m.PhysicalTraffic)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range s.encodeLocked(time.Now(), recs) {
+		if _, err := s.conn.Write(msg); err != nil {
+			s.logf("netlog: IPFIX export: %v", err)
+			return
+		}
+	}
+}
+
+// encodeLocked encodes recs as IPFIX messages, including the templates if
+// they're due to be resent. s.mu must be held.
+func (s *IPFIXSink) encodeLocked(now time.Time, recs [4][]ipfixRecord) [][]byte {
+	var msgs [][]byte
+	var b []byte  // message being encoded
+	var nrecs int // data records in b
+	startMessage := func() {
+		b = make([]byte, ipfixMessageHeaderSz, ipfixMaxMessageSize)
+		nrecs = 0
+		if now.Sub(s.lastTemplates) >= ipfixTemplateInterval {
+			s.lastTemplates = now
+			set := len(b)
+			b = append(b, make([]byte, ipfixSetHeaderSz)...)
+			for _, src6 := range []bool{false, true} {
+				for _, dst6 := range []bool{false, true} {
+					fields := ipfixTemplateFields(src6, dst6)
+					b = binary.BigEndian.AppendUint16(b, ipfixTemplateID(src6, dst6))
+					b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+					for _, f := range fields {
+						b = binary.BigEndian.AppendUint16(b, f.id)
+						b = binary.BigEndian.AppendUint16(b, f.length)
+					}
+				}
+			}
+			binary.BigEndian.PutUint16(b[set:], ipfixTemplateSetID)
+			binary.BigEndian.PutUint16(b[set+2:], uint16(len(b)-set))
+		}
+	}
+	endMessage := func() {
+		binary.BigEndian.PutUint16(b[0:], ipfixVersion)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(b[8:], s.seq)
+		binary.BigEndian.PutUint32(b[12:], 0) // observation domain ID
+		msgs = append(msgs, b)
+		s.seq += uint32(nrecs)
+	}
+
+	startMessage()
+	for i, rs := range recs {
+		if len(rs) == 0 {
+			continue
+		}
+		id := uint16(ipfixTemplateBase + i)
+		set := -1 // offset of the data set being encoded in b
+		for _, r := range rs {
+			need := r.size()
+			if set < 0 {
+				need += ipfixSetHeaderSz
+			}
+			if len(b)+need > ipfixMaxMessageSize && len(b) > ipfixMessageHeaderSz {
+				if set >= 0 {
+					binary.BigEndian.PutUint16(b[set+2:], uint16(len(b)-set))
+				}
+				endMessage()
+				startMessage()
+				set = -1
+			}
+			if set < 0 {
+				set = len(b)
+				b = binary.BigEndian.AppendUint16(b, id)
+				b = append(b, 0, 0) // length, set below
+			}
+			b = r.append(b)
+			nrecs++
+		}
+		binary.BigEndian.PutUint16(b[set+2:], uint16(len(b)-set))
+	}
+	if len(b) > ipfixMessageHeaderSz {
+		endMessage()
+	}
+	return msgs
+}
+
+// Close implements Sink.
+func (s *IPFIXSink) Close() error {
+	return s.conn.Close()
+}
@@ -11,8 +11,10 @@
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net/http"
 	"net/netip"
+	"slices"
 	"sync"
 	"time"
 
@@ -27,6 +29,7 @@
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netlogtype"
 	"tailscale.com/util/multierr"
+	"tailscale.com/util/set"
 	"tailscale.com/wgengine/router"
 )
 
@@ -48,15 +51,24 @@ func (noopDevice) SetStatistics(*connstats.Statistics) {}
 // Exit node traffic is not logged for privacy reasons.
 // The zero value is ready for use.
 type Logger struct {
+	// runMu serializes starting and stopping the logger and its
+	// statistics. It is acquired before mu.
+	runMu sync.Mutex
+
 	mu sync.Mutex // protects all fields below
 
-	logger *logtail.Logger
-	stats  *connstats.Statistics
-	tun    Device
-	sock   Device
+	logger             *logtail.Logger // nil unless uploading
+	nodeID             tailcfg.StableNodeID
+	logExitFlowEnabled bool
+
+	stats *connstats.Statistics // non-nil while uploading or watched
+	tun   Device
+	sock  Device
 
 	addrs    map[netip.Addr]bool
 	prefixes map[netip.Prefix]bool
+
+	watchers set.HandleSet[func(netlogtype.Message)]
 }
 
 // Running reports whether the logger is running.
@@ -94,6 +106,8 @@ func (nl *Logger) Running() bool {
 // The sock is used to populated the PhysicalTraffic field in Message.
 // The netMon parameter is optional; if non-nil it's used to do faster interface lookups.
 func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID logid.PrivateID, tun, sock Device, netMon *netmon.Monitor, health *health.Tracker, logExitFlowEnabledEnabled bool) error {
+	nl.runMu.Lock()
+	defer nl.runMu.Unlock()
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
 	if nl.logger != nil {
@@ -120,7 +134,19 @@ func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID lo
 		IncludeProcSequence: true,
 	}, logf)
 	nl.logger.SetSockstatsLabel(sockstats.LabelNetlogLogger)
+	nl.nodeID = nodeID
+	nl.logExitFlowEnabled = logExitFlowEnabledEnabled
+
+	// The statistics may already be running for watchers.
+	if nl.stats == nil {
+		nl.startStatsLocked(tun, sock)
+	}
+	return nil
+}
 
+// startStatsLocked starts tracking per-connection statistics for the
+// provided devices. nl.runMu and nl.mu must be held.
+func (nl *Logger) startStatsLocked(tun, sock Device) {
 	// Startup a data structure to track per-connection statistics.
 	// There is a maximum size for individual log messages that logtail
 	// can upload to the Tailscale log service, so stay below this limit.
@@ -128,10 +154,27 @@ func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID lo
 	const maxConns = (maxLogSize - netlogtype.MaxMessageJSONSize) / netlogtype.MaxConnectionCountsJSONSize
 	nl.stats = connstats.NewStatistics(pollPeriod, maxConns, func(start, end time.Time, virtual, physical map[netlogtype.Connection]netlogtype.Counts) {
 		nl.mu.Lock()
+		logger := nl.logger
+		nodeID := nl.nodeID
+		logExitFlowEnabled := nl.logExitFlowEnabled
 		addrs := nl.addrs
 		prefixes := nl.prefixes
+		watchers := slices.Collect(maps.Values(nl.watchers))
 		nl.mu.Unlock()
-		recordStatistics(nl.logger, nodeID, start, end, virtual, physical, addrs, prefixes, logExitFlowEnabledEnabled)
+		if logger == nil {
+			// Exit traffic is only recorded in full if it's uploaded.
+			logExitFlowEnabled = false
+		}
+		m := makeMessage(nodeID, start, end, virtual, physical, addrs, prefixes, logExitFlowEnabled)
+		if len(m.VirtualTraffic)+len(m.SubnetTraffic)+len(m.ExitTraffic)+len(m.PhysicalTraffic) == 0 {
+			return
+		}
+		if logger != nil {
+			recordMessage(logger, m)
+		}
+		for _, fn := range watchers {
+			fn(m)
+		}
 	})
 
 	// Register the connection tracker into the TUN device.
@@ -147,11 +190,71 @@ func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID lo
 	}
 	nl.sock = sock
 	nl.sock.SetStatistics(nl.stats)
+}
 
-	return nil
+// stopStats stops tracking per-connection statistics, after a final flush.
+// nl.runMu must be held, and nl.mu must not be.
+func (nl *Logger) stopStats(ctx context.Context) error {
+	nl.mu.Lock()
+	stats, tun, sock := nl.stats, nl.tun, nl.sock
+	nl.mu.Unlock()
+	if stats == nil {
+		return nil
+	}
+	// Do not hold lock while shutting down since this may flush one last time.
+	sock.SetStatistics(nil)
+	tun.SetStatistics(nil)
+	err := stats.Shutdown(ctx)
+	nl.mu.Lock()
+	nl.stats = nil
+	nl.tun = nil
+	nl.sock = nil
+	nl.mu.Unlock()
+	return err
 }
 
-func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start, end time.Time, connstats, sockStats map[netlogtype.Connection]netlogtype.Counts, addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool, logExitFlowEnabled bool) {
+// Watch calls fn with the traffic through the provided tun and sock
+// devices, as described for Startup, every time it would be logged, until
+// the returned func is called. It does not require the logger to be
+// running. If it isn't, exit traffic is anonymized, and the traffic isn't
+// uploaded.
+//
+// fn is called from a single goroutine and must not block.
+func (nl *Logger) Watch(tun, sock Device, fn func(netlogtype.Message)) (unwatch func()) {
+	nl.runMu.Lock()
+	defer nl.runMu.Unlock()
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	if nl.watchers == nil {
+		nl.watchers = make(set.HandleSet[func(netlogtype.Message)])
+	}
+	h := nl.watchers.Add(fn)
+	if nl.stats == nil {
+		nl.startStatsLocked(tun, sock)
+	}
+	return func() {
+		nl.runMu.Lock()
+		defer nl.runMu.Unlock()
+		nl.mu.Lock()
+		delete(nl.watchers, h)
+		idle := nl.logger == nil && len(nl.watchers) == 0
+		nl.mu.Unlock()
+		if idle {
+			nl.stopStats(context.Background())
+		}
+	}
+}
+
+// SetNodeID sets the stable ID of this node that the traffic is recorded
+// with, whether or not the logger is running.
+func (nl *Logger) SetNodeID(nodeID tailcfg.StableNodeID) {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	nl.nodeID = nodeID
+}
+
+// makeMessage classifies the connection statistics into a Message.
+func makeMessage(nodeID tailcfg.StableNodeID, start, end time.Time, connstats, sockStats map[netlogtype.Connection]netlogtype.Counts, addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool, logExitFlowEnabled bool) netlogtype.Message {
 	m := netlogtype.Message{NodeID: nodeID, Start: start.UTC(), End: end.UTC()}
 
 	classifyAddr := func(a netip.Addr) (isTailscale, withinRoute bool) {
@@ -200,13 +303,14 @@ func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start
 	for conn, cnts := range sockStats {
 		m.PhysicalTraffic = append(m.PhysicalTraffic, netlogtype.ConnectionCounts{Connection: conn, Counts: cnts})
 	}
+	return m
+}
 
-	if len(m.VirtualTraffic)+len(m.SubnetTraffic)+len(m.ExitTraffic)+len(m.PhysicalTraffic) > 0 {
-		if b, err := json.Marshal(m); err != nil {
-			logger.Logf("json.Marshal error: %v", err)
-		} else {
-			logger.Logf("%s", b)
-		}
+func recordMessage(logger *logtail.Logger, m netlogtype.Message) {
+	if b, err := json.Marshal(m); err != nil {
+		logger.Logf("json.Marshal error: %v", err)
+	} else {
+		logger.Logf("%s", b)
 	}
 }
 
@@ -246,29 +350,30 @@ func (nl *Logger) ReconfigRoutes(cfg *router.Config) {
 // Shutdown shuts down the network logger.
 // This attempts to flush out all pending log messages.
 // Even if an error is returned, the logger is still shut down.
+// Any watchers keep receiving traffic statistics.
 func (nl *Logger) Shutdown(ctx context.Context) error {
+	nl.runMu.Lock()
+	defer nl.runMu.Unlock()
 	nl.mu.Lock()
-	defer nl.mu.Unlock()
-	if nl.logger == nil {
+	logger, tun, sock := nl.logger, nl.tun, nl.sock
+	nl.mu.Unlock()
+	if logger == nil {
 		return nil
 	}
 
 	// Shutdown in reverse order of Startup.
-	// Do not hold lock while shutting down since this may flush one last time.
-	nl.mu.Unlock()
-	nl.sock.SetStatistics(nil)
-	nl.tun.SetStatistics(nil)
-	err1 := nl.stats.Shutdown(ctx)
-	err2 := nl.logger.Shutdown(ctx)
-	nl.mu.Lock()
+	err1 := nl.stopStats(ctx)
+	err2 := logger.Shutdown(ctx)
 
-	// Purge state.
+	// Purge state. The node ID and routes are kept, as they're
+	// reconfigured regardless of whether the logger is running.
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
 	nl.logger = nil
-	nl.stats = nil
-	nl.tun = nil
-	nl.sock = nil
-	nl.addrs = nil
-	nl.prefixes = nil
+	nl.logExitFlowEnabled = false
+	if len(nl.watchers) > 0 {
+		nl.startStatsLocked(tun, sock)
+	}
 
 	return multierr.New(err1, err2)
 }
@@ -0,0 +1,257 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netlogtype"
+)
+
+// Sink records network traffic messages somewhere other than Tailscale's
+// logging service, such as locally.
+type Sink interface {
+	// Record records m. It's called from a single goroutine, which it
+	// should not block for long.
+	Record(m netlogtype.Message)
+
+	io.Closer
+}
+
+var (
+	envFile  = envknob.RegisterString("TS_NETLOG_FILE")
+	envIPFIX = envknob.RegisterString("TS_NETLOG_IPFIX")
+)
+
+const (
+	// defaultFileMaxSize is the size at which the file that
+	// TS_NETLOG_FILE names is rotated.
+	defaultFileMaxSize = 10 << 20
+
+	// defaultFileMaxBackups is how many rotated files are kept for
+	// TS_NETLOG_FILE.
+	defaultFileMaxBackups = 5
+
+	// fileSinkQueueSize is how many messages a FileSink buffers for its
+	// writer goroutine before dropping them.
+	fileSinkQueueSize = 64
+)
+
+// LocalSinks returns the sinks that the environment configures network
+// traffic to be recorded to, regardless of whether it's uploaded:
+//
+//   - TS_NETLOG_FILE names a file to write messages to as JSON lines,
+//     rotated every 10MiB, keeping 5 old files. See FileSink.
+//   - TS_NETLOG_IPFIX is the host:port of an IPFIX collector to export
+//     traffic to over UDP. See IPFIXSink.
+//
+// Sinks that fail to start are logged and skipped.
+func LocalSinks(logf logger.Logf) []Sink {
+	var sinks []Sink
+	if path := envFile(); path != "" {
+		if s, err := NewFileSink(logf, path, defaultFileMaxSize, defaultFileMaxBackups); err != nil {
+			logf("netlog: TS_NETLOG_FILE: %v", err)
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+	if addr := envIPFIX(); addr != "" {
+		if s, err := NewIPFIXSink(logf, addr); err != nil {
+			logf("netlog: TS_NETLOG_IPFIX: %v", err)
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+	return sinks
+}
+
+// fileMessage is a line in a FileSink's file. It has the same "logged" field
+// as the messages uploaded to Tailscale's logging service.
+type fileMessage struct {
+	Logged time.Time `json:"logged"`
+	netlogtype.Message
+}
+
+// FileSink is a Sink that writes messages to a local file as JSON lines,
+// rotating it once it reaches a maximum size. Its files can be read with
+// cmd/netlogfmt.
+//
+// Messages are written by a goroutine of its own, so that a slow disk
+// doesn't block Record. If the writer falls behind by more than
+// fileSinkQueueSize messages, further messages are dropped and counted.
+type FileSink struct {
+	logf       logger.Logf
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu     sync.Mutex
+	queue  chan []byte // JSON lines for run to write; closed by Close
+	closed bool
+
+	dropped  atomic.Int64  // messages dropped since last logged
+	done     chan struct{} // closed when run returns
+	closeErr error         // from closing f; set before done is closed
+
+	// f and size are only used by run.
+	f    *os.File // nil if it couldn't be reopened
+	size int64
+}
+
+// NewFileSink returns a FileSink that appends to the file at path. Once
+// writing a message would make the file larger than maxSize bytes, the file
+// is renamed to path+".1", after renaming any path+".1" to path+".2", and
+// so on, keeping at most maxBackups old files.
+func NewFileSink(logf logger.Logf, path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s, err := openFileSink(logf, path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+// openFileSink is NewFileSink without starting the writer goroutine.
+func openFileSink(logf logger.Logf, path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileSink{
+		logf:       logf,
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		queue:      make(chan []byte, fileSinkQueueSize),
+		done:       make(chan struct{}),
+		f:          f,
+		size:       fi.Size(),
+	}, nil
+}
+
+// Record implements Sink. It doesn't block: if the writer is too far
+// behind, m is dropped.
+func (s *FileSink) Record(m netlogtype.Message) {
+	b, err := json.Marshal(fileMessage{Logged: time.Now().UTC(), Message: m})
+	if err != nil {
+		s.logf("netlog: json.Marshal error: %v", err)
+		return
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- b:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// run writes the queued messages until the queue is closed, then closes
+// the file.
+func (s *FileSink) run() {
+	defer close(s.done)
+	for b := range s.queue {
+		s.write(b)
+		s.logDropped()
+	}
+	s.logDropped()
+	if s.f != nil {
+		s.closeErr = s.f.Close()
+		s.f = nil
+	}
+}
+
+// logDropped logs how many messages were dropped since it was last called,
+// if any.
+func (s *FileSink) logDropped() {
+	if n := s.dropped.Swap(0); n > 0 {
+		s.logf("netlog: dropped %d messages for %s, which is written too slowly", n, s.path)
+	}
+}
+
+// write appends the JSON line b to the file, rotating it first if needed.
+func (s *FileSink) write(b []byte) {
+	if s.f == nil || s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			s.logf("netlog: rotating %s: %v", s.path, err)
+			if s.f == nil {
+				return
+			}
+		}
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	if err != nil {
+		s.logf("netlog: writing %s: %v", s.path, err)
+	}
+}
+
+// rotate moves the current file aside and starts a new one. If that
+// fails, it keeps appending to the current file if it can.
+func (s *FileSink) rotate() error {
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+	var err error
+	for i := s.maxBackups; i > 0 && err == nil; i-- {
+		src := s.path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", s.path, i-1)
+		}
+		if rerr := os.Rename(src, fmt.Sprintf("%s.%d", s.path, i)); rerr != nil && !os.IsNotExist(rerr) {
+			err = rerr
+		}
+	}
+	flag := os.O_TRUNC
+	if err != nil {
+		flag = os.O_APPEND
+	}
+	f, ferr := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|flag, 0600)
+	if ferr != nil {
+		return ferr
+	}
+	fi, ferr := f.Stat()
+	if ferr != nil {
+		f.Close()
+		return ferr
+	}
+	s.f = f
+	s.size = fi.Size()
+	return err
+}
+
+// Close implements Sink. It waits for the queued messages to be written.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+	return s.closeErr
+}
@@ -0,0 +1,248 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netlog", "flows.jsonl")
+	s, err := NewFileSink(t.Logf, path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		s.Record(netlogtype.Message{NodeID: tailcfg.StableNodeID(fmt.Sprintf("n%d", i))})
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.Record(netlogtype.Message{NodeID: "closed"})
+
+	var got []string
+	for _, name := range []string{path + ".2", path + ".1", path} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, _ := f.Stat()
+		if fi.Size() > 200 {
+			t.Errorf("%s is %d bytes; want at most 200", name, fi.Size())
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var m fileMessage
+			if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+				t.Fatal(err)
+			}
+			if m.Logged.IsZero() {
+				t.Errorf("message %s has no logged time", m.NodeID)
+			}
+			got = append(got, string(m.NodeID))
+		}
+		f.Close()
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists; want at most 2 backups", path)
+	}
+	// The oldest messages are rotated away; the rest are in order.
+	if len(got) == 0 || got[len(got)-1] != "n9" {
+		t.Fatalf("messages = %v; want to end with n9", got)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i-1] >= got[i] {
+			t.Fatalf("messages = %v; want in order", got)
+		}
+	}
+}
+
+func TestFileSinkDropsWhenBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.jsonl")
+	s, err := openFileSink(t.Logf, path, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With the writer not yet running, Record must not block once the
+	// queue is full.
+	const extra = 3
+	for i := range fileSinkQueueSize + extra {
+		s.Record(netlogtype.Message{NodeID: tailcfg.StableNodeID(fmt.Sprintf("n%03d", i))})
+	}
+	if got := s.dropped.Load(); got != extra {
+		t.Errorf("dropped %d messages; want %d", got, extra)
+	}
+	go s.run()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bytes.Count(b, []byte("\n")); got != fileSinkQueueSize {
+		t.Errorf("wrote %d messages; want %d", got, fileSinkQueueSize)
+	}
+}
+
+func TestIPFIXEncode(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	rec := ipfixRecord{
+		start:   start,
+		end:     start.Add(5 * time.Second),
+		proto:   ipproto.TCP,
+		src:     netip.MustParseAddrPort("100.64.0.1:22"),
+		dst:     netip.MustParseAddrPort("100.64.0.2:5000"),
+		egress:  true,
+		packets: 10,
+		bytes:   1000,
+	}
+	rec6 := rec
+	rec6.src = netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:22")
+	rec6.dst = netip.MustParseAddrPort("[fd7a:115c:a1e0::2]:5000")
+
+	var recs [4][]ipfixRecord
+	for range 100 {
+		recs[0] = append(recs[0], rec)
+		recs[3] = append(recs[3], rec6)
+	}
+	s := new(IPFIXSink)
+	now := start.Add(10 * time.Second)
+	msgs := s.encodeLocked(now, recs)
+	if len(msgs) < 2 {
+		t.Fatalf("got %d messages; want the records split across several", len(msgs))
+	}
+
+	var seq uint32
+	var data, templates int
+	for i, msg := range msgs {
+		if len(msg) > ipfixMaxMessageSize {
+			t.Errorf("message %d is %d bytes; want at most %d", i, len(msg), ipfixMaxMessageSize)
+		}
+		if v := binary.BigEndian.Uint16(msg[0:]); v != ipfixVersion {
+			t.Fatalf("message %d version = %d", i, v)
+		}
+		if n := binary.BigEndian.Uint16(msg[2:]); int(n) != len(msg) {
+			t.Fatalf("message %d length = %d; want %d", i, n, len(msg))
+		}
+		if ts := binary.BigEndian.Uint32(msg[4:]); int64(ts) != now.Unix() {
+			t.Errorf("message %d export time = %d", i, ts)
+		}
+		if got := binary.BigEndian.Uint32(msg[8:]); got != seq {
+			t.Errorf("message %d sequence number = %d; want %d", i, got, seq)
+		}
+		for b := msg[ipfixMessageHeaderSz:]; len(b) > 0; {
+			id, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+			if n < ipfixSetHeaderSz || n > len(b) {
+				t.Fatalf("message %d: set %d has bad length %d", i, id, n)
+			}
+			set := b[ipfixSetHeaderSz:n]
+			switch id {
+			case ipfixTemplateSetID:
+				templates++
+			case ipfixTemplateBase:
+				if len(set)%rec.size() != 0 {
+					t.Fatalf("message %d: IPv4 set has %d bytes", i, len(set))
+				}
+				if got := set[:rec.size()]; string(got) != string(rec.append(nil)) {
+					t.Errorf("message %d: IPv4 record = %x; want %x", i, got, rec.append(nil))
+				}
+				seq += uint32(len(set) / rec.size())
+				data += len(set) / rec.size()
+			case ipfixTemplateBase + 3:
+				if len(set)%rec6.size() != 0 {
+					t.Fatalf("message %d: IPv6 set has %d bytes", i, len(set))
+				}
+				seq += uint32(len(set) / rec6.size())
+				data += len(set) / rec6.size()
+			default:
+				t.Fatalf("message %d: unexpected set %d", i, id)
+			}
+			b = b[n:]
+		}
+	}
+	if data != 200 {
+		t.Errorf("got %d data records; want 200", data)
+	}
+	if templates != 1 {
+		t.Errorf("got %d template sets; want 1", templates)
+	}
+	if s.seq != 200 {
+		t.Errorf("sequence number = %d; want 200", s.seq)
+	}
+
+	// Templates are only resent once the interval has passed.
+	recs = [4][]ipfixRecord{{rec}}
+	msgs = s.encodeLocked(now.Add(time.Second), recs)
+	if len(msgs) != 1 || binary.BigEndian.Uint16(msgs[0][ipfixMessageHeaderSz:]) != ipfixTemplateBase {
+		t.Errorf("templates resent too soon")
+	}
+	msgs = s.encodeLocked(now.Add(ipfixTemplateInterval), recs)
+	if len(msgs) != 1 || binary.BigEndian.Uint16(msgs[0][ipfixMessageHeaderSz:]) != ipfixTemplateSetID {
+		t.Errorf("templates not resent after %v", ipfixTemplateInterval)
+	}
+}
+
+func TestIPFIXEncodeMixedFamiliesNearLimit(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	rec := ipfixRecord{
+		start:   start,
+		end:     start.Add(5 * time.Second),
+		proto:   ipproto.UDP,
+		src:     netip.MustParseAddrPort("100.64.0.1:53"),
+		dst:     netip.MustParseAddrPort("100.64.0.2:5000"),
+		packets: 1,
+		bytes:   100,
+	}
+	rec6 := rec
+	rec6.src = netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:53")
+	rec6.dst = netip.MustParseAddrPort("[fd7a:115c:a1e0::2]:5000")
+
+	// Fill the first message with IPv4 records to within a record of the
+	// limit, so that the IPv6 set that follows doesn't fit.
+	full := (ipfixMaxMessageSize - ipfixMessageHeaderSz - ipfixSetHeaderSz) / rec.size()
+	for n4 := full - 2; n4 <= full; n4++ {
+		var recs [4][]ipfixRecord
+		for range n4 {
+			recs[0] = append(recs[0], rec)
+		}
+		recs[3] = []ipfixRecord{rec6, rec6}
+		s := &IPFIXSink{lastTemplates: start}
+		var data int
+		for i, msg := range s.encodeLocked(start, recs) {
+			if len(msg) > ipfixMaxMessageSize {
+				t.Errorf("%d IPv4 records: message %d is %d bytes; want at most %d", n4, i, len(msg), ipfixMaxMessageSize)
+			}
+			for b := msg[ipfixMessageHeaderSz:]; len(b) > 0; {
+				n := int(binary.BigEndian.Uint16(b[2:]))
+				if n < ipfixSetHeaderSz || n > len(b) {
+					t.Fatalf("%d IPv4 records: message %d: set has bad length %d", n4, i, n)
+				}
+				if binary.BigEndian.Uint16(b) == ipfixTemplateBase {
+					data += (n - ipfixSetHeaderSz) / rec.size()
+				} else {
+					data += (n - ipfixSetHeaderSz) / rec6.size()
+				}
+				b = b[n:]
+			}
+		}
+		if want := n4 + 2; data != want {
+			t.Errorf("%d IPv4 records: got %d data records; want %d", n4, data, want)
+		}
+	}
+}
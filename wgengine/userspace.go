@@ -44,6 +44,7 @@
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/netlogtype"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/views"
 	"tailscale.com/util/clientmetric"
@@ -160,6 +161,10 @@ type userspaceEngine struct {
 	// networkLogger logs statistics about network connections.
 	networkLogger netlog.Logger
 
+	// stopLocalNetLogs stop recording network connection statistics to
+	// the sinks from netlog.LocalSinks.
+	stopLocalNetLogs []func()
+
 	// Lock ordering: magicsock.Conn.mu, wgLock, then mu.
 }
 
@@ -540,6 +545,16 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		}
 	}
 
+	// Record network traffic locally if configured to, whether or not
+	// it's also uploaded.
+	for _, sink := range netlog.LocalSinks(e.logf) {
+		unwatch := e.networkLogger.Watch(e.tundev, e.magicConn, sink.Record)
+		e.stopLocalNetLogs = append(e.stopLocalNetLogs, func() {
+			unwatch()
+			sink.Close()
+		})
+	}
+
 	cli := e.eventBus.Client("userspaceEngine")
 	e.eventSubs = cli.Monitor(e.consumeEventbusTopics(cli))
 	e.logf("Engine created.")
@@ -1026,6 +1041,8 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 		}
 	}
 
+	e.networkLogger.SetNodeID(cfg.NodeID)
+
 	// Startup the network logger.
 	// Do this before configuring the router so that we capture initial packets.
 	if netLogRunning && !e.networkLogger.Running() {
@@ -1254,6 +1271,9 @@ func (e *userspaceEngine) Close() {
 	if err := e.networkLogger.Shutdown(ctx); err != nil {
 		e.logf("wgengine: Close: error shutting down network logger: %v", err)
 	}
+	for _, stop := range e.stopLocalNetLogs {
+		stop()
+	}
 }
 
 func (e *userspaceEngine) Done() <-chan struct{} {
@@ -1652,6 +1672,10 @@ func (ls fwdDNSLinkSelector) PickLink(ip netip.Addr) (linkName string) {
 	metricNumMinorChanges = clientmetric.NewCounter("wgengine_minor_changes")
 )
 
+func (e *userspaceEngine) WatchFlows(fn func(netlogtype.Message)) (unwatch func()) {
+	return e.networkLogger.Watch(e.tundev, e.magicConn, fn)
+}
+
 func (e *userspaceEngine) InstallCaptureHook(cb packet.CaptureCallback) {
 	if !buildfeatures.HasCapture {
 		return
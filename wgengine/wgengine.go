@@ -14,6 +14,7 @@
 	"tailscale.com/net/packet"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
+	"tailscale.com/types/netlogtype"
 	"tailscale.com/types/netmap"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/router"
@@ -130,4 +131,9 @@ type Engine interface {
 	// packets traversing the data path. The hook can be uninstalled by
 	// calling this function with a nil value.
 	InstallCaptureHook(packet.CaptureCallback)
+
+	// WatchFlows calls fn with the traffic through the engine every time
+	// it's aggregated for network logging, whether or not network logging
+	// is enabled, until the returned func is called. fn must not block.
+	WatchFlows(fn func(netlogtype.Message)) (unwatch func())
 }